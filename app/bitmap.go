@@ -0,0 +1,692 @@
+package main
+
+import (
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bitmaps are plain strings addressed bit by bit. Bit 0 is the most
+// significant bit of the first byte, and strings grow with zero bytes
+// when a bit past their end is written. Strings bit commands write to are
+// kept as bytes they change in place, rather than copied on every write.
+
+// maxBitOffset is the largest bit offset a string can hold
+const maxBitOffset = maxStringLength*8 - 1
+
+var errBitOffset = token{typ: string(ERROR), val: "ERR bit offset is not an integer or out of range"}
+
+func getBit[T string | []byte](buf T, offset int) int {
+	if offset/8 >= len(buf) {
+		return 0
+	}
+
+	return int(buf[offset/8]>>(7-uint(offset%8))) & 1
+}
+
+// setBit sets the bit at offset, growing buf as needed
+func setBit(buf []byte, offset int, value int) []byte {
+	if need := offset/8 + 1; need > len(buf) {
+		buf = append(buf, make([]byte, need-len(buf))...)
+	}
+
+	mask := byte(1) << (7 - uint(offset%8))
+	if value == 1 {
+		buf[offset/8] |= mask
+	} else {
+		buf[offset/8] &^= mask
+	}
+
+	return buf
+}
+
+// bitmapForWrite returns the bytes of the string at key for bit commands
+// to change in place, turning the string into them the first time. A
+// missing key yields nil. Callers must hold mux.
+func bitmapForWrite(key string) (buf []byte, exists bool, ok bool) {
+	obj, exists := lookupKey(key)
+	if !exists {
+		return nil, false, true
+	}
+
+	if obj.typ != "string" {
+		return nil, true, false
+	}
+
+	if obj.bitmap == nil {
+		obj.bitmap = append(make([]byte, 0, len(obj.value)), obj.value...)
+		obj.value = ""
+		putKey(key, obj)
+	}
+
+	return obj.bitmap, true, true
+}
+
+// storeBitmap writes buf, which setBit may have grown, back to key. Like
+// other modifying commands it keeps the TTL. Callers must hold mux.
+func storeBitmap(key string, buf []byte) {
+	obj, exists := datastore[key]
+	if !exists {
+		obj = object{typ: "string"}
+	}
+
+	obj.bitmap = buf
+	obj.createdAt = time.Now().UTC()
+	putKey(key, obj)
+}
+
+// parseBitOffset reads a bit offset. With hashAllowed, "#n" stands for
+// the n-th field of the given width, like BITFIELD allows.
+func parseBitOffset(arg string, hashAllowed bool, width int) (int, bool) {
+	multiplier := 1
+	if hashAllowed && strings.HasPrefix(arg, "#") {
+		arg = arg[1:]
+		multiplier = width
+	}
+
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || n < 0 || n > maxBitOffset/int64(multiplier) {
+		return 0, false
+	}
+
+	n *= int64(multiplier)
+	if n+int64(width)-1 > maxBitOffset {
+		return 0, false
+	}
+
+	return int(n), true
+}
+
+// SETBIT key offset value
+func setbit(args []token) token {
+	if len(args) != 3 {
+		return wrongArgs("SETBIT")
+	}
+
+	offset, ok := parseBitOffset(args[1].bulk, false, 1)
+	if !ok {
+		return errBitOffset
+	}
+
+	if args[2].bulk != "0" && args[2].bulk != "1" {
+		return token{typ: string(ERROR), val: "ERR bit is not an integer or out of range"}
+	}
+	value := int(args[2].bulk[0] - '0')
+
+	key := args[0].bulk
+	buf, _, ok := bitmapForWrite(key)
+	if !ok {
+		return errWrongType
+	}
+
+	old := getBit(buf, offset)
+	storeBitmap(key, setBit(buf, offset, value))
+	notifyKeyspaceEvent(notifyString, "setbit", key)
+
+	return intToken(old)
+}
+
+// GETBIT key offset
+func getbit(args []token) token {
+	if len(args) != 2 {
+		return wrongArgs("GETBIT")
+	}
+
+	offset, ok := parseBitOffset(args[1].bulk, false, 1)
+	if !ok {
+		return errBitOffset
+	}
+
+	// The bit is read where it is, without copying the string
+	obj, exists := lookupKey(args[0].bulk)
+	if !exists {
+		return intToken(0)
+	}
+	if obj.typ != "string" {
+		return errWrongType
+	}
+	if obj.bitmap != nil {
+		return intToken(getBit(obj.bitmap, offset))
+	}
+
+	return intToken(getBit(obj.value, offset))
+}
+
+// bitRange parses the optional start, end and BYTE|BIT arguments of
+// BITCOUNT and BITPOS into an inclusive range of bit offsets within a
+// string of n bytes. empty is set when the range selects nothing.
+func bitRange(args []token, n int) (first, last int, empty bool, errTok *token) {
+	if len(args) == 0 {
+		return 0, n*8 - 1, n == 0, nil
+	}
+
+	start, err := strconv.Atoi(args[0].bulk)
+	if err != nil {
+		return 0, 0, false, &errNotInteger
+	}
+
+	end := math.MaxInt
+	if len(args) > 1 {
+		end, err = strconv.Atoi(args[1].bulk)
+		if err != nil {
+			return 0, 0, false, &errNotInteger
+		}
+	}
+
+	unit := 8
+	if len(args) > 2 {
+		switch strings.ToUpper(args[2].bulk) {
+		case "BYTE":
+		case "BIT":
+			unit = 1
+		default:
+			return 0, 0, false, &errSyntax
+		}
+	}
+	if len(args) > 3 {
+		return 0, 0, false, &errSyntax
+	}
+
+	// Negative offsets count from the end like GETRANGE does
+	total := n * 8 / unit
+	if start < 0 && end < 0 && start > end {
+		return 0, 0, true, nil
+	}
+	if start < 0 {
+		start = max(total+start, 0)
+	}
+	if end < 0 {
+		end = max(total+end, 0)
+	}
+	if end >= total {
+		end = total - 1
+	}
+	if start > end {
+		return 0, 0, true, nil
+	}
+
+	if unit == 8 {
+		return start * 8, end*8 + 7, false, nil
+	}
+
+	return start, end, false, nil
+}
+
+// BITCOUNT key [start end [BYTE|BIT]]
+func bitcount(args []token) token {
+	if len(args) != 1 && (len(args) < 3 || len(args) > 4) {
+		if len(args) == 2 {
+			return errSyntax
+		}
+		return wrongArgs("BITCOUNT")
+	}
+
+	// Like GETBIT, the bits are counted where they are
+	obj, exists := lookupKey(args[0].bulk)
+	if exists && obj.typ != "string" {
+		return errWrongType
+	}
+	if obj.bitmap != nil {
+		return countBits(obj.bitmap, args[1:])
+	}
+
+	return countBits(obj.value, args[1:])
+}
+
+// countBits replies to BITCOUNT for buf given the range arguments
+func countBits[T string | []byte](buf T, args []token) token {
+	first, last, empty, errTok := bitRange(args, len(buf))
+	if errTok != nil {
+		return *errTok
+	}
+	if empty {
+		return intToken(0)
+	}
+
+	count := 0
+	for i := first; i <= last; {
+		// Whole bytes at once, bit by bit at the edges of the range
+		if i%8 == 0 && i+7 <= last {
+			count += bits.OnesCount8(buf[i/8])
+			i += 8
+			continue
+		}
+		count += getBit(buf, i)
+		i++
+	}
+
+	return intToken(count)
+}
+
+// BITPOS key bit [start [end [BYTE|BIT]]]
+func bitpos(args []token) token {
+	if len(args) < 2 || len(args) > 5 {
+		return wrongArgs("BITPOS")
+	}
+
+	if args[1].bulk != "0" && args[1].bulk != "1" {
+		return token{typ: string(ERROR), val: "ERR The bit argument must be 1 or 0."}
+	}
+	bit := int(args[1].bulk[0] - '0')
+
+	obj, exists := lookupKey(args[0].bulk)
+	if exists && obj.typ != "string" {
+		return errWrongType
+	}
+
+	if !exists {
+		if bit == 1 {
+			return intToken(-1)
+		}
+		return intToken(0)
+	}
+
+	if obj.bitmap != nil {
+		return findBit(obj.bitmap, bit, args[2:])
+	}
+
+	return findBit(obj.value, bit, args[2:])
+}
+
+// findBit replies to BITPOS for the first bit of buf set to bit, given
+// the range arguments
+func findBit[T string | []byte](buf T, bit int, args []token) token {
+	first, last, empty, errTok := bitRange(args, len(buf))
+	if errTok != nil {
+		return *errTok
+	}
+	if empty {
+		return intToken(-1)
+	}
+
+	// Bytes that can't contain the bit are skipped whole
+	skip := byte(0x00)
+	if bit == 0 {
+		skip = 0xff
+	}
+
+	for i := first; i <= last; {
+		if i%8 == 0 && i+7 <= last && buf[i/8] == skip {
+			i += 8
+			continue
+		}
+		if getBit(buf, i) == bit {
+			return intToken(i)
+		}
+		i++
+	}
+
+	// Without an explicit end the string counts as padded with zeros
+	endGiven := len(args) > 1
+	if bit == 0 && !endGiven {
+		return intToken(len(buf) * 8)
+	}
+
+	return intToken(-1)
+}
+
+// BITOP AND|OR|XOR|NOT destkey key [key ...]
+func bitop(args []token) token {
+	if len(args) < 3 {
+		return wrongArgs("BITOP")
+	}
+
+	op := strings.ToUpper(args[0].bulk)
+	switch op {
+	case "AND", "OR", "XOR":
+	case "NOT":
+		if len(args) != 3 {
+			return token{typ: string(ERROR), val: "ERR BITOP NOT must be called with a single source key."}
+		}
+	default:
+		return errSyntax
+	}
+
+	sources := make([][]byte, 0, len(args)-2)
+	longest := 0
+	for _, arg := range args[2:] {
+		value, _, ok := lookupString(arg.bulk)
+		if !ok {
+			return errWrongType
+		}
+		sources = append(sources, []byte(value))
+		longest = max(longest, len(value))
+	}
+
+	// Shorter strings count as padded with zero bytes
+	result := make([]byte, longest)
+	for i := range result {
+		byteAt := func(src []byte) byte {
+			if i < len(src) {
+				return src[i]
+			}
+			return 0
+		}
+
+		acc := byteAt(sources[0])
+		for _, src := range sources[1:] {
+			switch op {
+			case "AND":
+				acc &= byteAt(src)
+			case "OR":
+				acc |= byteAt(src)
+			case "XOR":
+				acc ^= byteAt(src)
+			}
+		}
+		if op == "NOT" {
+			acc = ^acc
+		}
+
+		result[i] = acc
+	}
+
+	dst := args[1].bulk
+	if len(result) == 0 {
+		if _, exists := lookupKey(dst); exists {
+			removeKey(dst)
+			delete(expires, dst)
+			notifyKeyspaceEvent(notifyGeneric, "del", dst)
+		}
+		return intToken(0)
+	}
+
+	storeString(dst, string(result), false)
+	notifyKeyspaceEvent(notifyString, "set", dst)
+
+	return intToken(len(result))
+}
+
+// bitfieldType is an integer encoding like i8 or u16
+type bitfieldType struct {
+	signed bool
+	width  int
+}
+
+func parseBitfieldType(arg string) (bitfieldType, bool) {
+	if len(arg) < 2 || (arg[0] != 'i' && arg[0] != 'u') {
+		return bitfieldType{}, false
+	}
+
+	width, err := strconv.Atoi(arg[1:])
+	if err != nil {
+		return bitfieldType{}, false
+	}
+
+	// Unsigned values have to fit in a signed 64 bit reply
+	signed := arg[0] == 'i'
+	if width < 1 || (signed && width > 64) || (!signed && width > 63) {
+		return bitfieldType{}, false
+	}
+
+	return bitfieldType{signed: signed, width: width}, true
+}
+
+// readBitfield returns the field of the given type at offset, sign
+// extended when it is signed
+func readBitfield[T string | []byte](buf T, offset int, typ bitfieldType) int64 {
+	var value uint64
+	for j := 0; j < typ.width; j++ {
+		value = value<<1 | uint64(getBit(buf, offset+j))
+	}
+
+	if typ.signed && typ.width < 64 && value&(1<<(typ.width-1)) != 0 {
+		value |= math.MaxUint64 << typ.width
+	}
+
+	return int64(value)
+}
+
+func writeBitfield(buf []byte, offset int, typ bitfieldType, value int64) []byte {
+	for j := 0; j < typ.width; j++ {
+		bit := int(uint64(value)>>(typ.width-1-j)) & 1
+		buf = setBit(buf, offset+j, bit)
+	}
+
+	return buf
+}
+
+// Overflow behaviours of BITFIELD SET and INCRBY
+const (
+	overflowWrap = "WRAP"
+	overflowSat  = "SAT"
+	overflowFail = "FAIL"
+)
+
+// applyOverflow adds incr to value within the range of typ, handling
+// results that don't fit as mode says. ok is false when mode is FAIL and
+// the result doesn't fit.
+func applyOverflow(value, incr int64, typ bitfieldType, mode string) (result int64, ok bool) {
+	if !typ.signed {
+		limit := uint64(1)<<typ.width - 1
+		v, d := uint64(value), uint64(incr)
+
+		var overflow, underflow bool
+		if incr > 0 {
+			overflow = v > limit || d > limit-min(v, limit) || v+d > limit
+		} else if incr < 0 {
+			underflow = v > limit || uint64(-incr) > v
+		} else {
+			overflow = v > limit
+		}
+
+		switch {
+		case !overflow && !underflow:
+			return int64(v + d), true
+		case mode == overflowFail:
+			return 0, false
+		case mode == overflowSat && overflow:
+			return int64(limit), true
+		case mode == overflowSat:
+			return 0, true
+		default:
+			return int64((v + d) & limit), true
+		}
+	}
+
+	maxValue := int64(math.MaxInt64)
+	if typ.width < 64 {
+		maxValue = int64(1)<<(typ.width-1) - 1
+	}
+	minValue := -maxValue - 1
+
+	// Written so that the checks themselves can't overflow
+	overflow := value > maxValue || (incr > 0 && incr > maxValue-value)
+	underflow := value < minValue || (incr < 0 && incr < minValue-value)
+
+	switch {
+	case !overflow && !underflow:
+		return value + incr, true
+	case mode == overflowFail:
+		return 0, false
+	case mode == overflowSat && overflow:
+		return maxValue, true
+	case mode == overflowSat:
+		return minValue, true
+	}
+
+	// Wrap around in two's complement, then sign extend to the width
+	wrapped := uint64(value) + uint64(incr)
+	if typ.width < 64 {
+		msb := uint64(1) << (typ.width - 1)
+		mask := uint64(math.MaxUint64) << typ.width
+		if wrapped&msb != 0 {
+			wrapped |= mask
+		} else {
+			wrapped &^= mask
+		}
+	}
+
+	return int64(wrapped), true
+}
+
+type bitfieldOp struct {
+	command  string
+	typ      bitfieldType
+	offset   int
+	value    int64
+	overflow string
+}
+
+func parseBitfieldOps(command string, args []token) ([]bitfieldOp, *token) {
+	ops := []bitfieldOp{}
+	overflow := overflowWrap
+
+	for i := 0; i < len(args); i++ {
+		sub := strings.ToUpper(args[i].bulk)
+
+		if sub == "OVERFLOW" {
+			if i+1 >= len(args) {
+				return nil, &errSyntax
+			}
+			switch mode := strings.ToUpper(args[i+1].bulk); mode {
+			case overflowWrap, overflowSat, overflowFail:
+				overflow = mode
+			default:
+				return nil, &token{typ: string(ERROR), val: "ERR Invalid OVERFLOW type specified"}
+			}
+			i++
+			continue
+		}
+
+		operands := 2
+		switch sub {
+		case "GET":
+		case "SET", "INCRBY":
+			operands = 3
+			if command == "BITFIELD_RO" {
+				return nil, &token{typ: string(ERROR), val: "ERR BITFIELD_RO only supports the GET subcommand"}
+			}
+		default:
+			return nil, &errSyntax
+		}
+
+		if i+operands >= len(args) {
+			return nil, &errSyntax
+		}
+
+		typ, ok := parseBitfieldType(args[i+1].bulk)
+		if !ok {
+			return nil, &token{
+				typ: string(ERROR),
+				val: "ERR Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is.",
+			}
+		}
+
+		offset, ok := parseBitOffset(args[i+2].bulk, true, typ.width)
+		if !ok {
+			return nil, &errBitOffset
+		}
+
+		op := bitfieldOp{command: sub, typ: typ, offset: offset, overflow: overflow}
+		if operands == 3 {
+			n, err := strconv.ParseInt(args[i+3].bulk, 10, 64)
+			if err != nil {
+				return nil, &errNotInteger
+			}
+			op.value = n
+		}
+
+		ops = append(ops, op)
+		i += operands
+	}
+
+	return ops, nil
+}
+
+func bitfieldGeneric(command string, args []token) token {
+	if len(args) < 1 {
+		return wrongArgs(command)
+	}
+
+	ops, errTok := parseBitfieldOps(command, args[1:])
+	if errTok != nil {
+		return *errTok
+	}
+
+	key := args[0].bulk
+
+	writes := false
+	for _, op := range ops {
+		writes = writes || op.command != "GET"
+	}
+	if !writes {
+		return bitfieldGets(key, ops)
+	}
+
+	buf, _, ok := bitmapForWrite(key)
+	if !ok {
+		return errWrongType
+	}
+
+	written := false
+
+	results := make([]token, 0, len(ops))
+	for _, op := range ops {
+		current := readBitfield(buf, op.offset, op.typ)
+
+		switch op.command {
+		case "GET":
+			results = append(results, intToken(int(current)))
+			continue
+		case "SET":
+			updated, ok := applyOverflow(op.value, 0, op.typ, op.overflow)
+			if !ok {
+				results = append(results, token{typ: string(NULL)})
+				continue
+			}
+			buf = writeBitfield(buf, op.offset, op.typ, updated)
+			results = append(results, intToken(int(current)))
+		case "INCRBY":
+			updated, ok := applyOverflow(current, op.value, op.typ, op.overflow)
+			if !ok {
+				results = append(results, token{typ: string(NULL)})
+				continue
+			}
+			buf = writeBitfield(buf, op.offset, op.typ, updated)
+			results = append(results, intToken(int(updated)))
+		}
+		written = true
+	}
+
+	if written {
+		storeBitmap(key, buf)
+		notifyKeyspaceEvent(notifyString, "setbit", key)
+	}
+
+	return token{typ: string(ARRAY), array: results}
+}
+
+// bitfieldGets replies to a BITFIELD that only reads, which reads the
+// string where it is
+func bitfieldGets(key string, ops []bitfieldOp) token {
+	obj, exists := lookupKey(key)
+	if exists && obj.typ != "string" {
+		return errWrongType
+	}
+
+	results := make([]token, 0, len(ops))
+	for _, op := range ops {
+		var current int64
+		if obj.bitmap != nil {
+			current = readBitfield(obj.bitmap, op.offset, op.typ)
+		} else {
+			current = readBitfield(obj.value, op.offset, op.typ)
+		}
+		results = append(results, intToken(int(current)))
+	}
+
+	return token{typ: string(ARRAY), array: results}
+}
+
+// BITFIELD key [GET encoding offset | [OVERFLOW WRAP|SAT|FAIL] SET encoding offset value | INCRBY encoding offset increment] ...
+func bitfield(args []token) token {
+	return bitfieldGeneric("BITFIELD", args)
+}
+
+// BITFIELD_RO key [GET encoding offset ...]
+func bitfieldRO(args []token) token {
+	return bitfieldGeneric("BITFIELD_RO", args)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBitmaps(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want token
+	}{
+		{"setbit grows the string", []string{"SETBIT", "bit:a", "7", "1"}, intToken(0)},
+		{"setbit returns the old bit", []string{"SETBIT", "bit:a", "7", "1"}, intToken(1)},
+		{"bits are msb first", []string{"GET", "bit:a"}, token{typ: string(STRING), val: "\x01"}},
+		{"getbit", []string{"GETBIT", "bit:a", "7"}, intToken(1)},
+		{"getbit past the end", []string{"GETBIT", "bit:a", "100"}, intToken(0)},
+		{"bitcount a bitmap", []string{"BITCOUNT", "bit:a"}, intToken(1)},
+		{"bitpos a bitmap", []string{"BITPOS", "bit:a", "1"}, intToken(7)},
+		{"bad offset", []string{"SETBIT", "bit:a", "-1", "1"}, errBitOffset},
+		{"offset too large", []string{"SETBIT", "bit:a", "4294967296", "1"}, errBitOffset},
+		{"bad bit", []string{"SETBIT", "bit:a", "0", "2"}, token{typ: string(ERROR), val: "ERR bit is not an integer or out of range"}},
+		{"bitcount", []string{"SET", "bit:b", "foobar"}, token{typ: string(STRING), val: "OK"}},
+		{"bitcount whole", []string{"BITCOUNT", "bit:b"}, intToken(26)},
+		{"bitcount bytes", []string{"BITCOUNT", "bit:b", "1", "1"}, intToken(6)},
+		{"bitcount negative", []string{"BITCOUNT", "bit:b", "-2", "-1"}, intToken(7)},
+		{"bitcount bits", []string{"BITCOUNT", "bit:b", "5", "30", "BIT"}, intToken(17)},
+		{"bitcount missing end", []string{"BITCOUNT", "bit:b", "1"}, errSyntax},
+		{"bitcount missing key", []string{"BITCOUNT", "bit:none"}, intToken(0)},
+		{"bitpos setup", []string{"SET", "bit:c", "\xff\xf0\x00"}, token{typ: string(STRING), val: "OK"}},
+		{"bitpos clear", []string{"BITPOS", "bit:c", "0"}, intToken(12)},
+		{"bitpos set from byte", []string{"BITPOS", "bit:c", "1", "2"}, intToken(-1)},
+		{"bitpos bits", []string{"BITPOS", "bit:c", "1", "7", "15", "BIT"}, intToken(7)},
+		{"bitpos all ones", []string{"SET", "bit:d", "\xff"}, token{typ: string(STRING), val: "OK"}},
+		{"bitpos pads without end", []string{"BITPOS", "bit:d", "0"}, intToken(8)},
+		{"bitpos no padding with end", []string{"BITPOS", "bit:d", "0", "0", "-1"}, intToken(-1)},
+		{"bitpos missing key", []string{"BITPOS", "bit:none", "0"}, intToken(0)},
+		{"setbit on a string", []string{"SETBIT", "bit:b", "7", "1"}, intToken(0)},
+		{"strings see bit writes", []string{"APPEND", "bit:b", "!"}, intToken(7)},
+		{"bit writes see strings", []string{"GETBIT", "bit:b", "55"}, intToken(1)},
+		{"copy setup", []string{"COPY", "bit:a", "bit:copy"}, intToken(1)},
+		{"copies are apart", []string{"SETBIT", "bit:copy", "0", "1"}, intToken(0)},
+		{"original unchanged", []string{"GET", "bit:a"}, token{typ: string(STRING), val: "\x01"}},
+		{"copy changed", []string{"GET", "bit:copy"}, token{typ: string(STRING), val: "\x81"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := run(t, tt.args...); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Failed %s. wanted %v, got %v", tt.args[0], tt.want, got)
+			}
+		})
+	}
+
+	t.Run("wrong type", func(t *testing.T) {
+		run(t, "RPUSH", "bit:list", "a")
+
+		if got := run(t, "SETBIT", "bit:list", "0", "1"); !reflect.DeepEqual(got, errWrongType) {
+			t.Errorf("Failed setbit. wanted %v, got %v", errWrongType, got)
+		}
+	})
+}
+
+func TestBitop(t *testing.T) {
+	run(t, "SET", "bitop:a", "abc")
+	run(t, "SET", "bitop:b", "a")
+
+	tests := []struct {
+		name   string
+		args   []string
+		result string
+	}{
+		{"and pads with zeros", []string{"BITOP", "AND", "bitop:dst", "bitop:a", "bitop:b"}, "a\x00\x00"},
+		{"or", []string{"BITOP", "OR", "bitop:dst", "bitop:a", "bitop:b"}, "abc"},
+		{"xor", []string{"BITOP", "XOR", "bitop:dst", "bitop:a", "bitop:b"}, "\x00bc"},
+		{"not", []string{"BITOP", "NOT", "bitop:dst", "bitop:b"}, "\x9e"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := run(t, tt.args...); !reflect.DeepEqual(got, intToken(len(tt.result))) {
+				t.Errorf("Failed bitop. wanted %v, got %v", intToken(len(tt.result)), got)
+			}
+
+			want := token{typ: string(STRING), val: tt.result}
+			if got := run(t, "GET", "bitop:dst"); !reflect.DeepEqual(got, want) {
+				t.Errorf("Failed get. wanted %v, got %v", want, got)
+			}
+		})
+	}
+
+	t.Run("empty result deletes the destination", func(t *testing.T) {
+		run(t, "BITOP", "OR", "bitop:dst", "bitop:none")
+
+		if got := run(t, "EXISTS", "bitop:dst"); !reflect.DeepEqual(got, intToken(0)) {
+			t.Errorf("Failed exists. wanted %v, got %v", intToken(0), got)
+		}
+	})
+
+	t.Run("not takes one key", func(t *testing.T) {
+		got := run(t, "BITOP", "NOT", "bitop:dst", "bitop:a", "bitop:b")
+		if got.typ != string(ERROR) {
+			t.Errorf("Failed bitop. wanted an error, got %v", got)
+		}
+	})
+}
+
+func TestBitfield(t *testing.T) {
+	null := token{typ: string(NULL)}
+	ints := func(values ...int) token {
+		array := []token{}
+		for _, v := range values {
+			array = append(array, intToken(v))
+		}
+		return token{typ: string(ARRAY), array: array}
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		want token
+	}{
+		{"set and get", []string{"BITFIELD", "bf:a", "SET", "u8", "0", "200", "GET", "u8", "0", "GET", "i8", "0"}, ints(0, 200, -56)},
+		{"hash offsets", []string{"BITFIELD", "bf:a", "SET", "u8", "#1", "7", "GET", "u16", "0"}, ints(0, 200<<8|7)},
+		{"wrap unsigned", []string{"BITFIELD", "bf:b", "INCRBY", "u2", "100", "5"}, ints(1)},
+		{"wrap signed", []string{"BITFIELD", "bf:b", "SET", "i8", "0", "127", "INCRBY", "i8", "0", "1"}, ints(0, -128)},
+		{"saturate", []string{"BITFIELD", "bf:c", "OVERFLOW", "SAT", "INCRBY", "u4", "0", "20", "INCRBY", "i4", "4", "-20"}, ints(15, -8)},
+		{"fail", []string{"BITFIELD", "bf:d", "OVERFLOW", "FAIL", "INCRBY", "u4", "0", "16", "INCRBY", "u4", "0", "15"}, token{typ: string(ARRAY), array: []token{null, intToken(15)}}},
+		{"i64 wraps", []string{"BITFIELD", "bf:e", "SET", "i64", "0", "9223372036854775807", "INCRBY", "i64", "0", "1"}, ints(0, -9223372036854775808)},
+		{"readonly get", []string{"BITFIELD_RO", "bf:a", "GET", "u8", "8"}, ints(7)},
+		{"readonly rejects writes", []string{"BITFIELD_RO", "bf:a", "SET", "u8", "0", "1"}, token{typ: string(ERROR), val: "ERR BITFIELD_RO only supports the GET subcommand"}},
+		{"u64 isn't supported", []string{"BITFIELD", "bf:a", "GET", "u64", "0"}, token{typ: string(ERROR), val: "ERR Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is."}},
+		{"bad overflow", []string{"BITFIELD", "bf:a", "OVERFLOW", "NOPE"}, token{typ: string(ERROR), val: "ERR Invalid OVERFLOW type specified"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := run(t, tt.args...); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Failed %s. wanted %v, got %v", tt.args[0], tt.want, got)
+			}
+		})
+	}
+
+	t.Run("get doesn't create the key", func(t *testing.T) {
+		run(t, "BITFIELD", "bf:none", "GET", "u8", "0")
+
+		if got := run(t, "EXISTS", "bf:none"); !reflect.DeepEqual(got, intToken(0)) {
+			t.Errorf("Failed exists. wanted %v, got %v", intToken(0), got)
+		}
+	})
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// blockedClient is a connection parked in BLPOP, BRPOP, BLMOVE or
+// XREAD until one of its keys receives an element or the timeout fires.
+type blockedClient struct {
+	keys     []string
+	fromLeft bool
+	// Only used by BLMOVE
+	move   bool
+	dst    string
+	toLeft bool
+	// Only used by XREAD, which waits for entries newer than streamIDs,
+	// and XREADGROUP, which waits for entries new to group
+	stream    bool
+	streamIDs map[string]streamID
+	count     int
+	group     string
+	consumer  string
+	noAck     bool
+	// Receives the reply once the client has been served
+	reply chan token
+	// Closes when the connection of the client drops while it waits
+	gone <-chan struct{}
+}
+
+// blockedClients holds the clients waiting on each key,
+// in the order they blocked. Guarded by mux.
+var blockedClients = map[string][]*blockedClient{}
+
+// servedCommands are what replicas have to apply to mirror the blocking
+// commands served while the running command holds mux, in the order they
+// were served. Guarded by mux.
+var servedCommands []token
+
+// replicateServed queues command to reach the replicas right after the
+// command being run, before mux is released, so that no other write can
+// land in between. Callers must hold mux.
+func replicateServed(command token) {
+	if Role == "master" && len(replicas) > 0 {
+		servedCommands = append(servedCommands, command)
+	}
+}
+
+// blockingCommands are the commands that may park the client until they
+// are served, so process watches the connection while they run
+var blockingCommands = map[string]bool{
+	"BLPOP":      true,
+	"BRPOP":      true,
+	"BLMOVE":     true,
+	"XREAD":      true,
+	"XREADGROUP": true,
+}
+
+// connectionGone closes when the connection of the command being run
+// drops. It is nil for commands that aren't watched. Guarded by mux.
+var connectionGone <-chan struct{}
+
+// denyBlocking is set while commands run that must not give up mux
+// halfway, like the ones of a transaction. Guarded by mux.
+var denyBlocking bool
+
+// parseTimeout reads a blocking timeout given in seconds.
+// A zero duration means block forever.
+func parseTimeout(arg string) (time.Duration, *token) {
+	secs, err := strconv.ParseFloat(arg, 64)
+	if err != nil || math.IsNaN(secs) || math.IsInf(secs, 0) {
+		return 0, &token{typ: string(ERROR), val: "ERR timeout is not a float or out of range"}
+	}
+
+	if secs < 0 {
+		return 0, &token{typ: string(ERROR), val: "ERR timeout is negative"}
+	}
+
+	return time.Duration(secs * float64(time.Second)), nil
+}
+
+// block registers client on each of its keys, until it is served or its
+// connection drops. Callers must hold mux.
+func block(client *blockedClient) {
+	client.gone = connectionGone
+	for _, key := range client.keys {
+		blockedClients[key] = append(blockedClients[key], client)
+	}
+}
+
+// unblock removes client from every key it is waiting on.
+// Callers must hold mux.
+func unblock(client *blockedClient) {
+	for _, key := range client.keys {
+		waiting := blockedClients[key]
+		for i, c := range waiting {
+			if c == client {
+				waiting = append(waiting[:i], waiting[i+1:]...)
+				break
+			}
+		}
+
+		if len(waiting) == 0 {
+			delete(blockedClients, key)
+		} else {
+			blockedClients[key] = waiting
+		}
+	}
+}
+
+// serveBlockedClients serves the clients blocked on key with whatever it
+// now holds. Callers must hold mux.
+func serveBlockedClients(key string) {
+	if len(blockedClients[key]) == 0 {
+		return
+	}
+
+	obj, exists := lookupKey(key)
+	if !exists {
+		return
+	}
+
+	switch obj.typ {
+	case "list":
+		serveListClients(key)
+	case "stream":
+		serveStreamClients(key, obj.streamData)
+	}
+}
+
+// serveListClients hands elements of the list at key to the clients
+// blocked on it, oldest first, for as long as the list has elements.
+// Callers must hold mux.
+func serveListClients(key string) {
+	for _, client := range listClients(key) {
+		list, _ := lookupList(key)
+		if len(list) == 0 {
+			return
+		}
+
+		unblock(client)
+
+		if client.move {
+			client.reply <- moveServed(key, client.dst, client.fromLeft, client.toLeft)
+		} else {
+			client.reply <- popServed(key, list, client.fromLeft)
+		}
+	}
+}
+
+func listClients(key string) []*blockedClient {
+	clients := []*blockedClient{}
+	for _, client := range blockedClients[key] {
+		if !client.stream {
+			clients = append(clients, client)
+		}
+	}
+
+	return clients
+}
+
+// serveStreamClients replies to every XREAD and XREADGROUP blocked on key
+// that is waiting for entries s now has. Unlike list elements, entries are
+// not consumed so all of them may be served. Callers must hold mux.
+func serveStreamClients(key string, s *stream) {
+	waiting := append([]*blockedClient(nil), blockedClients[key]...)
+	for _, client := range waiting {
+		if !client.stream {
+			continue
+		}
+
+		if client.group == "" {
+			entries := entriesAfter(s, client.streamIDs[key], client.count)
+			if len(entries) == 0 {
+				continue
+			}
+
+			unblock(client)
+			client.reply <- token{
+				typ:   string(ARRAY),
+				array: []token{streamReadReply(key, entriesToken(entries))},
+			}
+			continue
+		}
+
+		g, exists := s.groups[client.group]
+		if !exists {
+			unblock(client)
+			client.reply <- token{
+				typ: string(ERROR),
+				val: "NOGROUP the consumer group this client was blocked on no longer exists",
+			}
+			continue
+		}
+
+		if len(entriesAfter(s, g.lastID, 1)) == 0 {
+			continue
+		}
+
+		unblock(client)
+		c := groupConsumer(key, client.group, g, client.consumer)
+		entries := s.deliverNew(g, c, client.count, client.noAck)
+		replicateServed(client.readGroupCommand(key))
+		client.reply <- token{
+			typ:   string(ARRAY),
+			array: []token{streamReadReply(key, entriesToken(entries))},
+		}
+	}
+}
+
+// readGroupCommand returns the XREADGROUP replicas apply to deliver to
+// client what it was served from the stream at key
+func (client *blockedClient) readGroupCommand(key string) token {
+	values := []string{"XREADGROUP", "GROUP", client.group, client.consumer}
+	if client.count > 0 {
+		values = append(values, "COUNT", strconv.Itoa(client.count))
+	}
+	if client.noAck {
+		values = append(values, "NOACK")
+	}
+
+	return bulkArray(append(values, "STREAMS", key, ">"))
+}
+
+// waitUntilServed parks the caller until client is served or timeout
+// elapses or its connection drops, in which case timeoutReply is returned
+// and nothing was taken for it. Callers must hold mux,
+// which is released while waiting and held again on return.
+func waitUntilServed(client *blockedClient, timeout time.Duration, timeoutReply token) token {
+	// Transactions can't wait for other clients, they time out right away
+	if denyBlocking {
+		unblock(client)
+		return timeoutReply
+	}
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	// What the caller queued so far has to reach the replicas before the
+	// commands that run while it waits
+	replicate(servedCommands...)
+	servedCommands = nil
+
+	mux.Unlock()
+
+	select {
+	case reply := <-client.reply:
+		mux.Lock()
+		return reply
+	case <-expired:
+	case <-client.gone:
+	}
+
+	mux.Lock()
+
+	// A push may have served us while we were waiting for the lock
+	select {
+	case reply := <-client.reply:
+		return reply
+	default:
+	}
+
+	unblock(client)
+
+	return timeoutReply
+}
+
+func blockingPop(command string, args []token, fromLeft bool) token {
+	if len(args) < 2 {
+		return wrongArgs(command)
+	}
+
+	timeout, errTok := parseTimeout(args[len(args)-1].bulk)
+	if errTok != nil {
+		return *errTok
+	}
+
+	keys := make([]string, 0, len(args)-1)
+	for _, arg := range args[:len(args)-1] {
+		keys = append(keys, arg.bulk)
+	}
+
+	for _, key := range keys {
+		list, ok := lookupList(key)
+		if !ok {
+			return errWrongType
+		}
+
+		if len(list) > 0 {
+			return popServed(key, list, fromLeft)
+		}
+	}
+
+	client := &blockedClient{
+		keys:     keys,
+		fromLeft: fromLeft,
+		reply:    make(chan token, 1),
+	}
+	block(client)
+
+	return waitUntilServed(client, timeout, token{typ: string(NULLARRAY)})
+}
+
+// BLPOP key [key ...] timeout
+func blpop(args []token) token {
+	return blockingPop("BLPOP", args, true)
+}
+
+// BRPOP key [key ...] timeout
+func brpop(args []token) token {
+	return blockingPop("BRPOP", args, false)
+}
+
+// BLMOVE source destination LEFT|RIGHT LEFT|RIGHT timeout
+func blmove(args []token) token {
+	if len(args) != 5 {
+		return wrongArgs("BLMOVE")
+	}
+
+	from, to := strings.ToUpper(args[2].bulk), strings.ToUpper(args[3].bulk)
+	if (from != "LEFT" && from != "RIGHT") || (to != "LEFT" && to != "RIGHT") {
+		return errSyntax
+	}
+
+	timeout, errTok := parseTimeout(args[4].bulk)
+	if errTok != nil {
+		return *errTok
+	}
+
+	src, dst := args[0].bulk, args[1].bulk
+
+	list, ok := lookupList(src)
+	if !ok {
+		return errWrongType
+	}
+
+	if len(list) > 0 {
+		return moveServed(src, dst, from == "LEFT", to == "LEFT")
+	}
+
+	client := &blockedClient{
+		keys:     []string{src},
+		fromLeft: from == "LEFT",
+		move:     true,
+		dst:      dst,
+		toLeft:   to == "LEFT",
+		reply:    make(chan token, 1),
+	}
+	block(client)
+
+	return waitUntilServed(client, timeout, token{typ: string(NULL)})
+}
+
+// popServed pops an element of the non-empty list at key for BLPOP or
+// BRPOP, which replicas apply as LPOP or RPOP. Callers must hold mux.
+func popServed(key string, list []string, fromLeft bool) token {
+	element := popElement(key, list, fromLeft)
+
+	pop := "RPOP"
+	if fromLeft {
+		pop = "LPOP"
+	}
+	replicateServed(bulkArray([]string{pop, key}))
+
+	return bulkArray([]string{key, element})
+}
+
+// moveServed moves an element of the non-empty list at src for BLMOVE,
+// which replicas apply as LMOVE. The LMOVE is queued before the push, as
+// that may serve clients blocked on dst in turn. Callers must hold mux.
+func moveServed(src, dst string, fromLeft, toLeft bool) token {
+	if _, ok := lookupList(dst); !ok {
+		return errWrongType
+	}
+
+	replicateServed(bulkArray([]string{"LMOVE", src, dst, listSide(fromLeft), listSide(toLeft)}))
+
+	return moveElement(src, dst, fromLeft, toLeft)
+}
+
+func listSide(left bool) string {
+	if left {
+		return "LEFT"
+	}
+	return "RIGHT"
+}
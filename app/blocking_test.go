@@ -0,0 +1,176 @@
+package main
+
+import (
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// waitForBlocked polls until n clients are blocked on key
+func waitForBlocked(t *testing.T, key string, n int) {
+	t.Helper()
+
+	for i := 0; i < 100; i++ {
+		mux.RLock()
+		blocked := len(blockedClients[key])
+		mux.RUnlock()
+
+		if blocked == n {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	t.Fatalf("Timed out waiting for %d clients blocked on %s", n, key)
+}
+
+// asMaster makes the server a master with one replica until t ends, so
+// that what blocked clients are served gets replicated
+func asMaster(t *testing.T) {
+	primary, replica := net.Pipe()
+	go io.Copy(io.Discard, replica)
+
+	c := newClient(primary)
+	mux.Lock()
+	Role, replicas = "master", []*client{c}
+	mux.Unlock()
+
+	t.Cleanup(func() {
+		mux.Lock()
+		Role, replicas, servedCommands = "", nil, nil
+		mux.Unlock()
+
+		c.close()
+		replica.Close()
+	})
+}
+
+func TestBlocking(t *testing.T) {
+	t.Run("blpop returns immediately when data exists", func(t *testing.T) {
+		run(t, "RPUSH", "block:ready", "a")
+
+		want := bulkArray([]string{"block:ready", "a"})
+		if got := run(t, "BLPOP", "block:empty", "block:ready", "0"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed blpop. wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("blpop times out with a null array", func(t *testing.T) {
+		want := token{typ: string(NULLARRAY)}
+		if got := run(t, "BLPOP", "block:timeout", "0.05"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed blpop. wanted %v, got %v", want, got)
+		}
+
+		mux.RLock()
+		defer mux.RUnlock()
+		if len(blockedClients["block:timeout"]) != 0 {
+			t.Errorf("Client still registered after timeout")
+		}
+	})
+
+	t.Run("push wakes blocked clients in order", func(t *testing.T) {
+		first := make(chan token)
+		second := make(chan token)
+
+		go func() { first <- run(t, "BLPOP", "block:fifo", "0") }()
+		waitForBlocked(t, "block:fifo", 1)
+		go func() { second <- run(t, "BRPOP", "block:fifo", "0") }()
+		waitForBlocked(t, "block:fifo", 2)
+
+		run(t, "RPUSH", "block:fifo", "x", "y", "z")
+
+		want := bulkArray([]string{"block:fifo", "x"})
+		if got := <-first; !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed blpop. wanted %v, got %v", want, got)
+		}
+
+		want = bulkArray([]string{"block:fifo", "z"})
+		if got := <-second; !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed brpop. wanted %v, got %v", want, got)
+		}
+
+		want = bulkArray([]string{"y"})
+		if got := run(t, "LRANGE", "block:fifo", "0", "-1"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed lrange. wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("blmove", func(t *testing.T) {
+		result := make(chan token)
+
+		go func() { result <- run(t, "BLMOVE", "block:src", "block:dst", "LEFT", "RIGHT", "1") }()
+		waitForBlocked(t, "block:src", 1)
+
+		run(t, "LPUSH", "block:src", "job")
+
+		want := token{typ: string(BULK), bulk: "job"}
+		if got := <-result; !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed blmove. wanted %v, got %v", want, got)
+		}
+
+		want = bulkArray([]string{"job"})
+		if got := run(t, "LRANGE", "block:dst", "0", "-1"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed blmove. wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("pushes replicate the pops they serve", func(t *testing.T) {
+		asMaster(t)
+
+		result := make(chan token)
+		go func() { result <- run(t, "BRPOP", "block:repl", "0") }()
+		waitForBlocked(t, "block:repl", 1)
+
+		push := []string{"RPUSH", "block:repl", "a", "b"}
+		args := []token{{typ: string(BULK), bulk: "block:repl"}, {typ: string(BULK), bulk: "a"}, {typ: string(BULK), bulk: "b"}}
+
+		mux.Lock()
+		got := propagatedCommands(bulkArray(push), "RPUSH", args, rpush(args))
+		mux.Unlock()
+
+		want := []token{bulkArray(push), bulkArray([]string{"RPOP", "block:repl"})}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed rpush. wanted %v, got %v", want, got)
+		}
+
+		// The woken client has nothing left to replicate
+		served := <-result
+		mux.Lock()
+		got = propagatedCommands(bulkArray([]string{"BRPOP", "block:repl", "0"}), "BRPOP", nil, served)
+		mux.Unlock()
+
+		if len(got) != 0 {
+			t.Errorf("Failed brpop. wanted nothing, got %v", got)
+		}
+	})
+
+	t.Run("dropped connections stop waiting", func(t *testing.T) {
+		for _, args := range [][]string{
+			{"BLPOP", "block:dropped", "0"},
+			{"BLMOVE", "block:dropped", "block:dropped:dst", "LEFT", "LEFT", "0"},
+		} {
+			c := newTestConn(t)
+			c.send(t, args...)
+			waitForBlocked(t, "block:dropped", 1)
+
+			c.conn.Close()
+			waitForBlocked(t, "block:dropped", 0)
+		}
+
+		run(t, "RPUSH", "block:dropped", "job")
+
+		want := bulkArray([]string{"job"})
+		if got := run(t, "LRANGE", "block:dropped", "0", "-1"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed lrange. wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("invalid timeout", func(t *testing.T) {
+		want := token{typ: string(ERROR), val: "ERR timeout is negative"}
+		if got := run(t, "BLPOP", "block:neg", "-1"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed blpop. wanted %v, got %v", want, got)
+		}
+	})
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A script holds mux for as long as it runs, so every other client waits
+// for it. Once it has run for longer than busyReplyThreshold, the others
+// get BUSY errors instead and may stop it with SCRIPT KILL or FUNCTION
+// KILL, unless it already wrote something: stopping it then would leave
+// its writes half done, and only SHUTDOWN NOSAVE is left.
+
+// busyReplyThreshold is how long scripts run before other clients get
+// BUSY errors. Guarded by mux.
+var busyReplyThreshold = 5 * time.Second
+
+type runningScript struct {
+	started   time.Time
+	threshold time.Duration
+	// function is set for FCALL, which FUNCTION KILL stops instead of
+	// SCRIPT KILL
+	function bool
+	wrote    bool
+	killed   bool
+	kill     context.CancelFunc
+}
+
+// running is the script running now, if any. Guarded by runningMux rather
+// than mux, which the script holds.
+var (
+	running    *runningScript
+	runningMux sync.Mutex
+)
+
+// startScript records that a script started, which kill stops.
+// Callers must hold mux.
+func startScript(function bool, kill context.CancelFunc) *runningScript {
+	script := &runningScript{
+		started:   time.Now(),
+		threshold: busyReplyThreshold,
+		function:  function,
+		kill:      kill,
+	}
+
+	runningMux.Lock()
+	running = script
+	runningMux.Unlock()
+
+	return script
+}
+
+func endScript() {
+	runningMux.Lock()
+	running = nil
+	runningMux.Unlock()
+}
+
+// scriptWrote marks the running script as unkillable
+func scriptWrote() {
+	runningMux.Lock()
+	running.wrote = true
+	runningMux.Unlock()
+}
+
+func (s *runningScript) wasKilled() bool {
+	runningMux.Lock()
+	defer runningMux.Unlock()
+
+	return s.killed
+}
+
+// busyCheckInterval is how often clients waiting for mux check whether
+// the script holding it ran for too long meanwhile
+const busyCheckInterval = 10 * time.Millisecond
+
+// scriptControl handles the commands that can't wait for a running
+// script: SCRIPT KILL and FUNCTION KILL, and any other once the script
+// runs for too long, which gets a BUSY error. It reports whether command
+// was handled. Callers must not hold mux.
+func scriptControl(command string, args []token) (token, bool) {
+	if (command == "SCRIPT" || command == "FUNCTION") && len(args) == 1 && strings.EqualFold(args[0].bulk, "KILL") {
+		return killScript(command == "FUNCTION"), true
+	}
+
+	return busyReply(command, args)
+}
+
+// lockUnlessBusy takes mux to run command, unless the script holding it
+// runs for too long while command waits, in which case it gives up with
+// the BUSY error. It reports whether mux was taken.
+func lockUnlessBusy(command string, args []token) (token, bool) {
+	if mux.TryLock() {
+		return token{}, true
+	}
+
+	locked := make(chan struct{})
+	go func() {
+		mux.Lock()
+		close(locked)
+	}()
+
+	ticker := time.NewTicker(busyCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-locked:
+			return token{}, true
+		case <-ticker.C:
+			if reply, busy := busyReply(command, args); busy {
+				// mux is released as soon as it is taken for us
+				go func() {
+					<-locked
+					mux.Unlock()
+				}()
+				return reply, false
+			}
+		}
+	}
+}
+
+// busyReply returns the BUSY error if a script is running for too long,
+// which every command but SHUTDOWN NOSAVE gets
+func busyReply(command string, args []token) (token, bool) {
+	runningMux.Lock()
+	defer runningMux.Unlock()
+
+	if running == nil || time.Since(running.started) < running.threshold {
+		return token{}, false
+	}
+
+	if command == "SHUTDOWN" && len(args) == 1 && strings.EqualFold(args[0].bulk, "NOSAVE") {
+		return token{}, false
+	}
+
+	kill := "SCRIPT KILL"
+	if running.function {
+		kill = "FUNCTION KILL"
+	}
+
+	return token{
+		typ: string(ERROR),
+		val: fmt.Sprintf("BUSY Redis is busy running a script. You can only call %s or SHUTDOWN NOSAVE.", kill),
+	}, true
+}
+
+// killScript stops the running script if it is a function when function
+// is set, or one run by EVAL otherwise
+func killScript(function bool) token {
+	runningMux.Lock()
+	defer runningMux.Unlock()
+
+	if running == nil || running.function != function {
+		return token{typ: string(ERROR), val: "NOTBUSY No scripts in execution right now."}
+	}
+
+	if running.wrote {
+		return token{
+			typ: string(ERROR),
+			val: "UNKILLABLE Sorry the script already executed write commands against the dataset. " +
+				"You can either wait the script termination or kill the server in a hard way using the SHUTDOWN NOSAVE command.",
+		}
+	}
+
+	running.killed = true
+	running.kill()
+
+	return token{typ: string(STRING), val: "OK"}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBusyScript(t *testing.T) {
+	run(t, "CONFIG", "SET", "busy-reply-threshold", "50")
+	t.Cleanup(func() { run(t, "CONFIG", "SET", "busy-reply-threshold", "5000") })
+
+	ok := token{typ: string(STRING), val: "OK"}
+	notBusy := token{typ: string(ERROR), val: "NOTBUSY No scripts in execution right now."}
+	busy := func(kill string) token {
+		return token{typ: string(ERROR), val: "BUSY Redis is busy running a script. You can only call " + kill + " or SHUTDOWN NOSAVE."}
+	}
+
+	run(t, "FUNCTION", "LOAD", "REPLACE", "#!lua name=busylib\nredis.register_function('busy_loop', function() while true do end end)")
+
+	cases := []struct {
+		name   string
+		script []string
+		kill   string
+		other  string
+		killed token
+	}{
+		{
+			name:   "eval",
+			script: []string{"EVAL", "while true do end", "0"},
+			kill:   "SCRIPT",
+			other:  "FUNCTION",
+			killed: token{typ: string(ERROR), val: "ERR Script killed by user with SCRIPT KILL..."},
+		},
+		{
+			name:   "function",
+			script: []string{"FCALL", "busy_loop", "0"},
+			kill:   "FUNCTION",
+			other:  "SCRIPT",
+			killed: token{typ: string(ERROR), val: "ERR Script killed by user with FUNCTION KILL..."},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			scripted, other := newTestConn(t), newTestConn(t)
+
+			if got := other.do(t, c.kill, "KILL"); !reflect.DeepEqual(got, notBusy) {
+				t.Errorf("Failed kill without script. wanted %v, got %v", notBusy, got)
+			}
+
+			scripted.send(t, c.script...)
+			time.Sleep(100 * time.Millisecond)
+
+			steps := []struct {
+				args []string
+				want token
+			}{
+				{[]string{"PING"}, busy(c.kill + " KILL")},
+				{[]string{"SHUTDOWN"}, busy(c.kill + " KILL")},
+				{[]string{c.other, "KILL"}, notBusy},
+				{[]string{c.kill, "KILL"}, ok},
+			}
+			for _, step := range steps {
+				if got := other.do(t, step.args...); !reflect.DeepEqual(got, step.want) {
+					t.Errorf("Failed %v. wanted %v, got %v", step.args, step.want, got)
+				}
+			}
+
+			if got := scripted.read(t); !reflect.DeepEqual(got, c.killed) {
+				t.Errorf("Failed killed script. wanted %v, got %v", c.killed, got)
+			}
+
+			if got, want := other.do(t, "PING"), (token{typ: string(STRING), val: "PONG"}); !reflect.DeepEqual(got, want) {
+				t.Errorf("Failed ping. wanted %v, got %v", want, got)
+			}
+		})
+	}
+
+	t.Run("clients waiting for the script", func(t *testing.T) {
+		scripted, waiting, watching := newTestConn(t), newTestConn(t), newTestConn(t)
+
+		scripted.send(t, "EVAL", "while true do end", "0")
+		for started := false; !started; time.Sleep(time.Millisecond) {
+			runningMux.Lock()
+			started = running != nil
+			runningMux.Unlock()
+		}
+
+		// Sent before the threshold, PING and WATCH wait for mux until it passes
+		waiting.send(t, "PING")
+		watching.send(t, "WATCH", "busy:watched")
+		if got, want := waiting.read(t), busy("SCRIPT KILL"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed waiting ping. wanted %v, got %v", want, got)
+		}
+		if got, want := watching.read(t), busy("SCRIPT KILL"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed waiting watch. wanted %v, got %v", want, got)
+		}
+
+		if got := waiting.do(t, "SCRIPT", "KILL"); !reflect.DeepEqual(got, ok) {
+			t.Errorf("Failed kill. wanted %v, got %v", ok, got)
+		}
+		scripted.read(t)
+	})
+
+	t.Run("write script", func(t *testing.T) {
+		exited := make(chan int, 1)
+		previous := exitProcess
+		exitProcess = func(code int) { exited <- code }
+		t.Cleanup(func() { exitProcess = previous })
+
+		scripted, other := newTestConn(t), newTestConn(t)
+
+		scripted.send(t, "EVAL", "redis.call('SET', KEYS[1], '1') while true do end", "1", "busy:written")
+		time.Sleep(100 * time.Millisecond)
+
+		unkillable := token{
+			typ: string(ERROR),
+			val: "UNKILLABLE Sorry the script already executed write commands against the dataset. " +
+				"You can either wait the script termination or kill the server in a hard way using the SHUTDOWN NOSAVE command.",
+		}
+		if got := other.do(t, "SCRIPT", "KILL"); !reflect.DeepEqual(got, unkillable) {
+			t.Errorf("Failed kill. wanted %v, got %v", unkillable, got)
+		}
+
+		other.send(t, "SHUTDOWN", "NOSAVE")
+		select {
+		case code := <-exited:
+			if code != 0 {
+				t.Errorf("Failed shutdown. wanted exit code 0, got %d", code)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Failed shutdown. the server didn't exit")
+		}
+
+		// The process would be gone by now, stop the script by hand
+		runningMux.Lock()
+		running.kill()
+		runningMux.Unlock()
+		scripted.read(t)
+	})
+
+	t.Run("function load timeout", func(t *testing.T) {
+		want := token{typ: string(ERROR), val: "ERR FUNCTION LOAD timeout"}
+		if got := run(t, "FUNCTION", "LOAD", "#!lua name=slowlib\nwhile true do end"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed load. wanted %v, got %v", want, got)
+		}
+	})
+}
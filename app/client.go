@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// client is the server side state of a connection
+type client struct {
+	conn net.Conn
+
+	// Replies and the messages other clients publish to this one wait in
+	// output until the writer goroutine sends them, so that nobody does
+	// socket I/O while holding a lock. outputBytes counts what wasn't
+	// sent yet, which may not grow past outputLimit unless that is zero.
+	// Guarded by writeMux.
+	writeMux    sync.Mutex
+	output      []token
+	outputBytes int
+	outputLimit int
+	closed      bool
+	// wakeup tells the writer goroutine there is output or the client
+	// was closed
+	wakeup chan struct{}
+
+	// Subscriptions, guarded by pubsubMux
+	channels      map[string]struct{}
+	patterns      map[string]struct{}
+	shardChannels map[string]struct{}
+
+	// Transaction state, only used by the connection's own goroutine.
+	// queued holds the commands received since MULTI and dirty is set
+	// once one of them was refused.
+	multi  bool
+	queued []token
+	dirty  bool
+
+	// The keys WATCH was given and their versions at the time.
+	// Guarded by mux.
+	watched map[string]uint64
+}
+
+// clientHandlers are the commands that need the connection they run on,
+// or must not wait for mux. They write their replies themselves, as many
+// as they have.
+var clientHandlers = map[string]func(*client, []token){
+	"SUBSCRIBE":    subscribe,
+	"UNSUBSCRIBE":  unsubscribe,
+	"PSUBSCRIBE":   psubscribe,
+	"PUNSUBSCRIBE": punsubscribe,
+	"SSUBSCRIBE":   ssubscribe,
+	"SUNSUBSCRIBE": sunsubscribe,
+	"MULTI":        multi,
+	"EXEC":         exec,
+	"DISCARD":      discard,
+	"WATCH":        watch,
+	"UNWATCH":      unwatch,
+	"SHUTDOWN":     shutdown,
+}
+
+// Subscribers and replicas whose output waiting to be sent grows past
+// these many bytes are disconnected, like with the hard limits of Redis'
+// client-output-buffer-limit. Other clients only wait for their own
+// replies, which aren't limited.
+var (
+	pubsubOutputLimit  = 32 << 20
+	replicaOutputLimit = 256 << 20
+)
+
+func newClient(conn net.Conn) *client {
+	c := &client{
+		conn:          conn,
+		wakeup:        make(chan struct{}, 1),
+		channels:      make(map[string]struct{}),
+		patterns:      make(map[string]struct{}),
+		shardChannels: make(map[string]struct{}),
+		watched:       make(map[string]uint64),
+	}
+	go c.writeOutput()
+
+	return c
+}
+
+// write queues tok for the connection, disconnecting the client if
+// that takes its output past the limit
+func (c *client) write(tok token) {
+	c.writeMux.Lock()
+	defer c.writeMux.Unlock()
+
+	if c.closed {
+		return
+	}
+
+	c.output = append(c.output, tok)
+	c.outputBytes += TokenLength(tok)
+	if c.outputLimit > 0 && c.outputBytes > c.outputLimit {
+		fmt.Printf("Closing client %s over its output buffer limit\n", c.conn.RemoteAddr())
+		c.disconnect(true)
+		return
+	}
+
+	select {
+	case c.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// limitOutput sets how many bytes of output may wait to be sent to c,
+// zero meaning no limit
+func (c *client) limitOutput(limit int) {
+	c.writeMux.Lock()
+	defer c.writeMux.Unlock()
+
+	c.outputLimit = limit
+}
+
+// writeOutput sends the queued output to the connection. Once the
+// client is closed it sends what is left and closes the connection.
+func (c *client) writeOutput() {
+	defer c.conn.Close()
+
+	encoder := NewEncoder(c.conn, c.conn)
+
+	for range c.wakeup {
+		c.writeMux.Lock()
+		output, closed := c.output, c.closed
+		c.output = nil
+		c.writeMux.Unlock()
+
+		sent := 0
+		for _, tok := range output {
+			if _, err := encoder.Encode(tok); err != nil {
+				c.writeMux.Lock()
+				c.disconnect(true)
+				c.writeMux.Unlock()
+				return
+			}
+			sent += TokenLength(tok)
+		}
+
+		c.writeMux.Lock()
+		c.outputBytes -= sent
+		c.writeMux.Unlock()
+
+		if closed {
+			return
+		}
+	}
+}
+
+// disconnect stops queueing output for c, and has the writer goroutine
+// close the connection once it sent what was queued. With drop set that
+// is thrown away and the connection closed right away, which ends the
+// reading goroutine too. Callers must hold writeMux.
+func (c *client) disconnect(drop bool) {
+	if c.closed {
+		return
+	}
+
+	c.closed = true
+	if drop {
+		c.output = nil
+		c.conn.Close()
+	} else {
+		// A peer that doesn't read anymore can't hold the writer forever
+		c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	}
+
+	select {
+	case c.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// close releases what the client holds once its connection is gone
+func (c *client) close() {
+	c.writeMux.Lock()
+	c.disconnect(false)
+	c.writeMux.Unlock()
+
+	mux.Lock()
+	c.unwatchAll()
+	mux.Unlock()
+
+	pubsubMux.Lock()
+	defer pubsubMux.Unlock()
+
+	for channel := range c.channels {
+		c.unsubscribe(channel)
+	}
+	for pattern := range c.patterns {
+		c.punsubscribe(pattern)
+	}
+	for channel := range c.shardChannels {
+		c.sunsubscribe(channel)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import "strings"
+
+// clusterSlots is how many hash slots Redis Cluster splits keys into
+const clusterSlots = 16384
+
+// crc16 is the CRC-16/XMODEM checksum Redis Cluster hashes keys with:
+// polynomial 0x1021, zero initial value, no reflection
+func crc16(data string) uint16 {
+	var crc uint16
+	for i := 0; i < len(data); i++ {
+		crc ^= uint16(data[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+
+	return crc
+}
+
+// keyHashSlot returns the slot of a key or shard channel. When it holds
+// a non empty hashtag like the "user1" of "{user1}.name", only the tag
+// is hashed so related keys can share a slot.
+func keyHashSlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+
+	return int(crc16(key)) & (clusterSlots - 1)
+}
+
+// CLUSTER KEYSLOT key
+func cluster(args []token) token {
+	if len(args) == 2 && strings.ToUpper(args[0].bulk) == "KEYSLOT" {
+		return intToken(keyHashSlot(args[1].bulk))
+	}
+
+	if len(args) == 0 {
+		return wrongArgs("CLUSTER")
+	}
+
+	return token{typ: string(ERROR), val: "ERR This instance has cluster support disabled"}
+}
@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestKeyHashSlot(t *testing.T) {
+	if got := crc16("123456789"); got != 0x31c3 {
+		t.Errorf("Failed crc16. wanted %#x, got %#x", 0x31c3, got)
+	}
+
+	tests := []struct {
+		key  string
+		want int
+	}{
+		{"foo", 12182},
+		{"somekey", 11058},
+		{"{user1000}.following", keyHashSlot("user1000")},
+		{"foo{}{bar}", int(crc16("foo{}{bar}")) % clusterSlots},
+		{"foo{{bar}}zap", keyHashSlot("{bar")},
+		{"foo{bar}{zap}", keyHashSlot("bar")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			if got := keyHashSlot(tt.key); got != tt.want {
+				t.Errorf("Failed keyslot. wanted %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// configParam is a parameter CONFIG GET and CONFIG SET know about.
+// Parameters without set can only be given on the command line.
+// Both are called with mux held.
+type configParam struct {
+	get func() string
+	set func(value string) error
+}
+
+func flagValue(flag *string) string {
+	if flag == nil {
+		return ""
+	}
+	return *flag
+}
+
+// busyReplyThresholdParam is busy-reply-threshold, which is also known by
+// its former name lua-time-limit
+var busyReplyThresholdParam = configParam{
+	get: func() string { return strconv.FormatInt(busyReplyThreshold.Milliseconds(), 10) },
+	set: func(value string) error {
+		ms, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || ms < 0 {
+			return errors.New("argument couldn't be parsed into an integer")
+		}
+		busyReplyThreshold = time.Duration(ms) * time.Millisecond
+		return nil
+	},
+}
+
+var configParams = map[string]configParam{
+	"busy-reply-threshold": busyReplyThresholdParam,
+	"lua-time-limit":       busyReplyThresholdParam,
+	"dir": {
+		get: func() string { return flagValue(DirFlag) },
+	},
+	"dbfilename": {
+		get: func() string { return flagValue(DBFlag) },
+	},
+	"notify-keyspace-events": {
+		get: func() string { return keyspaceEventsString(notifyKeyspaceEvents) },
+		set: func(value string) error {
+			flags, ok := parseKeyspaceEvents(value)
+			if !ok {
+				return errors.New("Invalid event class character. Use 'Ag$lshzxeKEtmdn'.")
+			}
+			notifyKeyspaceEvents = flags
+			return nil
+		},
+	},
+}
+
+// CONFIG GET parameter [parameter ...] | SET parameter value [parameter value ...]
+func config(args []token) token {
+	if len(args) < 1 {
+		return wrongArgs("CONFIG")
+	}
+
+	switch strings.ToUpper(args[0].bulk) {
+	case "GET":
+		if len(args) < 2 {
+			return wrongArgs("CONFIG|GET")
+		}
+
+		// Parameters are glob patterns, each match is listed once
+		names := []string{}
+		for name := range configParams {
+			for _, arg := range args[1:] {
+				if globMatch(strings.ToLower(arg.bulk), name) {
+					names = append(names, name)
+					break
+				}
+			}
+		}
+		sort.Strings(names)
+
+		values := make([]string, 0, 2*len(names))
+		for _, name := range names {
+			values = append(values, name, configParams[name].get())
+		}
+
+		return bulkArray(values)
+	case "SET":
+		if len(args) < 3 || len(args)%2 != 1 {
+			return wrongArgs("CONFIG|SET")
+		}
+
+		// Everything is checked before anything is applied
+		for i := 1; i < len(args); i += 2 {
+			name := strings.ToLower(args[i].bulk)
+			param, ok := configParams[name]
+			if !ok {
+				return token{typ: string(ERROR), val: fmt.Sprintf("ERR Unknown option or number of arguments for CONFIG SET - '%s'", args[i].bulk)}
+			}
+			if param.set == nil {
+				return token{typ: string(ERROR), val: fmt.Sprintf("ERR CONFIG SET failed (possibly related to argument '%s') - can't set immutable config", name)}
+			}
+		}
+
+		for i := 1; i < len(args); i += 2 {
+			name := strings.ToLower(args[i].bulk)
+			if err := configParams[name].set(args[i+1].bulk); err != nil {
+				return token{typ: string(ERROR), val: fmt.Sprintf("ERR CONFIG SET failed (possibly related to argument '%s') - %v", name, err)}
+			}
+		}
+
+		return token{typ: string(STRING), val: "OK"}
+	}
+
+	return token{
+		typ: string(ERROR),
+		val: fmt.Sprintf("ERR unknown subcommand '%s'. Try CONFIG HELP.", args[0].bulk),
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestConfig(t *testing.T) {
+	t.Cleanup(func() { run(t, "CONFIG", "SET", "notify-keyspace-events", "") })
+
+	ok := token{typ: string(STRING), val: "OK"}
+
+	cases := []struct {
+		name string
+		args []string
+		want token
+	}{
+		{"set flags", []string{"CONFIG", "SET", "notify-keyspace-events", "KEA"}, ok},
+		{"get canonical flags", []string{"CONFIG", "GET", "notify-keyspace-events"}, bulkArray([]string{"notify-keyspace-events", "AKE"})},
+		{"set classes", []string{"CONFIG", "SET", "NOTIFY-KEYSPACE-EVENTS", "Ehgx$"}, ok},
+		{"get classes in order", []string{"CONFIG", "GET", "notify-*"}, bulkArray([]string{"notify-keyspace-events", "g$hxE"})},
+		{"set misses and new keys", []string{"CONFIG", "SET", "notify-keyspace-events", "mKnA"}, ok},
+		{"get misses and new keys", []string{"CONFIG", "GET", "notify-keyspace-events"}, bulkArray([]string{"notify-keyspace-events", "AnKm"})},
+		{"get unknown", []string{"CONFIG", "GET", "no-such-option"}, bulkArray([]string{})},
+		{
+			"invalid class",
+			[]string{"CONFIG", "SET", "notify-keyspace-events", "Kq"},
+			token{typ: string(ERROR), val: "ERR CONFIG SET failed (possibly related to argument 'notify-keyspace-events') - Invalid event class character. Use 'Ag$lshzxeKEtmdn'."},
+		},
+		{
+			"unknown option",
+			[]string{"CONFIG", "SET", "no-such-option", "1"},
+			token{typ: string(ERROR), val: "ERR Unknown option or number of arguments for CONFIG SET - 'no-such-option'"},
+		},
+		{
+			"immutable option",
+			[]string{"CONFIG", "SET", "dir", "/tmp"},
+			token{typ: string(ERROR), val: "ERR CONFIG SET failed (possibly related to argument 'dir') - can't set immutable config"},
+		},
+		{"odd arguments", []string{"CONFIG", "SET", "notify-keyspace-events"}, wrongArgs("CONFIG|SET")},
+		{
+			"unknown subcommand",
+			[]string{"CONFIG", "NOPE"},
+			token{typ: string(ERROR), val: "ERR unknown subcommand 'NOPE'. Try CONFIG HELP."},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := run(t, c.args...); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("Failed %s. wanted %v, got %v", c.name, c.want, got)
+			}
+		})
+	}
+}
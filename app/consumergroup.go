@@ -0,0 +1,1492 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A consumer group remembers the last entry it handed out and keeps a
+// pending entries list (PEL) of the entries delivered to one of its
+// consumers but not acknowledged yet. Pending entries can be claimed by
+// another consumer when the one they were delivered to goes away.
+
+// entriesReadUnknown marks a group whose number of read entries can't be
+// worked out anymore because of deletions, which also makes its lag
+// unknown.
+const entriesReadUnknown = -1
+
+type pendingEntry struct {
+	id       streamID
+	consumer *streamConsumer
+	// Unix time in milliseconds of the last delivery
+	deliveryTime  int64
+	deliveryCount int
+}
+
+type streamConsumer struct {
+	name string
+	// Unix times in milliseconds of the last attempted and the last
+	// successful interaction, activeTime is -1 until there is one
+	seenTime   int64
+	activeTime int64
+	pending    *pendingList
+}
+
+type consumerGroup struct {
+	lastID      streamID
+	entriesRead int64
+	pending     *pendingList
+	consumers   map[string]*streamConsumer
+}
+
+func newConsumerGroup(lastID streamID, entriesRead int64) *consumerGroup {
+	return &consumerGroup{
+		lastID:      lastID,
+		entriesRead: entriesRead,
+		pending:     newPendingList(),
+		consumers:   make(map[string]*streamConsumer),
+	}
+}
+
+// clone returns a deep copy of g
+func (g *consumerGroup) clone() *consumerGroup {
+	c := newConsumerGroup(g.lastID, g.entriesRead)
+
+	for name, consumer := range g.consumers {
+		c.consumers[name] = &streamConsumer{
+			name:       name,
+			seenTime:   consumer.seenTime,
+			activeTime: consumer.activeTime,
+			pending:    newPendingList(),
+		}
+	}
+
+	g.pending.ascend(streamID{}, func(p *pendingEntry) bool {
+		owner := c.consumers[p.consumer.name]
+		copied := &pendingEntry{
+			id:            p.id,
+			consumer:      owner,
+			deliveryTime:  p.deliveryTime,
+			deliveryCount: p.deliveryCount,
+		}
+		c.pending.add(copied)
+		owner.pending.add(copied)
+		return true
+	})
+
+	return c
+}
+
+// consumer returns the consumer called name, creating it if needed.
+// created reports whether it did not exist yet.
+func (g *consumerGroup) consumer(name string) (c *streamConsumer, created bool) {
+	now := time.Now().UnixMilli()
+
+	if c, exists := g.consumers[name]; exists {
+		c.seenTime = now
+		return c, false
+	}
+
+	c = &streamConsumer{
+		name:       name,
+		seenTime:   now,
+		activeTime: -1,
+		pending:    newPendingList(),
+	}
+	g.consumers[name] = c
+
+	return c, true
+}
+
+// assign makes c the owner of the pending entry p
+func (g *consumerGroup) assign(p *pendingEntry, c *streamConsumer) {
+	if p.consumer != nil {
+		p.consumer.pending.remove(p.id)
+	}
+
+	p.consumer = c
+	c.pending.add(p)
+	g.pending.add(p)
+}
+
+// ack removes id from the PEL, reporting whether it was pending
+func (g *consumerGroup) ack(id streamID) bool {
+	p, exists := g.pending.get(id)
+	if !exists {
+		return false
+	}
+
+	g.pending.remove(id)
+	p.consumer.pending.remove(id)
+
+	return true
+}
+
+// pendingList is a PEL. Its entries are found by ID in a map and kept in
+// ID order by the sorted set skiplist, whose members are the IDs in big
+// endian so that they compare like the IDs do.
+type pendingList struct {
+	entries map[streamID]*pendingEntry
+	order   *skiplist
+}
+
+func newPendingList() *pendingList {
+	return &pendingList{entries: make(map[streamID]*pendingEntry), order: newSkiplist()}
+}
+
+func pendingMember(id streamID) string {
+	member := make([]byte, 16)
+	binary.BigEndian.PutUint64(member, id.ms)
+	binary.BigEndian.PutUint64(member[8:], id.seq)
+
+	return string(member)
+}
+
+func (pl *pendingList) get(id streamID) (*pendingEntry, bool) {
+	p, exists := pl.entries[id]
+	return p, exists
+}
+
+func (pl *pendingList) len() int {
+	return len(pl.entries)
+}
+
+// add puts p in the list, in place of the entry with the same ID if any
+func (pl *pendingList) add(p *pendingEntry) {
+	if _, exists := pl.entries[p.id]; !exists {
+		pl.order.insert(0, pendingMember(p.id))
+	}
+	pl.entries[p.id] = p
+}
+
+func (pl *pendingList) remove(id streamID) {
+	if _, exists := pl.entries[id]; exists {
+		delete(pl.entries, id)
+		pl.order.delete(0, pendingMember(id))
+	}
+}
+
+// first and last return the entries with the smallest and greatest IDs,
+// the list must not be empty
+func (pl *pendingList) first() *pendingEntry {
+	return pl.entry(pl.order.header.level[0].forward)
+}
+
+func (pl *pendingList) last() *pendingEntry {
+	return pl.entry(pl.order.tail)
+}
+
+func (pl *pendingList) entry(x *skiplistNode) *pendingEntry {
+	member := []byte(x.member)
+	return pl.entries[streamID{ms: binary.BigEndian.Uint64(member), seq: binary.BigEndian.Uint64(member[8:])}]
+}
+
+// ascend calls fn for the entries with an ID of at least from in ID order,
+// until it returns false. fn may remove the entry it is given.
+func (pl *pendingList) ascend(from streamID, fn func(p *pendingEntry) bool) {
+	x := pl.order.firstInLexRange(lexRange{
+		min: lexBound{value: pendingMember(from)},
+		max: lexBound{inf: 1},
+	})
+
+	for x != nil {
+		next := x.level[0].forward
+		if !fn(pl.entry(x)) {
+			return
+		}
+		x = next
+	}
+}
+
+func sortedGroupNames(groups map[string]*consumerGroup) []string {
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func sortedConsumers(g *consumerGroup) []*streamConsumer {
+	consumers := make([]*streamConsumer, 0, len(g.consumers))
+	for _, c := range g.consumers {
+		consumers = append(consumers, c)
+	}
+
+	sort.Slice(consumers, func(i, j int) bool {
+		return consumers[i].name < consumers[j].name
+	})
+
+	return consumers
+}
+
+// entry returns the entry with the given ID, if it is still in the stream
+func (s *stream) entry(id streamID) (streamEntry, bool) {
+	i := s.search(id)
+	if i == len(s.entries) || s.entries[i].id != id {
+		return streamEntry{}, false
+	}
+
+	return s.entries[i], true
+}
+
+// firstID returns the ID of the oldest entry, 0-0 when the stream is empty
+func (s *stream) firstID() streamID {
+	if len(s.entries) == 0 {
+		return streamID{}
+	}
+
+	return s.entries[0].id
+}
+
+// hasTombstones reports whether entries with an ID of at least start may
+// have been deleted
+func (s *stream) hasTombstones(start streamID) bool {
+	if len(s.entries) == 0 || s.maxDeletedID == (streamID{}) {
+		return false
+	}
+
+	return !s.maxDeletedID.less(start)
+}
+
+// estimateEntriesRead works out how many entries were added to the stream
+// up to and including id, or entriesReadUnknown if deletions make that
+// impossible.
+func (s *stream) estimateEntriesRead(id streamID) int64 {
+	added := int64(s.entriesAdded)
+	if added == 0 {
+		return 0
+	}
+
+	if len(s.entries) == 0 && !s.lastID.less(id) {
+		return added
+	}
+
+	switch {
+	case id == s.lastID:
+		return added
+	case s.lastID.less(id):
+		return entriesReadUnknown
+	}
+
+	// Without deletions past the first entry the stream is contiguous
+	first := s.firstID()
+	if s.maxDeletedID == (streamID{}) || s.maxDeletedID.less(first) {
+		if id.less(first) {
+			return added - int64(len(s.entries))
+		}
+		if id == first {
+			return added - int64(len(s.entries)) + 1
+		}
+	}
+
+	return entriesReadUnknown
+}
+
+// lag returns how many entries g has yet to read, ok is false when it
+// can't be known.
+func (s *stream) lag(g *consumerGroup) (int64, bool) {
+	added := int64(s.entriesAdded)
+	if added == 0 {
+		return 0, true
+	}
+
+	if g.entriesRead != entriesReadUnknown && !s.hasTombstones(g.lastID) {
+		return added - g.entriesRead, true
+	}
+
+	read := s.estimateEntriesRead(g.lastID)
+	if read == entriesReadUnknown {
+		return 0, false
+	}
+
+	return added - read, true
+}
+
+// deliverNew hands up to count entries g hasn't delivered yet to c,
+// adding them to the PEL unless noAck is set.
+func (s *stream) deliverNew(g *consumerGroup, c *streamConsumer, count int, noAck bool) []streamEntry {
+	entries := entriesAfter(s, g.lastID, count)
+	now := time.Now().UnixMilli()
+
+	for _, e := range entries {
+		if g.entriesRead != entriesReadUnknown && !s.hasTombstones(e.id) {
+			g.entriesRead++
+		} else if s.entriesAdded > 0 {
+			g.entriesRead = s.estimateEntriesRead(e.id)
+		}
+		g.lastID = e.id
+
+		if noAck {
+			continue
+		}
+
+		// The entry may still be pending for another consumer if the
+		// group was moved back with XGROUP SETID
+		p, exists := g.pending.get(e.id)
+		if !exists {
+			p = &pendingEntry{id: e.id}
+		}
+		g.assign(p, c)
+		p.deliveryTime = now
+		p.deliveryCount = 1
+	}
+
+	if len(entries) > 0 {
+		c.activeTime = now
+	}
+
+	return entries
+}
+
+// history redelivers up to count of the entries pending for c with an ID
+// greater than after. Entries deleted from the stream since are returned
+// without fields.
+func (s *stream) history(c *streamConsumer, after streamID, count int) token {
+	now := time.Now().UnixMilli()
+
+	entries := []token{}
+	c.pending.ascend(after, func(p *pendingEntry) bool {
+		if !after.less(p.id) {
+			return true
+		}
+		if count > 0 && len(entries) == count {
+			return false
+		}
+
+		p.deliveryTime = now
+		p.deliveryCount++
+
+		if e, exists := s.entry(p.id); exists {
+			entries = append(entries, entryToken(e))
+		} else {
+			entries = append(entries, token{
+				typ:   string(ARRAY),
+				array: []token{{typ: string(BULK), bulk: p.id.String()}, {typ: string(NULLARRAY)}},
+			})
+		}
+		return true
+	})
+
+	return token{typ: string(ARRAY), array: entries}
+}
+
+func noGroup(key, group string) token {
+	return token{
+		typ: string(ERROR),
+		val: fmt.Sprintf("NOGROUP No such key '%s' or consumer group '%s'", key, group),
+	}
+}
+
+func noGroupForKey(key, group string) token {
+	return token{
+		typ: string(ERROR),
+		val: fmt.Sprintf("NOGROUP No such consumer group '%s' for key name '%s'", group, key),
+	}
+}
+
+// lookupGroup returns the stream at key and its group called name. A nil
+// group means either of them does not exist. Callers must hold mux.
+func lookupGroup(key, name string) (*stream, *consumerGroup, bool) {
+	s, ok := lookupStream(key)
+	if !ok {
+		return nil, nil, false
+	}
+
+	if s == nil {
+		return nil, nil, true
+	}
+
+	return s, s.groups[name], true
+}
+
+// parseGroupID reads the ID of XGROUP CREATE and SETID,
+// where $ stands for the last ID of the stream.
+func parseGroupID(arg string, s *stream) (streamID, bool) {
+	if arg == "$" {
+		if s == nil {
+			return streamID{}, true
+		}
+		return s.lastID, true
+	}
+
+	return parseStreamID(arg, 0)
+}
+
+// parseEntriesRead reads the value of the ENTRIESREAD option
+func parseEntriesRead(arg string) (int64, *token) {
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return 0, &errNotInteger
+	}
+
+	if n < entriesReadUnknown {
+		return 0, &token{typ: string(ERROR), val: "ERR value for ENTRIESREAD must be positive or -1"}
+	}
+
+	return n, nil
+}
+
+// XGROUP CREATE key group id|$ [MKSTREAM] [ENTRIESREAD entries-read]
+// XGROUP SETID key group id|$ [ENTRIESREAD entries-read]
+// XGROUP DESTROY key group
+// XGROUP CREATECONSUMER key group consumer
+// XGROUP DELCONSUMER key group consumer
+func xgroup(args []token) token {
+	if len(args) < 1 {
+		return wrongArgs("XGROUP")
+	}
+
+	subcommand := strings.ToUpper(args[0].bulk)
+
+	arity := map[string]int{
+		"CREATE":         4,
+		"SETID":          4,
+		"DESTROY":        3,
+		"CREATECONSUMER": 4,
+		"DELCONSUMER":    4,
+	}
+	minArgs, known := arity[subcommand]
+	if !known {
+		return token{
+			typ: string(ERROR),
+			val: fmt.Sprintf("ERR unknown subcommand '%s'. Try XGROUP HELP.", args[0].bulk),
+		}
+	}
+	if len(args) < minArgs || (subcommand != "CREATE" && subcommand != "SETID" && len(args) != minArgs) {
+		return wrongArgs("XGROUP|" + subcommand)
+	}
+
+	key, name := args[1].bulk, args[2].bulk
+
+	s, g, ok := lookupGroup(key, name)
+	if !ok {
+		return errWrongType
+	}
+
+	switch subcommand {
+	case "CREATE":
+		return xgroupCreate(key, name, s, g, args[3:])
+	case "SETID":
+		if g == nil {
+			return noGroupForKey(key, name)
+		}
+
+		id, ok := parseGroupID(args[3].bulk, s)
+		if !ok {
+			return errInvalidStreamID
+		}
+
+		entriesRead := int64(entriesReadUnknown)
+		switch {
+		case len(args) == 6 && strings.ToUpper(args[4].bulk) == "ENTRIESREAD":
+			n, errTok := parseEntriesRead(args[5].bulk)
+			if errTok != nil {
+				return *errTok
+			}
+			entriesRead = n
+		case len(args) != 4:
+			return errSyntax
+		}
+
+		g.lastID = id
+		g.entriesRead = entriesRead
+		notifyKeyspaceEvent(notifyStream, "xgroup-setid", key)
+
+		return token{typ: string(STRING), val: "OK"}
+	case "DESTROY":
+		if g == nil {
+			return intToken(0)
+		}
+
+		delete(s.groups, name)
+		notifyKeyspaceEvent(notifyStream, "xgroup-destroy", key)
+		// Clients blocked on the group find out it is gone
+		serveBlockedClients(key)
+
+		return intToken(1)
+	case "CREATECONSUMER":
+		if g == nil {
+			return noGroupForKey(key, name)
+		}
+
+		if _, created := g.consumer(args[3].bulk); created {
+			notifyKeyspaceEvent(notifyStream, "xgroup-createconsumer", key)
+			return intToken(1)
+		}
+
+		return intToken(0)
+	default:
+		if g == nil {
+			return noGroupForKey(key, name)
+		}
+
+		c, exists := g.consumers[args[3].bulk]
+		if !exists {
+			return intToken(0)
+		}
+
+		pending := c.pending.len()
+		c.pending.ascend(streamID{}, func(p *pendingEntry) bool {
+			g.ack(p.id)
+			return true
+		})
+		delete(g.consumers, c.name)
+		notifyKeyspaceEvent(notifyStream, "xgroup-delconsumer", key)
+
+		return intToken(pending)
+	}
+}
+
+func xgroupCreate(key, name string, s *stream, g *consumerGroup, options []token) token {
+	mkStream := false
+	entriesRead := int64(entriesReadUnknown)
+
+	for i := 1; i < len(options); i++ {
+		switch strings.ToUpper(options[i].bulk) {
+		case "MKSTREAM":
+			mkStream = true
+		case "ENTRIESREAD":
+			if i+1 >= len(options) {
+				return errSyntax
+			}
+			n, errTok := parseEntriesRead(options[i+1].bulk)
+			if errTok != nil {
+				return *errTok
+			}
+			entriesRead = n
+			i++
+		default:
+			return errSyntax
+		}
+	}
+
+	id, ok := parseGroupID(options[0].bulk, s)
+	if !ok {
+		return errInvalidStreamID
+	}
+
+	if s == nil {
+		if !mkStream {
+			return token{
+				typ: string(ERROR),
+				val: "ERR The XGROUP subcommand requires the key to exist. " +
+					"Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.",
+			}
+		}
+
+		s = &stream{}
+		putKey(key, object{
+			typ:        "stream",
+			createdAt:  time.Now().UTC(),
+			streamData: s,
+		})
+	}
+
+	if g != nil {
+		return token{typ: string(ERROR), val: "BUSYGROUP Consumer Group name already exists"}
+	}
+
+	if s.groups == nil {
+		s.groups = make(map[string]*consumerGroup)
+	}
+	s.groups[name] = newConsumerGroup(id, entriesRead)
+	notifyKeyspaceEvent(notifyStream, "xgroup-create", key)
+
+	return token{typ: string(STRING), val: "OK"}
+}
+
+// XREADGROUP GROUP group consumer [COUNT count] [BLOCK milliseconds] [NOACK] STREAMS key [key ...] id [id ...]
+func xreadgroup(args []token) token {
+	parsed, errTok := parseXReadArgs("XREADGROUP", args)
+	if errTok != nil {
+		return *errTok
+	}
+
+	// Check every stream and group before delivering anything
+	streams := make([]*stream, len(parsed.keys))
+	groups := make([]*consumerGroup, len(parsed.keys))
+	history := make([]streamID, len(parsed.keys))
+	onlyNew := true
+	for j, key := range parsed.keys {
+		s, g, ok := lookupGroup(key, parsed.group)
+		if !ok {
+			return errWrongType
+		}
+		if g == nil {
+			return token{
+				typ: string(ERROR),
+				val: fmt.Sprintf(
+					"NOGROUP No such key '%s' or consumer group '%s' in XREADGROUP with GROUP option",
+					key, parsed.group,
+				),
+			}
+		}
+
+		switch parsed.ids[j] {
+		case ">":
+		case "$":
+			return token{typ: string(ERROR), val: "ERR The $ ID is meaningful only for XREAD"}
+		default:
+			id, ok := parseStreamID(parsed.ids[j], 0)
+			if !ok {
+				return errInvalidStreamID
+			}
+			history[j] = id
+			onlyNew = false
+		}
+
+		streams[j], groups[j] = s, g
+	}
+
+	result := []token{}
+	delivered := false
+	for j, key := range parsed.keys {
+		s, g := streams[j], groups[j]
+		c := groupConsumer(key, parsed.group, g, parsed.consumer)
+
+		if parsed.ids[j] != ">" {
+			// The history is returned even when there is none
+			result = append(result, streamReadReply(key, s.history(c, history[j], parsed.count)))
+			continue
+		}
+
+		if entries := s.deliverNew(g, c, parsed.count, parsed.noAck); len(entries) > 0 {
+			result = append(result, streamReadReply(key, entriesToken(entries)))
+			delivered = true
+		}
+	}
+
+	if delivered {
+		replicateServed(readGroupCommand(args))
+	}
+
+	if len(result) > 0 || !parsed.blocking || !onlyNew {
+		if len(result) == 0 {
+			return token{typ: string(NULLARRAY)}
+		}
+		return token{typ: string(ARRAY), array: result}
+	}
+
+	client := &blockedClient{
+		keys:     parsed.keys,
+		stream:   true,
+		group:    parsed.group,
+		consumer: parsed.consumer,
+		noAck:    parsed.noAck,
+		count:    parsed.count,
+		reply:    make(chan token, 1),
+	}
+	block(client)
+
+	return waitUntilServed(client, parsed.timeout, token{typ: string(NULLARRAY)})
+}
+
+// parseIDs reads a list of stream IDs
+func parseIDs(args []token) ([]streamID, bool) {
+	ids := make([]streamID, 0, len(args))
+	for _, arg := range args {
+		id, ok := parseStreamID(arg.bulk, 0)
+		if !ok {
+			return nil, false
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, true
+}
+
+// XACK key group id [id ...]
+func xack(args []token) token {
+	if len(args) < 3 {
+		return wrongArgs("XACK")
+	}
+
+	ids, ok := parseIDs(args[2:])
+	if !ok {
+		return errInvalidStreamID
+	}
+
+	_, g, ok := lookupGroup(args[0].bulk, args[1].bulk)
+	if !ok {
+		return errWrongType
+	}
+	if g == nil {
+		return intToken(0)
+	}
+
+	acked := 0
+	for _, id := range ids {
+		if g.ack(id) {
+			acked++
+		}
+	}
+
+	return intToken(acked)
+}
+
+// XPENDING key group [[IDLE min-idle-time] start end count [consumer]]
+func xpending(args []token) token {
+	if len(args) < 2 {
+		return wrongArgs("XPENDING")
+	}
+
+	key, name := args[0].bulk, args[1].bulk
+
+	extended := len(args) > 2
+	var minIdle int64
+	var start, end streamID
+	count := 0
+	consumer := ""
+
+	if extended {
+		rest := args[2:]
+		if len(rest) > 0 && strings.ToUpper(rest[0].bulk) == "IDLE" {
+			if len(rest) < 2 {
+				return errSyntax
+			}
+			n, err := strconv.ParseInt(rest[1].bulk, 10, 64)
+			if err != nil {
+				return errNotInteger
+			}
+			minIdle = n
+			rest = rest[2:]
+		}
+
+		if len(rest) < 3 || len(rest) > 4 {
+			return errSyntax
+		}
+
+		var errTok *token
+		if start, errTok = parseRangeID(rest[0].bulk, true); errTok != nil {
+			return *errTok
+		}
+		if end, errTok = parseRangeID(rest[1].bulk, false); errTok != nil {
+			return *errTok
+		}
+
+		n, err := strconv.Atoi(rest[2].bulk)
+		if err != nil {
+			return errNotInteger
+		}
+		if n < 0 {
+			n = 0
+		}
+		count = n
+
+		if len(rest) == 4 {
+			consumer = rest[3].bulk
+		}
+	}
+
+	_, g, ok := lookupGroup(key, name)
+	if !ok {
+		return errWrongType
+	}
+	if g == nil {
+		return noGroup(key, name)
+	}
+
+	if !extended {
+		return pendingSummary(g)
+	}
+
+	pel := g.pending
+	if consumer != "" {
+		c, exists := g.consumers[consumer]
+		if !exists {
+			return token{typ: string(ARRAY), array: []token{}}
+		}
+		pel = c.pending
+	}
+
+	now := time.Now().UnixMilli()
+	result := []token{}
+	pel.ascend(start, func(p *pendingEntry) bool {
+		if len(result) == count || end.less(p.id) {
+			return false
+		}
+
+		idle := now - p.deliveryTime
+		if idle < minIdle {
+			return true
+		}
+
+		result = append(result, token{
+			typ: string(ARRAY),
+			array: []token{
+				{typ: string(BULK), bulk: p.id.String()},
+				{typ: string(BULK), bulk: p.consumer.name},
+				intToken(int(idle)),
+				intToken(p.deliveryCount),
+			},
+		})
+		return true
+	})
+
+	return token{typ: string(ARRAY), array: result}
+}
+
+// pendingSummary is the reply of XPENDING without a range: the number of
+// pending entries, the smallest and greatest of their IDs and how many
+// each consumer has.
+func pendingSummary(g *consumerGroup) token {
+	if g.pending.len() == 0 {
+		return token{
+			typ: string(ARRAY),
+			array: []token{
+				intToken(0),
+				{typ: string(NULL)},
+				{typ: string(NULL)},
+				{typ: string(NULLARRAY)},
+			},
+		}
+	}
+
+	perConsumer := []token{}
+	for _, c := range sortedConsumers(g) {
+		if c.pending.len() == 0 {
+			continue
+		}
+		perConsumer = append(perConsumer, bulkArray([]string{c.name, strconv.Itoa(c.pending.len())}))
+	}
+
+	return token{
+		typ: string(ARRAY),
+		array: []token{
+			intToken(g.pending.len()),
+			{typ: string(BULK), bulk: g.pending.first().id.String()},
+			{typ: string(BULK), bulk: g.pending.last().id.String()},
+			{typ: string(ARRAY), array: perConsumer},
+		},
+	}
+}
+
+// XCLAIM key group consumer min-idle-time id [id ...] [IDLE ms] [TIME unix-time-milliseconds] [RETRYCOUNT count] [FORCE] [JUSTID] [LASTID lastid]
+func xclaim(args []token) token {
+	if len(args) < 5 {
+		return wrongArgs("XCLAIM")
+	}
+
+	minIdle, err := strconv.ParseInt(args[3].bulk, 10, 64)
+	if err != nil {
+		return token{typ: string(ERROR), val: "ERR Invalid min-idle-time argument for XCLAIM"}
+	}
+	if minIdle < 0 {
+		minIdle = 0
+	}
+
+	// IDs run up to the first argument that isn't one
+	i := 4
+	ids := []streamID{}
+	for ; i < len(args); i++ {
+		id, ok := parseStreamID(args[i].bulk, 0)
+		if !ok {
+			break
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return errInvalidStreamID
+	}
+
+	now := time.Now().UnixMilli()
+	deliveryTime := now
+	retryCount := -1
+	force, justID := false, false
+	var lastID *streamID
+
+	for ; i < len(args); i++ {
+		option := strings.ToUpper(args[i].bulk)
+		hasValue := i+1 < len(args)
+
+		switch {
+		case option == "FORCE":
+			force = true
+		case option == "JUSTID":
+			justID = true
+		case (option == "IDLE" || option == "TIME") && hasValue:
+			n, err := strconv.ParseInt(args[i+1].bulk, 10, 64)
+			if err != nil {
+				return token{typ: string(ERROR), val: fmt.Sprintf("ERR Invalid %s option argument for XCLAIM", option)}
+			}
+			if option == "IDLE" {
+				deliveryTime = now - n
+			} else {
+				deliveryTime = n
+			}
+			i++
+		case option == "RETRYCOUNT" && hasValue:
+			n, err := strconv.Atoi(args[i+1].bulk)
+			if err != nil {
+				return token{typ: string(ERROR), val: "ERR Invalid RETRYCOUNT option argument for XCLAIM"}
+			}
+			retryCount = n
+			i++
+		case option == "LASTID" && hasValue:
+			id, ok := parseStreamID(args[i+1].bulk, 0)
+			if !ok {
+				return errInvalidStreamID
+			}
+			lastID = &id
+			i++
+		default:
+			return token{typ: string(ERROR), val: fmt.Sprintf("ERR Unrecognized XCLAIM option '%s'", args[i].bulk)}
+		}
+	}
+
+	// Delivery times in the future are clamped to now
+	if deliveryTime < 0 || deliveryTime > now {
+		deliveryTime = now
+	}
+
+	key, name := args[0].bulk, args[1].bulk
+
+	s, g, ok := lookupGroup(key, name)
+	if !ok {
+		return errWrongType
+	}
+	if g == nil {
+		return noGroup(key, name)
+	}
+
+	if lastID != nil && g.lastID.less(*lastID) {
+		g.lastID = *lastID
+	}
+
+	c, created := g.consumer(args[2].bulk)
+	if created {
+		notifyKeyspaceEvent(notifyStream, "xgroup-createconsumer", key)
+	}
+
+	claimed := []token{}
+	for _, id := range ids {
+		p, pending := g.pending.get(id)
+		if !pending && force {
+			if _, exists := s.entry(id); exists {
+				p = &pendingEntry{id: id, deliveryTime: now, deliveryCount: 1}
+				g.assign(p, c)
+				pending = true
+			}
+		}
+		if !pending {
+			continue
+		}
+
+		if minIdle > 0 && now-p.deliveryTime < minIdle {
+			continue
+		}
+
+		e, exists := s.entry(id)
+		if !exists {
+			// Deleted entries can't be claimed, they are dropped instead
+			g.ack(id)
+			continue
+		}
+
+		g.assign(p, c)
+		p.deliveryTime = deliveryTime
+		if retryCount >= 0 {
+			p.deliveryCount = retryCount
+		} else if !justID {
+			p.deliveryCount++
+		}
+
+		if justID {
+			claimed = append(claimed, token{typ: string(BULK), bulk: id.String()})
+		} else {
+			claimed = append(claimed, entryToken(e))
+		}
+	}
+
+	if len(claimed) > 0 {
+		c.activeTime = now
+	}
+
+	return token{typ: string(ARRAY), array: claimed}
+}
+
+// XAUTOCLAIM key group consumer min-idle-time start [COUNT count] [JUSTID]
+func xautoclaim(args []token) token {
+	if len(args) < 5 {
+		return wrongArgs("XAUTOCLAIM")
+	}
+
+	minIdle, err := strconv.ParseInt(args[3].bulk, 10, 64)
+	if err != nil {
+		return token{typ: string(ERROR), val: "ERR Invalid min-idle-time argument for XAUTOCLAIM"}
+	}
+	if minIdle < 0 {
+		minIdle = 0
+	}
+
+	start, errTok := parseRangeID(args[4].bulk, true)
+	if errTok != nil {
+		return *errTok
+	}
+
+	// Like in Redis, at most ten entries are looked at per entry asked for
+	const attemptsFactor = 10
+	count := 100
+	justID := false
+
+	for i := 5; i < len(args); i++ {
+		switch strings.ToUpper(args[i].bulk) {
+		case "COUNT":
+			if i+1 >= len(args) {
+				return errSyntax
+			}
+			n, err := strconv.Atoi(args[i+1].bulk)
+			if err != nil {
+				return errNotInteger
+			}
+			if n < 1 || n > math.MaxInt/attemptsFactor {
+				return token{typ: string(ERROR), val: "ERR COUNT must be > 0"}
+			}
+			count = n
+			i++
+		case "JUSTID":
+			justID = true
+		default:
+			return errSyntax
+		}
+	}
+
+	key, name := args[0].bulk, args[1].bulk
+
+	s, g, ok := lookupGroup(key, name)
+	if !ok {
+		return errWrongType
+	}
+	if g == nil {
+		return noGroup(key, name)
+	}
+
+	c, created := g.consumer(args[2].bulk)
+	if created {
+		notifyKeyspaceEvent(notifyStream, "xgroup-createconsumer", key)
+	}
+	now := time.Now().UnixMilli()
+
+	// The cursor is the next pending entry to look at, 0-0 once done
+	cursor := streamID{}
+	claimed := []token{}
+	deleted := []string{}
+	attempts := count * attemptsFactor
+	g.pending.ascend(start, func(p *pendingEntry) bool {
+		if attempts == 0 || count == 0 {
+			cursor = p.id
+			return false
+		}
+		attempts--
+
+		e, exists := s.entry(p.id)
+		if !exists {
+			deleted = append(deleted, p.id.String())
+			g.ack(p.id)
+			return true
+		}
+
+		if minIdle > 0 && now-p.deliveryTime < minIdle {
+			return true
+		}
+
+		g.assign(p, c)
+		p.deliveryTime = now
+		if !justID {
+			p.deliveryCount++
+		}
+
+		if justID {
+			claimed = append(claimed, token{typ: string(BULK), bulk: p.id.String()})
+		} else {
+			claimed = append(claimed, entryToken(e))
+		}
+		count--
+		return true
+	})
+
+	if len(claimed) > 0 {
+		c.activeTime = now
+	}
+
+	return token{
+		typ: string(ARRAY),
+		array: []token{
+			{typ: string(BULK), bulk: cursor.String()},
+			{typ: string(ARRAY), array: claimed},
+			bulkArray(deleted),
+		},
+	}
+}
+
+// fieldsToken builds the flat field/value array XINFO replies with
+func fieldsToken(fields ...interface{}) token {
+	arr := make([]token, 0, len(fields))
+	for _, f := range fields {
+		switch v := f.(type) {
+		case token:
+			arr = append(arr, v)
+		case string:
+			arr = append(arr, token{typ: string(BULK), bulk: v})
+		case int:
+			arr = append(arr, intToken(v))
+		case int64:
+			arr = append(arr, intToken(int(v)))
+		}
+	}
+
+	return token{typ: string(ARRAY), array: arr}
+}
+
+// XINFO STREAM key [FULL [COUNT count]]
+// XINFO GROUPS key
+// XINFO CONSUMERS key group
+func xinfo(args []token) token {
+	if len(args) < 2 {
+		return wrongArgs("XINFO")
+	}
+
+	subcommand := strings.ToUpper(args[0].bulk)
+	key := args[1].bulk
+
+	switch subcommand {
+	case "STREAM", "GROUPS", "CONSUMERS":
+	default:
+		return token{
+			typ: string(ERROR),
+			val: fmt.Sprintf("ERR unknown subcommand '%s'. Try XINFO HELP.", args[0].bulk),
+		}
+	}
+
+	if (subcommand == "GROUPS" && len(args) != 2) || (subcommand == "CONSUMERS" && len(args) != 3) {
+		return wrongArgs("XINFO|" + subcommand)
+	}
+
+	full := false
+	count := 10
+	if subcommand == "STREAM" && len(args) > 2 {
+		if strings.ToUpper(args[2].bulk) != "FULL" {
+			return errSyntax
+		}
+		full = true
+
+		switch {
+		case len(args) == 5 && strings.ToUpper(args[3].bulk) == "COUNT":
+			n, err := strconv.Atoi(args[4].bulk)
+			if err != nil {
+				return errNotInteger
+			}
+			if n < 0 {
+				n = 0
+			}
+			count = n
+		case len(args) != 3:
+			return errSyntax
+		}
+	}
+
+	s, ok := lookupStream(key)
+	if !ok {
+		return errWrongType
+	}
+	if s == nil {
+		return token{typ: string(ERROR), val: "ERR no such key"}
+	}
+
+	switch subcommand {
+	case "STREAM":
+		if full {
+			return streamInfoFull(s, count)
+		}
+		return streamInfo(s)
+	case "GROUPS":
+		groups := []token{}
+		for _, name := range sortedGroupNames(s.groups) {
+			g := s.groups[name]
+			groups = append(groups, fieldsToken(
+				"name", name,
+				"consumers", len(g.consumers),
+				"pending", g.pending.len(),
+				"last-delivered-id", g.lastID.String(),
+				"entries-read", entriesReadToken(g),
+				"lag", lagToken(s, g),
+			))
+		}
+		return token{typ: string(ARRAY), array: groups}
+	default:
+		name := args[2].bulk
+		g, exists := s.groups[name]
+		if !exists {
+			return noGroupForKey(key, name)
+		}
+
+		now := time.Now().UnixMilli()
+		consumers := []token{}
+		for _, c := range sortedConsumers(g) {
+			inactive := int64(-1)
+			if c.activeTime != -1 {
+				inactive = now - c.activeTime
+			}
+			consumers = append(consumers, fieldsToken(
+				"name", c.name,
+				"pending", c.pending.len(),
+				"idle", now-c.seenTime,
+				"inactive", inactive,
+			))
+		}
+		return token{typ: string(ARRAY), array: consumers}
+	}
+}
+
+func entriesReadToken(g *consumerGroup) token {
+	if g.entriesRead == entriesReadUnknown {
+		return token{typ: string(NULL)}
+	}
+
+	return intToken(int(g.entriesRead))
+}
+
+func lagToken(s *stream, g *consumerGroup) token {
+	lag, ok := s.lag(g)
+	if !ok {
+		return token{typ: string(NULL)}
+	}
+
+	return intToken(int(lag))
+}
+
+// radixTreeSize reports the sizes XINFO STREAM shows for the radix tree
+// Redis keeps entries in. Entries live in a plain slice here, so these
+// are what a tree of nodes holding up to 100 entries each would take.
+func radixTreeSize(s *stream) (keys, nodes int) {
+	keys = (len(s.entries) + 99) / 100
+	return keys, keys + 1
+}
+
+func streamInfo(s *stream) token {
+	first, last := token{typ: string(NULL)}, token{typ: string(NULL)}
+	if len(s.entries) > 0 {
+		first = entryToken(s.entries[0])
+		last = entryToken(s.entries[len(s.entries)-1])
+	}
+
+	keys, nodes := radixTreeSize(s)
+
+	return fieldsToken(
+		"length", len(s.entries),
+		"radix-tree-keys", keys,
+		"radix-tree-nodes", nodes,
+		"last-generated-id", s.lastID.String(),
+		"max-deleted-entry-id", s.maxDeletedID.String(),
+		"entries-added", int64(s.entriesAdded),
+		"recorded-first-entry-id", s.firstID().String(),
+		"groups", len(s.groups),
+		"first-entry", first,
+		"last-entry", last,
+	)
+}
+
+// streamInfoFull details the entries and groups of s, listing at most
+// count entries and pending entries of each kind, zero meaning all.
+func streamInfoFull(s *stream, count int) token {
+	limit := func(n int) int {
+		if count > 0 && n > count {
+			return count
+		}
+		return n
+	}
+
+	groups := []token{}
+	for _, name := range sortedGroupNames(s.groups) {
+		g := s.groups[name]
+
+		pending := []token{}
+		g.pending.ascend(streamID{}, func(p *pendingEntry) bool {
+			if len(pending) == limit(g.pending.len()) {
+				return false
+			}
+			pending = append(pending, token{
+				typ: string(ARRAY),
+				array: []token{
+					{typ: string(BULK), bulk: p.id.String()},
+					{typ: string(BULK), bulk: p.consumer.name},
+					intToken(int(p.deliveryTime)),
+					intToken(p.deliveryCount),
+				},
+			})
+			return true
+		})
+
+		consumers := []token{}
+		for _, c := range sortedConsumers(g) {
+			consumerPending := []token{}
+			c.pending.ascend(streamID{}, func(p *pendingEntry) bool {
+				if len(consumerPending) == limit(c.pending.len()) {
+					return false
+				}
+				consumerPending = append(consumerPending, token{
+					typ: string(ARRAY),
+					array: []token{
+						{typ: string(BULK), bulk: p.id.String()},
+						intToken(int(p.deliveryTime)),
+						intToken(p.deliveryCount),
+					},
+				})
+				return true
+			})
+
+			consumers = append(consumers, fieldsToken(
+				"name", c.name,
+				"seen-time", c.seenTime,
+				"active-time", c.activeTime,
+				"pel-count", c.pending.len(),
+				"pending", token{typ: string(ARRAY), array: consumerPending},
+			))
+		}
+
+		groups = append(groups, fieldsToken(
+			"name", name,
+			"last-delivered-id", g.lastID.String(),
+			"entries-read", entriesReadToken(g),
+			"lag", lagToken(s, g),
+			"pel-count", g.pending.len(),
+			"pending", token{typ: string(ARRAY), array: pending},
+			"consumers", token{typ: string(ARRAY), array: consumers},
+		))
+	}
+
+	keys, nodes := radixTreeSize(s)
+
+	return fieldsToken(
+		"length", len(s.entries),
+		"radix-tree-keys", keys,
+		"radix-tree-nodes", nodes,
+		"last-generated-id", s.lastID.String(),
+		"max-deleted-entry-id", s.maxDeletedID.String(),
+		"entries-added", int64(s.entriesAdded),
+		"recorded-first-entry-id", s.firstID().String(),
+		"entries", entriesToken(s.entries[:limit(len(s.entries))]),
+		"groups", token{typ: string(ARRAY), array: groups},
+	)
+}
+
+// groupConsumer returns the consumer of the group of the stream at key
+// called name, creating it if needed. Callers must hold mux.
+func groupConsumer(key, group string, g *consumerGroup, name string) *streamConsumer {
+	c, created := g.consumer(name)
+	if created {
+		notifyKeyspaceEvent(notifyStream, "xgroup-createconsumer", key)
+		replicateServed(bulkArray([]string{"XGROUP", "CREATECONSUMER", key, group, name}))
+	}
+
+	return c
+}
+
+// readGroupCommand returns the XREADGROUP replicas apply to deliver what
+// one with args did, which is the same command without BLOCK: the group
+// is in the same state on the replicas, so they deliver the same entries.
+func readGroupCommand(args []token) token {
+	values := []string{"XREADGROUP"}
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i].bulk) {
+		case "BLOCK":
+			i++
+			continue
+		case "STREAMS":
+			for _, arg := range args[i:] {
+				values = append(values, arg.bulk)
+			}
+			return bulkArray(values)
+		}
+		values = append(values, args[i].bulk)
+	}
+
+	return bulkArray(values)
+}
+
+// groupCommands returns what replicas have to apply to mirror the effect
+// of a consumer group command that depends on the master's clock or
+// blocking state.
+//
+// XREADGROUP replicates its deliveries itself, as the ones of a blocked
+// client happen while another command runs. Claims are sent as one
+// XCLAIM per entry carrying the resulting delivery time and count, and
+// entries that were dropped from the PEL as an XACK. Callers must
+// hold mux.
+func groupCommands(command string, args []token, result token) ([]token, bool) {
+	switch command {
+	case "XREADGROUP":
+		return nil, true
+	case "XCLAIM", "XAUTOCLAIM":
+	default:
+		return nil, false
+	}
+
+	key, name, consumer := args[0].bulk, args[1].bulk, args[2].bulk
+
+	claimed := result.array
+	if command == "XAUTOCLAIM" {
+		claimed = result.array[1].array
+	}
+
+	claimedIDs := make([]string, 0, len(claimed))
+	for _, c := range claimed {
+		if c.typ == string(ARRAY) {
+			claimedIDs = append(claimedIDs, c.array[0].bulk)
+		} else {
+			claimedIDs = append(claimedIDs, c.bulk)
+		}
+	}
+
+	_, g, _ := lookupGroup(key, name)
+	if g == nil {
+		return nil, true
+	}
+
+	commands := []token{bulkArray([]string{"XGROUP", "CREATECONSUMER", key, name, consumer})}
+
+	for _, id := range claimedIDs {
+		parsed, _ := parseStreamID(id, 0)
+		p, exists := g.pending.get(parsed)
+		if !exists {
+			continue
+		}
+
+		commands = append(commands, bulkArray([]string{
+			"XCLAIM", key, name, p.consumer.name, "0", id,
+			"TIME", strconv.FormatInt(p.deliveryTime, 10),
+			"RETRYCOUNT", strconv.Itoa(p.deliveryCount),
+			"FORCE", "JUSTID", "LASTID", g.lastID.String(),
+		}))
+	}
+
+	// Whatever was asked for but isn't pending anymore was dropped
+	dropped := []string{"XACK", key, name}
+	if command == "XAUTOCLAIM" {
+		for _, id := range result.array[2].array {
+			dropped = append(dropped, id.bulk)
+		}
+	} else {
+		for _, arg := range args[4:] {
+			id, ok := parseStreamID(arg.bulk, 0)
+			if !ok {
+				break
+			}
+			if _, exists := g.pending.get(id); !exists {
+				dropped = append(dropped, arg.bulk)
+			}
+		}
+	}
+	if len(dropped) > 3 {
+		commands = append(commands, bulkArray(dropped))
+	}
+
+	return commands, true
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// readGroupIDs returns the IDs XREADGROUP delivered from its only stream
+func readGroupIDs(t *testing.T, tok token) []string {
+	t.Helper()
+
+	if tok.typ == string(NULLARRAY) {
+		return []string{}
+	}
+	if tok.typ != string(ARRAY) || len(tok.array) != 1 {
+		t.Fatalf("Unexpected xreadgroup reply %v", tok)
+	}
+
+	return entryIDs(tok.array[0].array[1])
+}
+
+func TestConsumerGroups(t *testing.T) {
+	ok := token{typ: string(STRING), val: "OK"}
+
+	t.Run("create", func(t *testing.T) {
+		if got := run(t, "XGROUP", "CREATE", "cg:none", "g", "$"); got.typ != string(ERROR) {
+			t.Errorf("Failed xgroup create without key. got %v", got)
+		}
+
+		if got := run(t, "XGROUP", "CREATE", "cg:s", "g", "$", "MKSTREAM"); !reflect.DeepEqual(got, ok) {
+			t.Errorf("Failed xgroup create. wanted %v, got %v", ok, got)
+		}
+
+		want := token{typ: string(ERROR), val: "BUSYGROUP Consumer Group name already exists"}
+		if got := run(t, "XGROUP", "CREATE", "cg:s", "g", "0"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed xgroup create. wanted %v, got %v", want, got)
+		}
+	})
+
+	for _, id := range []string{"1-0", "2-0", "3-0"} {
+		run(t, "XADD", "cg:s", id, "f", id)
+	}
+
+	t.Run("new entries are delivered once", func(t *testing.T) {
+		got := readGroupIDs(t, run(t, "XREADGROUP", "GROUP", "g", "alice", "COUNT", "2", "STREAMS", "cg:s", ">"))
+		if want := []string{"1-0", "2-0"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed xreadgroup. wanted %v, got %v", want, got)
+		}
+
+		got = readGroupIDs(t, run(t, "XREADGROUP", "GROUP", "g", "bob", "STREAMS", "cg:s", ">"))
+		if want := []string{"3-0"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed xreadgroup. wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("history", func(t *testing.T) {
+		got := readGroupIDs(t, run(t, "XREADGROUP", "GROUP", "g", "alice", "STREAMS", "cg:s", "0"))
+		if want := []string{"1-0", "2-0"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed xreadgroup history. wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("pending summary", func(t *testing.T) {
+		want := token{typ: string(ARRAY), array: []token{
+			intToken(3),
+			{typ: string(BULK), bulk: "1-0"},
+			{typ: string(BULK), bulk: "3-0"},
+			{typ: string(ARRAY), array: []token{
+				bulkArray([]string{"alice", "2"}),
+				bulkArray([]string{"bob", "1"}),
+			}},
+		}}
+		if got := run(t, "XPENDING", "cg:s", "g"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed xpending. wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("pending details count deliveries", func(t *testing.T) {
+		got := run(t, "XPENDING", "cg:s", "g", "-", "+", "10", "alice")
+		if len(got.array) != 2 {
+			t.Fatalf("Failed xpending. got %v", got)
+		}
+
+		// Read once as new and once more through the history
+		if deliveries := got.array[0].array[3]; !reflect.DeepEqual(deliveries, intToken(2)) {
+			t.Errorf("Failed xpending. wanted %v, got %v", intToken(2), deliveries)
+		}
+	})
+
+	t.Run("ack", func(t *testing.T) {
+		if got := run(t, "XACK", "cg:s", "g", "1-0", "1-0", "9-0"); !reflect.DeepEqual(got, intToken(1)) {
+			t.Errorf("Failed xack. wanted %v, got %v", intToken(1), got)
+		}
+	})
+
+	t.Run("claim", func(t *testing.T) {
+		time.Sleep(5 * time.Millisecond)
+
+		got := run(t, "XCLAIM", "cg:s", "g", "carol", "1", "2-0", "3-0", "JUSTID")
+		want := bulkArray([]string{"2-0", "3-0"})
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed xclaim. wanted %v, got %v", want, got)
+		}
+
+		if got := run(t, "XCLAIM", "cg:s", "g", "dave", "100000", "2-0"); len(got.array) != 0 {
+			t.Errorf("Failed xclaim of a recently delivered entry. got %v", got)
+		}
+	})
+
+	t.Run("autoclaim drops deleted entries", func(t *testing.T) {
+		run(t, "XDEL", "cg:s", "3-0")
+
+		got := run(t, "XAUTOCLAIM", "cg:s", "g", "dave", "0", "-", "JUSTID")
+		want := token{typ: string(ARRAY), array: []token{
+			{typ: string(BULK), bulk: "0-0"},
+			bulkArray([]string{"2-0"}),
+			bulkArray([]string{"3-0"}),
+		}}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed xautoclaim. wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("info", func(t *testing.T) {
+		groups := run(t, "XINFO", "GROUPS", "cg:s")
+		if len(groups.array) != 1 {
+			t.Fatalf("Failed xinfo groups. got %v", groups)
+		}
+
+		want := []token{
+			{typ: string(BULK), bulk: "name"}, {typ: string(BULK), bulk: "g"},
+			{typ: string(BULK), bulk: "consumers"}, intToken(4),
+			{typ: string(BULK), bulk: "pending"}, intToken(1),
+			{typ: string(BULK), bulk: "last-delivered-id"}, {typ: string(BULK), bulk: "3-0"},
+			{typ: string(BULK), bulk: "entries-read"}, intToken(3),
+			{typ: string(BULK), bulk: "lag"}, intToken(0),
+		}
+		if got := groups.array[0].array; !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed xinfo groups. wanted %v, got %v", want, got)
+		}
+
+		consumers := run(t, "XINFO", "CONSUMERS", "cg:s", "g")
+		if len(consumers.array) != 4 || consumers.array[0].array[1].bulk != "alice" {
+			t.Errorf("Failed xinfo consumers. got %v", consumers)
+		}
+
+		info := run(t, "XINFO", "STREAM", "cg:s")
+		if got := info.array[1]; !reflect.DeepEqual(got, intToken(2)) {
+			t.Errorf("Failed xinfo stream length. wanted %v, got %v", intToken(2), got)
+		}
+	})
+
+	t.Run("delconsumer and destroy", func(t *testing.T) {
+		if got := run(t, "XGROUP", "DELCONSUMER", "cg:s", "g", "dave"); !reflect.DeepEqual(got, intToken(1)) {
+			t.Errorf("Failed xgroup delconsumer. wanted %v, got %v", intToken(1), got)
+		}
+		if got := run(t, "XGROUP", "DESTROY", "cg:s", "g"); !reflect.DeepEqual(got, intToken(1)) {
+			t.Errorf("Failed xgroup destroy. wanted %v, got %v", intToken(1), got)
+		}
+		if got := run(t, "XPENDING", "cg:s", "g"); got.typ != string(ERROR) {
+			t.Errorf("Failed xpending on a destroyed group. got %v", got)
+		}
+	})
+}
+
+func TestPendingList(t *testing.T) {
+	pl := newPendingList()
+	for _, id := range []streamID{{ms: 5}, {ms: 1, seq: 2}, {ms: 256}, {ms: 1}, {ms: 3}} {
+		pl.add(&pendingEntry{id: id})
+	}
+	pl.remove(streamID{ms: 3})
+
+	ids := func(from streamID) []string {
+		got := []string{}
+		pl.ascend(from, func(p *pendingEntry) bool {
+			got = append(got, p.id.String())
+			return true
+		})
+		return got
+	}
+
+	want := []string{"1-0", "1-2", "5-0", "256-0"}
+	if got := ids(streamID{}); !reflect.DeepEqual(got, want) {
+		t.Errorf("Failed ascend. wanted %v, got %v", want, got)
+	}
+
+	want = []string{"5-0", "256-0"}
+	if got := ids(streamID{ms: 2}); !reflect.DeepEqual(got, want) {
+		t.Errorf("Failed ascend from 2-0. wanted %v, got %v", want, got)
+	}
+
+	if first, last := pl.first().id.String(), pl.last().id.String(); first != "1-0" || last != "256-0" {
+		t.Errorf("Failed ends. wanted 1-0 and 256-0, got %s and %s", first, last)
+	}
+}
+
+func TestXReadGroupBlock(t *testing.T) {
+	run(t, "XGROUP", "CREATE", "cg:block", "g", "$", "MKSTREAM")
+
+	result := make(chan token)
+	go func() {
+		result <- run(t, "XREADGROUP", "GROUP", "g", "c", "BLOCK", "0", "STREAMS", "cg:block", ">")
+	}()
+	waitForBlocked(t, "cg:block", 1)
+
+	run(t, "XADD", "cg:block", "1-0", "f", "v")
+
+	if got := readGroupIDs(t, <-result); !reflect.DeepEqual(got, []string{"1-0"}) {
+		t.Errorf("Failed xreadgroup. got %v", got)
+	}
+
+	if got := run(t, "XPENDING", "cg:block", "g"); !reflect.DeepEqual(got.array[0], intToken(1)) {
+		t.Errorf("Failed xpending after a blocking read. got %v", got)
+	}
+}
+
+func TestConsumerGroupPropagation(t *testing.T) {
+	args := func(values ...string) []token {
+		return bulkArray(values).array
+	}
+
+	t.Run("xreadgroup drops block", func(t *testing.T) {
+		asMaster(t)
+		run(t, "XGROUP", "CREATE", "cg:drop", "g", "0", "MKSTREAM")
+		run(t, "XADD", "cg:drop", "1-0", "f", "v")
+
+		readArgs := args("GROUP", "g", "c", "BLOCK", "0", "STREAMS", "cg:drop", ">")
+		mux.Lock()
+		got := propagatedCommands(token{}, "XREADGROUP", readArgs, xreadgroup(readArgs))
+		mux.Unlock()
+
+		want := []token{
+			bulkArray([]string{"XGROUP", "CREATECONSUMER", "cg:drop", "g", "c"}),
+			bulkArray([]string{"XREADGROUP", "GROUP", "g", "c", "STREAMS", "cg:drop", ">"}),
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed propagation. wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("empty reads create the consumer", func(t *testing.T) {
+		asMaster(t)
+		run(t, "XGROUP", "CREATE", "cg:empty", "g", "$", "MKSTREAM")
+
+		readArgs := args("GROUP", "g", "c", "STREAMS", "cg:empty", ">")
+		mux.Lock()
+		got := propagatedCommands(token{}, "XREADGROUP", readArgs, xreadgroup(readArgs))
+		mux.Unlock()
+
+		want := []token{bulkArray([]string{"XGROUP", "CREATECONSUMER", "cg:empty", "g", "c"})}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed propagation. wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("xadd replicates the reads it serves", func(t *testing.T) {
+		asMaster(t)
+		run(t, "XGROUP", "CREATE", "cg:served", "g", "$", "MKSTREAM")
+
+		result := make(chan token)
+		go func() {
+			readArgs := args("GROUP", "g", "c", "COUNT", "5", "BLOCK", "0", "STREAMS", "cg:served", ">")
+			mux.Lock()
+			defer mux.Unlock()
+
+			served := xreadgroup(readArgs)
+			if got := propagatedCommands(token{}, "XREADGROUP", readArgs, served); len(got) != 0 {
+				t.Errorf("Failed propagation. wanted nothing from the served client, got %v", got)
+			}
+			result <- served
+		}()
+		waitForBlocked(t, "cg:served", 1)
+
+		add := bulkArray([]string{"XADD", "cg:served", "1-0", "f", "v"})
+		mux.Lock()
+		got := propagatedCommands(add, "XADD", add.array[1:], xadd(add.array[1:]))
+		mux.Unlock()
+		<-result
+
+		want := []token{
+			add,
+			bulkArray([]string{"XREADGROUP", "GROUP", "g", "c", "COUNT", "5", "STREAMS", "cg:served", ">"}),
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed propagation. wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("xclaim sends the delivery state", func(t *testing.T) {
+		run(t, "XGROUP", "CREATE", "cg:repl", "g", "0", "MKSTREAM")
+		run(t, "XADD", "cg:repl", "1-0", "f", "v")
+		run(t, "XREADGROUP", "GROUP", "g", "a", "STREAMS", "cg:repl", ">")
+
+		result := run(t, "XCLAIM", "cg:repl", "g", "b", "0", "1-0", "JUSTID")
+		claimArgs := args("cg:repl", "g", "b", "0", "1-0", "JUSTID")
+		got := propagatedCommands(token{}, "XCLAIM", claimArgs, result)
+
+		if len(got) != 2 || got[1].array[0].bulk != "XCLAIM" || got[1].array[3].bulk != "b" {
+			t.Fatalf("Failed propagation. got %v", got)
+		}
+		if retries := got[1].array[9].bulk; retries != "1" {
+			t.Errorf("Failed propagation. wanted retry count 1, got %v", retries)
+		}
+	})
+}
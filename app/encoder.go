@@ -53,6 +53,8 @@ func (t token) Marshal() []byte {
 		return t.marshalSet()
 	case string(NULL):
 		return t.marshalNull()
+	case string(NULLARRAY):
+		return t.marshalNullArray()
 	case string(SYNC):
 		return t.marshalPsync()
 	case string(INTEGER):
@@ -74,6 +76,13 @@ func (t token) marshalArray() []byte {
 	bytes = append(bytes, '\r', '\n')
 
 	for _, v := range t.array {
+		// Elements without an explicit type are treated as bulk strings,
+		// anything else (integers, nested arrays, nulls) encodes itself
+		if v.typ != "" && v.typ != string(BULK) {
+			bytes = append(bytes, v.Marshal()...)
+			continue
+		}
+
 		bytes = append(bytes, BULK)
 		bytes = append(bytes, strconv.Itoa(len(v.bulk))...)
 		bytes = append(bytes, '\r', '\n')
@@ -117,6 +126,10 @@ func (t token) marshalNull() []byte {
 	return []byte("$-1\r\n")
 }
 
+func (t token) marshalNullArray() []byte {
+	return []byte("*-1\r\n")
+}
+
 func (t token) marshalSet() []byte {
 	var bytes []byte
 	bytes = append(bytes, SET)
@@ -15,7 +15,7 @@ func TestRespEncoder(t *testing.T) {
 
 		// new() allocates a new block of memory for the given type
 		got := new(bytes.Buffer)
-		w := NewEncoder(got)
+		w := NewEncoder(got, nil)
 		w.Encode(tok)
 
 		if !bytes.Equal(want, got.Bytes()) {
@@ -32,7 +32,7 @@ func TestRespEncoder(t *testing.T) {
 
 		// new() allocates a new block of memory for the given type
 		got := new(bytes.Buffer)
-		w := NewEncoder(got)
+		w := NewEncoder(got, nil)
 		w.Encode(tok)
 
 		if !bytes.Equal(want, got.Bytes()) {
@@ -58,7 +58,7 @@ func TestRespEncoder(t *testing.T) {
 
 		// new() allocates a new block of memory for the given type
 		got := new(bytes.Buffer)
-		w := NewEncoder(got)
+		w := NewEncoder(got, nil)
 		w.Encode(tok)
 
 		if !bytes.Equal(want, got.Bytes()) {
@@ -88,7 +88,7 @@ func TestRespEncoder(t *testing.T) {
 
 		// new() allocates a new block of memory for the given type
 		got := new(bytes.Buffer)
-		w := NewEncoder(got)
+		w := NewEncoder(got, nil)
 		w.Encode(tok)
 
 		if !bytes.Equal(want, got.Bytes()) {
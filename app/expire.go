@@ -0,0 +1,378 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Keys with a TTL are expired in two complementary ways, like in Redis:
+//
+//   - Lazily: every lookup goes through lookupKey, which treats a key
+//     whose expiry has passed as missing and deletes it.
+//   - Actively: activeExpireCycle periodically samples keys carrying a
+//     TTL and deletes the expired ones, so keys that are never read
+//     again still get reclaimed.
+//
+// The expiry itself only lives in object.expiry, so overwriting a key
+// without a TTL makes it persistent again.
+const (
+	activeExpireInterval = 100 * time.Millisecond
+	// Keys looked at per sampling round
+	activeExpireSampleSize = 20
+	// Upper bound on the time a single cycle may hold the lock
+	activeExpireTimeLimit = 25 * time.Millisecond
+)
+
+// expires indexes the keys that were given a TTL so the active cycle
+// doesn't have to scan the whole keyspace. It may hold stale entries for
+// keys that were since deleted or persisted, the cycle drops those when
+// it comes across them. Guarded by mux.
+var expires = map[string]struct{}{}
+
+func isExpired(obj object) bool {
+	return obj.expiry != 0 && time.Now().UnixMilli() >= int64(obj.expiry)
+}
+
+// trackExpiry registers key with the active expire cycle.
+// Callers must hold mux.
+func trackExpiry(key string) {
+	expires[key] = struct{}{}
+}
+
+// lookupKey returns the object stored at key, treating it as missing once
+// its expiry has passed. Callers must hold mux.
+func lookupKey(key string) (object, bool) {
+	obj, exists := datastore[key]
+	if !exists {
+		return object{}, false
+	}
+
+	if isExpired(obj) {
+		// Replicas wait for the master's DEL so both sides stay in sync
+		if Role != "slave" {
+			deleteExpiredKey(key)
+		}
+		return object{}, false
+	}
+
+	return obj, true
+}
+
+// deleteExpiredKey removes key and tells the replicas about it.
+// Callers must hold mux.
+func deleteExpiredKey(key string) {
+	removeKey(key)
+	delete(expires, key)
+	notifyKeyspaceEvent(notifyExpired, "expired", key)
+
+	if Role == "master" && len(replicas) > 0 {
+		del := bulkArray([]string{"DEL", key})
+		bytesWritten += TokenLength(del)
+		propagate(del)
+	}
+}
+
+// activeExpireCycle samples keys with a TTL and deletes the expired ones.
+// As long as more than a quarter of a sample turns out to be expired
+// another round is run, until the time limit is reached.
+func activeExpireCycle() {
+	start := time.Now()
+
+	for {
+		mux.Lock()
+
+		sampled, expired := 0, 0
+		// Map iteration starts at a random position, which gives us the sample
+		for key := range expires {
+			if sampled == activeExpireSampleSize {
+				break
+			}
+			sampled++
+
+			obj, exists := datastore[key]
+			if !exists || obj.expiry == 0 {
+				delete(expires, key)
+				continue
+			}
+
+			if isExpired(obj) {
+				deleteExpiredKey(key)
+				expired++
+			}
+		}
+
+		mux.Unlock()
+
+		if sampled == 0 || expired*4 <= sampled || time.Since(start) > activeExpireTimeLimit {
+			return
+		}
+	}
+}
+
+// StartActiveExpire runs the active expire cycle in the background
+func StartActiveExpire() {
+	go func() {
+		ticker := time.NewTicker(activeExpireInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			activeExpireCycle()
+		}
+	}()
+}
+
+// parseExpiryOption reads the argument of the EX, PX, EXAT or PXAT option
+// of command into the time it expires at, rejecting times that don't fit
+// in milliseconds like Redis does
+func parseExpiryOption(command, opt, arg string) (time.Time, *token) {
+	when, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return time.Time{}, &errNotInteger
+	}
+
+	invalid := token{typ: string(ERROR), val: fmt.Sprintf("ERR invalid expire time in '%s' command", command)}
+	if when <= 0 {
+		return time.Time{}, &invalid
+	}
+
+	if opt == "EX" || opt == "EXAT" {
+		if when > math.MaxInt64/1000 {
+			return time.Time{}, &invalid
+		}
+		when *= 1000
+	}
+
+	if opt == "EX" || opt == "PX" {
+		now := time.Now().UnixMilli()
+		if when > math.MaxInt64-now {
+			return time.Time{}, &invalid
+		}
+		when += now
+	}
+
+	return time.UnixMilli(when), nil
+}
+
+func expireGeneric(command string, args []token, unit time.Duration, absolute bool) token {
+	if len(args) < 2 {
+		return wrongArgs(command)
+	}
+
+	when, err := strconv.ParseInt(args[1].bulk, 10, 64)
+	if err != nil {
+		return errNotInteger
+	}
+
+	var nx, xx, gt, lt bool
+	for _, arg := range args[2:] {
+		switch strings.ToUpper(arg.bulk) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GT":
+			gt = true
+		case "LT":
+			lt = true
+		default:
+			return token{typ: string(ERROR), val: "ERR Unsupported option " + arg.bulk}
+		}
+	}
+
+	if nx && (xx || gt || lt) {
+		return token{typ: string(ERROR), val: "ERR NX and XX, GT or LT options at the same time are not compatible"}
+	}
+	if gt && lt {
+		return token{typ: string(ERROR), val: "ERR GT and LT options at the same time are not compatible"}
+	}
+
+	// Work in milliseconds, rejecting anything that would overflow
+	invalid := token{
+		typ: string(ERROR),
+		val: fmt.Sprintf("ERR invalid expire time in '%s' command", strings.ToLower(command)),
+	}
+	scale := int64(unit / time.Millisecond)
+	if when > math.MaxInt64/scale || when < math.MinInt64/scale {
+		return invalid
+	}
+	when *= scale
+
+	if !absolute {
+		now := time.Now().UnixMilli()
+		if when > math.MaxInt64-now {
+			return invalid
+		}
+		when += now
+	}
+
+	key := args[0].bulk
+	obj, exists := lookupKey(key)
+	if !exists {
+		return intToken(0)
+	}
+
+	// A key without a TTL counts as expiring never, ie. later than anything
+	current := int64(obj.expiry)
+	switch {
+	case nx && current != 0,
+		xx && current == 0,
+		gt && (current == 0 || when <= current),
+		lt && current != 0 && when >= current:
+		return intToken(0)
+	}
+
+	if when <= time.Now().UnixMilli() {
+		removeKey(key)
+		delete(expires, key)
+		notifyKeyspaceEvent(notifyGeneric, "del", key)
+		return intToken(1)
+	}
+
+	obj.expiry = int(when)
+	putKey(key, obj)
+	trackExpiry(key)
+	notifyKeyspaceEvent(notifyGeneric, "expire", key)
+
+	return intToken(1)
+}
+
+// EXPIRE key seconds [NX|XX|GT|LT]
+func expire(args []token) token {
+	return expireGeneric("EXPIRE", args, time.Second, false)
+}
+
+// PEXPIRE key milliseconds [NX|XX|GT|LT]
+func pexpire(args []token) token {
+	return expireGeneric("PEXPIRE", args, time.Millisecond, false)
+}
+
+// EXPIREAT key unix-time-seconds [NX|XX|GT|LT]
+func expireat(args []token) token {
+	return expireGeneric("EXPIREAT", args, time.Second, true)
+}
+
+// PEXPIREAT key unix-time-milliseconds [NX|XX|GT|LT]
+func pexpireat(args []token) token {
+	return expireGeneric("PEXPIREAT", args, time.Millisecond, true)
+}
+
+// ttlGeneric answers TTL, PTTL, EXPIRETIME and PEXPIRETIME. Missing keys
+// return -2 and keys without a TTL return -1.
+func ttlGeneric(command string, args []token, unit time.Duration, absolute bool) token {
+	if len(args) != 1 {
+		return wrongArgs(command)
+	}
+
+	obj, exists := lookupKey(args[0].bulk)
+	if !exists {
+		return intToken(-2)
+	}
+
+	if obj.expiry == 0 {
+		return intToken(-1)
+	}
+
+	when := int64(obj.expiry)
+	if !absolute {
+		when -= time.Now().UnixMilli()
+		if when < 0 {
+			when = 0
+		}
+	}
+
+	scale := int64(unit / time.Millisecond)
+	if !absolute && scale > 1 {
+		// Round to the closest second like Redis does
+		return intToken(int((when + scale/2) / scale))
+	}
+
+	return intToken(int(when / scale))
+}
+
+// TTL key
+func ttl(args []token) token {
+	return ttlGeneric("TTL", args, time.Second, false)
+}
+
+// PTTL key
+func pttl(args []token) token {
+	return ttlGeneric("PTTL", args, time.Millisecond, false)
+}
+
+// EXPIRETIME key
+func expiretime(args []token) token {
+	return ttlGeneric("EXPIRETIME", args, time.Second, true)
+}
+
+// PEXPIRETIME key
+func pexpiretime(args []token) token {
+	return ttlGeneric("PEXPIRETIME", args, time.Millisecond, true)
+}
+
+// PERSIST key
+func persist(args []token) token {
+	if len(args) != 1 {
+		return wrongArgs("PERSIST")
+	}
+
+	key := args[0].bulk
+	obj, exists := lookupKey(key)
+	if !exists || obj.expiry == 0 {
+		return intToken(0)
+	}
+
+	obj.expiry = 0
+	putKey(key, obj)
+	delete(expires, key)
+	notifyKeyspaceEvent(notifyGeneric, "persist", key)
+
+	return intToken(1)
+}
+
+// absoluteExpiryCommand rewrites a command that set a TTL into one carrying
+// the absolute expiry the master ended up with, so replicas expire the key
+// at the same moment no matter when they apply it. Callers must hold mux.
+func absoluteExpiryCommand(command string, args []token, result token) (token, bool) {
+	switch command {
+	case "SET":
+		relative := false
+		for _, arg := range args[2:] {
+			switch strings.ToUpper(arg.bulk) {
+			case "EX", "PX", "EXAT":
+				relative = true
+			}
+		}
+		if !relative {
+			return token{}, false
+		}
+	case "EXPIRE", "PEXPIRE", "EXPIREAT":
+		if result.val != "1" {
+			return token{}, false
+		}
+	default:
+		return token{}, false
+	}
+
+	key := args[0].bulk
+
+	obj, exists := lookupKey(key)
+	if !exists {
+		return bulkArray([]string{"DEL", key}), true
+	}
+
+	if command == "SET" {
+		// Whether or not the SET applied, replicas end up with what we have
+		if obj.typ != "string" {
+			return token{}, false
+		}
+		if obj.expiry == 0 {
+			return bulkArray([]string{"SET", key, obj.str()}), true
+		}
+		return bulkArray([]string{"SET", key, obj.str(), "PXAT", strconv.Itoa(obj.expiry)}), true
+	}
+
+	return bulkArray([]string{"PEXPIREAT", key, strconv.Itoa(obj.expiry)}), true
+}
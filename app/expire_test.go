@@ -0,0 +1,150 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestExpire(t *testing.T) {
+	t.Run("expired keys are deleted on access", func(t *testing.T) {
+		run(t, "SET", "exp:lazy", "v", "PX", "10")
+		time.Sleep(20 * time.Millisecond)
+
+		want := token{typ: string(NULL), val: "1"}
+		if got := run(t, "GET", "exp:lazy"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed lazy expire. wanted %v, got %v", want, got)
+		}
+
+		mux.Lock()
+		_, exists := datastore["exp:lazy"]
+		mux.Unlock()
+		if exists {
+			t.Errorf("Expired key is still in the datastore")
+		}
+	})
+
+	t.Run("overwriting a key drops its ttl", func(t *testing.T) {
+		run(t, "SET", "exp:overwrite", "old", "PX", "10")
+		run(t, "SET", "exp:overwrite", "new")
+		time.Sleep(20 * time.Millisecond)
+
+		want := token{typ: string(STRING), val: "new"}
+		if got := run(t, "GET", "exp:overwrite"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed overwrite. wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("active cycle reclaims keys nobody reads", func(t *testing.T) {
+		for _, key := range []string{"exp:a", "exp:b", "exp:c"} {
+			run(t, "SET", key, "v", "PX", "10")
+		}
+		run(t, "RPUSH", "exp:list", "a")
+		time.Sleep(20 * time.Millisecond)
+
+		activeExpireCycle()
+
+		mux.Lock()
+		defer mux.Unlock()
+		for _, key := range []string{"exp:a", "exp:b", "exp:c"} {
+			if _, exists := datastore[key]; exists {
+				t.Errorf("Expired key %s is still in the datastore", key)
+			}
+			if _, tracked := expires[key]; tracked {
+				t.Errorf("Expired key %s is still tracked", key)
+			}
+		}
+
+		if _, exists := datastore["exp:list"]; !exists {
+			t.Errorf("Key without ttl was removed")
+		}
+	})
+}
+
+func TestExpireCommands(t *testing.T) {
+	t.Run("ttl return codes", func(t *testing.T) {
+		if got := run(t, "TTL", "ttl:missing"); !reflect.DeepEqual(got, intToken(-2)) {
+			t.Errorf("Failed ttl. wanted %v, got %v", intToken(-2), got)
+		}
+
+		run(t, "SET", "ttl:plain", "v")
+		if got := run(t, "TTL", "ttl:plain"); !reflect.DeepEqual(got, intToken(-1)) {
+			t.Errorf("Failed ttl. wanted %v, got %v", intToken(-1), got)
+		}
+
+		if got := run(t, "EXPIRE", "ttl:plain", "100"); !reflect.DeepEqual(got, intToken(1)) {
+			t.Errorf("Failed expire. wanted %v, got %v", intToken(1), got)
+		}
+		if got := run(t, "TTL", "ttl:plain"); !reflect.DeepEqual(got, intToken(100)) {
+			t.Errorf("Failed ttl. wanted %v, got %v", intToken(100), got)
+		}
+
+		if got := run(t, "PERSIST", "ttl:plain"); !reflect.DeepEqual(got, intToken(1)) {
+			t.Errorf("Failed persist. wanted %v, got %v", intToken(1), got)
+		}
+		if got := run(t, "PTTL", "ttl:plain"); !reflect.DeepEqual(got, intToken(-1)) {
+			t.Errorf("Failed pttl. wanted %v, got %v", intToken(-1), got)
+		}
+	})
+
+	t.Run("expire options", func(t *testing.T) {
+		run(t, "SET", "ttl:opts", "v")
+
+		if got := run(t, "EXPIRE", "ttl:opts", "100", "XX"); !reflect.DeepEqual(got, intToken(0)) {
+			t.Errorf("Failed expire xx. wanted %v, got %v", intToken(0), got)
+		}
+		if got := run(t, "EXPIRE", "ttl:opts", "100", "GT"); !reflect.DeepEqual(got, intToken(0)) {
+			t.Errorf("Failed expire gt. wanted %v, got %v", intToken(0), got)
+		}
+		if got := run(t, "EXPIRE", "ttl:opts", "100", "NX"); !reflect.DeepEqual(got, intToken(1)) {
+			t.Errorf("Failed expire nx. wanted %v, got %v", intToken(1), got)
+		}
+		if got := run(t, "EXPIRE", "ttl:opts", "200", "LT"); !reflect.DeepEqual(got, intToken(0)) {
+			t.Errorf("Failed expire lt. wanted %v, got %v", intToken(0), got)
+		}
+		if got := run(t, "EXPIRE", "ttl:opts", "50", "LT"); !reflect.DeepEqual(got, intToken(1)) {
+			t.Errorf("Failed expire lt. wanted %v, got %v", intToken(1), got)
+		}
+
+		want := token{typ: string(ERROR), val: "ERR NX and XX, GT or LT options at the same time are not compatible"}
+		if got := run(t, "EXPIRE", "ttl:opts", "50", "NX", "GT"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed expire. wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("expiretime and past timestamps", func(t *testing.T) {
+		run(t, "SET", "ttl:at", "v")
+		run(t, "PEXPIREAT", "ttl:at", "32503680000000")
+
+		if got := run(t, "EXPIRETIME", "ttl:at"); !reflect.DeepEqual(got, intToken(32503680000)) {
+			t.Errorf("Failed expiretime. wanted %v, got %v", intToken(32503680000), got)
+		}
+
+		// An expiry in the past deletes the key straight away
+		if got := run(t, "EXPIREAT", "ttl:at", "1"); !reflect.DeepEqual(got, intToken(1)) {
+			t.Errorf("Failed expireat. wanted %v, got %v", intToken(1), got)
+		}
+		if got := run(t, "TTL", "ttl:at"); !reflect.DeepEqual(got, intToken(-2)) {
+			t.Errorf("Failed ttl. wanted %v, got %v", intToken(-2), got)
+		}
+	})
+
+	t.Run("relative ttls replicate as absolute ones", func(t *testing.T) {
+		run(t, "SET", "ttl:repl", "v")
+		args := []token{{typ: string(BULK), bulk: "ttl:repl"}, {typ: string(BULK), bulk: "100"}}
+		result := expire(args)
+
+		got, ok := absoluteExpiryCommand("EXPIRE", args, result)
+		if !ok || len(got.array) != 3 || got.array[0].bulk != "PEXPIREAT" {
+			t.Fatalf("Failed rewrite. got %v", got)
+		}
+
+		mux.Lock()
+		expiry := datastore["ttl:repl"].expiry
+		mux.Unlock()
+		if got.array[2].bulk != strconv.Itoa(expiry) {
+			t.Errorf("Failed rewrite. wanted %d, got %s", expiry, got.array[2].bulk)
+		}
+	})
+}
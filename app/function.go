@@ -0,0 +1,606 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// Functions are the named alternative to EVAL: a library starting with a
+// #!lua name=<library> line registers them when it is loaded, and FCALL
+// runs them. Each library keeps the interpreter its code ran in, which is
+// where its functions run too. Libraries reach replicas as the FUNCTION
+// commands that changed them and are part of the RDB files read and sent.
+
+type library struct {
+	name string
+	// code is the library as given to FUNCTION LOAD, metadata included
+	code      string
+	functions map[string]*function
+	state     *lua.LState
+	run       *scriptRun
+}
+
+type function struct {
+	name        string
+	description string
+	flags       map[string]bool
+	callback    *lua.LFunction
+	library     *library
+}
+
+// libraries holds the function libraries by name. Guarded by mux.
+var libraries = map[string]*library{}
+
+// functionLoadTimeout is how long library code may run when it is loaded
+const functionLoadTimeout = 500 * time.Millisecond
+
+// functionFlags are the flags functions may be registered with, in the
+// order FUNCTION LIST shows them
+var functionFlags = []string{"no-writes", "allow-oom", "allow-stale", "no-cluster", "allow-cross-slot-keys"}
+
+// Like the scripting commands, the function commands end up calling
+// Handlers themselves
+func init() {
+	Handlers["FUNCTION"] = commandSpec{functionCommand, -2}
+	Handlers["FCALL"] = commandSpec{fcall, -3}
+	Handlers["FCALL_RO"] = commandSpec{fcallRO, -3}
+}
+
+// validName reports whether name can be the name of a library or function
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// parseLibraryMetadata reads the #! line code starts with and returns the
+// name of the library along with the code following that line
+func parseLibraryMetadata(code string) (string, string, *token) {
+	if !strings.HasPrefix(code, "#!") {
+		return "", "", &token{typ: string(ERROR), val: "ERR Missing library metadata"}
+	}
+
+	shebang, body, _ := strings.Cut(code, "\n")
+	// Keep the line so errors point at the right one
+	body = "\n" + body
+
+	fields := strings.Fields(shebang[2:])
+	if len(fields) == 0 || !strings.EqualFold(fields[0], "lua") {
+		engine := ""
+		if len(fields) > 0 {
+			engine = fields[0]
+		}
+		return "", "", &token{typ: string(ERROR), val: fmt.Sprintf("ERR Engine '%s' not found", engine)}
+	}
+
+	name := ""
+	for _, field := range fields[1:] {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok || key != "name" {
+			return "", "", &token{typ: string(ERROR), val: fmt.Sprintf("ERR Invalid metadata value given: %s", field)}
+		}
+		name = value
+	}
+
+	if name == "" {
+		return "", "", &token{typ: string(ERROR), val: "ERR Library name was not given"}
+	}
+
+	if !validName(name) {
+		return "", "", &token{
+			typ: string(ERROR),
+			val: "ERR Library names can only contain letters, numbers, or underscores(_) and must be at least one character long",
+		}
+	}
+
+	return name, body, nil
+}
+
+// loadLibrary runs code and adds the library it registers to libs, where
+// it replaces a library with the same name when replace is set.
+// Callers must hold mux.
+func loadLibrary(libs map[string]*library, code string, replace bool) (*library, *token) {
+	name, body, errTok := parseLibraryMetadata(code)
+	if errTok != nil {
+		return nil, errTok
+	}
+
+	if _, exists := libs[name]; exists && !replace {
+		return nil, &token{typ: string(ERROR), val: fmt.Sprintf("ERR Library '%s' already exists", name)}
+	}
+
+	lib, errTok := newLibrary(name, code, body)
+	if errTok != nil {
+		return nil, errTok
+	}
+
+	for fn := range lib.functions {
+		for _, other := range libs {
+			if other.name != name && other.functions[fn] != nil {
+				lib.state.Close()
+				return nil, &token{typ: string(ERROR), val: fmt.Sprintf("ERR Function %s already exists", fn)}
+			}
+		}
+	}
+
+	libs[name] = lib
+
+	return lib, nil
+}
+
+// newLibrary runs the body of a library in an interpreter of its own and
+// returns the library with the functions it registered
+func newLibrary(name, code, body string) (*library, *token) {
+	chunk, err := parse.Parse(strings.NewReader(body), "@user_function")
+	if err != nil {
+		return nil, &token{typ: string(ERROR), val: fmt.Sprintf("ERR Error compiling function: %v", err)}
+	}
+
+	proto, err := lua.Compile(chunk, "@user_function")
+	if err != nil {
+		return nil, &token{typ: string(ERROR), val: fmt.Sprintf("ERR Error compiling function: %v", err)}
+	}
+
+	lib := &library{
+		name:      name,
+		code:      code,
+		functions: map[string]*function{},
+		run:       &scriptRun{loading: true, function: true},
+	}
+
+	L := newScriptState(lib.run)
+	L.SetField(L.GetGlobal("redis"), "register_function", L.NewFunction(lib.register))
+	lib.state = L
+
+	// Loading can't be killed, it gets a time limit instead
+	ctx, cancel := context.WithTimeout(context.Background(), functionLoadTimeout)
+	defer cancel()
+	L.SetContext(ctx)
+
+	L.Push(L.NewFunctionFromProto(proto))
+	err = L.PCall(0, 0, nil)
+	lib.run.loading = false
+	L.RemoveContext()
+
+	if ctx.Err() == context.DeadlineExceeded {
+		L.Close()
+		return nil, &token{typ: string(ERROR), val: "ERR FUNCTION LOAD timeout"}
+	}
+
+	if err != nil {
+		L.Close()
+		errTok := raisedError(err, "ERR Error registering functions")
+		return nil, &errTok
+	}
+
+	if len(lib.functions) == 0 {
+		L.Close()
+		return nil, &token{typ: string(ERROR), val: "ERR No functions registered"}
+	}
+
+	return lib, nil
+}
+
+// closeDropped closes the interpreters of the libraries in previous that
+// libs no longer holds, having been deleted or replaced
+func closeDropped(previous, libs map[string]*library) {
+	for name, lib := range previous {
+		if libs[name] != lib {
+			lib.state.Close()
+		}
+	}
+}
+
+// flushLibraries removes every library. Callers must hold mux.
+func flushLibraries() {
+	closeDropped(libraries, nil)
+	clear(libraries)
+}
+
+// register is redis.register_function, which takes either a name and a
+// callback or a table with the function_name, callback, flags and
+// description fields
+func (lib *library) register(L *lua.LState) int {
+	if !lib.run.loading {
+		L.RaiseError("redis.register_function can only be called on FUNCTION LOAD command")
+	}
+
+	f := &function{flags: map[string]bool{}, library: lib}
+
+	var callback, flags lua.LValue = lua.LNil, lua.LNil
+	switch L.GetTop() {
+	case 1:
+		var unknown bool
+		L.CheckTable(1).ForEach(func(key, value lua.LValue) {
+			switch key.String() {
+			case "function_name":
+				f.name = value.String()
+			case "callback":
+				callback = value
+			case "flags":
+				flags = value
+			case "description":
+				f.description = value.String()
+			default:
+				unknown = true
+			}
+		})
+		if unknown {
+			L.RaiseError("unknown argument given to redis.register_function")
+		}
+	case 2:
+		f.name = L.CheckString(1)
+		callback = L.Get(2)
+	default:
+		L.RaiseError("wrong number of arguments to redis.register_function")
+	}
+
+	var ok bool
+	if f.callback, ok = callback.(*lua.LFunction); !ok {
+		L.RaiseError("callback argument given to redis.register_function must be a function")
+	}
+
+	if !validName(f.name) {
+		L.RaiseError("Function names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	}
+
+	if _, exists := lib.functions[f.name]; exists {
+		L.RaiseError("Function already exists in the library")
+	}
+
+	if flags != lua.LNil {
+		tbl, ok := flags.(*lua.LTable)
+		if !ok {
+			L.RaiseError("flags argument to redis.register_function must be a table representing function flags")
+		}
+
+		for i := 1; i <= tbl.Len(); i++ {
+			flag := tbl.RawGetInt(i).String()
+			if !slices.Contains(functionFlags, flag) {
+				L.RaiseError("unknown flag given")
+			}
+			f.flags[flag] = true
+		}
+	}
+
+	lib.functions[f.name] = f
+
+	return 0
+}
+
+func sortedLibraryNames() []string {
+	names := make([]string, 0, len(libraries))
+	for name := range libraries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func sortedFunctionNames(lib *library) []string {
+	names := make([]string, 0, len(lib.functions))
+	for name := range lib.functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// findFunction returns the function called name. Callers must hold mux.
+func findFunction(name string) (*function, bool) {
+	for _, lib := range libraries {
+		if f, ok := lib.functions[name]; ok {
+			return f, true
+		}
+	}
+
+	return nil, false
+}
+
+// dumpLibraries encodes the libraries the way RDB files hold them.
+// Callers must hold mux.
+func dumpLibraries() []byte {
+	var out []byte
+	for _, name := range sortedLibraryNames() {
+		out = append(out, FUNCTION_OFFSET)
+		out = append(out, encodeString(libraries[name].code)...)
+	}
+
+	return out
+}
+
+// FCALL function numkeys [key [key ...]] [arg [arg ...]]
+func fcall(args []token) token {
+	return callFunction("FCALL", args, false)
+}
+
+// FCALL_RO function numkeys [key [key ...]] [arg [arg ...]]
+func fcallRO(args []token) token {
+	return callFunction("FCALL_RO", args, true)
+}
+
+func callFunction(command string, args []token, readOnly bool) token {
+	if len(args) < 2 {
+		return wrongArgs(command)
+	}
+
+	// Nothing to replicate unless the function runs
+	scriptEffects = nil
+
+	f, ok := findFunction(args[0].bulk)
+	if !ok {
+		return token{typ: string(ERROR), val: "ERR Function not found"}
+	}
+
+	keys, argv, errTok := parseScriptArgs(args[1:])
+	if errTok != nil {
+		return *errTok
+	}
+
+	if readOnly && !f.flags["no-writes"] {
+		return token{typ: string(ERROR), val: "ERR Can not execute a script with write flag using *_ro command."}
+	}
+
+	L, run := f.library.state, f.library.run
+	run.readOnly = f.flags["no-writes"]
+
+	return runFunction(L, run, f.callback, stringsTable(L, keys), stringsTable(L, argv))
+}
+
+// FUNCTION LOAD | DELETE | FLUSH | LIST | DUMP | RESTORE | KILL
+func functionCommand(args []token) token {
+	if len(args) == 0 {
+		return wrongArgs("FUNCTION")
+	}
+
+	switch strings.ToUpper(args[0].bulk) {
+	case "LOAD":
+		return functionLoad(args[1:])
+	case "DELETE":
+		return functionDelete(args[1:])
+	case "FLUSH":
+		return functionFlush(args[1:])
+	case "LIST":
+		return functionList(args[1:])
+	case "DUMP":
+		return functionDump(args[1:])
+	case "RESTORE":
+		return functionRestore(args[1:])
+	case "KILL":
+		// FUNCTION KILL itself doesn't wait for mux, see scriptControl
+		return wrongArgs("FUNCTION|KILL")
+	default:
+		return token{
+			typ: string(ERROR),
+			val: fmt.Sprintf("ERR unknown subcommand '%s'. Try FUNCTION HELP.", args[0].bulk),
+		}
+	}
+}
+
+// FUNCTION LOAD [REPLACE] function-code
+func functionLoad(args []token) token {
+	if len(args) != 1 && len(args) != 2 {
+		return wrongArgs("FUNCTION|LOAD")
+	}
+
+	replace := false
+	if len(args) == 2 {
+		if !strings.EqualFold(args[0].bulk, "REPLACE") {
+			return token{typ: string(ERROR), val: fmt.Sprintf("ERR Unknown option given: %s", args[0].bulk)}
+		}
+		replace = true
+	}
+
+	previous := maps.Clone(libraries)
+	lib, errTok := loadLibrary(libraries, args[len(args)-1].bulk, replace)
+	if errTok != nil {
+		return *errTok
+	}
+	closeDropped(previous, libraries)
+
+	return token{typ: string(BULK), bulk: lib.name}
+}
+
+// FUNCTION DELETE library-name
+func functionDelete(args []token) token {
+	if len(args) != 1 {
+		return wrongArgs("FUNCTION|DELETE")
+	}
+
+	lib, ok := libraries[args[0].bulk]
+	if !ok {
+		return token{typ: string(ERROR), val: "ERR Library not found"}
+	}
+
+	delete(libraries, args[0].bulk)
+	lib.state.Close()
+
+	return token{typ: string(STRING), val: "OK"}
+}
+
+// FUNCTION FLUSH [ASYNC|SYNC]
+func functionFlush(args []token) token {
+	if len(args) > 1 {
+		return wrongArgs("FUNCTION|FLUSH")
+	}
+
+	if len(args) == 1 {
+		mode := strings.ToUpper(args[0].bulk)
+		if mode != "ASYNC" && mode != "SYNC" {
+			return token{typ: string(ERROR), val: "ERR FUNCTION FLUSH only supports SYNC|ASYNC option"}
+		}
+	}
+
+	flushLibraries()
+
+	return token{typ: string(STRING), val: "OK"}
+}
+
+// FUNCTION LIST [LIBRARYNAME library-name-pattern] [WITHCODE]
+func functionList(args []token) token {
+	pattern, withCode := "", false
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i].bulk) {
+		case "WITHCODE":
+			withCode = true
+		case "LIBRARYNAME":
+			if i+1 >= len(args) {
+				return token{typ: string(ERROR), val: "ERR library name argument was not given"}
+			}
+			i++
+			pattern = args[i].bulk
+		default:
+			return token{typ: string(ERROR), val: fmt.Sprintf("ERR Unknown argument %s", args[i].bulk)}
+		}
+	}
+
+	list := []token{}
+	for _, name := range sortedLibraryNames() {
+		if pattern != "" && !globMatch(pattern, name) {
+			continue
+		}
+		lib := libraries[name]
+
+		functions := []token{}
+		for _, fn := range sortedFunctionNames(lib) {
+			f := lib.functions[fn]
+
+			description := token{typ: string(NULL)}
+			if f.description != "" {
+				description = token{typ: string(BULK), bulk: f.description}
+			}
+
+			flags := []string{}
+			for _, flag := range functionFlags {
+				if f.flags[flag] {
+					flags = append(flags, flag)
+				}
+			}
+
+			functions = append(functions, token{typ: string(ARRAY), array: []token{
+				{typ: string(BULK), bulk: "name"},
+				{typ: string(BULK), bulk: f.name},
+				{typ: string(BULK), bulk: "description"},
+				description,
+				{typ: string(BULK), bulk: "flags"},
+				bulkArray(flags),
+			}})
+		}
+
+		entry := []token{
+			{typ: string(BULK), bulk: "library_name"},
+			{typ: string(BULK), bulk: lib.name},
+			{typ: string(BULK), bulk: "engine"},
+			{typ: string(BULK), bulk: "LUA"},
+			{typ: string(BULK), bulk: "functions"},
+			{typ: string(ARRAY), array: functions},
+		}
+		if withCode {
+			entry = append(entry,
+				token{typ: string(BULK), bulk: "library_code"},
+				token{typ: string(BULK), bulk: lib.code},
+			)
+		}
+
+		list = append(list, token{typ: string(ARRAY), array: entry})
+	}
+
+	return token{typ: string(ARRAY), array: list}
+}
+
+// FUNCTION DUMP
+func functionDump(args []token) token {
+	if len(args) != 0 {
+		return wrongArgs("FUNCTION|DUMP")
+	}
+
+	// Like DUMP payloads, the libraries are followed by the RDB version
+	// and a checksum
+	payload := dumpLibraries()
+	payload = binary.LittleEndian.AppendUint16(payload, RDB_VERSION)
+	payload = binary.LittleEndian.AppendUint64(payload, rdbChecksum(payload))
+
+	return token{typ: string(BULK), bulk: string(payload)}
+}
+
+// FUNCTION RESTORE serialized-value [FLUSH|APPEND|REPLACE]
+func functionRestore(args []token) token {
+	if len(args) != 1 && len(args) != 2 {
+		return wrongArgs("FUNCTION|RESTORE")
+	}
+
+	policy := "APPEND"
+	if len(args) == 2 {
+		policy = strings.ToUpper(args[1].bulk)
+		if policy != "FLUSH" && policy != "APPEND" && policy != "REPLACE" {
+			return token{typ: string(ERROR), val: "ERR Wrong restore policy given, value should be either FLUSH, APPEND or REPLACE."}
+		}
+	}
+
+	payload := []byte(args[0].bulk)
+	if len(payload) < 10 ||
+		binary.LittleEndian.Uint16(payload[len(payload)-10:]) > RDB_VERSION ||
+		binary.LittleEndian.Uint64(payload[len(payload)-8:]) != rdbChecksum(payload[:len(payload)-8]) {
+		return token{typ: string(ERROR), val: "ERR payload version or checksum are wrong"}
+	}
+
+	r := rdb{reader: *bufio.NewReader(bytes.NewReader(payload[:len(payload)-10]))}
+	codes := []string{}
+	for {
+		opcode, err := r.reader.ReadByte()
+		if err == io.EOF {
+			break
+		}
+
+		if opcode != FUNCTION_OFFSET {
+			return token{typ: string(ERROR), val: "ERR given type is not a function"}
+		}
+
+		code, err := r.readString()
+		if err != nil {
+			return token{typ: string(ERROR), val: "ERR payload version or checksum are wrong"}
+		}
+		codes = append(codes, string(code))
+	}
+
+	// The libraries are only swapped once all of them loaded
+	libs := map[string]*library{}
+	if policy != "FLUSH" {
+		maps.Copy(libs, libraries)
+	}
+
+	for _, code := range codes {
+		if _, errTok := loadLibrary(libs, code, policy == "REPLACE"); errTok != nil {
+			// What loaded so far is dropped along with libs
+			closeDropped(libs, libraries)
+			return *errTok
+		}
+	}
+
+	closeDropped(libraries, libs)
+	libraries = libs
+
+	return token{typ: string(STRING), val: "OK"}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testLibrary = `#!lua name=fnlib
+local function incr(keys, args)
+  return redis.call('INCRBY', keys[1], args[1])
+end
+
+redis.register_function('fn_incr', incr)
+redis.register_function{
+  function_name = 'fn_get',
+  callback = function(keys) return redis.call('GET', keys[1]) end,
+  flags = {'no-writes'},
+  description = 'reads a key',
+}
+redis.register_function{
+  function_name = 'fn_sneaky',
+  callback = function(keys) return redis.call('SET', keys[1], 'x') end,
+  flags = {'no-writes'},
+}
+`
+
+func TestFunction(t *testing.T) {
+	ok := token{typ: string(STRING), val: "OK"}
+	run(t, "FUNCTION", "FLUSH")
+
+	steps := []struct {
+		args []string
+		want token
+	}{
+		{[]string{"FCALL", "fn_incr", "1", "fn:counter", "2"}, token{typ: string(ERROR), val: "ERR Function not found"}},
+		{[]string{"FUNCTION", "LOAD", testLibrary}, token{typ: string(BULK), bulk: "fnlib"}},
+		{[]string{"FUNCTION", "LOAD", testLibrary}, token{typ: string(ERROR), val: "ERR Library 'fnlib' already exists"}},
+		{[]string{"FUNCTION", "LOAD", "REPLACE", testLibrary}, token{typ: string(BULK), bulk: "fnlib"}},
+		{[]string{"FCALL", "fn_incr", "1", "fn:counter", "2"}, intToken(2)},
+		{[]string{"FCALL", "fn_get", "1", "fn:counter"}, token{typ: string(BULK), bulk: "2"}},
+		{[]string{"FCALL_RO", "fn_get", "1", "fn:counter"}, token{typ: string(BULK), bulk: "2"}},
+		{
+			[]string{"FCALL_RO", "fn_incr", "1", "fn:counter", "2"},
+			token{typ: string(ERROR), val: "ERR Can not execute a script with write flag using *_ro command."},
+		},
+		{
+			[]string{"FCALL", "fn_sneaky", "1", "fn:counter"},
+			token{typ: string(ERROR), val: "ERR Write commands are not allowed from read-only scripts."},
+		},
+		{
+			[]string{"FUNCTION", "LOAD", "#!lua name=other\nredis.register_function('fn_incr', function() end)"},
+			token{typ: string(ERROR), val: "ERR Function fn_incr already exists"},
+		},
+		{[]string{"FUNCTION", "LOAD", "return 1"}, token{typ: string(ERROR), val: "ERR Missing library metadata"}},
+		{[]string{"FUNCTION", "LOAD", "#!js name=x\n"}, token{typ: string(ERROR), val: "ERR Engine 'js' not found"}},
+		{[]string{"FUNCTION", "LOAD", "#!lua\n"}, token{typ: string(ERROR), val: "ERR Library name was not given"}},
+		{[]string{"FUNCTION", "LOAD", "#!lua name=empty\nlocal x = 1"}, token{typ: string(ERROR), val: "ERR No functions registered"}},
+		{
+			[]string{"FUNCTION", "LOAD", "#!lua name=eager\nredis.call('SET', 'fn:eager', '1')"},
+			token{typ: string(ERROR), val: "ERR redis.call can only be called inside a script invocation"},
+		},
+		{[]string{"EXISTS", "fn:eager"}, intToken(0)},
+		{[]string{"FUNCTION", "DELETE", "nosuch"}, token{typ: string(ERROR), val: "ERR Library not found"}},
+		{[]string{"FUNCTION", "DELETE", "fnlib"}, ok},
+		{[]string{"FCALL", "fn_get", "1", "fn:counter"}, token{typ: string(ERROR), val: "ERR Function not found"}},
+	}
+
+	for _, step := range steps {
+		if got := run(t, step.args...); !reflect.DeepEqual(got, step.want) {
+			t.Errorf("Failed %v. wanted %v, got %v", step.args, step.want, got)
+		}
+	}
+}
+
+func TestFunctionList(t *testing.T) {
+	run(t, "FUNCTION", "FLUSH")
+	run(t, "FUNCTION", "LOAD", testLibrary)
+	run(t, "FUNCTION", "LOAD", "#!lua name=otherlib\nredis.register_function('fn_other', function() return 1 end)")
+
+	fn := func(name string, description token, flags ...string) token {
+		return token{typ: string(ARRAY), array: []token{
+			{typ: string(BULK), bulk: "name"},
+			{typ: string(BULK), bulk: name},
+			{typ: string(BULK), bulk: "description"},
+			description,
+			{typ: string(BULK), bulk: "flags"},
+			bulkArray(flags),
+		}}
+	}
+
+	want := token{typ: string(ARRAY), array: []token{
+		{typ: string(ARRAY), array: []token{
+			{typ: string(BULK), bulk: "library_name"},
+			{typ: string(BULK), bulk: "fnlib"},
+			{typ: string(BULK), bulk: "engine"},
+			{typ: string(BULK), bulk: "LUA"},
+			{typ: string(BULK), bulk: "functions"},
+			{typ: string(ARRAY), array: []token{
+				fn("fn_get", token{typ: string(BULK), bulk: "reads a key"}, "no-writes"),
+				fn("fn_incr", token{typ: string(NULL)}),
+				fn("fn_sneaky", token{typ: string(NULL)}, "no-writes"),
+			}},
+			{typ: string(BULK), bulk: "library_code"},
+			{typ: string(BULK), bulk: testLibrary},
+		}},
+	}}
+
+	if got := run(t, "FUNCTION", "LIST", "LIBRARYNAME", "fn*", "WITHCODE"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Failed list. wanted %v, got %v", want, got)
+	}
+
+	if got := run(t, "FUNCTION", "LIST"); len(got.array) != 2 {
+		t.Errorf("Failed list. wanted 2 libraries, got %v", got)
+	}
+}
+
+func TestFunctionDumpRestore(t *testing.T) {
+	ok := token{typ: string(STRING), val: "OK"}
+	run(t, "FUNCTION", "FLUSH")
+	run(t, "FUNCTION", "LOAD", testLibrary)
+
+	payload := run(t, "FUNCTION", "DUMP").bulk
+	corrupt := payload[:len(payload)-1] + "x"
+
+	steps := []struct {
+		args []string
+		want token
+	}{
+		{[]string{"FUNCTION", "RESTORE", payload}, token{typ: string(ERROR), val: "ERR Library 'fnlib' already exists"}},
+		{[]string{"FUNCTION", "RESTORE", corrupt}, token{typ: string(ERROR), val: "ERR payload version or checksum are wrong"}},
+		{[]string{"FUNCTION", "RESTORE", payload, "REPLACE"}, ok},
+		{[]string{"FUNCTION", "FLUSH"}, ok},
+		{[]string{"FUNCTION", "RESTORE", payload}, ok},
+		{[]string{"FCALL", "fn_incr", "1", "fn:restored", "5"}, intToken(5)},
+	}
+
+	for _, step := range steps {
+		if got := run(t, step.args...); !reflect.DeepEqual(got, step.want) {
+			t.Errorf("Failed %v. wanted %v, got %v", step.args, step.want, got)
+		}
+	}
+
+	t.Run("rdb", func(t *testing.T) {
+		empty, _, _ := LoadRDB("")
+
+		mux.Lock()
+		defer mux.Unlock()
+
+		file := withLibraries(empty)
+		flushLibraries()
+
+		r := rdb{reader: *bufio.NewReader(bytes.NewReader(file))}
+		if err := r.ReadRDB(); err != nil {
+			t.Fatalf("Failed read. %v", err)
+		}
+
+		if _, ok := findFunction("fn_incr"); !ok {
+			t.Errorf("Failed rdb. wanted fn_incr to be loaded")
+		}
+	})
+
+	t.Run("full resyncs replace the libraries", func(t *testing.T) {
+		empty, _, _ := LoadRDB("")
+		mux.Lock()
+		file := withLibraries(empty)
+		before := libraries["fnlib"]
+		mux.Unlock()
+
+		for range 2 {
+			bulk := fmt.Sprintf("$%d\r\n%s", len(file), file)
+			if err := receiveRDBFile(bufio.NewReader(strings.NewReader(bulk))); err != nil {
+				t.Fatalf("Failed resync. %v", err)
+			}
+		}
+
+		mux.Lock()
+		defer mux.Unlock()
+		if lib := libraries["fnlib"]; lib == nil || lib.state.IsClosed() {
+			t.Errorf("Failed resync. wanted fnlib to be loaded")
+		}
+		if !before.state.IsClosed() {
+			t.Errorf("Failed resync. wanted the replaced library closed")
+		}
+	})
+
+	t.Run("dropped libraries are closed", func(t *testing.T) {
+		current := func() *library {
+			mux.Lock()
+			defer mux.Unlock()
+			return libraries["fnlib"]
+		}
+
+		steps := [][]string{
+			{"FUNCTION", "LOAD", "REPLACE", testLibrary},
+			{"FUNCTION", "RESTORE", payload, "REPLACE"},
+			{"FUNCTION", "RESTORE", payload, "FLUSH"},
+			{"FUNCTION", "DELETE", "fnlib"},
+		}
+
+		for _, step := range steps {
+			lib := current()
+			if lib == nil {
+				run(t, "FUNCTION", "LOAD", testLibrary)
+				lib = current()
+			}
+
+			run(t, step...)
+			if !lib.state.IsClosed() {
+				t.Errorf("Failed %v. wanted the dropped library closed", step)
+			}
+		}
+	})
+}
+
+func TestRdbChecksum(t *testing.T) {
+	if got, want := rdbChecksum([]byte("123456789")), uint64(0xe9c6d914c4b8d9ca); got != want {
+		t.Errorf("Failed checksum. wanted %x, got %x", want, got)
+	}
+
+	// The empty RDB sent to replicas ends with the checksum of the rest
+	file, l, _ := LoadRDB("")
+	if got, want := rdbChecksum(file[:l-8]), (uint64(0xa25affc0fe3b6ef0)); got != want {
+		t.Errorf("Failed checksum. wanted %x, got %x", want, got)
+	}
+}
@@ -0,0 +1,851 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Geo members live in sorted sets, scored by a 52 bit geohash that
+// interleaves 26 bits of latitude with 26 bits of longitude. Everything
+// below follows geo.c and geohash.c of Redis closely, searches included,
+// so that scores, distances and result order match it exactly.
+
+const (
+	geoStepMax = 26
+	geoLatMin  = -85.05112878
+	geoLatMax  = 85.05112878
+	geoLongMin = -180.0
+	geoLongMax = 180.0
+
+	earthRadiusInMeters = 6372797.560856
+	mercatorMax         = 20037726.37
+
+	geoAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+)
+
+// geoHash is a cell of a geohash grid, 2*step bits long
+type geoHash struct {
+	bits uint64
+	step uint
+}
+
+func (h geoHash) isZero() bool {
+	return h.bits == 0 && h.step == 0
+}
+
+// geoArea is the rectangle a geoHash covers
+type geoArea struct {
+	longMin, longMax float64
+	latMin, latMax   float64
+}
+
+// interleave64 spreads the bits of x over the even bits of the result
+// and the bits of y over the odd ones
+func interleave64(x, y uint32) uint64 {
+	var bits uint64
+	for i := 0; i < 32; i++ {
+		bits |= uint64(x>>i&1) << (2 * i)
+		bits |= uint64(y>>i&1) << (2*i + 1)
+	}
+
+	return bits
+}
+
+func deinterleave64(bits uint64) (x, y uint32) {
+	for i := 0; i < 32; i++ {
+		x |= uint32(bits>>(2*i)&1) << i
+		y |= uint32(bits>>(2*i+1)&1) << i
+	}
+
+	return x, y
+}
+
+// geohashEncode returns the cell of the given step holding the point,
+// within the given ranges of longitude and latitude
+func geohashEncode(longMin, longMax, latMin, latMax, longitude, latitude float64, step uint) (geoHash, bool) {
+	if longitude > geoLongMax || longitude < geoLongMin || latitude > geoLatMax || latitude < geoLatMin {
+		return geoHash{}, false
+	}
+	if latitude < latMin || latitude > latMax || longitude < longMin || longitude > longMax {
+		return geoHash{}, false
+	}
+
+	latOffset := (latitude - latMin) / (latMax - latMin) * float64(uint64(1)<<step)
+	longOffset := (longitude - longMin) / (longMax - longMin) * float64(uint64(1)<<step)
+
+	return geoHash{bits: interleave64(uint32(latOffset), uint32(longOffset)), step: step}, true
+}
+
+func geohashEncodeWGS84(longitude, latitude float64, step uint) (geoHash, bool) {
+	return geohashEncode(geoLongMin, geoLongMax, geoLatMin, geoLatMax, longitude, latitude, step)
+}
+
+func geohashDecodeWGS84(hash geoHash) geoArea {
+	ilat, ilong := deinterleave64(hash.bits)
+	cells := float64(uint64(1) << hash.step)
+	latScale := geoLatMax - geoLatMin
+	longScale := geoLongMax - geoLongMin
+
+	return geoArea{
+		latMin:  geoLatMin + float64(ilat)/cells*latScale,
+		latMax:  geoLatMin + float64(uint64(ilat)+1)/cells*latScale,
+		longMin: geoLongMin + float64(ilong)/cells*longScale,
+		longMax: geoLongMin + float64(uint64(ilong)+1)/cells*longScale,
+	}
+}
+
+// geoScoreToLongLat returns the center of the cell a score encodes
+func geoScoreToLongLat(score float64) (longitude, latitude float64) {
+	area := geohashDecodeWGS84(geoHash{bits: uint64(score), step: geoStepMax})
+
+	longitude = min(max((area.longMin+area.longMax)/2, geoLongMin), geoLongMax)
+	latitude = min(max((area.latMin+area.latMax)/2, geoLatMin), geoLatMax)
+
+	return longitude, latitude
+}
+
+// align52 turns a cell into the score of its first point
+func (h geoHash) align52() uint64 {
+	return h.bits << (52 - h.step*2)
+}
+
+// moveX moves the cell d steps east, or west when d is negative
+func (h *geoHash) moveX(d int) {
+	x := h.bits & 0xaaaaaaaaaaaaaaaa
+	y := h.bits & 0x5555555555555555
+	zz := uint64(0x5555555555555555) >> (64 - h.step*2)
+
+	if d > 0 {
+		x = x + (zz + 1)
+	} else {
+		x = x | zz
+		x = x - (zz + 1)
+	}
+
+	x &= 0xaaaaaaaaaaaaaaaa >> (64 - h.step*2)
+	h.bits = x | y
+}
+
+// moveY moves the cell d steps north, or south when d is negative
+func (h *geoHash) moveY(d int) {
+	x := h.bits & 0xaaaaaaaaaaaaaaaa
+	y := h.bits & 0x5555555555555555
+	zz := uint64(0xaaaaaaaaaaaaaaaa) >> (64 - h.step*2)
+
+	if d > 0 {
+		y = y + (zz + 1)
+	} else {
+		y = y | zz
+		y = y - (zz + 1)
+	}
+
+	y &= 0x5555555555555555 >> (64 - h.step*2)
+	h.bits = x | y
+}
+
+func (h geoHash) neighbor(dx, dy int) geoHash {
+	if dx != 0 {
+		h.moveX(dx)
+	}
+	if dy != 0 {
+		h.moveY(dy)
+	}
+
+	return h
+}
+
+func degToRad(deg float64) float64 {
+	return deg * (math.Pi / 180)
+}
+
+func radToDeg(rad float64) float64 {
+	return rad / (math.Pi / 180)
+}
+
+func geoLatDistance(lat1, lat2 float64) float64 {
+	return earthRadiusInMeters * math.Abs(degToRad(lat2)-degToRad(lat1))
+}
+
+// geoDistance is the haversine distance between two points in meters
+func geoDistance(long1, lat1, long2, lat2 float64) float64 {
+	lat1r := degToRad(lat1)
+	lat2r := degToRad(lat2)
+
+	v := math.Sin((degToRad(long2) - degToRad(long1)) / 2)
+	if v == 0 {
+		// Same meridian, the cheaper formula is exact
+		return geoLatDistance(lat1, lat2)
+	}
+
+	u := math.Sin((lat2r - lat1r) / 2)
+	a := u*u + math.Cos(lat1r)*math.Cos(lat2r)*v*v
+
+	return 2 * earthRadiusInMeters * math.Asin(math.Sqrt(a))
+}
+
+// parseLongLat reads a longitude, latitude pair
+func parseLongLat(longArg, latArg string) (longitude, latitude float64, errTok *token) {
+	longitude, err := strconv.ParseFloat(longArg, 64)
+	if err != nil || math.IsNaN(longitude) {
+		return 0, 0, &errNotFloat
+	}
+	latitude, err = strconv.ParseFloat(latArg, 64)
+	if err != nil || math.IsNaN(latitude) {
+		return 0, 0, &errNotFloat
+	}
+
+	if longitude < geoLongMin || longitude > geoLongMax || latitude < geoLatMin || latitude > geoLatMax {
+		return 0, 0, &token{
+			typ: string(ERROR),
+			val: fmt.Sprintf("ERR invalid longitude,latitude pair %f,%f", longitude, latitude),
+		}
+	}
+
+	return longitude, latitude, nil
+}
+
+// parseGeoUnit returns how many meters one unit is
+func parseGeoUnit(arg string) (float64, bool) {
+	switch strings.ToLower(arg) {
+	case "m":
+		return 1, true
+	case "km":
+		return 1000, true
+	case "ft":
+		return 0.3048, true
+	case "mi":
+		return 1609.34, true
+	}
+
+	return 0, false
+}
+
+var errGeoUnit = token{typ: string(ERROR), val: "ERR unsupported unit provided. please use M, KM, FT, MI"}
+
+// geoDistanceToken replies with a distance the way Redis does
+func geoDistanceToken(distance float64) token {
+	return token{typ: string(BULK), bulk: strconv.FormatFloat(distance, 'f', 4, 64)}
+}
+
+// geoCoordToken replies with a coordinate like Redis prints long
+// doubles, with 17 decimals minus the trailing zeros
+func geoCoordToken(coord float64) token {
+	formatted := strconv.FormatFloat(coord, 'f', 17, 64)
+	formatted = strings.TrimRight(formatted, "0")
+	formatted = strings.TrimSuffix(formatted, ".")
+
+	return token{typ: string(BULK), bulk: formatted}
+}
+
+// GEOADD key [NX|XX] [CH] longitude latitude member [longitude latitude member ...]
+func geoadd(args []token) token {
+	if len(args) < 4 {
+		return wrongArgs("GEOADD")
+	}
+
+	var nx, xx bool
+	zaddArgs := []token{args[0]}
+
+	i := 1
+flags:
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(args[i].bulk) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "CH":
+		default:
+			break flags
+		}
+		zaddArgs = append(zaddArgs, args[i])
+	}
+
+	triples := args[i:]
+	if len(triples) == 0 || len(triples)%3 != 0 {
+		return errSyntax
+	}
+	if nx && xx {
+		return token{typ: string(ERROR), val: "ERR XX and NX options at the same time are not compatible"}
+	}
+
+	// The rest is a ZADD with the geohashes as scores
+	for j := 0; j < len(triples); j += 3 {
+		longitude, latitude, errTok := parseLongLat(triples[j].bulk, triples[j+1].bulk)
+		if errTok != nil {
+			return *errTok
+		}
+
+		hash, _ := geohashEncodeWGS84(longitude, latitude, geoStepMax)
+		score := strconv.FormatUint(hash.align52(), 10)
+
+		zaddArgs = append(zaddArgs,
+			token{typ: string(BULK), bulk: score},
+			triples[j+2],
+		)
+	}
+
+	return zadd(zaddArgs)
+}
+
+// GEODIST key member1 member2 [M|KM|FT|MI]
+func geodist(args []token) token {
+	if len(args) != 3 && len(args) != 4 {
+		return wrongArgs("GEODIST")
+	}
+
+	conversion := 1.0
+	if len(args) == 4 {
+		var ok bool
+		if conversion, ok = parseGeoUnit(args[3].bulk); !ok {
+			return errGeoUnit
+		}
+	}
+
+	zs, ok := lookupZset(args[0].bulk)
+	if !ok {
+		return errWrongType
+	}
+	if zs == nil {
+		return token{typ: string(NULL)}
+	}
+
+	score1, exists1 := zs.dict[args[1].bulk]
+	score2, exists2 := zs.dict[args[2].bulk]
+	if !exists1 || !exists2 {
+		return token{typ: string(NULL)}
+	}
+
+	long1, lat1 := geoScoreToLongLat(score1)
+	long2, lat2 := geoScoreToLongLat(score2)
+
+	return geoDistanceToken(geoDistance(long1, lat1, long2, lat2) / conversion)
+}
+
+// GEOPOS key [member ...]
+func geopos(args []token) token {
+	if len(args) < 1 {
+		return wrongArgs("GEOPOS")
+	}
+
+	zs, ok := lookupZset(args[0].bulk)
+	if !ok {
+		return errWrongType
+	}
+
+	positions := make([]token, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		var score float64
+		exists := false
+		if zs != nil {
+			score, exists = zs.dict[arg.bulk]
+		}
+		if !exists {
+			positions = append(positions, token{typ: string(NULLARRAY)})
+			continue
+		}
+
+		longitude, latitude := geoScoreToLongLat(score)
+		positions = append(positions, token{
+			typ:   string(ARRAY),
+			array: []token{geoCoordToken(longitude), geoCoordToken(latitude)},
+		})
+	}
+
+	return token{typ: string(ARRAY), array: positions}
+}
+
+// GEOHASH key [member ...]
+func geohash(args []token) token {
+	if len(args) < 1 {
+		return wrongArgs("GEOHASH")
+	}
+
+	zs, ok := lookupZset(args[0].bulk)
+	if !ok {
+		return errWrongType
+	}
+
+	hashes := make([]token, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		var score float64
+		exists := false
+		if zs != nil {
+			score, exists = zs.dict[arg.bulk]
+		}
+		if !exists {
+			hashes = append(hashes, token{typ: string(NULL)})
+			continue
+		}
+
+		// Standard geohashes span the whole latitude range, unlike the
+		// scores which stop where the Mercator projection does
+		longitude, latitude := geoScoreToLongLat(score)
+		hash, _ := geohashEncode(-180, 180, -90, 90, longitude, latitude, geoStepMax)
+
+		buf := make([]byte, 11)
+		for i := range buf {
+			idx := 0
+			if i < 10 {
+				idx = int(hash.bits>>(52-(i+1)*5)) & 0x1f
+			}
+			buf[i] = geoAlphabet[idx]
+		}
+
+		hashes = append(hashes, token{typ: string(BULK), bulk: string(buf)})
+	}
+
+	return token{typ: string(ARRAY), array: hashes}
+}
+
+// geoShape is the area a search covers: a circle of radius around the
+// center, or a width by height box centered on it, in units
+type geoShape struct {
+	longitude, latitude float64
+	box                 bool
+	radius              float64
+	width, height       float64
+	conversion          float64
+}
+
+// geoPoint is a search result, dist is in meters
+type geoPoint struct {
+	member              string
+	score               float64
+	longitude, latitude float64
+	dist                float64
+}
+
+// estimateSteps picks the coarsest grid whose cells are about as large
+// as the searched radius
+func estimateSteps(rangeMeters, latitude float64) uint {
+	if rangeMeters == 0 {
+		return geoStepMax
+	}
+
+	step := 1
+	for rangeMeters < mercatorMax {
+		rangeMeters *= 2
+		step++
+	}
+	step -= 2
+
+	// Meridians get closer towards the poles
+	if latitude > 66 || latitude < -66 {
+		step--
+		if latitude > 80 || latitude < -80 {
+			step--
+		}
+	}
+
+	return uint(min(max(step, 1), geoStepMax))
+}
+
+// boundingBox returns the longitude and latitude bounds of the shape
+func (s geoShape) boundingBox() (minLong, minLat, maxLong, maxLat float64) {
+	height := s.conversion * s.radius
+	width := s.conversion * s.radius
+	if s.box {
+		height = s.conversion * s.height / 2
+		width = s.conversion * s.width / 2
+	}
+
+	latDelta := radToDeg(height / earthRadiusInMeters)
+	longDeltaTop := radToDeg(width / earthRadiusInMeters / math.Cos(degToRad(s.latitude+latDelta)))
+	longDeltaBottom := radToDeg(width / earthRadiusInMeters / math.Cos(degToRad(s.latitude-latDelta)))
+
+	// The hemispheres widen in opposite directions
+	longDelta := longDeltaTop
+	if s.latitude < 0 {
+		longDelta = longDeltaBottom
+	}
+
+	return s.longitude - longDelta, s.latitude - latDelta, s.longitude + longDelta, s.latitude + latDelta
+}
+
+// searchCells returns the cell holding the center of the shape followed
+// by its neighbors, in the order Redis visits them. Neighbors that can't
+// overlap the shape are zero.
+func (s geoShape) searchCells() []geoHash {
+	minLong, minLat, maxLong, maxLat := s.boundingBox()
+
+	radiusMeters := s.radius
+	if s.box {
+		radiusMeters = math.Sqrt((s.width/2)*(s.width/2) + (s.height/2)*(s.height/2))
+	}
+	radiusMeters *= s.conversion
+
+	steps := estimateSteps(radiusMeters, s.latitude)
+	hash, _ := geohashEncodeWGS84(s.longitude, s.latitude, steps)
+
+	// Step back once more when a neighbor doesn't reach the bounds
+	north := geohashDecodeWGS84(hash.neighbor(0, 1))
+	south := geohashDecodeWGS84(hash.neighbor(0, -1))
+	east := geohashDecodeWGS84(hash.neighbor(1, 0))
+	west := geohashDecodeWGS84(hash.neighbor(-1, 0))
+	if steps > 1 && (north.latMax < maxLat || south.latMin > minLat || east.longMax < maxLong || west.longMin > minLong) {
+		steps--
+		hash, _ = geohashEncodeWGS84(s.longitude, s.latitude, steps)
+	}
+
+	cells := []geoHash{
+		hash,
+		hash.neighbor(0, 1),   // north
+		hash.neighbor(0, -1),  // south
+		hash.neighbor(1, 0),   // east
+		hash.neighbor(-1, 0),  // west
+		hash.neighbor(1, 1),   // north east
+		hash.neighbor(-1, 1),  // north west
+		hash.neighbor(1, -1),  // south east
+		hash.neighbor(-1, -1), // south west
+	}
+
+	if steps >= 2 {
+		area := geohashDecodeWGS84(hash)
+		zero := func(indexes ...int) {
+			for _, i := range indexes {
+				cells[i] = geoHash{}
+			}
+		}
+
+		if area.latMin < minLat {
+			zero(2, 7, 8)
+		}
+		if area.latMax > maxLat {
+			zero(1, 5, 6)
+		}
+		if area.longMin < minLong {
+			zero(4, 8, 6)
+		}
+		if area.longMax > maxLong {
+			zero(3, 7, 5)
+		}
+	}
+
+	return cells
+}
+
+// contains reports whether the point is inside the shape and its
+// distance from the center in meters
+func (s geoShape) contains(longitude, latitude float64) (float64, bool) {
+	if !s.box {
+		distance := geoDistance(s.longitude, s.latitude, longitude, latitude)
+		return distance, distance <= s.radius*s.conversion
+	}
+
+	// Latitude first, it is cheaper
+	if geoLatDistance(latitude, s.latitude) > s.height*s.conversion/2 {
+		return 0, false
+	}
+	if geoDistance(longitude, latitude, s.longitude, latitude) > s.width*s.conversion/2 {
+		return 0, false
+	}
+
+	return geoDistance(s.longitude, s.latitude, longitude, latitude), true
+}
+
+// search returns the members of zs inside the shape. A nonzero limit
+// stops the search once that many were found.
+func (s geoShape) search(zs *zset, limit int) []geoPoint {
+	points := []geoPoint{}
+	cells := s.searchCells()
+
+	last := -1
+	for i, cell := range cells {
+		if cell.isZero() {
+			continue
+		}
+
+		// Huge radiuses can make neighbors the same cell
+		if last >= 0 && cell == cells[last] {
+			continue
+		}
+		if limit > 0 && len(points) >= limit {
+			break
+		}
+
+		next := cell
+		next.bits++
+		r := scoreRange{min: float64(cell.align52()), max: float64(next.align52()), maxex: true}
+
+		for node := zs.zsl.firstInRange(r); node != nil && r.lteMax(node.score); node = node.level[0].forward {
+			if limit > 0 && len(points) >= limit {
+				break
+			}
+
+			longitude, latitude := geoScoreToLongLat(node.score)
+			if distance, ok := s.contains(longitude, latitude); ok {
+				points = append(points, geoPoint{
+					member:    node.member,
+					score:     node.score,
+					longitude: longitude,
+					latitude:  latitude,
+					dist:      distance,
+				})
+			}
+		}
+		last = i
+	}
+
+	return points
+}
+
+// geoSearchOptions are the parsed arguments of GEOSEARCH and
+// GEOSEARCHSTORE
+type geoSearchOptions struct {
+	fromMember, fromLongLat bool
+	member                  string
+	shape                   geoShape
+	byRadius, byBox         bool
+
+	sort      int // 1 for ASC, -1 for DESC
+	count     int
+	any       bool
+	withCoord bool
+	withDist  bool
+	withHash  bool
+	storeDist bool
+}
+
+func parseGeoSearchOptions(command string, args []token) (geoSearchOptions, *token) {
+	var opts geoSearchOptions
+	store := command == "GEOSEARCHSTORE"
+	name := strings.ToLower(command)
+
+	for i := 0; i < len(args); i++ {
+		remaining := len(args) - i - 1
+
+		switch opt := strings.ToUpper(args[i].bulk); {
+		case opt == "WITHCOORD":
+			opts.withCoord = true
+		case opt == "WITHDIST":
+			opts.withDist = true
+		case opt == "WITHHASH":
+			opts.withHash = true
+		case opt == "ANY":
+			opts.any = true
+		case opt == "ASC":
+			opts.sort = 1
+		case opt == "DESC":
+			opts.sort = -1
+		case opt == "STOREDIST" && store:
+			opts.storeDist = true
+		case opt == "COUNT" && remaining >= 1:
+			n, err := strconv.Atoi(args[i+1].bulk)
+			if err != nil {
+				return opts, &errNotInteger
+			}
+			if n <= 0 {
+				return opts, &token{typ: string(ERROR), val: "ERR COUNT must be > 0"}
+			}
+			opts.count = n
+			i++
+		case opt == "FROMMEMBER" && remaining >= 1:
+			if opts.fromLongLat {
+				return opts, &token{typ: string(ERROR), val: "ERR exactly one of FROMMEMBER or FROMLONLAT can be specified for " + name}
+			}
+			opts.fromMember = true
+			opts.member = args[i+1].bulk
+			i++
+		case opt == "FROMLONLAT" && remaining >= 2:
+			if opts.fromMember {
+				return opts, &token{typ: string(ERROR), val: "ERR exactly one of FROMMEMBER or FROMLONLAT can be specified for " + name}
+			}
+			longitude, latitude, errTok := parseLongLat(args[i+1].bulk, args[i+2].bulk)
+			if errTok != nil {
+				return opts, errTok
+			}
+			opts.fromLongLat = true
+			opts.shape.longitude, opts.shape.latitude = longitude, latitude
+			i += 2
+		case opt == "BYRADIUS" && remaining >= 2:
+			if opts.byBox {
+				return opts, &token{typ: string(ERROR), val: "ERR exactly one of BYRADIUS and BYBOX can be specified for " + name}
+			}
+			radius, err := strconv.ParseFloat(args[i+1].bulk, 64)
+			if err != nil || math.IsNaN(radius) {
+				return opts, &token{typ: string(ERROR), val: "ERR need numeric radius"}
+			}
+			if radius < 0 {
+				return opts, &token{typ: string(ERROR), val: "ERR radius cannot be negative"}
+			}
+			conversion, ok := parseGeoUnit(args[i+2].bulk)
+			if !ok {
+				return opts, &errGeoUnit
+			}
+			opts.byRadius = true
+			opts.shape.radius, opts.shape.conversion = radius, conversion
+			i += 2
+		case opt == "BYBOX" && remaining >= 3:
+			if opts.byRadius {
+				return opts, &token{typ: string(ERROR), val: "ERR exactly one of BYRADIUS and BYBOX can be specified for " + name}
+			}
+			width, err1 := strconv.ParseFloat(args[i+1].bulk, 64)
+			height, err2 := strconv.ParseFloat(args[i+2].bulk, 64)
+			if err1 != nil || err2 != nil || math.IsNaN(width) || math.IsNaN(height) {
+				return opts, &errNotFloat
+			}
+			if width < 0 || height < 0 {
+				return opts, &token{typ: string(ERROR), val: "ERR height or width cannot be negative"}
+			}
+			conversion, ok := parseGeoUnit(args[i+3].bulk)
+			if !ok {
+				return opts, &errGeoUnit
+			}
+			opts.byBox = true
+			opts.shape.box = true
+			opts.shape.width, opts.shape.height, opts.shape.conversion = width, height, conversion
+			i += 3
+		default:
+			return opts, &errSyntax
+		}
+	}
+
+	if store && (opts.withDist || opts.withHash || opts.withCoord) {
+		return opts, &token{typ: string(ERROR), val: "ERR GEOSEARCHSTORE is not compatible with WITHDIST, WITHHASH and WITHCOORD options"}
+	}
+	if !opts.fromMember && !opts.fromLongLat {
+		return opts, &token{typ: string(ERROR), val: "ERR exactly one of FROMMEMBER or FROMLONLAT can be specified for " + name}
+	}
+	if !opts.byRadius && !opts.byBox {
+		return opts, &token{typ: string(ERROR), val: "ERR exactly one of BYRADIUS and BYBOX can be specified for " + name}
+	}
+	if opts.any && opts.count == 0 {
+		return opts, &token{typ: string(ERROR), val: "ERR the ANY argument requires COUNT argument"}
+	}
+
+	return opts, nil
+}
+
+// geoSearchGeneric runs the search on the sorted set at key. A nil result
+// with a nil error means the key doesn't exist. Callers must hold mux.
+func geoSearchGeneric(key string, opts geoSearchOptions) ([]geoPoint, *token) {
+	zs, ok := lookupZset(key)
+	if !ok {
+		return nil, &errWrongType
+	}
+	if zs == nil {
+		return nil, nil
+	}
+
+	shape := opts.shape
+	if opts.fromMember {
+		score, exists := zs.dict[opts.member]
+		if !exists {
+			return nil, &token{typ: string(ERROR), val: "ERR could not decode requested zset member"}
+		}
+		shape.longitude, shape.latitude = geoScoreToLongLat(score)
+	}
+
+	limit := 0
+	if opts.any {
+		limit = opts.count
+	}
+	points := shape.search(zs, limit)
+
+	// COUNT without ANY wants the closest ones
+	order := opts.sort
+	if order == 0 && opts.count > 0 && !opts.any {
+		order = 1
+	}
+	switch order {
+	case 1:
+		sort.SliceStable(points, func(i, j int) bool { return points[i].dist < points[j].dist })
+	case -1:
+		sort.SliceStable(points, func(i, j int) bool { return points[i].dist > points[j].dist })
+	}
+
+	if opts.count > 0 && len(points) > opts.count {
+		points = points[:opts.count]
+	}
+
+	return points, nil
+}
+
+// GEOSEARCH key FROMMEMBER member|FROMLONLAT longitude latitude BYRADIUS radius M|KM|FT|MI|BYBOX width height M|KM|FT|MI [ASC|DESC] [COUNT count [ANY]] [WITHCOORD] [WITHDIST] [WITHHASH]
+func geosearch(args []token) token {
+	if len(args) < 1 {
+		return wrongArgs("GEOSEARCH")
+	}
+
+	opts, errTok := parseGeoSearchOptions("GEOSEARCH", args[1:])
+	if errTok != nil {
+		return *errTok
+	}
+
+	points, errTok := geoSearchGeneric(args[0].bulk, opts)
+	if errTok != nil {
+		return *errTok
+	}
+
+	conversion := opts.shape.conversion
+	results := make([]token, 0, len(points))
+	for _, p := range points {
+		member := token{typ: string(BULK), bulk: p.member}
+		if !opts.withDist && !opts.withHash && !opts.withCoord {
+			results = append(results, member)
+			continue
+		}
+
+		item := []token{member}
+		if opts.withDist {
+			item = append(item, geoDistanceToken(p.dist/conversion))
+		}
+		if opts.withHash {
+			item = append(item, token{typ: string(INTEGER), val: strconv.FormatUint(uint64(p.score), 10)})
+		}
+		if opts.withCoord {
+			item = append(item, token{
+				typ:   string(ARRAY),
+				array: []token{geoCoordToken(p.longitude), geoCoordToken(p.latitude)},
+			})
+		}
+
+		results = append(results, token{typ: string(ARRAY), array: item})
+	}
+
+	return token{typ: string(ARRAY), array: results}
+}
+
+// GEOSEARCHSTORE destination source FROMMEMBER member|FROMLONLAT longitude latitude BYRADIUS radius M|KM|FT|MI|BYBOX width height M|KM|FT|MI [ASC|DESC] [COUNT count [ANY]] [STOREDIST]
+func geosearchstore(args []token) token {
+	if len(args) < 2 {
+		return wrongArgs("GEOSEARCHSTORE")
+	}
+
+	opts, errTok := parseGeoSearchOptions("GEOSEARCHSTORE", args[2:])
+	if errTok != nil {
+		return *errTok
+	}
+
+	points, errTok := geoSearchGeneric(args[1].bulk, opts)
+	if errTok != nil {
+		return *errTok
+	}
+
+	// Scores are either the geohashes or the distances in units
+	zs := newZset()
+	for _, p := range points {
+		score := p.score
+		if opts.storeDist {
+			score = p.dist / opts.shape.conversion
+		}
+		zs.add(p.member, score)
+	}
+
+	dst := args[0].bulk
+	_, existed := lookupKey(dst)
+	storeZset(dst, zs)
+
+	switch {
+	case zs.len() > 0:
+		notifyKeyspaceEvent(notifyZset, "geosearchstore", dst)
+	case existed:
+		notifyKeyspaceEvent(notifyGeneric, "del", dst)
+	}
+
+	return intToken(zs.len())
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// The expected replies below are the ones Redis gives for the examples
+// in its documentation
+func TestGeo(t *testing.T) {
+	run(t, "GEOADD", "geo:sicily", "13.361389", "38.115556", "Palermo", "15.087269", "37.502669", "Catania")
+
+	bulk := func(s string) token { return token{typ: string(BULK), bulk: s} }
+	coords := func(longitude, latitude string) token {
+		return token{typ: string(ARRAY), array: []token{bulk(longitude), bulk(latitude)}}
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		want token
+	}{
+		{"geoadd updates", []string{"GEOADD", "geo:sicily", "CH", "13.361389", "38.115556", "Palermo"}, intToken(0)},
+		{"geodist", []string{"GEODIST", "geo:sicily", "Palermo", "Catania"}, bulk("166274.1516")},
+		{"geodist km", []string{"GEODIST", "geo:sicily", "Palermo", "Catania", "km"}, bulk("166.2742")},
+		{"geodist mi", []string{"GEODIST", "geo:sicily", "Palermo", "Catania", "MI"}, bulk("103.3182")},
+		{"geodist missing member", []string{"GEODIST", "geo:sicily", "Palermo", "Rome"}, token{typ: string(NULL)}},
+		{"geodist bad unit", []string{"GEODIST", "geo:sicily", "Palermo", "Catania", "yd"}, errGeoUnit},
+		{"geopos", []string{"GEOPOS", "geo:sicily", "Palermo", "Catania", "Rome"}, token{typ: string(ARRAY), array: []token{
+			coords("13.36138933897018433", "38.11555639549629859"),
+			coords("15.08726745843887329", "37.50266842333162032"),
+			{typ: string(NULLARRAY)},
+		}}},
+		{"geohash", []string{"GEOHASH", "geo:sicily", "Palermo", "Catania", "Rome"}, token{typ: string(ARRAY), array: []token{
+			bulk("sqc8b49rny0"), bulk("sqdtr74hyu0"), {typ: string(NULL)},
+		}}},
+		{"invalid pair", []string{"GEOADD", "geo:sicily", "200", "100", "Nowhere"}, token{typ: string(ERROR), val: "ERR invalid longitude,latitude pair 200.000000,100.000000"}},
+		{"incomplete triple", []string{"GEOADD", "geo:sicily", "13", "38", "Rome", "14"}, errSyntax},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := run(t, tt.args...); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Failed %s. wanted %v, got %v", tt.args[0], tt.want, got)
+			}
+		})
+	}
+}
+
+func TestGeoSearch(t *testing.T) {
+	run(t, "GEOADD", "geos:sicily", "13.361389", "38.115556", "Palermo", "15.087269", "37.502669", "Catania")
+	run(t, "GEOADD", "geos:sicily", "12.758489", "38.788135", "edge1", "17.241510", "38.788135", "edge2")
+
+	bulk := func(s string) token { return token{typ: string(BULK), bulk: s} }
+	item := func(member, dist, longitude, latitude string) token {
+		return token{typ: string(ARRAY), array: []token{
+			bulk(member),
+			bulk(dist),
+			{typ: string(ARRAY), array: []token{bulk(longitude), bulk(latitude)}},
+		}}
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		want token
+	}{
+		{"by radius", []string{"GEOSEARCH", "geos:sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km", "ASC"}, bulkArray([]string{"Catania", "Palermo"})},
+		{"by box", []string{"GEOSEARCH", "geos:sicily", "FROMLONLAT", "15", "37", "BYBOX", "400", "400", "km", "ASC", "WITHCOORD", "WITHDIST"}, token{typ: string(ARRAY), array: []token{
+			item("Catania", "56.4413", "15.08726745843887329", "37.50266842333162032"),
+			item("Palermo", "190.4424", "13.36138933897018433", "38.11555639549629859"),
+			item("edge2", "279.7403", "17.24151045083999634", "38.78813451624225195"),
+			item("edge1", "279.7405", "12.7584877610206604", "38.78813451624225195"),
+		}}},
+		{"desc with count", []string{"GEOSEARCH", "geos:sicily", "FROMMEMBER", "Palermo", "BYRADIUS", "500", "km", "DESC", "COUNT", "2"}, bulkArray([]string{"edge2", "Catania"})},
+		{"count sorts ascending", []string{"GEOSEARCH", "geos:sicily", "FROMMEMBER", "Palermo", "BYRADIUS", "500", "km", "COUNT", "2"}, bulkArray([]string{"Palermo", "edge1"})},
+		{"withhash", []string{"GEOSEARCH", "geos:sicily", "FROMMEMBER", "Palermo", "BYRADIUS", "1", "m", "WITHHASH"}, token{typ: string(ARRAY), array: []token{
+			{typ: string(ARRAY), array: []token{bulk("Palermo"), {typ: string(INTEGER), val: "3479099956230698"}}},
+		}}},
+		{"missing key", []string{"GEOSEARCH", "geos:none", "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km"}, token{typ: string(ARRAY), array: []token{}}},
+		{"missing member", []string{"GEOSEARCH", "geos:sicily", "FROMMEMBER", "Rome", "BYRADIUS", "200", "km"}, token{typ: string(ERROR), val: "ERR could not decode requested zset member"}},
+		{"any needs count", []string{"GEOSEARCH", "geos:sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km", "ANY"}, token{typ: string(ERROR), val: "ERR the ANY argument requires COUNT argument"}},
+		{"needs a center", []string{"GEOSEARCH", "geos:sicily", "BYRADIUS", "200", "km"}, token{typ: string(ERROR), val: "ERR exactly one of FROMMEMBER or FROMLONLAT can be specified for geosearch"}},
+		{"needs a shape", []string{"GEOSEARCH", "geos:sicily", "FROMLONLAT", "15", "37"}, token{typ: string(ERROR), val: "ERR exactly one of BYRADIUS and BYBOX can be specified for geosearch"}},
+		{"store", []string{"GEOSEARCHSTORE", "geos:dst", "geos:sicily", "FROMLONLAT", "15", "37", "BYBOX", "400", "400", "km", "ASC", "COUNT", "3"}, intToken(3)},
+		{"stored geohashes", []string{"ZRANGE", "geos:dst", "0", "-1"}, bulkArray([]string{"Palermo", "Catania", "edge2"})},
+		{"store distances", []string{"GEOSEARCHSTORE", "geos:dst", "geos:sicily", "FROMLONLAT", "15", "37", "BYBOX", "400", "400", "km", "ASC", "COUNT", "1", "STOREDIST"}, intToken(1)},
+		{"stored distance", []string{"ZSCORE", "geos:dst", "Catania"}, bulk("56.4412578701582")},
+		{"store rejects with options", []string{"GEOSEARCHSTORE", "geos:dst", "geos:sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km", "WITHDIST"}, token{typ: string(ERROR), val: "ERR GEOSEARCHSTORE is not compatible with WITHDIST, WITHHASH and WITHCOORD options"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := run(t, tt.args...); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Failed %s. wanted %v, got %v", tt.args[0], tt.want, got)
+			}
+		})
+	}
+
+	t.Run("any stops early", func(t *testing.T) {
+		got := run(t, "GEOSEARCH", "geos:sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "500", "km", "COUNT", "1", "ANY")
+		if len(got.array) != 1 {
+			t.Errorf("Failed geosearch. wanted one member, got %v", got)
+		}
+	})
+}
@@ -8,41 +8,230 @@ import (
 	"time"
 )
 
-var Handlers = map[string]func([]token) token{
-	"PING":     ping,
-	"ECHO":     echo,
-	"SET":      set,
-	"GET":      get,
-	"CONFIG":   config,
-	"KEYS":     keys,
-	"INFO":     info,
-	"REPLCONF": replconf,
-	"PSYNC":    psync,
-	"WAIT":     wait,
-	"TYPE":     typ,
-	"XADD":     xadd,
+// commandSpec is how a command runs: its handler and the number of
+// arguments it takes, counting the command name, as Redis defines it. A
+// negative arity is a minimum.
+type commandSpec struct {
+	handler func([]token) token
+	arity   int
+}
+
+var Handlers = map[string]commandSpec{
+	"PING":             {ping, -1},
+	"ECHO":             {echo, 2},
+	"SET":              {set, -3},
+	"GET":              {get, 2},
+	"INCR":             {incr, 2},
+	"DECR":             {decr, 2},
+	"INCRBY":           {incrby, 3},
+	"DECRBY":           {decrby, 3},
+	"INCRBYFLOAT":      {incrbyfloat, 3},
+	"APPEND":           {appendString, 3},
+	"STRLEN":           {strlen, 2},
+	"GETRANGE":         {getrange, 4},
+	"SETRANGE":         {setrange, 4},
+	"GETSET":           {getset, 3},
+	"GETDEL":           {getdel, 2},
+	"GETEX":            {getex, -2},
+	"MGET":             {mget, -2},
+	"MSET":             {mset, -3},
+	"MSETNX":           {msetnx, -3},
+	"SETBIT":           {setbit, 4},
+	"GETBIT":           {getbit, 3},
+	"BITCOUNT":         {bitcount, -2},
+	"BITPOS":           {bitpos, -3},
+	"BITOP":            {bitop, -4},
+	"BITFIELD":         {bitfield, -2},
+	"BITFIELD_RO":      {bitfieldRO, -2},
+	"PFADD":            {pfadd, -2},
+	"PFCOUNT":          {pfcount, -2},
+	"PFMERGE":          {pfmerge, -2},
+	"GEOADD":           {geoadd, -5},
+	"GEODIST":          {geodist, -4},
+	"GEOPOS":           {geopos, -2},
+	"GEOHASH":          {geohash, -2},
+	"GEOSEARCH":        {geosearch, -7},
+	"GEOSEARCHSTORE":   {geosearchstore, -8},
+	"PUBLISH":          {publishCommand, 3},
+	"PUBSUB":           {pubsub, -2},
+	"SPUBLISH":         {spublish, 3},
+	"CLUSTER":          {cluster, -2},
+	"CONFIG":           {config, -2},
+	"KEYS":             {keys, 2},
+	"SCAN":             {scan, -2},
+	"HSCAN":            {hscan, -3},
+	"SSCAN":            {sscan, -3},
+	"ZSCAN":            {zscan, -3},
+	"INFO":             {info, -1},
+	"REPLCONF":         {replconf, -1},
+	"PSYNC":            {psync, -3},
+	"WAIT":             {wait, 3},
+	"TYPE":             {typ, 2},
+	"XADD":             {xadd, -5},
+	"XLEN":             {xlen, 2},
+	"XRANGE":           {xrange, -4},
+	"XREVRANGE":        {xrevrange, -4},
+	"XREAD":            {xread, -4},
+	"XDEL":             {xdel, -3},
+	"XTRIM":            {xtrim, -4},
+	"XGROUP":           {xgroup, -2},
+	"XREADGROUP":       {xreadgroup, -7},
+	"XACK":             {xack, -4},
+	"XPENDING":         {xpending, -3},
+	"XCLAIM":           {xclaim, -6},
+	"XAUTOCLAIM":       {xautoclaim, -6},
+	"XINFO":            {xinfo, -2},
+	"LPUSH":            {lpush, -3},
+	"RPUSH":            {rpush, -3},
+	"LPUSHX":           {lpushx, -3},
+	"RPUSHX":           {rpushx, -3},
+	"LPOP":             {lpop, -2},
+	"RPOP":             {rpop, -2},
+	"LRANGE":           {lrange, 4},
+	"LLEN":             {llen, 2},
+	"LINDEX":           {lindex, 3},
+	"LSET":             {lset, 4},
+	"LTRIM":            {ltrim, 4},
+	"LINSERT":          {linsert, 5},
+	"LREM":             {lrem, 4},
+	"LPOS":             {lpos, -3},
+	"LMOVE":            {lmove, 5},
+	"BLPOP":            {blpop, -3},
+	"BRPOP":            {brpop, -3},
+	"BLMOVE":           {blmove, 6},
+	"HSET":             {hset, -4},
+	"HMSET":            {hmset, -4},
+	"HSETNX":           {hsetnx, 4},
+	"HGET":             {hget, 3},
+	"HMGET":            {hmget, -3},
+	"HGETALL":          {hgetall, 2},
+	"HKEYS":            {hkeys, 2},
+	"HVALS":            {hvals, 2},
+	"HDEL":             {hdel, -3},
+	"HEXISTS":          {hexists, 3},
+	"HLEN":             {hlen, 2},
+	"HSTRLEN":          {hstrlen, 3},
+	"HINCRBY":          {hincrby, 4},
+	"HINCRBYFLOAT":     {hincrbyfloat, 4},
+	"SADD":             {sadd, -3},
+	"SREM":             {srem, -3},
+	"SMEMBERS":         {smembers, 2},
+	"SISMEMBER":        {sismember, 3},
+	"SMISMEMBER":       {smismember, -3},
+	"SCARD":            {scard, 2},
+	"SMOVE":            {smove, 4},
+	"SPOP":             {spop, -2},
+	"SRANDMEMBER":      {srandmember, -2},
+	"SINTER":           {sinter, -2},
+	"SUNION":           {sunion, -2},
+	"SDIFF":            {sdiff, -2},
+	"SINTERSTORE":      {sinterstore, -3},
+	"SUNIONSTORE":      {sunionstore, -3},
+	"SDIFFSTORE":       {sdiffstore, -3},
+	"ZADD":             {zadd, -4},
+	"ZINCRBY":          {zincrby, 4},
+	"ZREM":             {zrem, -3},
+	"ZCARD":            {zcard, 2},
+	"ZSCORE":           {zscore, 3},
+	"ZMSCORE":          {zmscore, -3},
+	"ZRANK":            {zrank, -3},
+	"ZREVRANK":         {zrevrank, -3},
+	"ZCOUNT":           {zcount, 4},
+	"ZLEXCOUNT":        {zlexcount, 4},
+	"ZRANGE":           {zrange, -4},
+	"ZREVRANGE":        {zrevrange, -4},
+	"ZRANGEBYSCORE":    {zrangebyscore, -4},
+	"ZREVRANGEBYSCORE": {zrevrangebyscore, -4},
+	"ZRANGEBYLEX":      {zrangebylex, -4},
+	"ZREVRANGEBYLEX":   {zrevrangebylex, -4},
+	"ZPOPMIN":          {zpopmin, -2},
+	"ZPOPMAX":          {zpopmax, -2},
+	"EXPIRE":           {expire, -3},
+	"PEXPIRE":          {pexpire, -3},
+	"EXPIREAT":         {expireat, -3},
+	"PEXPIREAT":        {pexpireat, -3},
+	"TTL":              {ttl, 2},
+	"PTTL":             {pttl, 2},
+	"EXPIRETIME":       {expiretime, 2},
+	"PEXPIRETIME":      {pexpiretime, 2},
+	"PERSIST":          {persist, 2},
+	"DEL":              {del, -2},
+	"UNLINK":           {unlink, -2},
+	"EXISTS":           {keysExist, -2},
+	"TOUCH":            {touch, -2},
+	"RENAME":           {rename, 3},
+	"RENAMENX":         {renamenx, 3},
+	"COPY":             {copyKey, -3},
+	"RANDOMKEY":        {randomkey, 1},
+	"DBSIZE":           {dbsize, 1},
+	"FLUSHALL":         {flushall, -1},
 }
 
 var (
 	datastore = map[string]object{}
+	// keyIndex orders the keys of datastore for SCAN
+	keyIndex = newScanIndex()
 	// Mutex is short for mutal-exclusion
 	// A mutex keeps track of which thread has access to which
-	// variable at any given time
+	// variable at any given time. process holds it while a command
+	// runs, so handlers don't lock it themselves.
 	mux = &sync.RWMutex{}
 )
 
+// Error replies shared by the command families
+var (
+	errWrongType = token{
+		typ: string(ERROR),
+		val: "WRONGTYPE Operation against a key holding the wrong kind of value",
+	}
+	errNotInteger = token{typ: string(ERROR), val: "ERR value is not an integer or out of range"}
+	errSyntax     = token{typ: string(ERROR), val: "ERR syntax error"}
+)
+
 type object struct {
 	value      string
 	createdAt  time.Time
-	expiry     int                     // In Milliseconds
-	typ        string                  // Type of entry (string, set, stream)
-	streamData map[string]streamObject // Only used when typ is 'stream'
+	expiry     int                 // In Milliseconds
+	typ        string              // Type of entry (string, list, hash, set, zset, stream)
+	streamData *stream             // Only used when typ is 'stream'
+	listData   []string            // Only used when typ is 'list'
+	listArray  []string            // The array listData lies in, with room before it for pushes to the head
+	hashData   map[string]string   // Only used when typ is 'hash'
+	setData    map[string]struct{} // Only used when typ is 'set'
+	zsetData   *zset               // Only used when typ is 'zset'
+	index      *scanIndex          // Orders hashData or setData for HSCAN and SSCAN
+	bitmap     []byte              // Replaces value once bit commands wrote to it in place
+}
+
+// str returns the value of a string, whichever way it is stored
+func (obj object) str() string {
+	if obj.bitmap != nil {
+		return string(obj.bitmap)
+	}
+
+	return obj.value
+}
+
+// wrongArgs builds the arity error Redis returns for command
+func wrongArgs(command string) token {
+	return token{
+		typ: string(ERROR),
+		val: fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(command)),
+	}
 }
 
-type streamObject struct {
-	id    string
-	key   string
-	value string
+func intToken(n int) token {
+	return token{typ: string(INTEGER), val: fmt.Sprintf("%d", n)}
+}
+
+// bulkArray wraps each value in a bulk string token
+func bulkArray(values []string) token {
+	arr := make([]token, 0, len(values))
+	for _, v := range values {
+		arr = append(arr, token{typ: string(BULK), bulk: v})
+	}
+
+	return token{typ: string(ARRAY), array: arr}
 }
 
 func echo(args []token) token {
@@ -61,156 +250,124 @@ func ping(args []token) token {
 	return token{typ: string(STRING), val: args[0].bulk}
 }
 
+// SET key value [NX|XX] [GET] [EX seconds|PX milliseconds|EXAT unix-time-seconds|PXAT unix-time-milliseconds|KEEPTTL]
 func set(args []token) token {
 	if len(args) < 2 {
-		return token{typ: string(ERROR), val: "Set needs two values"}
-	}
-
-	// Check if we need to set expiry
-	if len(args) >= 4 && strings.ToUpper(args[2].bulk) == "PX" {
-		setWithExpiry(args)
-	} else {
-		// Create lock to avoid race-conditions
-		mux.Lock()
-		datastore[args[0].bulk] = object{
-			value:     args[1].bulk,
-			createdAt: time.Now().UTC(),
-			typ:       "string",
-		}
-		mux.Unlock()
+		return wrongArgs("SET")
 	}
 
-	return token{typ: string(STRING), val: "OK"}
-}
+	var nx, xx, withGet, keepTTL bool
+	var expiryTime time.Time
 
-func setWithExpiry(args []token) token {
-	// Assuming args[2].bulk indicates the type of expiry, e.g., "PX" for duration or "PXAT" for absolute timestamp
-	fmt.Println("Setting key with expiry")
-	expiryType := args[2].bulk
-	expValue := args[3].bulk
+	for i := 2; i < len(args); i++ {
+		opt := strings.ToUpper(args[i].bulk)
 
-	exp, err := strconv.ParseInt(expValue, 10, 64)
-	if err != nil {
-		return token{typ: string(ERROR), val: "Invalid expiration value"}
+		switch opt {
+		case "NX":
+			if xx {
+				return errSyntax
+			}
+			nx = true
+		case "XX":
+			if nx {
+				return errSyntax
+			}
+			xx = true
+		case "GET":
+			withGet = true
+		case "KEEPTTL":
+			if !expiryTime.IsZero() {
+				return errSyntax
+			}
+			keepTTL = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if keepTTL || !expiryTime.IsZero() || i+1 >= len(args) {
+				return errSyntax
+			}
+
+			when, errTok := parseExpiryOption("set", opt, args[i+1].bulk)
+			if errTok != nil {
+				return *errTok
+			}
+			expiryTime = when
+			i++
+		default:
+			return errSyntax
+		}
 	}
 
-	var expiryTime time.Time
-	switch strings.ToUpper(expiryType) {
-	case "PX": // Duration in milliseconds
-		expiryTime = time.Now().Add(time.Duration(exp) * time.Millisecond)
-	case "PXAT": // Absolute timestamp in milliseconds
-		expiryTime = time.UnixMilli(exp)
-	default:
-		return token{typ: string(ERROR), val: "Invalid expiry type. Use PX or PXAT."}
+	key := args[0].bulk
+
+	old, exists := lookupKey(key)
+	if withGet && exists && old.typ != "" && old.typ != "string" {
+		return errWrongType
 	}
 
-	durationUntilExpiry := time.Until(expiryTime)
+	reply := token{typ: string(STRING), val: "OK"}
+	if withGet {
+		reply = token{typ: string(NULL)}
+		if exists {
+			reply = token{typ: string(BULK), bulk: old.str()}
+		}
+	}
 
-	if durationUntilExpiry <= 0 {
-		// Expiration time is in the past
-		return token{typ: string(ERROR), val: "Expiration time is in the past"}
+	// Conditional writes that don't apply leave the key untouched
+	if (nx && exists) || (xx && !exists) {
+		if withGet {
+			return reply
+		}
+		return token{typ: string(NULL)}
 	}
 
-	// Store the key with expiration information
-	mux.Lock()
-	datastore[args[0].bulk] = object{
+	obj := object{
 		value:     args[1].bulk,
-		expiry:    int(expiryTime.UnixMilli()),
 		createdAt: time.Now().UTC(),
+		typ:       "string",
 	}
-	mux.Unlock()
 
-	// Set up a timer to delete the key after the specified duration
-	time.AfterFunc(durationUntilExpiry, func() {
-		mux.Lock()
-		delete(datastore, args[0].bulk)
-		mux.Unlock()
-	})
+	if keepTTL && exists {
+		obj.expiry = old.expiry
+	}
 
-	return token{typ: string(STRING), val: "OK"}
-}
+	if !expiryTime.IsZero() {
+		if time.Until(expiryTime) <= 0 {
+			// Expiration time is in the past
+			removeKey(key)
+			if exists {
+				notifyKeyspaceEvent(notifyGeneric, "del", key)
+			}
+			return reply
+		}
 
-func get(args []token) token {
-	if len(args) == 0 {
-		return token{typ: string(ERROR), val: "Get needs a value"}
+		obj.expiry = int(expiryTime.UnixMilli())
+		trackExpiry(key)
 	}
 
-	mux.RLock()
-	obj := datastore[args[0].bulk]
-	mux.RUnlock()
-
-	if obj.value == "" {
-		return token{typ: string(NULL), val: "1"}
+	putKey(key, obj)
+	notifyKeyspaceEvent(notifyString, "set", key)
+	if !expiryTime.IsZero() {
+		notifyKeyspaceEvent(notifyGeneric, "expire", key)
 	}
 
-	return token{typ: string(STRING), val: obj.value}
+	return reply
 }
 
-func config(args []token) token {
-	switch args[0].bulk {
-	case strings.ToUpper("GET"):
-		if args[1].bulk == "dir" {
-			return token{
-				typ: string(ARRAY),
-				array: []token{
-					{
-						typ:  string(BULK),
-						bulk: "dir",
-					},
-					{
-						typ:  string(BULK),
-						bulk: *DirFlag,
-					},
-				},
-			}
-		} else if args[1].bulk == "dbfilename" {
-			return token{
-				typ: string(ARRAY),
-				array: []token{
-					{
-						typ:  string(BULK),
-						bulk: "dbfilename",
-					},
-					{
-						typ:  string(BULK),
-						bulk: *DBFlag,
-					},
-				},
-			}
-		}
-	case strings.ToUpper("SET"):
-		return token{}
-	default:
-		return token{}
+func get(args []token) token {
+	if len(args) == 0 {
+		return token{typ: string(ERROR), val: "Get needs a value"}
 	}
 
-	return token{}
-}
-
-func keys(args []token) token {
-	switch args[0].bulk {
-	case "*":
-		allKeys := make([]token, 0, len(datastore))
-		mux.Lock()
+	obj, exists := lookupKey(args[0].bulk)
 
-		for k := range datastore {
-			allKeys = append(
-				allKeys,
-				token{
-					typ:  string(BULK),
-					bulk: string(k),
-				},
-			)
-		}
+	if exists && obj.typ != "string" {
+		return errWrongType
+	}
 
-		mux.Unlock()
-		return token{
-			typ:   string(ARRAY),
-			array: allKeys,
-		}
-	default:
-		return token{typ: string(ERROR), val: "KEYS error"}
+	if !exists {
+		return token{typ: string(NULL), val: "1"}
 	}
+
+	return token{typ: string(STRING), val: obj.str()}
 }
 
 func info(args []token) token {
@@ -282,12 +439,18 @@ func psync(args []token) token {
 }
 
 func psyncWithRDB() token {
-	file, l, err := LoadRDB("./test_data/empty.rdb")
+	file, _, err := LoadRDB("./test_data/empty.rdb")
 	if err != nil {
 		fmt.Println(err)
 		return token{typ: string(ERROR), val: fmt.Sprintf("%v", err)}
 	}
 
+	// The keys aren't sent, but the function libraries are
+	mux.Lock()
+	file = withLibraries(file)
+	mux.Unlock()
+	l := len(file)
+
 	return token{
 		typ: string(SYNC),
 		array: []token{
@@ -321,6 +484,15 @@ func wait(args []token) token {
 		return token{typ: string(INTEGER), val: fmt.Sprintf("%d", len(replicas))}
 	}
 
+	// Transactions can't wait for the replicas
+	if denyBlocking {
+		return intToken(0)
+	}
+
+	// The replicas' ACKs come in through other connections, which need mux
+	mux.Unlock()
+	defer mux.Lock()
+
 	// Make a fresh ACK channel
 	waitACKCh = make(chan struct{}, len(replicas))
 
@@ -334,8 +506,7 @@ func wait(args []token) token {
 				{typ: string(BULK), bulk: "*"},
 			},
 		}
-		e := NewEncoder(rc, rc)
-		e.Encode(getAck)
+		rc.write(getAck)
 	}
 
 	timer := time.NewTimer(time.Duration(timeoutMs) * time.Millisecond)
@@ -361,9 +532,7 @@ func typ(args []token) token {
 		return token{typ: string(ERROR), val: "TYPE must take a key as arugment."}
 	}
 
-	mux.RLock()
-	t := datastore[args[0].bulk]
-	mux.RUnlock()
+	t, _ := lookupKey(args[0].bulk)
 
 	switch t.typ {
 	case "":
@@ -372,83 +541,15 @@ func typ(args []token) token {
 		return token{typ: string(STRING), val: "string"}
 	case "stream":
 		return token{typ: string(STRING), val: "stream"}
+	case "list":
+		return token{typ: string(STRING), val: "list"}
+	case "hash":
+		return token{typ: string(STRING), val: "hash"}
+	case "set":
+		return token{typ: string(STRING), val: "set"}
+	case "zset":
+		return token{typ: string(STRING), val: "zset"}
 	default:
 		return token{typ: string(STRING), val: "string"}
 	}
 }
-
-// XADD stream_key 1526919030474-0 temperature 36 humidity 95
-
-func xadd(args []token) token {
-	if len(args) < 4 {
-		return token{typ: string(ERROR), val: "XADD needs a stream key and a key/value pair."}
-	}
-
-	if len(args[2:])%2 != 0 {
-		return token{typ: string(ERROR), val: "XADD key/value pairs must be even."}
-	}
-
-	fmt.Println(args[0].bulk)
-	streamKey := args[0].bulk
-	entryID := args[1].bulk
-
-	mux.Lock()
-	defer mux.Unlock()
-
-	t, exists := datastore[streamKey]
-
-	// If the stream doesn't exist, create it
-	if !exists || t.typ != "stream" {
-		t = object{
-			typ:        "stream",
-			createdAt:  time.Now().UTC(),
-			streamData: make(map[string]streamObject),
-		}
-	} else if t.streamData == nil {
-		t.streamData = make(map[string]streamObject)
-	}
-
-	// Check for duplicate ID
-	if _, ok := t.streamData[entryID]; ok {
-		return token{
-			typ: string(ERROR),
-			val: "ERR The ID specified in XADD is equal or smaller than the target stream top item",
-		}
-	}
-
-	if exists {
-		existingKeys := GetMapKeys(t.streamData)
-		sequenceID := ConvertSeqID(SplitXAddSequenceID(entryID))
-		sequenceIDLastKey := ConvertSeqID(SplitXAddSequenceID(existingKeys[len(existingKeys)-1]))
-
-		if sequenceID == ConvertSeqID([]string{"0", "0"}) {
-			return token{
-				typ: string(ERROR),
-				val: "ERR The ID specified in XADD must be greater than 0-0",
-			}
-		}
-
-		if sequenceID <= sequenceIDLastKey {
-			return token{
-				typ: string(ERROR),
-				val: "ERR The ID specified in XADD is equal or smaller than the target stream top item",
-			}
-		}
-	}
-
-	// Add entries to the stream
-	for i := 2; i < len(args); i += 2 {
-		field := args[i].bulk
-		value := args[i+1].bulk
-		t.streamData[entryID] = streamObject{
-			id:    entryID,
-			key:   field,
-			value: value,
-		}
-	}
-
-	// Save back to datastore
-	datastore[streamKey] = t
-
-	return token{typ: string(STRING), val: entryID}
-}
@@ -30,12 +30,12 @@ func TestHandler(t *testing.T) {
 		command := strings.ToUpper(tok.array[0].bulk)
 		args := tok.array[1:]
 
-		handler, ok := Handlers[command]
+		spec, ok := Handlers[command]
 		if !ok {
 			t.Errorf("Could not get handler. wanted %s, got %s", "echo", command)
 		}
 
-		result := handler(args)
+		result := call(spec, args)
 
 		if !reflect.DeepEqual(result, want) {
 			t.Errorf("Failed echo. wanted %v, got %v", result, want)
@@ -61,12 +61,12 @@ func TestHandler(t *testing.T) {
 		command := strings.ToUpper(tok.array[0].bulk)
 		args := tok.array[1:]
 
-		handler, ok := Handlers[command]
+		spec, ok := Handlers[command]
 		if !ok {
 			t.Errorf("Could not get handler. wanted %s, got %s", "echo", command)
 		}
 
-		result := handler(args)
+		result := call(spec, args)
 
 		if !reflect.DeepEqual(result, want) {
 			t.Errorf("Failed ping. wanted %v, got %v", result, want)
@@ -100,12 +100,12 @@ func TestHandler(t *testing.T) {
 		command := strings.ToUpper(tok.array[0].bulk)
 		args := tok.array[1:]
 
-		handler, ok := Handlers[command]
+		spec, ok := Handlers[command]
 		if !ok {
 			t.Errorf("Could not get handler. wanted %s, got %s", "echo", command)
 		}
 
-		result := handler(args)
+		result := call(spec, args)
 
 		if !reflect.DeepEqual(result, want) {
 			t.Errorf("Failed set. wanted %v, got %v", result, want)
@@ -146,12 +146,12 @@ func TestHandler(t *testing.T) {
 		command := strings.ToUpper(tok.array[0].bulk)
 		args := tok.array[1:]
 
-		handler, ok := Handlers[command]
+		spec, ok := Handlers[command]
 		if !ok {
 			t.Errorf("Could not get handler. wanted %s, got %s", "echo", command)
 		}
 
-		result := handler(args)
+		result := call(spec, args)
 
 		if !reflect.DeepEqual(result, want) {
 			t.Errorf("Failed set. wanted %v, got %v", result, want)
@@ -180,12 +180,12 @@ func TestHandler(t *testing.T) {
 		command := strings.ToUpper(tok.array[0].bulk)
 		args := tok.array[1:]
 
-		handler, ok := Handlers[command]
+		spec, ok := Handlers[command]
 		if !ok {
 			t.Errorf("Could not get handler. wanted %s, got %s", "echo", command)
 		}
 
-		result := handler(args)
+		result := call(spec, args)
 
 		// Should be true as set was called in previous run step
 		if !reflect.DeepEqual(result, want) {
@@ -193,3 +193,106 @@ func TestHandler(t *testing.T) {
 		}
 	})
 }
+
+// run dispatches a command through Handlers the same way process does
+func run(t *testing.T, args ...string) token {
+	t.Helper()
+
+	spec, ok := Handlers[strings.ToUpper(args[0])]
+	if !ok {
+		t.Fatalf("Could not get handler for %s", args[0])
+	}
+
+	tokens := make([]token, 0, len(args)-1)
+	for _, a := range args[1:] {
+		tokens = append(tokens, token{typ: string(BULK), bulk: a})
+	}
+
+	return call(spec, tokens)
+}
+
+// call runs the handler of spec under mux, which process holds around every command
+func call(spec commandSpec, args []token) token {
+	mux.Lock()
+	defer mux.Unlock()
+
+	return spec.handler(args)
+}
+
+func TestSetOptions(t *testing.T) {
+	ok := token{typ: string(STRING), val: "OK"}
+	null := token{typ: string(NULL)}
+
+	t.Run("nx and xx", func(t *testing.T) {
+		if got := run(t, "SET", "opt:lock", "a", "NX", "PX", "30000"); !reflect.DeepEqual(got, ok) {
+			t.Errorf("Failed set nx. wanted %v, got %v", ok, got)
+		}
+		if got := run(t, "SET", "opt:lock", "b", "NX"); !reflect.DeepEqual(got, null) {
+			t.Errorf("Failed set nx. wanted %v, got %v", null, got)
+		}
+		if got := run(t, "SET", "opt:missing", "b", "XX"); !reflect.DeepEqual(got, null) {
+			t.Errorf("Failed set xx. wanted %v, got %v", null, got)
+		}
+
+		want := token{typ: string(STRING), val: "a"}
+		if got := run(t, "GET", "opt:lock"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed get. wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("get returns the old value", func(t *testing.T) {
+		if got := run(t, "SET", "opt:get", "1", "GET"); !reflect.DeepEqual(got, null) {
+			t.Errorf("Failed set get. wanted %v, got %v", null, got)
+		}
+
+		want := token{typ: string(BULK), bulk: "1"}
+		if got := run(t, "SET", "opt:get", "2", "GET"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed set get. wanted %v, got %v", want, got)
+		}
+
+		run(t, "RPUSH", "opt:list", "a")
+		if got := run(t, "SET", "opt:list", "2", "GET"); !reflect.DeepEqual(got, errWrongType) {
+			t.Errorf("Failed set get. wanted %v, got %v", errWrongType, got)
+		}
+	})
+
+	t.Run("expiry options", func(t *testing.T) {
+		run(t, "SET", "opt:ex", "v", "EX", "100")
+
+		mux.RLock()
+		expiry := datastore["opt:ex"].expiry
+		mux.RUnlock()
+		if expiry == 0 {
+			t.Errorf("Failed set ex. expiry was not recorded")
+		}
+
+		run(t, "SET", "opt:ex", "w", "KEEPTTL")
+
+		mux.RLock()
+		kept := datastore["opt:ex"].expiry
+		mux.RUnlock()
+		if kept != expiry {
+			t.Errorf("Failed set keepttl. wanted %d, got %d", expiry, kept)
+		}
+
+		want := token{typ: string(ERROR), val: "ERR invalid expire time in 'set' command"}
+		if got := run(t, "SET", "opt:ex", "v", "PX", "0"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed set px. wanted %v, got %v", want, got)
+		}
+
+		for _, expiry := range [][]string{
+			{"EX", "9223372036854775"},
+			{"EXAT", "9223372036854776"},
+			{"PX", "9223372036854775807"},
+		} {
+			args := append([]string{"SET", "opt:overflow", "v"}, expiry...)
+			if got := run(t, args...); !reflect.DeepEqual(got, want) {
+				t.Errorf("Failed set %s. wanted %v, got %v", expiry[0], want, got)
+			}
+		}
+
+		if got := run(t, "SET", "opt:ex", "v", "EX", "10", "PX", "10"); !reflect.DeepEqual(got, errSyntax) {
+			t.Errorf("Failed set ex px. wanted %v, got %v", errSyntax, got)
+		}
+	})
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"time"
+)
+
+// lookupHash returns the hash stored at key. A missing key yields a nil
+// map, ok is false when the key holds another type.
+// Callers must hold mux.
+func lookupHash(key string) (hash map[string]string, ok bool) {
+	obj, exists := lookupKey(key)
+	if !exists {
+		return nil, true
+	}
+
+	if obj.typ != "hash" {
+		return nil, false
+	}
+
+	return obj.hashData, true
+}
+
+// hashForWrite returns the hash at key, creating an empty one if the key
+// does not exist yet. Callers must hold mux.
+func hashForWrite(key string) (map[string]string, bool) {
+	hash, ok := lookupHash(key)
+	if !ok {
+		return nil, false
+	}
+
+	if hash == nil {
+		hash = make(map[string]string)
+		putKey(key, object{
+			typ:       "hash",
+			createdAt: time.Now().UTC(),
+			hashData:  hash,
+			index:     newScanIndex(),
+		})
+	}
+
+	return hash, true
+}
+
+// HSET key field value [field value ...]
+func hset(args []token) token {
+	if len(args) < 3 || len(args)%2 != 1 {
+		return wrongArgs("HSET")
+	}
+
+	hash, ok := hashForWrite(args[0].bulk)
+	if !ok {
+		return errWrongType
+	}
+
+	index := scanIndexOf(args[0].bulk)
+	added := 0
+	for i := 1; i < len(args); i += 2 {
+		if _, exists := hash[args[i].bulk]; !exists {
+			index.add(args[i].bulk)
+			added++
+		}
+		hash[args[i].bulk] = args[i+1].bulk
+	}
+	notifyKeyspaceEvent(notifyHash, "hset", args[0].bulk)
+
+	return intToken(added)
+}
+
+// HMSET key field value [field value ...]
+func hmset(args []token) token {
+	if len(args) < 3 || len(args)%2 != 1 {
+		return wrongArgs("HMSET")
+	}
+
+	if result := hset(args); result.typ == string(ERROR) {
+		return result
+	}
+
+	return token{typ: string(STRING), val: "OK"}
+}
+
+// HSETNX key field value
+func hsetnx(args []token) token {
+	if len(args) != 3 {
+		return wrongArgs("HSETNX")
+	}
+
+	hash, ok := hashForWrite(args[0].bulk)
+	if !ok {
+		return errWrongType
+	}
+
+	if _, exists := hash[args[1].bulk]; exists {
+		return intToken(0)
+	}
+	hash[args[1].bulk] = args[2].bulk
+	scanIndexOf(args[0].bulk).add(args[1].bulk)
+	notifyKeyspaceEvent(notifyHash, "hset", args[0].bulk)
+
+	return intToken(1)
+}
+
+// HGET key field
+func hget(args []token) token {
+	if len(args) != 2 {
+		return wrongArgs("HGET")
+	}
+
+	hash, ok := lookupHash(args[0].bulk)
+	if !ok {
+		return errWrongType
+	}
+
+	value, exists := hash[args[1].bulk]
+	if !exists {
+		return token{typ: string(NULL)}
+	}
+
+	return token{typ: string(BULK), bulk: value}
+}
+
+// HMGET key field [field ...]
+func hmget(args []token) token {
+	if len(args) < 2 {
+		return wrongArgs("HMGET")
+	}
+
+	hash, ok := lookupHash(args[0].bulk)
+	if !ok {
+		return errWrongType
+	}
+
+	values := make([]token, 0, len(args)-1)
+	for _, field := range args[1:] {
+		value, exists := hash[field.bulk]
+		if !exists {
+			values = append(values, token{typ: string(NULL)})
+			continue
+		}
+		values = append(values, token{typ: string(BULK), bulk: value})
+	}
+
+	return token{typ: string(ARRAY), array: values}
+}
+
+// HGETALL key
+func hgetall(args []token) token {
+	if len(args) != 1 {
+		return wrongArgs("HGETALL")
+	}
+
+	hash, ok := lookupHash(args[0].bulk)
+	if !ok {
+		return errWrongType
+	}
+
+	pairs := make([]string, 0, len(hash)*2)
+	for field, value := range hash {
+		pairs = append(pairs, field, value)
+	}
+
+	return bulkArray(pairs)
+}
+
+// HKEYS key
+func hkeys(args []token) token {
+	if len(args) != 1 {
+		return wrongArgs("HKEYS")
+	}
+
+	hash, ok := lookupHash(args[0].bulk)
+	if !ok {
+		return errWrongType
+	}
+
+	fields := make([]string, 0, len(hash))
+	for field := range hash {
+		fields = append(fields, field)
+	}
+
+	return bulkArray(fields)
+}
+
+// HVALS key
+func hvals(args []token) token {
+	if len(args) != 1 {
+		return wrongArgs("HVALS")
+	}
+
+	hash, ok := lookupHash(args[0].bulk)
+	if !ok {
+		return errWrongType
+	}
+
+	values := make([]string, 0, len(hash))
+	for _, value := range hash {
+		values = append(values, value)
+	}
+
+	return bulkArray(values)
+}
+
+// HDEL key field [field ...]
+func hdel(args []token) token {
+	if len(args) < 2 {
+		return wrongArgs("HDEL")
+	}
+
+	key := args[0].bulk
+	hash, ok := lookupHash(key)
+	if !ok {
+		return errWrongType
+	}
+
+	removed := 0
+	for _, field := range args[1:] {
+		if _, exists := hash[field.bulk]; exists {
+			delete(hash, field.bulk)
+			scanIndexOf(key).remove(field.bulk)
+			removed++
+		}
+	}
+
+	if removed > 0 {
+		notifyKeyspaceEvent(notifyHash, "hdel", key)
+	}
+
+	if hash != nil && len(hash) == 0 {
+		removeKey(key)
+		notifyKeyspaceEvent(notifyGeneric, "del", key)
+	}
+
+	return intToken(removed)
+}
+
+// HEXISTS key field
+func hexists(args []token) token {
+	if len(args) != 2 {
+		return wrongArgs("HEXISTS")
+	}
+
+	hash, ok := lookupHash(args[0].bulk)
+	if !ok {
+		return errWrongType
+	}
+
+	if _, exists := hash[args[1].bulk]; exists {
+		return intToken(1)
+	}
+
+	return intToken(0)
+}
+
+// HLEN key
+func hlen(args []token) token {
+	if len(args) != 1 {
+		return wrongArgs("HLEN")
+	}
+
+	hash, ok := lookupHash(args[0].bulk)
+	if !ok {
+		return errWrongType
+	}
+
+	return intToken(len(hash))
+}
+
+// HSTRLEN key field
+func hstrlen(args []token) token {
+	if len(args) != 2 {
+		return wrongArgs("HSTRLEN")
+	}
+
+	hash, ok := lookupHash(args[0].bulk)
+	if !ok {
+		return errWrongType
+	}
+
+	return intToken(len(hash[args[1].bulk]))
+}
+
+// HINCRBY key field increment
+func hincrby(args []token) token {
+	if len(args) != 3 {
+		return wrongArgs("HINCRBY")
+	}
+
+	incr, err := strconv.ParseInt(args[2].bulk, 10, 64)
+	if err != nil {
+		return errNotInteger
+	}
+
+	hash, ok := hashForWrite(args[0].bulk)
+	if !ok {
+		return errWrongType
+	}
+
+	var current int64
+	value, exists := hash[args[1].bulk]
+	if exists {
+		current, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return token{typ: string(ERROR), val: "ERR hash value is not an integer"}
+		}
+	}
+
+	if (incr > 0 && current > math.MaxInt64-incr) || (incr < 0 && current < math.MinInt64-incr) {
+		return token{typ: string(ERROR), val: "ERR increment or decrement would overflow"}
+	}
+
+	current += incr
+	hash[args[1].bulk] = strconv.FormatInt(current, 10)
+	if !exists {
+		scanIndexOf(args[0].bulk).add(args[1].bulk)
+	}
+	notifyKeyspaceEvent(notifyHash, "hincrby", args[0].bulk)
+
+	return token{typ: string(INTEGER), val: strconv.FormatInt(current, 10)}
+}
+
+// HINCRBYFLOAT key field increment
+func hincrbyfloat(args []token) token {
+	if len(args) != 3 {
+		return wrongArgs("HINCRBYFLOAT")
+	}
+
+	incr, err := strconv.ParseFloat(args[2].bulk, 64)
+	if err != nil || math.IsNaN(incr) || math.IsInf(incr, 0) {
+		return token{typ: string(ERROR), val: "ERR value is not a valid float"}
+	}
+
+	hash, ok := hashForWrite(args[0].bulk)
+	if !ok {
+		return errWrongType
+	}
+
+	var current float64
+	value, exists := hash[args[1].bulk]
+	if exists {
+		current, err = strconv.ParseFloat(value, 64)
+		if err != nil {
+			return token{typ: string(ERROR), val: "ERR hash value is not a float"}
+		}
+	}
+
+	current += incr
+	if math.IsNaN(current) || math.IsInf(current, 0) {
+		return token{typ: string(ERROR), val: "ERR increment would produce NaN or Infinity"}
+	}
+
+	formatted := strconv.FormatFloat(current, 'f', -1, 64)
+	hash[args[1].bulk] = formatted
+	if !exists {
+		scanIndexOf(args[0].bulk).add(args[1].bulk)
+	}
+	notifyKeyspaceEvent(notifyHash, "hincrbyfloat", args[0].bulk)
+
+	return token{typ: string(BULK), bulk: formatted}
+}
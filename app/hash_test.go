@@ -0,0 +1,100 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestHash(t *testing.T) {
+	t.Run("hset and hget", func(t *testing.T) {
+		if got := run(t, "HSET", "hash:a", "name", "john", "age", "30"); !reflect.DeepEqual(got, intToken(2)) {
+			t.Errorf("Failed hset. wanted %v, got %v", intToken(2), got)
+		}
+		if got := run(t, "HSET", "hash:a", "name", "jane"); !reflect.DeepEqual(got, intToken(0)) {
+			t.Errorf("Failed hset. wanted %v, got %v", intToken(0), got)
+		}
+
+		want := token{typ: string(BULK), bulk: "jane"}
+		if got := run(t, "HGET", "hash:a", "name"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed hget. wanted %v, got %v", want, got)
+		}
+
+		want = token{typ: string(ARRAY), array: []token{
+			{typ: string(BULK), bulk: "30"},
+			{typ: string(NULL)},
+		}}
+		if got := run(t, "HMGET", "hash:a", "age", "missing"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed hmget. wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("hgetall and hkeys", func(t *testing.T) {
+		run(t, "HSET", "hash:all", "a", "1", "b", "2")
+
+		got := run(t, "HGETALL", "hash:all")
+		pairs := map[string]string{}
+		for i := 0; i+1 < len(got.array); i += 2 {
+			pairs[got.array[i].bulk] = got.array[i+1].bulk
+		}
+		if !reflect.DeepEqual(pairs, map[string]string{"a": "1", "b": "2"}) {
+			t.Errorf("Failed hgetall. got %v", got)
+		}
+
+		fields := []string{}
+		for _, f := range run(t, "HKEYS", "hash:all").array {
+			fields = append(fields, f.bulk)
+		}
+		sort.Strings(fields)
+		if !reflect.DeepEqual(fields, []string{"a", "b"}) {
+			t.Errorf("Failed hkeys. got %v", fields)
+		}
+	})
+
+	t.Run("hdel removes empty hashes", func(t *testing.T) {
+		run(t, "HSET", "hash:del", "a", "1")
+
+		if got := run(t, "HDEL", "hash:del", "a", "b"); !reflect.DeepEqual(got, intToken(1)) {
+			t.Errorf("Failed hdel. wanted %v, got %v", intToken(1), got)
+		}
+
+		want := token{typ: string(STRING), val: "none"}
+		if got := run(t, "TYPE", "hash:del"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed type. wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("hincrby", func(t *testing.T) {
+		if got := run(t, "HINCRBY", "hash:n", "count", "5"); !reflect.DeepEqual(got, intToken(5)) {
+			t.Errorf("Failed hincrby. wanted %v, got %v", intToken(5), got)
+		}
+		if got := run(t, "HINCRBY", "hash:n", "count", "-7"); !reflect.DeepEqual(got, intToken(-2)) {
+			t.Errorf("Failed hincrby. wanted %v, got %v", intToken(-2), got)
+		}
+
+		run(t, "HSET", "hash:n", "name", "x")
+		want := token{typ: string(ERROR), val: "ERR hash value is not an integer"}
+		if got := run(t, "HINCRBY", "hash:n", "name", "1"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed hincrby. wanted %v, got %v", want, got)
+		}
+
+		want = token{typ: string(BULK), bulk: "1.5"}
+		if got := run(t, "HINCRBYFLOAT", "hash:n", "f", "1.5"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed hincrbyfloat. wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("wrong type", func(t *testing.T) {
+		run(t, "RPUSH", "hash:list", "a")
+
+		if got := run(t, "HGET", "hash:list", "a"); !reflect.DeepEqual(got, errWrongType) {
+			t.Errorf("Failed wrongtype. wanted %v, got %v", errWrongType, got)
+		}
+
+		run(t, "HSET", "hash:typ", "a", "1")
+		want := token{typ: string(STRING), val: "hash"}
+		if got := run(t, "TYPE", "hash:typ"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed type. wanted %v, got %v", want, got)
+		}
+	})
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+)
+
+// HyperLogLogs are strings laid out exactly like Redis lays them out, so
+// values loaded from its RDB files can be counted and merged here. A
+// 16 byte header holds the "HYLL" magic, the encoding and a cached
+// cardinality, followed by 16384 registers of 6 bits each. The dense
+// encoding packs every register, the sparse one run length encodes them
+// and is used while the counter is small.
+
+const (
+	hllP         = 14
+	hllQ         = 64 - hllP
+	hllRegisters = 1 << hllP
+	hllBits      = 6
+	hllHeaderLen = 16
+	hllDenseLen  = hllHeaderLen + (hllRegisters*hllBits+7)/8
+
+	hllDense  = 0
+	hllSparse = 1
+
+	// hllSparseMaxBytes is the size past which sparse counters are
+	// promoted to dense, the default hll-sparse-max-bytes of Redis
+	hllSparseMaxBytes = 3000
+
+	// hllSparseMaxValue is the largest register a sparse VAL opcode holds
+	hllSparseMaxValue = 32
+
+	hllAlphaInf = 0.721347520444481703680
+)
+
+var (
+	errNotHLL     = token{typ: string(ERROR), val: "WRONGTYPE Key is not a valid HyperLogLog string value."}
+	errCorruptHLL = token{typ: string(ERROR), val: "INVALIDOBJ Corrupted HLL object detected"}
+)
+
+type hyperLogLog struct {
+	registers [hllRegisters]uint8
+	dense     bool
+
+	// card is the cached cardinality, valid until a register changes
+	card      uint64
+	cardValid bool
+}
+
+func newHyperLogLog() *hyperLogLog {
+	return &hyperLogLog{cardValid: true}
+}
+
+// parseHyperLogLog decodes a string value, returning the error to reply
+// with when it isn't a HyperLogLog
+func parseHyperLogLog(value string) (*hyperLogLog, *token) {
+	if len(value) < hllHeaderLen || value[:4] != "HYLL" {
+		return nil, &errNotHLL
+	}
+
+	h := &hyperLogLog{}
+	card := binary.LittleEndian.Uint64([]byte(value[8:16]))
+	h.cardValid = card&(1<<63) == 0
+	h.card = card
+
+	body := value[hllHeaderLen:]
+
+	switch value[4] {
+	case hllDense:
+		if len(value) != hllDenseLen {
+			return nil, &errNotHLL
+		}
+		h.dense = true
+		for i := range h.registers {
+			h.registers[i] = denseRegister(body, i)
+		}
+	case hllSparse:
+		if !h.decodeSparse(body) {
+			return nil, &errCorruptHLL
+		}
+	default:
+		return nil, &errNotHLL
+	}
+
+	return h, nil
+}
+
+func denseRegister(body string, i int) uint8 {
+	b0 := i * hllBits / 8
+	fb := uint(i * hllBits % 8)
+
+	reg := body[b0] >> fb
+	if b0+1 < len(body) {
+		reg |= body[b0+1] << (8 - fb)
+	}
+
+	return reg & (1<<hllBits - 1)
+}
+
+// decodeSparse reads the opcodes of the sparse encoding:
+//
+//	ZERO  00xxxxxx           xxxxxx+1 registers set to 0
+//	XZERO 01xxxxxx yyyyyyyy  xxxxxxyyyyyyyy+1 registers set to 0
+//	VAL   1vvvvvxx           xx+1 registers set to vvvvv+1
+//
+// It reports whether they describe exactly hllRegisters registers.
+func (h *hyperLogLog) decodeSparse(body string) bool {
+	idx := 0
+
+	for i := 0; i < len(body); i++ {
+		op := body[i]
+		var run int
+		var value uint8
+
+		switch {
+		case op&0xc0 == 0x00:
+			run = int(op&0x3f) + 1
+		case op&0xc0 == 0x40:
+			if i+1 >= len(body) {
+				return false
+			}
+			run = (int(op&0x3f)<<8 | int(body[i+1])) + 1
+			i++
+		default:
+			run = int(op&0x03) + 1
+			value = (op>>2)&0x1f + 1
+		}
+
+		if idx+run > hllRegisters {
+			return false
+		}
+		for j := 0; j < run; j++ {
+			h.registers[idx+j] = value
+		}
+		idx += run
+	}
+
+	return idx == hllRegisters
+}
+
+// encodeSparse returns the sparse opcodes for the registers, ok is false
+// when a register is too large for them
+func (h *hyperLogLog) encodeSparse() (body []byte, ok bool) {
+	for i := 0; i < hllRegisters; {
+		value := h.registers[i]
+		run := 1
+		for i+run < hllRegisters && h.registers[i+run] == value {
+			run++
+		}
+		i += run
+
+		if value > hllSparseMaxValue {
+			return nil, false
+		}
+
+		for run > 0 {
+			switch {
+			case value == 0 && run > 64:
+				n := min(run, 1<<14)
+				body = append(body, 0x40|byte((n-1)>>8), byte(n-1))
+				run -= n
+			case value == 0:
+				body = append(body, byte(run-1))
+				run = 0
+			default:
+				n := min(run, 4)
+				body = append(body, 0x80|(value-1)<<2|byte(n-1))
+				run -= n
+			}
+		}
+	}
+
+	return body, true
+}
+
+// String encodes the counter, sparse while it can stay sparse
+func (h *hyperLogLog) String() string {
+	var body []byte
+	if !h.dense {
+		if sparse, ok := h.encodeSparse(); ok && hllHeaderLen+len(sparse) <= hllSparseMaxBytes {
+			body = sparse
+		} else {
+			h.dense = true
+		}
+	}
+
+	header := make([]byte, hllHeaderLen, hllHeaderLen+hllDenseLen)
+	copy(header, "HYLL")
+	if h.dense {
+		header[4] = hllDense
+	} else {
+		header[4] = hllSparse
+	}
+
+	card := h.card
+	if !h.cardValid {
+		card |= 1 << 63
+	}
+	binary.LittleEndian.PutUint64(header[8:], card)
+
+	if !h.dense {
+		return string(append(header, body...))
+	}
+
+	body = make([]byte, hllDenseLen-hllHeaderLen)
+	for i, reg := range h.registers {
+		b0 := i * hllBits / 8
+		fb := uint(i * hllBits % 8)
+
+		body[b0] |= reg << fb
+		if b0+1 < len(body) {
+			body[b0+1] |= reg >> (8 - fb)
+		}
+	}
+
+	return string(append(header, body...))
+}
+
+// add hashes element into its register, reporting whether it changed
+func (h *hyperLogLog) add(element string) bool {
+	hash := murmurHash64A([]byte(element), 0xadc83b19)
+
+	// The low bits pick the register, the run of zeros in the rest is
+	// what it records. The sentinel bit keeps the run at most hllQ+1.
+	index := hash & (hllRegisters - 1)
+	hash >>= hllP
+	hash |= 1 << hllQ
+	count := uint8(bits.TrailingZeros64(hash) + 1)
+
+	if count <= h.registers[index] {
+		return false
+	}
+
+	h.registers[index] = count
+	h.cardValid = false
+
+	return true
+}
+
+// merge keeps the larger of each pair of registers
+func (h *hyperLogLog) merge(other *hyperLogLog) {
+	for i, reg := range other.registers {
+		if reg > h.registers[i] {
+			h.registers[i] = reg
+			h.cardValid = false
+		}
+	}
+}
+
+// count estimates the cardinality with the estimator by Otmar Ertl that
+// Redis uses, caching the result in the header
+func (h *hyperLogLog) count() uint64 {
+	if h.cardValid {
+		return h.card
+	}
+
+	var histogram [64]int
+	for _, reg := range h.registers {
+		histogram[reg]++
+	}
+
+	m := float64(hllRegisters)
+	z := m * hllTau((m-float64(histogram[hllQ+1]))/m)
+	for j := hllQ; j >= 1; j-- {
+		z += float64(histogram[j])
+		z *= 0.5
+	}
+	z += m * hllSigma(float64(histogram[0])/m)
+
+	h.card = uint64(math.Round(hllAlphaInf * m * m / z))
+	h.cardValid = true
+
+	return h.card
+}
+
+func hllSigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+
+	y := 1.0
+	z := x
+	for {
+		x *= x
+		prev := z
+		z += x * y
+		y += y
+		if prev == z {
+			return z
+		}
+	}
+}
+
+func hllTau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+
+	y := 1.0
+	z := 1 - x
+	for {
+		x = math.Sqrt(x)
+		prev := z
+		y *= 0.5
+		z -= (1 - x) * (1 - x) * y
+		if prev == z {
+			return z / 3
+		}
+	}
+}
+
+// murmurHash64A is the 64 bit MurmurHash2 variant Redis hashes
+// HyperLogLog elements with
+func murmurHash64A(data []byte, seed uint64) uint64 {
+	const m = 0xc6a4a7935bd1e995
+	const r = 47
+
+	h := seed ^ uint64(len(data))*m
+
+	for len(data) >= 8 {
+		k := binary.LittleEndian.Uint64(data)
+		k *= m
+		k ^= k >> r
+		k *= m
+
+		h ^= k
+		h *= m
+		data = data[8:]
+	}
+
+	if len(data) > 0 {
+		for i := len(data) - 1; i >= 0; i-- {
+			h ^= uint64(data[i]) << (8 * i)
+		}
+		h *= m
+	}
+
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+
+	return h
+}
+
+// lookupHyperLogLog returns the counter stored at key, nil when there is
+// none. Callers must hold mux.
+func lookupHyperLogLog(key string) (*hyperLogLog, *token) {
+	value, exists, ok := lookupString(key)
+	if !ok {
+		return nil, &errWrongType
+	}
+	if !exists {
+		return nil, nil
+	}
+
+	return parseHyperLogLog(value)
+}
+
+// PFADD key [element ...]
+func pfadd(args []token) token {
+	if len(args) < 1 {
+		return wrongArgs("PFADD")
+	}
+
+	key := args[0].bulk
+	h, errTok := lookupHyperLogLog(key)
+	if errTok != nil {
+		return *errTok
+	}
+
+	// Creating the key counts as a change even without elements
+	updated := h == nil
+	if h == nil {
+		h = newHyperLogLog()
+	}
+
+	for _, element := range args[1:] {
+		if h.add(element.bulk) {
+			updated = true
+		}
+	}
+
+	if !updated {
+		return intToken(0)
+	}
+
+	storeString(key, h.String(), true)
+	notifyKeyspaceEvent(notifyString, "pfadd", key)
+
+	return intToken(1)
+}
+
+// PFCOUNT key [key ...]
+func pfcount(args []token) token {
+	if len(args) < 1 {
+		return wrongArgs("PFCOUNT")
+	}
+
+	if len(args) == 1 {
+		key := args[0].bulk
+		h, errTok := lookupHyperLogLog(key)
+		if errTok != nil {
+			return *errTok
+		}
+		if h == nil {
+			return intToken(0)
+		}
+
+		// Remember the estimate in the header for the next call
+		if !h.cardValid {
+			h.count()
+			storeString(key, h.String(), true)
+		}
+
+		return intToken(int(h.card))
+	}
+
+	// Several keys count their union, which isn't cached anywhere
+	union := newHyperLogLog()
+	union.cardValid = false
+	for _, arg := range args {
+		h, errTok := lookupHyperLogLog(arg.bulk)
+		if errTok != nil {
+			return *errTok
+		}
+		if h != nil {
+			union.merge(h)
+		}
+	}
+
+	return intToken(int(union.count()))
+}
+
+// PFMERGE destkey [sourcekey ...]
+func pfmerge(args []token) token {
+	if len(args) < 1 {
+		return wrongArgs("PFMERGE")
+	}
+
+	// The destination is one of the inputs. The result stays sparse
+	// only when all of them were.
+	merged := newHyperLogLog()
+	for _, arg := range args {
+		h, errTok := lookupHyperLogLog(arg.bulk)
+		if errTok != nil {
+			return *errTok
+		}
+		if h != nil {
+			merged.merge(h)
+			merged.dense = merged.dense || h.dense
+		}
+	}
+	merged.cardValid = false
+
+	storeString(args[0].bulk, merged.String(), true)
+	notifyKeyspaceEvent(notifyString, "pfadd", args[0].bulk)
+
+	return token{typ: string(STRING), val: "OK"}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// sparseHLL builds a sparse HyperLogLog the way Redis writes one, with a
+// single register set between runs of XZERO opcodes
+func sparseHLL(index int, value byte) string {
+	xzero := func(n int) string {
+		if n == 0 {
+			return ""
+		}
+		return string([]byte{0x40 | byte((n-1)>>8), byte(n - 1)})
+	}
+
+	header := "HYLL\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x80"
+	val := string([]byte{0x80 | (value-1)<<2})
+
+	return header + xzero(index) + val + xzero(hllRegisters-index-1)
+}
+
+func TestHyperLogLog(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want token
+	}{
+		{"pfadd creates the key", []string{"PFADD", "hll:a"}, intToken(1)},
+		{"pfadd on an empty counter", []string{"PFADD", "hll:a", "a", "b", "c", "d", "e", "f", "g"}, intToken(1)},
+		{"pfadd with seen elements", []string{"PFADD", "hll:a", "a", "b"}, intToken(0)},
+		{"pfcount", []string{"PFCOUNT", "hll:a"}, intToken(7)},
+		{"pfcount missing key", []string{"PFCOUNT", "hll:none"}, intToken(0)},
+		{"pfadd more", []string{"PFADD", "hll:b", "f", "g", "h", "i"}, intToken(1)},
+		{"pfcount union", []string{"PFCOUNT", "hll:a", "hll:b", "hll:none"}, intToken(9)},
+		{"pfmerge", []string{"PFMERGE", "hll:c", "hll:a", "hll:b"}, token{typ: string(STRING), val: "OK"}},
+		{"pfcount merged", []string{"PFCOUNT", "hll:c"}, intToken(9)},
+		{"type is string", []string{"TYPE", "hll:c"}, token{typ: string(STRING), val: "string"}},
+		{"plain string", []string{"SET", "hll:str", "hello"}, token{typ: string(STRING), val: "OK"}},
+		{"not a hyperloglog", []string{"PFADD", "hll:str", "a"}, errNotHLL},
+		{"not a string", []string{"RPUSH", "hll:list", "a"}, intToken(1)},
+		{"wrong type", []string{"PFCOUNT", "hll:list"}, errWrongType},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := run(t, tt.args...); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Failed %s. wanted %v, got %v", tt.args[0], tt.want, got)
+			}
+		})
+	}
+
+	t.Run("counts large sets closely", func(t *testing.T) {
+		args := []string{"PFADD", "hll:large"}
+		for i := 0; i < 100000; i++ {
+			args = append(args, fmt.Sprintf("element:%d", i))
+		}
+		run(t, args...)
+
+		got, _ := strconv.Atoi(run(t, "PFCOUNT", "hll:large").val)
+		if got < 98000 || got > 102000 {
+			t.Errorf("Failed pfcount. wanted about 100000, got %d", got)
+		}
+
+		// Far too many registers for the sparse encoding by now
+		if value := run(t, "GET", "hll:large").val; value[4] != hllDense || len(value) != hllDenseLen {
+			t.Errorf("Failed promotion. wanted a dense encoding, got %d with length %d", value[4], len(value))
+		}
+	})
+
+	t.Run("reads sparse values written by redis", func(t *testing.T) {
+		run(t, "SET", "hll:sparse", sparseHLL(1000, 3))
+
+		if got := run(t, "PFCOUNT", "hll:sparse"); !reflect.DeepEqual(got, intToken(1)) {
+			t.Errorf("Failed pfcount. wanted %v, got %v", intToken(1), got)
+		}
+
+		// The cached cardinality is now valid and stored little endian
+		value := run(t, "GET", "hll:sparse").val
+		if want := "HYLL\x01\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00\x00"; value[:hllHeaderLen] != want {
+			t.Errorf("Failed header. wanted %q, got %q", want, value[:hllHeaderLen])
+		}
+	})
+
+	t.Run("encodes like it decodes", func(t *testing.T) {
+		for _, encoded := range []string{sparseHLL(0, 1), sparseHLL(hllRegisters-1, 32), run(t, "GET", "hll:large").val} {
+			h, errTok := parseHyperLogLog(encoded)
+			if errTok != nil {
+				t.Fatalf("Failed parse. got %v", *errTok)
+			}
+			if got := h.String(); got != encoded {
+				t.Errorf("Failed encoding. wanted %q, got %q", encoded[:32], got[:32])
+			}
+		}
+	})
+
+	t.Run("corrupted sparse value", func(t *testing.T) {
+		run(t, "SET", "hll:corrupt", sparseHLL(1000, 3)[:20])
+
+		if got := run(t, "PFCOUNT", "hll:corrupt"); !reflect.DeepEqual(got, errCorruptHLL) {
+			t.Errorf("Failed pfcount. wanted %v, got %v", errCorruptHLL, got)
+		}
+	})
+
+	t.Run("dense value of the wrong size", func(t *testing.T) {
+		run(t, "SET", "hll:short", "HYLL\x00"+strings.Repeat("\x00", 20))
+
+		if got := run(t, "PFCOUNT", "hll:short"); !reflect.DeepEqual(got, errNotHLL) {
+			t.Errorf("Failed pfcount. wanted %v, got %v", errNotHLL, got)
+		}
+	})
+}
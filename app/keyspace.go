@@ -0,0 +1,289 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// clone returns a deep copy of obj so the copy can be modified
+// independently of the original
+func (obj object) clone() object {
+	c := obj
+	c.createdAt = time.Now().UTC()
+
+	if obj.streamData != nil {
+		c.streamData = obj.streamData.clone()
+	}
+
+	if obj.listData != nil {
+		c.listData = append([]string(nil), obj.listData...)
+		c.listArray = nil
+	}
+
+	if obj.bitmap != nil {
+		c.bitmap = append([]byte{}, obj.bitmap...)
+	}
+
+	if obj.hashData != nil {
+		c.hashData = make(map[string]string, len(obj.hashData))
+		c.index = newScanIndex()
+		for k, v := range obj.hashData {
+			c.hashData[k] = v
+			c.index.add(k)
+		}
+	}
+
+	if obj.setData != nil {
+		c.setData = make(map[string]struct{}, len(obj.setData))
+		c.index = newScanIndex()
+		for k := range obj.setData {
+			c.setData[k] = struct{}{}
+			c.index.add(k)
+		}
+	}
+
+	if obj.zsetData != nil {
+		c.zsetData = newZset()
+		for member, score := range obj.zsetData.dict {
+			c.zsetData.add(member, score)
+		}
+	}
+
+	return c
+}
+
+// putKey writes obj under key, indexing the key for SCAN if it is new.
+// Callers must hold mux.
+func putKey(key string, obj object) {
+	if _, exists := datastore[key]; !exists {
+		keyIndex.add(key)
+	}
+
+	datastore[key] = obj
+}
+
+// removeKey deletes key and drops it from the SCAN index.
+// Callers must hold mux.
+func removeKey(key string) {
+	if _, exists := datastore[key]; exists {
+		delete(datastore, key)
+		keyIndex.remove(key)
+	}
+}
+
+// storeObject writes obj under key, registering its TTL if it has one and
+// serving clients blocked on the key. Callers must hold mux.
+func storeObject(key string, obj object) {
+	putKey(key, obj)
+
+	if obj.expiry != 0 {
+		trackExpiry(key)
+	}
+
+	serveBlockedClients(key)
+}
+
+// deleteKeys removes every existing key in args and returns how many
+// there were. Callers must hold mux.
+func deleteKeys(args []token) int {
+	deleted := 0
+	for _, arg := range args {
+		if _, exists := lookupKey(arg.bulk); exists {
+			removeKey(arg.bulk)
+			delete(expires, arg.bulk)
+			notifyKeyspaceEvent(notifyGeneric, "del", arg.bulk)
+			deleted++
+		}
+	}
+
+	return deleted
+}
+
+// DEL key [key ...]
+func del(args []token) token {
+	if len(args) < 1 {
+		return wrongArgs("DEL")
+	}
+
+	return intToken(deleteKeys(args))
+}
+
+// UNLINK key [key ...]
+// Values are reclaimed by the garbage collector anyway,
+// so this is the same as DEL.
+func unlink(args []token) token {
+	if len(args) < 1 {
+		return wrongArgs("UNLINK")
+	}
+
+	return intToken(deleteKeys(args))
+}
+
+func countExisting(command string, args []token) token {
+	if len(args) < 1 {
+		return wrongArgs(command)
+	}
+
+	// Keys given more than once are counted more than once
+	count := 0
+	for _, arg := range args {
+		if _, exists := lookupKey(arg.bulk); exists {
+			count++
+		}
+	}
+
+	return intToken(count)
+}
+
+// EXISTS key [key ...]
+func keysExist(args []token) token {
+	return countExisting("EXISTS", args)
+}
+
+// TOUCH key [key ...]
+func touch(args []token) token {
+	return countExisting("TOUCH", args)
+}
+
+func renameGeneric(command string, args []token, nx bool) token {
+	if len(args) != 2 {
+		return wrongArgs(command)
+	}
+
+	src, dst := args[0].bulk, args[1].bulk
+
+	obj, exists := lookupKey(src)
+	if !exists {
+		return token{typ: string(ERROR), val: "ERR no such key"}
+	}
+
+	if nx {
+		if _, taken := lookupKey(dst); taken {
+			return intToken(0)
+		}
+	}
+
+	if src != dst {
+		removeKey(src)
+		delete(expires, src)
+		storeObject(dst, obj)
+	}
+
+	notifyKeyspaceEvent(notifyGeneric, "rename_from", src)
+	notifyKeyspaceEvent(notifyGeneric, "rename_to", dst)
+
+	if nx {
+		return intToken(1)
+	}
+
+	return token{typ: string(STRING), val: "OK"}
+}
+
+// RENAME key newkey
+func rename(args []token) token {
+	return renameGeneric("RENAME", args, false)
+}
+
+// RENAMENX key newkey
+func renamenx(args []token) token {
+	return renameGeneric("RENAMENX", args, true)
+}
+
+// COPY source destination [DB destination-db] [REPLACE]
+func copyKey(args []token) token {
+	if len(args) < 2 {
+		return wrongArgs("COPY")
+	}
+
+	replace := false
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i].bulk) {
+		case "REPLACE":
+			replace = true
+		case "DB":
+			// Only database 0 exists
+			if i+1 >= len(args) {
+				return errSyntax
+			}
+			if args[i+1].bulk != "0" {
+				return token{typ: string(ERROR), val: "ERR DB index is out of range"}
+			}
+			i++
+		default:
+			return errSyntax
+		}
+	}
+
+	src, dst := args[0].bulk, args[1].bulk
+	if src == dst {
+		return token{typ: string(ERROR), val: "ERR source and destination objects are the same"}
+	}
+
+	obj, exists := lookupKey(src)
+	if !exists {
+		return intToken(0)
+	}
+
+	if _, taken := lookupKey(dst); taken && !replace {
+		return intToken(0)
+	}
+
+	storeObject(dst, obj.clone())
+	notifyKeyspaceEvent(notifyGeneric, "copy_to", dst)
+
+	return intToken(1)
+}
+
+// RANDOMKEY
+func randomkey(args []token) token {
+	if len(args) != 0 {
+		return wrongArgs("RANDOMKEY")
+	}
+
+	// Map iteration starts at a random position
+	for key := range datastore {
+		if _, exists := lookupKey(key); exists {
+			return token{typ: string(BULK), bulk: key}
+		}
+	}
+
+	return token{typ: string(NULL)}
+}
+
+// DBSIZE
+func dbsize(args []token) token {
+	if len(args) != 0 {
+		return wrongArgs("DBSIZE")
+	}
+
+	return intToken(len(datastore))
+}
+
+// FLUSHALL [ASYNC|SYNC]
+// Values are reclaimed by the garbage collector anyway,
+// so both modes are the same.
+func flushall(args []token) token {
+	if len(args) > 1 {
+		return errSyntax
+	}
+	if len(args) == 1 {
+		switch strings.ToUpper(args[0].bulk) {
+		case "ASYNC", "SYNC":
+		default:
+			return errSyntax
+		}
+	}
+
+	// Watching a key that goes away counts as seeing it change
+	for key := range keyVersions {
+		if _, exists := datastore[key]; exists {
+			touchWatchedKey(key)
+		}
+	}
+
+	clear(datastore)
+	keyIndex = newScanIndex()
+	clear(expires)
+
+	return token{typ: string(STRING), val: "OK"}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestKeyspace(t *testing.T) {
+	t.Run("del and exists", func(t *testing.T) {
+		run(t, "SET", "ks:a", "1")
+		run(t, "RPUSH", "ks:b", "x")
+
+		if got := run(t, "EXISTS", "ks:a", "ks:b", "ks:a", "ks:none"); !reflect.DeepEqual(got, intToken(3)) {
+			t.Errorf("Failed exists. wanted %v, got %v", intToken(3), got)
+		}
+		if got := run(t, "DEL", "ks:a", "ks:b", "ks:none"); !reflect.DeepEqual(got, intToken(2)) {
+			t.Errorf("Failed del. wanted %v, got %v", intToken(2), got)
+		}
+		if got := run(t, "UNLINK", "ks:a"); !reflect.DeepEqual(got, intToken(0)) {
+			t.Errorf("Failed unlink. wanted %v, got %v", intToken(0), got)
+		}
+	})
+
+	t.Run("rename keeps the ttl", func(t *testing.T) {
+		run(t, "SET", "ks:old", "v", "EX", "100")
+
+		want := token{typ: string(STRING), val: "OK"}
+		if got := run(t, "RENAME", "ks:old", "ks:new"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed rename. wanted %v, got %v", want, got)
+		}
+		if got := run(t, "TTL", "ks:new"); !reflect.DeepEqual(got, intToken(100)) {
+			t.Errorf("Failed rename ttl. wanted %v, got %v", intToken(100), got)
+		}
+
+		want = token{typ: string(ERROR), val: "ERR no such key"}
+		if got := run(t, "RENAME", "ks:old", "ks:new"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed rename. wanted %v, got %v", want, got)
+		}
+
+		run(t, "SET", "ks:other", "v")
+		if got := run(t, "RENAMENX", "ks:new", "ks:other"); !reflect.DeepEqual(got, intToken(0)) {
+			t.Errorf("Failed renamenx. wanted %v, got %v", intToken(0), got)
+		}
+	})
+
+	t.Run("copy is independent of the source", func(t *testing.T) {
+		run(t, "RPUSH", "ks:src", "a")
+
+		if got := run(t, "COPY", "ks:src", "ks:dst"); !reflect.DeepEqual(got, intToken(1)) {
+			t.Errorf("Failed copy. wanted %v, got %v", intToken(1), got)
+		}
+		if got := run(t, "COPY", "ks:src", "ks:dst"); !reflect.DeepEqual(got, intToken(0)) {
+			t.Errorf("Failed copy. wanted %v, got %v", intToken(0), got)
+		}
+
+		run(t, "RPUSH", "ks:dst", "b")
+		want := bulkArray([]string{"a"})
+		if got := run(t, "LRANGE", "ks:src", "0", "-1"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed copy. wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("randomkey and dbsize", func(t *testing.T) {
+		run(t, "SET", "ks:random", "v")
+
+		if got := run(t, "RANDOMKEY"); got.typ != string(BULK) {
+			t.Errorf("Failed randomkey. got %v", got)
+		}
+		if got := run(t, "DBSIZE"); got.typ != string(INTEGER) || got.val == "0" {
+			t.Errorf("Failed dbsize. got %v", got)
+		}
+	})
+}
@@ -0,0 +1,616 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lookupList returns the list stored at key. A missing key yields an
+// empty list, ok is false when the key holds another type.
+// Callers must hold mux.
+func lookupList(key string) (list []string, ok bool) {
+	obj, exists := lookupKey(key)
+	if !exists {
+		return nil, true
+	}
+
+	if obj.typ != "list" {
+		return nil, false
+	}
+
+	return obj.listData, true
+}
+
+// storeList writes list back to key, keeping any expiry already set, and
+// fires event for it. Empty lists are removed from the datastore like in
+// Redis, which fires a del event as well. Callers must hold mux.
+func storeList(key string, list []string, event string) {
+	storeListIn(key, datastore[key].listArray, list, event)
+}
+
+// storeListIn is storeList for a list that may lie in array, whose room
+// before the list is kept for later pushes to the head
+func storeListIn(key string, array, list []string, event string) {
+	notifyKeyspaceEvent(notifyList, event, key)
+
+	if len(list) == 0 {
+		if _, exists := datastore[key]; exists {
+			removeKey(key)
+			notifyKeyspaceEvent(notifyGeneric, "del", key)
+		}
+		return
+	}
+
+	obj, exists := datastore[key]
+	if !exists || obj.typ != "list" {
+		obj = object{
+			typ:       "list",
+			createdAt: time.Now().UTC(),
+		}
+	}
+
+	if _, ok := listOffset(array, list); !ok {
+		array = list[:cap(list)]
+	}
+
+	obj.listData = list
+	obj.listArray = array
+	putKey(key, obj)
+}
+
+// listOffset returns where list starts within array, ok is false when it
+// doesn't lie in array
+func listOffset(array, list []string) (offset int, ok bool) {
+	offset = cap(array) - cap(list)
+	if cap(list) == 0 || offset < 0 || offset >= cap(array) {
+		return 0, false
+	}
+
+	return offset, &array[:cap(array)][offset] == &list[:1][0]
+}
+
+// prependList pushes elements onto the head of list in turn, using the
+// room array has before it when there is enough, and returns the array
+// the result lies in along with it
+func prependList(array, list []string, elements ...string) ([]string, []string) {
+	room, ok := listOffset(array, list)
+	if !ok || room < len(elements) {
+		// A new array leaves as much room at both ends as the list takes,
+		// so pushes to either end cost amortized O(1)
+		n := len(list) + len(elements)
+		array = make([]string, 3*n)
+		room = 2*n - len(list)
+		copy(array[room:], list)
+	}
+
+	for _, element := range elements {
+		room--
+		array[room] = element
+	}
+
+	return array, array[room : room+len(elements)+len(list)]
+}
+
+// listIndex converts a possibly negative index into an offset into a list
+// of length n. The result may still be out of range.
+func listIndex(index, n int) int {
+	if index < 0 {
+		return n + index
+	}
+
+	return index
+}
+
+// listRange normalises start/stop the way LRANGE and LTRIM do and returns
+// the half-open interval [from, to). An empty range has from >= to.
+func listRange(start, stop, n int) (int, int) {
+	start = listIndex(start, n)
+	stop = listIndex(stop, n)
+
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	if start > stop || start >= n {
+		return 0, 0
+	}
+
+	return start, stop + 1
+}
+
+func push(command string, args []token, left, onlyExisting bool) token {
+	if len(args) < 2 {
+		return wrongArgs(command)
+	}
+
+	key := args[0].bulk
+
+	list, ok := lookupList(key)
+	if !ok {
+		return errWrongType
+	}
+
+	if onlyExisting && len(list) == 0 {
+		return intToken(0)
+	}
+
+	elements := make([]string, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		elements = append(elements, arg.bulk)
+	}
+
+	if left {
+		// Each element is pushed onto the head in turn, so they end up reversed
+		var array []string
+		array, list = prependList(datastore[key].listArray, list, elements...)
+		storeListIn(key, array, list, "lpush")
+	} else {
+		list = append(list, elements...)
+		storeList(key, list, "rpush")
+	}
+	serveBlockedClients(key)
+
+	return intToken(len(list))
+}
+
+// LPUSH key element [element ...]
+func lpush(args []token) token {
+	return push("LPUSH", args, true, false)
+}
+
+// RPUSH key element [element ...]
+func rpush(args []token) token {
+	return push("RPUSH", args, false, false)
+}
+
+// LPUSHX key element [element ...]
+func lpushx(args []token) token {
+	return push("LPUSHX", args, true, true)
+}
+
+// RPUSHX key element [element ...]
+func rpushx(args []token) token {
+	return push("RPUSHX", args, false, true)
+}
+
+func pop(command string, args []token, left bool) token {
+	if len(args) < 1 || len(args) > 2 {
+		return wrongArgs(command)
+	}
+
+	count := 1
+	withCount := len(args) == 2
+	if withCount {
+		n, err := strconv.Atoi(args[1].bulk)
+		if err != nil || n < 0 {
+			return token{typ: string(ERROR), val: "ERR value is out of range, must be positive"}
+		}
+		count = n
+	}
+
+	key := args[0].bulk
+
+	list, ok := lookupList(key)
+	if !ok {
+		return errWrongType
+	}
+
+	if len(list) == 0 {
+		if withCount {
+			return token{typ: string(NULLARRAY)}
+		}
+		return token{typ: string(NULL)}
+	}
+
+	if count > len(list) {
+		count = len(list)
+	}
+
+	popped := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		// Popped slots are cleared, as the array outlives them
+		if left {
+			popped = append(popped, list[0])
+			list[0] = ""
+			list = list[1:]
+		} else {
+			popped = append(popped, list[len(list)-1])
+			list[len(list)-1] = ""
+			list = list[:len(list)-1]
+		}
+	}
+
+	event := "rpop"
+	if left {
+		event = "lpop"
+	}
+	storeList(key, list, event)
+
+	if !withCount {
+		return token{typ: string(BULK), bulk: popped[0]}
+	}
+
+	return bulkArray(popped)
+}
+
+// LPOP key [count]
+func lpop(args []token) token {
+	return pop("LPOP", args, true)
+}
+
+// RPOP key [count]
+func rpop(args []token) token {
+	return pop("RPOP", args, false)
+}
+
+// LRANGE key start stop
+func lrange(args []token) token {
+	if len(args) != 3 {
+		return wrongArgs("LRANGE")
+	}
+
+	start, err := strconv.Atoi(args[1].bulk)
+	if err != nil {
+		return errNotInteger
+	}
+	stop, err := strconv.Atoi(args[2].bulk)
+	if err != nil {
+		return errNotInteger
+	}
+
+	list, ok := lookupList(args[0].bulk)
+	if !ok {
+		return errWrongType
+	}
+
+	from, to := listRange(start, stop, len(list))
+
+	return bulkArray(list[from:to])
+}
+
+// LLEN key
+func llen(args []token) token {
+	if len(args) != 1 {
+		return wrongArgs("LLEN")
+	}
+
+	list, ok := lookupList(args[0].bulk)
+	if !ok {
+		return errWrongType
+	}
+
+	return intToken(len(list))
+}
+
+// LINDEX key index
+func lindex(args []token) token {
+	if len(args) != 2 {
+		return wrongArgs("LINDEX")
+	}
+
+	index, err := strconv.Atoi(args[1].bulk)
+	if err != nil {
+		return errNotInteger
+	}
+
+	list, ok := lookupList(args[0].bulk)
+	if !ok {
+		return errWrongType
+	}
+
+	index = listIndex(index, len(list))
+	if index < 0 || index >= len(list) {
+		return token{typ: string(NULL)}
+	}
+
+	return token{typ: string(BULK), bulk: list[index]}
+}
+
+// LSET key index element
+func lset(args []token) token {
+	if len(args) != 3 {
+		return wrongArgs("LSET")
+	}
+
+	index, err := strconv.Atoi(args[1].bulk)
+	if err != nil {
+		return errNotInteger
+	}
+
+	list, ok := lookupList(args[0].bulk)
+	if !ok {
+		return errWrongType
+	}
+
+	if len(list) == 0 {
+		return token{typ: string(ERROR), val: "ERR no such key"}
+	}
+
+	index = listIndex(index, len(list))
+	if index < 0 || index >= len(list) {
+		return token{typ: string(ERROR), val: "ERR index out of range"}
+	}
+
+	list[index] = args[2].bulk
+	notifyKeyspaceEvent(notifyList, "lset", args[0].bulk)
+
+	return token{typ: string(STRING), val: "OK"}
+}
+
+// LTRIM key start stop
+func ltrim(args []token) token {
+	if len(args) != 3 {
+		return wrongArgs("LTRIM")
+	}
+
+	start, err := strconv.Atoi(args[1].bulk)
+	if err != nil {
+		return errNotInteger
+	}
+	stop, err := strconv.Atoi(args[2].bulk)
+	if err != nil {
+		return errNotInteger
+	}
+
+	key := args[0].bulk
+	list, ok := lookupList(key)
+	if !ok {
+		return errWrongType
+	}
+
+	if len(list) == 0 {
+		return token{typ: string(STRING), val: "OK"}
+	}
+
+	from, to := listRange(start, stop, len(list))
+	storeList(key, list[from:to], "ltrim")
+
+	return token{typ: string(STRING), val: "OK"}
+}
+
+// LINSERT key BEFORE|AFTER pivot element
+func linsert(args []token) token {
+	if len(args) != 4 {
+		return wrongArgs("LINSERT")
+	}
+
+	var after bool
+	switch strings.ToUpper(args[1].bulk) {
+	case "BEFORE":
+		after = false
+	case "AFTER":
+		after = true
+	default:
+		return errSyntax
+	}
+
+	key := args[0].bulk
+	list, ok := lookupList(key)
+	if !ok {
+		return errWrongType
+	}
+
+	if len(list) == 0 {
+		return intToken(0)
+	}
+
+	for i, v := range list {
+		if v != args[2].bulk {
+			continue
+		}
+
+		if after {
+			i++
+		}
+
+		list = append(list[:i], append([]string{args[3].bulk}, list[i:]...)...)
+		storeList(key, list, "linsert")
+
+		return intToken(len(list))
+	}
+
+	return intToken(-1)
+}
+
+// LREM key count element
+func lrem(args []token) token {
+	if len(args) != 3 {
+		return wrongArgs("LREM")
+	}
+
+	count, err := strconv.Atoi(args[1].bulk)
+	if err != nil {
+		return errNotInteger
+	}
+
+	key := args[0].bulk
+	list, ok := lookupList(key)
+	if !ok {
+		return errWrongType
+	}
+
+	element := args[2].bulk
+	limit := count
+	if limit < 0 {
+		limit = -limit
+	}
+
+	// Mark the matching positions first, scanning from the tail when count is negative
+	drop := make(map[int]bool)
+	for i := range list {
+		pos := i
+		if count < 0 {
+			pos = len(list) - 1 - i
+		}
+
+		if list[pos] == element {
+			drop[pos] = true
+			if limit > 0 && len(drop) == limit {
+				break
+			}
+		}
+	}
+
+	if len(drop) == 0 {
+		return intToken(0)
+	}
+
+	kept := make([]string, 0, len(list)-len(drop))
+	for i, v := range list {
+		if !drop[i] {
+			kept = append(kept, v)
+		}
+	}
+
+	storeList(key, kept, "lrem")
+
+	return intToken(len(drop))
+}
+
+// LPOS key element [RANK rank] [COUNT num-matches] [MAXLEN len]
+func lpos(args []token) token {
+	if len(args) < 2 || len(args)%2 != 0 {
+		return wrongArgs("LPOS")
+	}
+
+	rank, count, maxLen := 1, -1, 0
+	for i := 2; i < len(args); i += 2 {
+		n, err := strconv.Atoi(args[i+1].bulk)
+		if err != nil {
+			return errNotInteger
+		}
+
+		switch strings.ToUpper(args[i].bulk) {
+		case "RANK":
+			if n == 0 {
+				return token{
+					typ: string(ERROR),
+					val: "ERR RANK can't be zero: use 1 to start from the first match, 2 from the second ... or use negative to start from the end of the list",
+				}
+			}
+			rank = n
+		case "COUNT":
+			if n < 0 {
+				return token{typ: string(ERROR), val: "ERR COUNT can't be negative"}
+			}
+			count = n
+		case "MAXLEN":
+			if n < 0 {
+				return token{typ: string(ERROR), val: "ERR MAXLEN can't be negative"}
+			}
+			maxLen = n
+		default:
+			return errSyntax
+		}
+	}
+
+	list, ok := lookupList(args[0].bulk)
+	if !ok {
+		return errWrongType
+	}
+
+	skip := rank - 1
+	if rank < 0 {
+		skip = -rank - 1
+	}
+
+	matches := []token{}
+	for i := range list {
+		if maxLen > 0 && i >= maxLen {
+			break
+		}
+
+		pos := i
+		if rank < 0 {
+			pos = len(list) - 1 - i
+		}
+
+		if list[pos] != args[1].bulk {
+			continue
+		}
+
+		if skip > 0 {
+			skip--
+			continue
+		}
+
+		matches = append(matches, intToken(pos))
+		if count == -1 || (count > 0 && len(matches) == count) {
+			break
+		}
+	}
+
+	if count == -1 {
+		if len(matches) == 0 {
+			return token{typ: string(NULL)}
+		}
+		return matches[0]
+	}
+
+	return token{typ: string(ARRAY), array: matches}
+}
+
+// LMOVE source destination LEFT|RIGHT LEFT|RIGHT
+func lmove(args []token) token {
+	if len(args) != 4 {
+		return wrongArgs("LMOVE")
+	}
+
+	from, to := strings.ToUpper(args[2].bulk), strings.ToUpper(args[3].bulk)
+	if (from != "LEFT" && from != "RIGHT") || (to != "LEFT" && to != "RIGHT") {
+		return errSyntax
+	}
+
+	return moveElement(args[0].bulk, args[1].bulk, from == "LEFT", to == "LEFT")
+}
+
+// moveElement pops an element from one end of src and pushes it onto dst.
+// Callers must hold mux.
+func moveElement(src, dst string, fromLeft, toLeft bool) token {
+	srcList, ok := lookupList(src)
+	if !ok {
+		return errWrongType
+	}
+	if _, ok := lookupList(dst); !ok {
+		return errWrongType
+	}
+
+	if len(srcList) == 0 {
+		return token{typ: string(NULL)}
+	}
+
+	element := popElement(src, srcList, fromLeft)
+
+	// Re-read the destination as it may be the same key as the source
+	dstList, _ := lookupList(dst)
+	if toLeft {
+		array, list := prependList(datastore[dst].listArray, dstList, element)
+		storeListIn(dst, array, list, "lpush")
+	} else {
+		storeList(dst, append(dstList, element), "rpush")
+	}
+	serveBlockedClients(dst)
+
+	return token{typ: string(BULK), bulk: element}
+}
+
+// popElement removes one element from the head or tail of list, which must
+// be the non-empty list stored at key. Callers must hold mux.
+func popElement(key string, list []string, fromLeft bool) string {
+	element, event := "", "rpop"
+	if fromLeft {
+		element, event = list[0], "lpop"
+		list[0] = ""
+		list = list[1:]
+	} else {
+		element = list[len(list)-1]
+		list[len(list)-1] = ""
+		list = list[:len(list)-1]
+	}
+	storeList(key, list, event)
+
+	return element
+}
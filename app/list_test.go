@@ -0,0 +1,150 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestList(t *testing.T) {
+	t.Run("push and range", func(t *testing.T) {
+		if got := run(t, "RPUSH", "list:a", "b", "c"); !reflect.DeepEqual(got, intToken(2)) {
+			t.Errorf("Failed rpush. wanted %v, got %v", intToken(2), got)
+		}
+		if got := run(t, "LPUSH", "list:a", "a", "z"); !reflect.DeepEqual(got, intToken(4)) {
+			t.Errorf("Failed lpush. wanted %v, got %v", intToken(4), got)
+		}
+
+		want := bulkArray([]string{"z", "a", "b", "c"})
+		if got := run(t, "LRANGE", "list:a", "0", "-1"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed lrange. wanted %v, got %v", want, got)
+		}
+
+		want = bulkArray([]string{"a", "b"})
+		if got := run(t, "LRANGE", "list:a", "1", "-2"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed lrange. wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("queue through the head", func(t *testing.T) {
+		for i := 0; i < 100; i++ {
+			run(t, "LPUSH", "list:queue", strconv.Itoa(i))
+			if i%2 == 1 {
+				want := token{typ: string(BULK), bulk: strconv.Itoa(i / 2)}
+				if got := run(t, "RPOP", "list:queue"); !reflect.DeepEqual(got, want) {
+					t.Fatalf("Failed rpop. wanted %v, got %v", want, got)
+				}
+			}
+		}
+
+		if got := run(t, "LLEN", "list:queue"); !reflect.DeepEqual(got, intToken(50)) {
+			t.Errorf("Failed llen. wanted %v, got %v", intToken(50), got)
+		}
+
+		// Pushes to the head use the room left before the list
+		mux.Lock()
+		obj := datastore["list:queue"]
+		mux.Unlock()
+		if array, _ := prependList(obj.listArray, obj.listData, "x"); &array[0] != &obj.listArray[0] {
+			t.Errorf("Failed lpush. wanted the list to stay in its array")
+		}
+	})
+
+	t.Run("pop", func(t *testing.T) {
+		run(t, "RPUSH", "list:pop", "1", "2", "3", "4")
+
+		want := token{typ: string(BULK), bulk: "1"}
+		if got := run(t, "LPOP", "list:pop"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed lpop. wanted %v, got %v", want, got)
+		}
+
+		want = bulkArray([]string{"4", "3", "2"})
+		if got := run(t, "RPOP", "list:pop", "5"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed rpop. wanted %v, got %v", want, got)
+		}
+
+		// Emptied lists are removed
+		want = token{typ: string(STRING), val: "none"}
+		if got := run(t, "TYPE", "list:pop"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed type. wanted %v, got %v", want, got)
+		}
+
+		want = token{typ: string(NULL)}
+		if got := run(t, "LPOP", "list:pop"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed lpop. wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("index, set and trim", func(t *testing.T) {
+		run(t, "RPUSH", "list:idx", "a", "b", "c", "d")
+
+		want := token{typ: string(BULK), bulk: "d"}
+		if got := run(t, "LINDEX", "list:idx", "-1"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed lindex. wanted %v, got %v", want, got)
+		}
+
+		want = token{typ: string(ERROR), val: "ERR index out of range"}
+		if got := run(t, "LSET", "list:idx", "10", "x"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed lset. wanted %v, got %v", want, got)
+		}
+
+		run(t, "LSET", "list:idx", "0", "x")
+		run(t, "LTRIM", "list:idx", "0", "1")
+
+		want = bulkArray([]string{"x", "b"})
+		if got := run(t, "LRANGE", "list:idx", "0", "-1"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed ltrim. wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("insert, rem and pos", func(t *testing.T) {
+		run(t, "RPUSH", "list:rem", "a", "b", "a", "c", "a")
+		run(t, "LINSERT", "list:rem", "BEFORE", "c", "x")
+
+		want := token{typ: string(ARRAY), array: []token{intToken(0), intToken(2), intToken(5)}}
+		if got := run(t, "LPOS", "list:rem", "a", "COUNT", "0"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed lpos. wanted %v, got %v", want, got)
+		}
+
+		if got := run(t, "LREM", "list:rem", "-2", "a"); !reflect.DeepEqual(got, intToken(2)) {
+			t.Errorf("Failed lrem. wanted %v, got %v", intToken(2), got)
+		}
+
+		want = bulkArray([]string{"a", "b", "x", "c"})
+		if got := run(t, "LRANGE", "list:rem", "0", "-1"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed lrem. wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("lmove", func(t *testing.T) {
+		run(t, "RPUSH", "list:src", "1", "2")
+
+		want := token{typ: string(BULK), bulk: "2"}
+		if got := run(t, "LMOVE", "list:src", "list:dst", "RIGHT", "LEFT"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed lmove. wanted %v, got %v", want, got)
+		}
+
+		want = bulkArray([]string{"2"})
+		if got := run(t, "LRANGE", "list:dst", "0", "-1"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed lmove. wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("wrong type", func(t *testing.T) {
+		run(t, "SET", "list:str", "value")
+
+		if got := run(t, "LPUSH", "list:str", "a"); !reflect.DeepEqual(got, errWrongType) {
+			t.Errorf("Failed wrongtype. wanted %v, got %v", errWrongType, got)
+		}
+
+		run(t, "RPUSH", "list:list", "a")
+		if got := run(t, "GET", "list:list"); !reflect.DeepEqual(got, errWrongType) {
+			t.Errorf("Failed wrongtype. wanted %v, got %v", errWrongType, got)
+		}
+
+		want := token{typ: string(STRING), val: "list"}
+		if got := run(t, "TYPE", "list:list"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed type. wanted %v, got %v", want, got)
+		}
+	})
+}
@@ -0,0 +1,136 @@
+package main
+
+// Keyspace notifications are pub/sub messages about changes to keys.
+// For an event of an enabled class, __keyspace@0__:<key> receives the
+// event name and __keyevent@0__:<event> receives the key, depending on
+// whether K and E are part of notify-keyspace-events.
+
+// Keyspace event classes and where they go, the flags of
+// notify-keyspace-events
+const (
+	notifyKeyspace = 1 << iota // K
+	notifyKeyevent             // E
+	notifyGeneric              // g
+	notifyString               // $
+	notifyList                 // l
+	notifySet                  // s
+	notifyHash                 // h
+	notifyZset                 // z
+	notifyExpired              // x
+	notifyEvicted              // e
+	notifyStream               // t
+	notifyKeyMiss              // m
+	notifyModule               // d
+	notifyNew                  // n
+
+	// notifyAll is what A stands for, the misses and new keys have to
+	// be asked for explicitly
+	notifyAll = notifyGeneric | notifyString | notifyList | notifySet | notifyHash |
+		notifyZset | notifyExpired | notifyEvicted | notifyStream | notifyModule
+)
+
+// keyspaceEventClasses maps the characters of notify-keyspace-events to
+// their classes, in the order CONFIG GET lists them
+var keyspaceEventClasses = []struct {
+	char  byte
+	class int
+}{
+	{'g', notifyGeneric},
+	{'$', notifyString},
+	{'l', notifyList},
+	{'s', notifySet},
+	{'h', notifyHash},
+	{'z', notifyZset},
+	{'x', notifyExpired},
+	{'e', notifyEvicted},
+	{'t', notifyStream},
+	{'d', notifyModule},
+	{'n', notifyNew},
+}
+
+// notifyKeyspaceEvents holds the enabled classes, none by default.
+// Guarded by mux.
+var notifyKeyspaceEvents int
+
+// parseKeyspaceEvents turns a notify-keyspace-events string into flags
+func parseKeyspaceEvents(s string) (int, bool) {
+	flags := 0
+
+outer:
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case 'A':
+			flags |= notifyAll
+			continue
+		case 'K':
+			flags |= notifyKeyspace
+			continue
+		case 'E':
+			flags |= notifyKeyevent
+			continue
+		case 'm':
+			flags |= notifyKeyMiss
+			continue
+		}
+
+		for _, c := range keyspaceEventClasses {
+			if c.char == s[i] {
+				flags |= c.class
+				continue outer
+			}
+		}
+
+		return 0, false
+	}
+
+	return flags, true
+}
+
+// keyspaceEventsString is the canonical notify-keyspace-events string
+// for flags
+func keyspaceEventsString(flags int) string {
+	var s []byte
+
+	if flags&notifyAll == notifyAll {
+		s = append(s, 'A')
+		if flags&notifyNew != 0 {
+			s = append(s, 'n')
+		}
+	} else {
+		for _, c := range keyspaceEventClasses {
+			if flags&c.class != 0 {
+				s = append(s, c.char)
+			}
+		}
+	}
+
+	if flags&notifyKeyspace != 0 {
+		s = append(s, 'K')
+	}
+	if flags&notifyKeyevent != 0 {
+		s = append(s, 'E')
+	}
+	if flags&notifyKeyMiss != 0 {
+		s = append(s, 'm')
+	}
+
+	return string(s)
+}
+
+// notifyKeyspaceEvent publishes event about key if its class is
+// enabled. As every change to a key goes through here, it also bumps
+// the version WATCH looks at. Callers must hold mux.
+func notifyKeyspaceEvent(class int, event, key string) {
+	touchWatchedKey(key)
+
+	if notifyKeyspaceEvents&class == 0 {
+		return
+	}
+
+	if notifyKeyspaceEvents&notifyKeyspace != 0 {
+		publish("__keyspace@0__:"+key, event)
+	}
+	if notifyKeyspaceEvents&notifyKeyevent != 0 {
+		publish("__keyevent@0__:"+event, key)
+	}
+}
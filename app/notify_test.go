@@ -0,0 +1,92 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestKeyspaceNotifications(t *testing.T) {
+	t.Cleanup(func() { run(t, "CONFIG", "SET", "notify-keyspace-events", "") })
+	run(t, "CONFIG", "SET", "notify-keyspace-events", "Kg$lhx")
+
+	subscriber := newTestConn(t)
+	client := newTestConn(t)
+
+	if got, want := subscriber.do(t, "PSUBSCRIBE", "__keyspace@0__:nt:*"), pushed("psubscribe", "__keyspace@0__:nt:*", 1); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Failed psubscribe. wanted %v, got %v", want, got)
+	}
+
+	// keyspace is what the subscriber receives for event on key
+	keyspace := func(key, event string) token {
+		return pushed("pmessage", "__keyspace@0__:nt:*", "__keyspace@0__:"+key, event)
+	}
+
+	cases := []struct {
+		name string
+		args []string
+		want []token
+	}{
+		{"set with a ttl", []string{"SET", "nt:str", "1", "EX", "100"}, []token{keyspace("nt:str", "set"), keyspace("nt:str", "expire")}},
+		{"incr", []string{"INCR", "nt:str"}, []token{keyspace("nt:str", "incrby")}},
+		{"persist", []string{"PERSIST", "nt:str"}, []token{keyspace("nt:str", "persist")}},
+		{"rename", []string{"RENAME", "nt:str", "nt:other"}, []token{keyspace("nt:str", "rename_from"), keyspace("nt:other", "rename_to")}},
+		{"del", []string{"DEL", "nt:other"}, []token{keyspace("nt:other", "del")}},
+		{"rpush", []string{"RPUSH", "nt:list", "a"}, []token{keyspace("nt:list", "rpush")}},
+		{"pop the last element", []string{"LPOP", "nt:list"}, []token{keyspace("nt:list", "lpop"), keyspace("nt:list", "del")}},
+		{"hset", []string{"HSET", "nt:hash", "f", "v"}, []token{keyspace("nt:hash", "hset")}},
+		// Sets are not enabled, only the generic del comes through
+		{"disabled class", []string{"SADD", "nt:set", "m"}, nil},
+		{"generic event of a disabled class", []string{"DEL", "nt:set"}, []token{keyspace("nt:set", "del")}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client.send(t, c.args...)
+
+			for _, want := range c.want {
+				if got := subscriber.read(t); !reflect.DeepEqual(got, want) {
+					t.Errorf("Failed %s. wanted %v, got %v", c.name, want, got)
+				}
+			}
+
+			if got := client.read(t); got.typ == string(ERROR) {
+				t.Errorf("Failed %s. wanted a reply, got %v", c.name, got)
+			}
+		})
+	}
+
+	t.Run("expired", func(t *testing.T) {
+		client.send(t, "SET", "nt:gone", "1", "PX", "1")
+		for i := 0; i < 2; i++ {
+			subscriber.read(t)
+		}
+		client.read(t)
+		time.Sleep(5 * time.Millisecond)
+
+		client.send(t, "GET", "nt:gone")
+
+		if got, want := subscriber.read(t), keyspace("nt:gone", "expired"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed expired. wanted %v, got %v", want, got)
+		}
+		if got, want := client.read(t), (token{typ: string(NULL)}); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed get. wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("keyevent", func(t *testing.T) {
+		run(t, "CONFIG", "SET", "notify-keyspace-events", "E$")
+
+		if got, want := subscriber.do(t, "SUBSCRIBE", "__keyevent@0__:set"), pushed("subscribe", "__keyevent@0__:set", 2); !reflect.DeepEqual(got, want) {
+			t.Fatalf("Failed subscribe. wanted %v, got %v", want, got)
+		}
+
+		client.send(t, "MSET", "nt:a", "1", "nt:b", "2")
+		for _, key := range []string{"nt:a", "nt:b"} {
+			if got, want := subscriber.read(t), pushed("message", "__keyevent@0__:set", key); !reflect.DeepEqual(got, want) {
+				t.Errorf("Failed mset. wanted %v, got %v", want, got)
+			}
+		}
+		client.read(t)
+	})
+}
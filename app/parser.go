@@ -17,6 +17,8 @@ const (
 	SET     = '~'
 	NULL    = '_'
 	SYNC    = '?'
+	// Internal marker for the RESP2 null array (*-1), which has no prefix of its own
+	NULLARRAY = '.'
 )
 
 type token struct {
@@ -37,6 +39,23 @@ func NewResp(rd io.Reader) *Resp {
 	}
 }
 
+// watchClosed returns a channel that closes if the connection drops before
+// it sends anything more, and a function waiting for the watch to end.
+// Nothing is consumed, r may be read again once wait returns.
+func (r *Resp) watchClosed() (gone <-chan struct{}, wait func()) {
+	closed := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		if _, err := r.reader.Peek(1); err != nil {
+			close(closed)
+		}
+	}()
+
+	return closed, func() { <-done }
+}
+
 func (r *Resp) Read() (token, error) {
 	// Read the first byte to determine type
 	// By reading the first byte here, and because we're using a reader
@@ -55,6 +74,8 @@ func (r *Resp) Read() (token, error) {
 		return r.readString()
 	case ERROR:
 		return r.readError()
+	case INTEGER:
+		return r.readIntegerToken()
 	case SET:
 		return r.readSet()
 	default:
@@ -108,6 +129,11 @@ func (r *Resp) readArray() (t token, err error) {
 		return token{}, nil
 	}
 
+	// A negative size is the null array
+	if size < 0 {
+		return token{typ: string(NULLARRAY)}, nil
+	}
+
 	t.array = make([]token, 0)
 	for i := 0; i < size; i++ {
 		v, err := r.Read()
@@ -150,9 +176,16 @@ func (r *Resp) readBulk() (t token, err error) {
 		return token{}, nil
 	}
 
+	// A negative size is the null bulk string
+	if size < 0 {
+		return token{typ: string(NULL)}, nil
+	}
+
 	bulk := make([]byte, size)
 	// Read raw bytes from underlying reader
-	r.reader.Read(bulk)
+	if _, err := io.ReadFull(r.reader, bulk); err != nil {
+		return token{}, err
+	}
 	t.bulk = string(bulk)
 
 	r.readLine()
@@ -183,3 +216,15 @@ func (r *Resp) readError() (t token, err error) {
 	t.val = string(line)
 	return t, nil
 }
+
+func (r *Resp) readIntegerToken() (t token, err error) {
+	t.typ = string(INTEGER)
+
+	line, _, err := r.readLine()
+	if err != nil {
+		return token{}, err
+	}
+
+	t.val = string(line)
+	return t, nil
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Subscribers are kept in the order they subscribed, which is the order
+// messages reach them. Lock order is mux, then pubsubMux, then the
+// writeMux of a client, so that subscription confirmations always go
+// out before the first message on the channel.
+var (
+	pubsubMux          sync.Mutex
+	channelSubscribers = map[string][]*client{}
+	patternSubscribers = map[string][]*client{}
+
+	// Shard channels are grouped by the cluster slot they hash to
+	shardSubscribers = map[int]map[string][]*client{}
+)
+
+// subscribedModeCommands are the only commands a client with
+// subscriptions may run
+var subscribedModeCommands = map[string]bool{
+	"SUBSCRIBE":    true,
+	"UNSUBSCRIBE":  true,
+	"PSUBSCRIBE":   true,
+	"PUNSUBSCRIBE": true,
+	"SSUBSCRIBE":   true,
+	"SUNSUBSCRIBE": true,
+	"PING":         true,
+}
+
+// subscriptions counts the channels and patterns of c.
+// Callers must hold pubsubMux.
+func (c *client) subscriptions() int {
+	return len(c.channels) + len(c.patterns)
+}
+
+// shardSubscriptions counts the shard channels of c, which SSUBSCRIBE
+// and SUNSUBSCRIBE report apart from the others.
+// Callers must hold pubsubMux.
+func (c *client) shardSubscriptions() int {
+	return len(c.shardChannels)
+}
+
+// subscribed reports whether c is in subscribed mode
+func (c *client) subscribed() bool {
+	pubsubMux.Lock()
+	defer pubsubMux.Unlock()
+
+	return c.subscriptions()+c.shardSubscriptions() > 0
+}
+
+// removeClient returns subscribers without c
+func removeClient(subscribers []*client, c *client) []*client {
+	for i, s := range subscribers {
+		if s == c {
+			return append(subscribers[:i:i], subscribers[i+1:]...)
+		}
+	}
+
+	return subscribers
+}
+
+// unsubscribe drops channel from the subscriptions of c, reporting
+// whether it was there. Callers must hold pubsubMux.
+func (c *client) unsubscribe(channel string) bool {
+	if _, ok := c.channels[channel]; !ok {
+		return false
+	}
+
+	delete(c.channels, channel)
+	channelSubscribers[channel] = removeClient(channelSubscribers[channel], c)
+	if len(channelSubscribers[channel]) == 0 {
+		delete(channelSubscribers, channel)
+	}
+
+	return true
+}
+
+// punsubscribe is unsubscribe for patterns. Callers must hold pubsubMux.
+func (c *client) punsubscribe(pattern string) bool {
+	if _, ok := c.patterns[pattern]; !ok {
+		return false
+	}
+
+	delete(c.patterns, pattern)
+	patternSubscribers[pattern] = removeClient(patternSubscribers[pattern], c)
+	if len(patternSubscribers[pattern]) == 0 {
+		delete(patternSubscribers, pattern)
+	}
+
+	return true
+}
+
+// sunsubscribe is unsubscribe for shard channels.
+// Callers must hold pubsubMux.
+func (c *client) sunsubscribe(channel string) bool {
+	if _, ok := c.shardChannels[channel]; !ok {
+		return false
+	}
+
+	delete(c.shardChannels, channel)
+
+	slot := keyHashSlot(channel)
+	channels := shardSubscribers[slot]
+	channels[channel] = removeClient(channels[channel], c)
+	if len(channels[channel]) == 0 {
+		delete(channels, channel)
+	}
+	if len(channels) == 0 {
+		delete(shardSubscribers, slot)
+	}
+
+	return true
+}
+
+// subscriptionReply confirms a change to the subscriptions of c
+func subscriptionReply(kind string, name *string, count int) token {
+	nameToken := token{typ: string(NULL)}
+	if name != nil {
+		nameToken = token{typ: string(BULK), bulk: *name}
+	}
+
+	return token{typ: string(ARRAY), array: []token{
+		{typ: string(BULK), bulk: kind},
+		nameToken,
+		intToken(count),
+	}}
+}
+
+// SUBSCRIBE channel [channel ...]
+func subscribe(c *client, args []token) {
+	if len(args) < 1 {
+		c.write(wrongArgs("SUBSCRIBE"))
+		return
+	}
+
+	pubsubMux.Lock()
+	defer pubsubMux.Unlock()
+
+	for _, arg := range args {
+		channel := arg.bulk
+		if _, ok := c.channels[channel]; !ok {
+			c.channels[channel] = struct{}{}
+			channelSubscribers[channel] = append(channelSubscribers[channel], c)
+		}
+
+		// Written under pubsubMux so no message can overtake it
+		c.write(subscriptionReply("subscribe", &channel, c.subscriptions()))
+	}
+	c.limitOutput(pubsubOutputLimit)
+}
+
+// PSUBSCRIBE pattern [pattern ...]
+func psubscribe(c *client, args []token) {
+	if len(args) < 1 {
+		c.write(wrongArgs("PSUBSCRIBE"))
+		return
+	}
+
+	pubsubMux.Lock()
+	defer pubsubMux.Unlock()
+
+	for _, arg := range args {
+		pattern := arg.bulk
+		if _, ok := c.patterns[pattern]; !ok {
+			c.patterns[pattern] = struct{}{}
+			patternSubscribers[pattern] = append(patternSubscribers[pattern], c)
+		}
+
+		c.write(subscriptionReply("psubscribe", &pattern, c.subscriptions()))
+	}
+	c.limitOutput(pubsubOutputLimit)
+}
+
+// SSUBSCRIBE shardchannel [shardchannel ...]
+func ssubscribe(c *client, args []token) {
+	if len(args) < 1 {
+		c.write(wrongArgs("SSUBSCRIBE"))
+		return
+	}
+
+	pubsubMux.Lock()
+	defer pubsubMux.Unlock()
+
+	for _, arg := range args {
+		channel := arg.bulk
+		if _, ok := c.shardChannels[channel]; !ok {
+			c.shardChannels[channel] = struct{}{}
+
+			slot := keyHashSlot(channel)
+			if shardSubscribers[slot] == nil {
+				shardSubscribers[slot] = map[string][]*client{}
+			}
+			shardSubscribers[slot][channel] = append(shardSubscribers[slot][channel], c)
+		}
+
+		c.write(subscriptionReply("ssubscribe", &channel, c.shardSubscriptions()))
+	}
+	c.limitOutput(pubsubOutputLimit)
+}
+
+// unsubscribeGeneric removes the named subscriptions, or all of them
+// when there are no names, confirming each one with the count left
+func unsubscribeGeneric(c *client, kind string, args []token, current map[string]struct{}, remove func(string) bool, count func() int) {
+	pubsubMux.Lock()
+	defer pubsubMux.Unlock()
+
+	names := make([]string, 0, len(args))
+	for _, arg := range args {
+		names = append(names, arg.bulk)
+	}
+	if len(args) == 0 {
+		for name := range current {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	// Even nothing to drop gets a reply
+	if len(names) == 0 {
+		c.write(subscriptionReply(kind, nil, count()))
+		return
+	}
+
+	for _, name := range names {
+		remove(name)
+		c.write(subscriptionReply(kind, &name, count()))
+	}
+
+	if c.subscriptions()+c.shardSubscriptions() == 0 {
+		c.limitOutput(0)
+	}
+}
+
+// UNSUBSCRIBE [channel [channel ...]]
+func unsubscribe(c *client, args []token) {
+	unsubscribeGeneric(c, "unsubscribe", args, c.channels, c.unsubscribe, c.subscriptions)
+}
+
+// PUNSUBSCRIBE [pattern [pattern ...]]
+func punsubscribe(c *client, args []token) {
+	unsubscribeGeneric(c, "punsubscribe", args, c.patterns, c.punsubscribe, c.subscriptions)
+}
+
+// SUNSUBSCRIBE [shardchannel [shardchannel ...]]
+func sunsubscribe(c *client, args []token) {
+	unsubscribeGeneric(c, "sunsubscribe", args, c.shardChannels, c.sunsubscribe, c.shardSubscriptions)
+}
+
+// subscribedModeError is the reply to commands a subscribed client
+// can't run
+func subscribedModeError(command string) token {
+	return token{
+		typ: string(ERROR),
+		val: fmt.Sprintf(
+			"ERR Can't execute '%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context",
+			strings.ToLower(command),
+		),
+	}
+}
+
+// subscribedPing is how PING replies in subscribed mode
+func subscribedPing(args []token) token {
+	message := ""
+	if len(args) > 0 {
+		message = args[0].bulk
+	}
+
+	return bulkArray([]string{"pong", message})
+}
+
+// publish sends message to the subscribers of channel and of the
+// patterns matching it, returning how many received it. Messages are
+// queued, subscribers that don't keep up get disconnected.
+func publish(channel, message string) int {
+	pubsubMux.Lock()
+	defer pubsubMux.Unlock()
+
+	receivers := 0
+	for _, c := range channelSubscribers[channel] {
+		c.write(bulkArray([]string{"message", channel, message}))
+		receivers++
+	}
+
+	for pattern, subscribers := range patternSubscribers {
+		if !globMatch(pattern, channel) {
+			continue
+		}
+		for _, c := range subscribers {
+			c.write(bulkArray([]string{"pmessage", pattern, channel, message}))
+			receivers++
+		}
+	}
+
+	return receivers
+}
+
+// SPUBLISH shardchannel message
+func spublish(args []token) token {
+	if len(args) != 2 {
+		return wrongArgs("SPUBLISH")
+	}
+
+	pubsubMux.Lock()
+	defer pubsubMux.Unlock()
+
+	// Shard channels don't match patterns
+	channel := args[0].bulk
+	subscribers := shardSubscribers[keyHashSlot(channel)][channel]
+	for _, c := range subscribers {
+		c.write(bulkArray([]string{"smessage", channel, args[1].bulk}))
+	}
+
+	return intToken(len(subscribers))
+}
+
+// PUBLISH channel message
+func publishCommand(args []token) token {
+	if len(args) != 2 {
+		return wrongArgs("PUBLISH")
+	}
+
+	return intToken(publish(args[0].bulk, args[1].bulk))
+}
+
+// PUBSUB CHANNELS [pattern] | NUMSUB [channel ...] | NUMPAT |
+// SHARDCHANNELS [pattern] | SHARDNUMSUB [shardchannel ...]
+func pubsub(args []token) token {
+	if len(args) < 1 {
+		return wrongArgs("PUBSUB")
+	}
+
+	pubsubMux.Lock()
+	defer pubsubMux.Unlock()
+
+	switch sub := strings.ToUpper(args[0].bulk); {
+	case sub == "CHANNELS" && len(args) <= 2:
+		channels := []string{}
+		for channel := range channelSubscribers {
+			if len(args) == 1 || globMatch(args[1].bulk, channel) {
+				channels = append(channels, channel)
+			}
+		}
+		sort.Strings(channels)
+
+		return bulkArray(channels)
+	case sub == "NUMSUB":
+		counts := make([]token, 0, 2*(len(args)-1))
+		for _, arg := range args[1:] {
+			counts = append(counts,
+				token{typ: string(BULK), bulk: arg.bulk},
+				intToken(len(channelSubscribers[arg.bulk])),
+			)
+		}
+
+		return token{typ: string(ARRAY), array: counts}
+	case sub == "NUMPAT" && len(args) == 1:
+		return intToken(len(patternSubscribers))
+	case sub == "SHARDCHANNELS" && len(args) <= 2:
+		channels := []string{}
+		for _, slotChannels := range shardSubscribers {
+			for channel := range slotChannels {
+				if len(args) == 1 || globMatch(args[1].bulk, channel) {
+					channels = append(channels, channel)
+				}
+			}
+		}
+		sort.Strings(channels)
+
+		return bulkArray(channels)
+	case sub == "SHARDNUMSUB":
+		counts := make([]token, 0, 2*(len(args)-1))
+		for _, arg := range args[1:] {
+			counts = append(counts,
+				token{typ: string(BULK), bulk: arg.bulk},
+				intToken(len(shardSubscribers[keyHashSlot(arg.bulk)][arg.bulk])),
+			)
+		}
+
+		return token{typ: string(ARRAY), array: counts}
+	}
+
+	return token{
+		typ: string(ERROR),
+		val: fmt.Sprintf("ERR unknown subcommand or wrong number of arguments for '%s'. Try PUBSUB HELP.", args[0].bulk),
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testConn is the client end of a connection served by process
+type testConn struct {
+	conn net.Conn
+	resp *Resp
+}
+
+func newTestConn(t *testing.T) *testConn {
+	t.Helper()
+
+	server, conn := net.Pipe()
+	go process(server)
+	t.Cleanup(func() { conn.Close() })
+
+	return &testConn{conn: conn, resp: NewResp(conn)}
+}
+
+// send writes a command without waiting for replies
+func (tc *testConn) send(t *testing.T, args ...string) {
+	t.Helper()
+
+	tc.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, err := tc.conn.Write(bulkArray(args).Marshal()); err != nil {
+		t.Fatalf("Failed to send %v: %v", args, err)
+	}
+}
+
+// read returns the next reply or pushed message
+func (tc *testConn) read(t *testing.T) token {
+	t.Helper()
+
+	tc.conn.SetReadDeadline(time.Now().Add(time.Second))
+	reply, err := tc.resp.Read()
+	if err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+
+	return reply
+}
+
+// do sends a command and returns its reply
+func (tc *testConn) do(t *testing.T, args ...string) token {
+	t.Helper()
+
+	tc.send(t, args...)
+	return tc.read(t)
+}
+
+// pushed builds the array of bulk strings and integers a pushed message
+// decodes to
+func pushed(values ...any) token {
+	array := []token{}
+	for _, v := range values {
+		switch v := v.(type) {
+		case string:
+			array = append(array, token{typ: string(BULK), bulk: v})
+		case int:
+			array = append(array, intToken(v))
+		}
+	}
+
+	return token{typ: string(ARRAY), array: array}
+}
+
+func TestPubSub(t *testing.T) {
+	subscriber := newTestConn(t)
+	publisher := newTestConn(t)
+
+	subscriber.send(t, "SUBSCRIBE", "ps:news", "ps:sport")
+	for i, channel := range []string{"ps:news", "ps:sport"} {
+		if got, want := subscriber.read(t), pushed("subscribe", channel, i+1); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed subscribe. wanted %v, got %v", want, got)
+		}
+	}
+
+	if got, want := subscriber.do(t, "PSUBSCRIBE", "ps:*"), pushed("psubscribe", "ps:*", 3); !reflect.DeepEqual(got, want) {
+		t.Errorf("Failed psubscribe. wanted %v, got %v", want, got)
+	}
+
+	t.Run("publish reaches channels and patterns", func(t *testing.T) {
+		publisher.send(t, "PUBLISH", "ps:news", "hello")
+
+		if got, want := subscriber.read(t), pushed("message", "ps:news", "hello"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed message. wanted %v, got %v", want, got)
+		}
+		if got, want := subscriber.read(t), pushed("pmessage", "ps:*", "ps:news", "hello"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed pmessage. wanted %v, got %v", want, got)
+		}
+		if got, want := publisher.read(t), intToken(2); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed publish. wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("introspection", func(t *testing.T) {
+		if got, want := run(t, "PUBSUB", "CHANNELS", "ps:*"), bulkArray([]string{"ps:news", "ps:sport"}); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed channels. wanted %v, got %v", want, got)
+		}
+
+		want := token{typ: string(ARRAY), array: []token{{typ: string(BULK), bulk: "ps:news"}, intToken(1), {typ: string(BULK), bulk: "ps:none"}, intToken(0)}}
+		if got := run(t, "PUBSUB", "NUMSUB", "ps:news", "ps:none"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed numsub. wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("subscribed mode", func(t *testing.T) {
+		want := subscribedModeError("GET")
+		if got := subscriber.do(t, "GET", "ps:key"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed get. wanted %v, got %v", want, got)
+		}
+
+		if got, want := subscriber.do(t, "PING"), pushed("pong", ""); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed ping. wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("unsubscribe from everything", func(t *testing.T) {
+		subscriber.send(t, "UNSUBSCRIBE")
+		for i, channel := range []string{"ps:news", "ps:sport"} {
+			if got, want := subscriber.read(t), pushed("unsubscribe", channel, 2-i); !reflect.DeepEqual(got, want) {
+				t.Errorf("Failed unsubscribe. wanted %v, got %v", want, got)
+			}
+		}
+
+		if got, want := subscriber.do(t, "PUNSUBSCRIBE", "ps:*"), pushed("punsubscribe", "ps:*", 0); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed punsubscribe. wanted %v, got %v", want, got)
+		}
+
+		// Back to regular commands
+		if got, want := subscriber.do(t, "PING"), (token{typ: string(STRING), val: "PONG"}); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed ping. wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("unsubscribe without subscriptions", func(t *testing.T) {
+		want := token{typ: string(ARRAY), array: []token{{typ: string(BULK), bulk: "unsubscribe"}, {typ: string(NULL)}, intToken(0)}}
+		if got := subscriber.do(t, "UNSUBSCRIBE"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed unsubscribe. wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("closed connections unsubscribe", func(t *testing.T) {
+		gone := newTestConn(t)
+		gone.do(t, "SUBSCRIBE", "ps:gone")
+		gone.conn.Close()
+
+		deadline := time.Now().Add(time.Second)
+		for run(t, "PUBLISH", "ps:gone", "anyone?").val != "0" {
+			if time.Now().After(deadline) {
+				t.Fatalf("Failed close. the subscription outlived the connection")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+}
+
+func TestShardedPubSub(t *testing.T) {
+	subscriber := newTestConn(t)
+	publisher := newTestConn(t)
+
+	subscriber.send(t, "SSUBSCRIBE", "{sps}:a", "{sps}:b")
+	for i, channel := range []string{"{sps}:a", "{sps}:b"} {
+		if got, want := subscriber.read(t), pushed("ssubscribe", channel, i+1); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed ssubscribe. wanted %v, got %v", want, got)
+		}
+	}
+
+	// Shard subscriptions are counted apart from the others
+	if got, want := subscriber.do(t, "SUBSCRIBE", "{sps}:a"), pushed("subscribe", "{sps}:a", 1); !reflect.DeepEqual(got, want) {
+		t.Errorf("Failed subscribe. wanted %v, got %v", want, got)
+	}
+
+	t.Run("spublish only reaches shard subscribers", func(t *testing.T) {
+		publisher.send(t, "SPUBLISH", "{sps}:a", "hi")
+
+		if got, want := subscriber.read(t), pushed("smessage", "{sps}:a", "hi"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed smessage. wanted %v, got %v", want, got)
+		}
+		if got, want := publisher.read(t), intToken(1); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed spublish. wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("introspection", func(t *testing.T) {
+		if got, want := run(t, "PUBSUB", "SHARDCHANNELS", "{sps}*"), bulkArray([]string{"{sps}:a", "{sps}:b"}); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed shardchannels. wanted %v, got %v", want, got)
+		}
+
+		want := token{typ: string(ARRAY), array: []token{{typ: string(BULK), bulk: "{sps}:b"}, intToken(1)}}
+		if got := run(t, "PUBSUB", "SHARDNUMSUB", "{sps}:b"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed shardnumsub. wanted %v, got %v", want, got)
+		}
+
+		if got, want := run(t, "CLUSTER", "KEYSLOT", "{sps}:a"), intToken(keyHashSlot("sps")); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed keyslot. wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("sunsubscribe", func(t *testing.T) {
+		subscriber.send(t, "SUNSUBSCRIBE")
+		for i, channel := range []string{"{sps}:a", "{sps}:b"} {
+			if got, want := subscriber.read(t), pushed("sunsubscribe", channel, 1-i); !reflect.DeepEqual(got, want) {
+				t.Errorf("Failed sunsubscribe. wanted %v, got %v", want, got)
+			}
+		}
+
+		if got, want := publisher.do(t, "SPUBLISH", "{sps}:a", "hi"), intToken(0); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed spublish. wanted %v, got %v", want, got)
+		}
+	})
+}
+
+func TestPubSubOutputLimit(t *testing.T) {
+	previous := pubsubOutputLimit
+	pubsubOutputLimit = 200
+	t.Cleanup(func() { pubsubOutputLimit = previous })
+
+	slow, publisher := newTestConn(t), newTestConn(t)
+	slow.do(t, "SUBSCRIBE", "ps:slow")
+
+	// A subscriber that doesn't read holds nobody up
+	for i := 0; i < 20; i++ {
+		if got := publisher.do(t, "PUBLISH", "ps:slow", "a message to fill the output buffer"); got.typ != string(INTEGER) {
+			t.Fatalf("Failed publish. got %v", got)
+		}
+	}
+
+	// and gets disconnected once its output passes the limit
+	want := token{typ: string(ARRAY), array: []token{{typ: string(BULK), bulk: "ps:slow"}, intToken(0)}}
+	for i := 0; i < 100; i++ {
+		if got := run(t, "PUBSUB", "NUMSUB", "ps:slow"); reflect.DeepEqual(got, want) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Errorf("Failed output limit. the subscriber is still connected")
+}
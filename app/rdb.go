@@ -6,19 +6,53 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash/crc64"
 	"io"
 	"log"
 	"os"
+	"strconv"
 	"time"
 )
 
 var expiryTime time.Time
 
 const (
+	FUNCTION_OFFSET   = 0xF5
+	AUX_OFFSET        = 0xFA
 	DB_SECTION_OFFSET = 0xFE
 	EOF_OFFSET        = 0xFF
+
+	RDB_VERSION = 11
 )
 
+// rdbCRC is the checksum Redis ends RDB files and DUMP payloads with:
+// CRC-64 with the Jones polynomial, given here reflected
+var rdbCRC = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+// rdbChecksum returns the checksum of data as Redis computes it
+func rdbChecksum(data []byte) uint64 {
+	// Unlike the standard library, Redis doesn't invert the CRC before
+	// and after, which the extra inversions undo
+	return ^crc64.Update(^uint64(0), rdbCRC, data)
+}
+
+// encodeSize encodes n the way decodeSize reads it
+func encodeSize(n int) []byte {
+	switch {
+	case n < 1<<6:
+		return []byte{byte(n)}
+	case n < 1<<14:
+		return []byte{0x40 | byte(n>>8), byte(n)}
+	default:
+		return binary.BigEndian.AppendUint32([]byte{0x80}, uint32(n))
+	}
+}
+
+// encodeString encodes s as a length prefixed string
+func encodeString(s string) []byte {
+	return append(encodeSize(len(s)), s...)
+}
+
 type rdb struct {
 	reader     bufio.Reader
 	file       os.File
@@ -61,6 +95,20 @@ func LoadRDB(path string) ([]byte, int, error) {
 	return fd, len(fd), nil
 }
 
+// withLibraries adds the function libraries to an RDB file without any,
+// right before its EOF opcode and checksum. Callers must hold mux.
+func withLibraries(file []byte) []byte {
+	if len(libraries) == 0 {
+		return file
+	}
+
+	out := append([]byte{}, file[:len(file)-9]...)
+	out = append(out, dumpLibraries()...)
+	out = append(out, EOF_OFFSET)
+
+	return binary.LittleEndian.AppendUint64(out, rdbChecksum(out))
+}
+
 func (r *rdb) ReadRDB() error {
 	// If first two bits are 00, the size is stored in the remaining 6 bits of the byte.
 	// If first two are 01, the size is tored in the next 14 bits (the remaing 6 bits + 8 bits from the next byte)
@@ -87,9 +135,37 @@ func (r *rdb) ReadRDB() error {
 		return fmt.Errorf("Invalid RDB file format")
 	}
 
-	// Skip to DB selector
-	if _, err := r.reader.ReadBytes(0xFE); err != nil {
-		return err
+	// Auxiliary fields and function libraries come before the first
+	// database, which an RDB without keys doesn't have
+	for selected := false; !selected; {
+		opcode, err := r.reader.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		switch opcode {
+		case AUX_OFFSET:
+			for range 2 {
+				if _, err := r.readString(); err != nil {
+					return err
+				}
+			}
+		case FUNCTION_OFFSET:
+			code, err := r.readString()
+			if err != nil {
+				return err
+			}
+			if _, errTok := loadLibrary(libraries, string(code), false); errTok != nil {
+				return fmt.Errorf("Could not load function library: %s", errTok.val)
+			}
+		case DB_SECTION_OFFSET:
+			selected = true
+		case EOF_OFFSET:
+			fmt.Println("End of RDB File")
+			return nil
+		default:
+			return fmt.Errorf("Unsupported opcode: %d", opcode)
+		}
 	}
 
 	if b, err := r.reader.ReadByte(); err != nil {
@@ -147,21 +223,19 @@ func (r *rdb) ReadRDB() error {
 			return fmt.Errorf("Unsupported value type: %d", b)
 		}
 
-		keySize, err := r.decodeSize()
-		fmt.Println(keySize)
+		keyBuf, err := r.readString()
+		if err != nil {
+			return err
+		}
+		valBuf, err := r.readString()
 		if err != nil {
 			return err
 		}
-		keyBuf := make([]byte, keySize)
-		r.reader.Read(keyBuf)
-		valSize, err := r.decodeSize()
-		valBuf := make([]byte, valSize)
-		r.reader.Read(valBuf)
 		fmt.Println("KeyVal Pair: ", string(keyBuf), ":", string(valBuf))
 
 		if !expiry.IsZero() {
 			fmt.Println("Set with Expiry: ", expiry)
-			setWithExpiry([]token{
+			set([]token{
 				{
 					typ:  string(BULK),
 					bulk: string(keyBuf),
@@ -229,3 +303,116 @@ func (r *rdb) decodeSize() (int, error) {
 		return 0, errors.New("unexpected string encoding type")
 	}
 }
+
+// readString reads a string in any of its RDB encodings: length
+// prefixed, stored as an integer or LZF compressed. The latter is how
+// Redis writes most values longer than 20 bytes, HyperLogLogs included.
+func (r *rdb) readString() ([]byte, error) {
+	first, err := r.reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if first[0]>>6 != 3 {
+		size, err := r.decodeSize()
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(&r.reader, buf); err != nil {
+			return nil, err
+		}
+		return buf, nil
+	}
+
+	r.reader.ReadByte()
+
+	switch first[0] & 0x3F {
+	case 0, 1, 2:
+		// 8, 16 or 32 bit little endian integers
+		buf := make([]byte, 1<<(first[0]&0x3F))
+		if _, err := io.ReadFull(&r.reader, buf); err != nil {
+			return nil, err
+		}
+
+		var n int64
+		switch len(buf) {
+		case 1:
+			n = int64(int8(buf[0]))
+		case 2:
+			n = int64(int16(binary.LittleEndian.Uint16(buf)))
+		case 4:
+			n = int64(int32(binary.LittleEndian.Uint32(buf)))
+		}
+		return []byte(strconv.FormatInt(n, 10)), nil
+	case 3:
+		compressedLen, err := r.decodeSize()
+		if err != nil {
+			return nil, err
+		}
+		length, err := r.decodeSize()
+		if err != nil {
+			return nil, err
+		}
+
+		compressed := make([]byte, compressedLen)
+		if _, err := io.ReadFull(&r.reader, compressed); err != nil {
+			return nil, err
+		}
+		return lzfDecompress(compressed, length)
+	default:
+		return nil, errors.New("unexpected string encoding type")
+	}
+}
+
+// lzfDecompress expands data compressed with liblzf into a buffer of
+// the given length
+func lzfDecompress(in []byte, length int) ([]byte, error) {
+	out := make([]byte, 0, length)
+	errCorrupt := errors.New("corrupt LZF compressed string")
+
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+
+		if ctrl < 32 {
+			// A run of ctrl+1 literal bytes
+			end := i + ctrl + 1
+			if end > len(in) {
+				return nil, errCorrupt
+			}
+			out = append(out, in[i:end]...)
+			i = end
+			continue
+		}
+
+		// A back reference into what was already expanded
+		n := ctrl >> 5
+		if n == 7 {
+			if i >= len(in) {
+				return nil, errCorrupt
+			}
+			n += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, errCorrupt
+		}
+		ref := len(out) - (ctrl&0x1F)<<8 - int(in[i]) - 1
+		i++
+		if ref < 0 {
+			return nil, errCorrupt
+		}
+
+		// Byte by byte since the reference may overlap the output
+		for j := 0; j < n+2; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+
+	if len(out) != length {
+		return nil, errCorrupt
+	}
+
+	return out, nil
+}
@@ -12,3 +12,15 @@ func TestRdb(t *testing.T) {
 		defer r.file.Close()
 	})
 }
+
+func TestLzfDecompress(t *testing.T) {
+	// A literal "a" followed by a back reference repeating it nine times
+	got, err := lzfDecompress([]byte{0x00, 'a', 0xe0, 0x00, 0x00}, 10)
+	if err != nil || string(got) != "aaaaaaaaaa" {
+		t.Errorf("Failed lzf. wanted %q, got %q (%v)", "aaaaaaaaaa", got, err)
+	}
+
+	if _, err := lzfDecompress([]byte{0x20, 0x05}, 3); err == nil {
+		t.Errorf("Failed lzf. wanted an error for a reference before the start")
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"net"
@@ -34,12 +35,6 @@ func NewHandshake(replicaof *string, replicaPort *string) (net.Conn, error) {
 	return conn, nil
 }
 
-func PropagateToReplica(conn net.Conn, tok token) {
-	fmt.Println("Sending token to replica: ", tok, conn.LocalAddr().String())
-	e := NewEncoder(conn, conn)
-	e.Encode(tok)
-}
-
 func pingHandshake(conn net.Conn) error {
 	tok := token{
 		typ: string(ARRAY),
@@ -218,11 +213,25 @@ func receiveRDBFile(reader *bufio.Reader) error {
 	}
 
 	fmt.Printf("Received RDB file of length: %d\n", len(rdbData))
-	// You can process rdbData here if needed
+
+	// The master leaves the keys out, this loads its function libraries
+	// in place of the ones an earlier sync brought
+	r := rdb{reader: *bufio.NewReader(bytes.NewReader(rdbData))}
+	mux.Lock()
+	flushLibraries()
+	if err := r.ReadRDB(); err != nil {
+		fmt.Printf("Could not load RDB file: %v\n", err)
+	}
+	mux.Unlock()
 
 	return nil
 }
 
+// masterTransaction collects the commands of a transaction the master
+// sends until its EXEC arrives, it is nil outside of one. Only used by
+// the goroutine reading from the master.
+var masterTransaction []token
+
 func processMasterCommand(args []token, e Encoder, t token) {
 	if len(args) == 0 {
 		return
@@ -246,11 +255,25 @@ func processMasterCommand(args []token, e Encoder, t token) {
 			bytesWritten += TokenLength(t)
 			e.Encode(ackResponse)
 		}
+	} else if command == "MULTI" {
+		masterTransaction = []token{}
+		bytesWritten += TokenLength(t)
+	} else if command == "EXEC" && masterTransaction != nil {
+		mux.Lock()
+		runTransaction(masterTransaction)
+		mux.Unlock()
+		masterTransaction = nil
+		bytesWritten += TokenLength(t)
+	} else if masterTransaction != nil {
+		masterTransaction = append(masterTransaction, t)
+		bytesWritten += TokenLength(t)
 	} else {
 		// Process other commands silently
-		handler, ok := Handlers[command]
+		spec, ok := Handlers[command]
 		if ok {
-			handler(cmdArgs)
+			mux.Lock()
+			spec.handler(cmdArgs)
+			mux.Unlock()
 			bytesWritten += TokenLength(t)
 		} else {
 			fmt.Printf("Unhandled command from master: %s\n", command)
@@ -259,7 +282,7 @@ func processMasterCommand(args []token, e Encoder, t token) {
 }
 
 func connect(server, port string) (net.Conn, error) {
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%s", server, port))
+	conn, err := net.Dial("tcp", net.JoinHostPort(server, port))
 	if err != nil {
 		return nil, err
 	}
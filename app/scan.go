@@ -0,0 +1,397 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// globMatch reports whether str matches the glob-style pattern, following
+// the rules of Redis' stringmatchlen: * matches any sequence, ? any single
+// byte, [abc], [^abc] and [a-z] a class of bytes, and \ escapes the byte
+// that follows it.
+func globMatch(pattern, str string) bool {
+	skipLonger := false
+	return globMatchImpl(pattern, str, &skipLonger, 0)
+}
+
+// skipLonger is set once the remainder of a pattern following a * failed
+// to match any suffix of the string, in which case trying longer matches
+// for an earlier * is pointless. This keeps patterns like "*a*a*a*b"
+// from taking exponential time.
+func globMatchImpl(pattern, str string, skipLonger *bool, nesting int) bool {
+	// Protection against abusive patterns
+	if nesting > 1000 {
+		return false
+	}
+
+	for len(pattern) > 0 && len(str) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+
+			for len(str) > 0 {
+				if globMatchImpl(pattern[1:], str, skipLonger, nesting+1) {
+					return true
+				}
+				if *skipLonger {
+					return false
+				}
+				str = str[1:]
+			}
+
+			*skipLonger = true
+			return false
+		case '?':
+			str = str[1:]
+		case '[':
+			pattern = pattern[1:]
+			not := len(pattern) > 0 && pattern[0] == '^'
+			if not {
+				pattern = pattern[1:]
+			}
+
+			match := false
+			for {
+				if len(pattern) == 0 {
+					// An unterminated class ends with the pattern
+					break
+				}
+
+				if pattern[0] == '\\' && len(pattern) >= 2 {
+					pattern = pattern[1:]
+					if pattern[0] == str[0] {
+						match = true
+					}
+				} else if pattern[0] == ']' {
+					break
+				} else if len(pattern) >= 3 && pattern[1] == '-' {
+					start, end := pattern[0], pattern[2]
+					if start > end {
+						start, end = end, start
+					}
+					if str[0] >= start && str[0] <= end {
+						match = true
+					}
+					pattern = pattern[2:]
+				} else if pattern[0] == str[0] {
+					match = true
+				}
+
+				pattern = pattern[1:]
+			}
+
+			if not {
+				match = !match
+			}
+			if !match {
+				return false
+			}
+			str = str[1:]
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if pattern[0] != str[0] {
+				return false
+			}
+			str = str[1:]
+		}
+
+		if len(pattern) > 0 {
+			pattern = pattern[1:]
+		}
+	}
+
+	// Trailing stars match the empty string
+	if len(str) == 0 {
+		pattern = strings.TrimLeft(pattern, "*")
+	}
+
+	return len(pattern) == 0 && len(str) == 0
+}
+
+// KEYS pattern
+func keys(args []token) token {
+	if len(args) != 1 {
+		return wrongArgs("KEYS")
+	}
+
+	pattern := args[0].bulk
+	allKeys := pattern == "*"
+
+	matched := []token{}
+	for k := range datastore {
+		if !allKeys && !globMatch(pattern, k) {
+			continue
+		}
+
+		if _, exists := lookupKey(k); !exists {
+			continue
+		}
+
+		matched = append(matched, token{typ: string(BULK), bulk: k})
+	}
+
+	return token{typ: string(ARRAY), array: matched}
+}
+
+// The SCAN family walks elements in the order of a fixed hash of their
+// name rather than in map order, and the cursor is the hash to carry on
+// from. As the order doesn't depend on the size or layout of the map,
+// the guarantees of Redis' SCAN hold while the collection grows or
+// shrinks: an element present for the whole iteration is returned, and no
+// element is returned twice. Every collection keeps its names in that
+// order in a scanIndex, so a call only looks at the elements it returns.
+//
+// The hash is kept to 52 bits so skiplist scores hold it exactly, and
+// above zero, which is the cursor of a complete iteration.
+func scanHash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()>>12 + 1
+}
+
+// scanIndex orders the names of a collection by their scanHash, reusing
+// the sorted set skiplist with the hash as the score
+type scanIndex struct {
+	zsl *skiplist
+}
+
+func newScanIndex() *scanIndex {
+	return &scanIndex{zsl: newSkiplist()}
+}
+
+// add indexes name, which the caller makes sure is not indexed yet
+func (ix *scanIndex) add(name string) {
+	ix.zsl.insert(float64(scanHash(name)), name)
+}
+
+func (ix *scanIndex) remove(name string) {
+	ix.zsl.delete(float64(scanHash(name)), name)
+}
+
+// scanIndexOf returns the index of the hash or set at key, which must
+// exist. Callers must hold mux.
+func scanIndexOf(key string) *scanIndex {
+	return datastore[key].index
+}
+
+// batch returns around count names starting at cursor, along with the
+// next cursor. Zero means the iteration is complete.
+func (ix *scanIndex) batch(cursor uint64, count int) ([]string, uint64) {
+	batch := []string{}
+
+	// Colliding elements can't be told apart by the cursor, so they are
+	// all returned in the same batch
+	var last *skiplistNode
+	x := ix.zsl.firstInRange(scoreRange{min: float64(cursor), max: math.Inf(1)})
+	for x != nil && (len(batch) < count || x.score == last.score) {
+		batch = append(batch, x.member)
+		last, x = x, x.level[0].forward
+	}
+
+	if x == nil {
+		return batch, 0
+	}
+
+	return batch, uint64(x.score)
+}
+
+type scanOptions struct {
+	cursor   uint64
+	count    int
+	pattern  string
+	typ      string
+	noValues bool
+}
+
+// parseScanOptions reads the cursor and the options following it. TYPE is
+// only accepted by SCAN and NOVALUES only by HSCAN.
+func parseScanOptions(command string, args []token) (scanOptions, token, bool) {
+	opts := scanOptions{count: 10}
+
+	cursor, err := strconv.ParseUint(args[0].bulk, 10, 64)
+	if err != nil {
+		return opts, token{typ: string(ERROR), val: "ERR invalid cursor"}, false
+	}
+	opts.cursor = cursor
+
+	for i := 1; i < len(args); i++ {
+		option := strings.ToUpper(args[i].bulk)
+		hasValue := i+1 < len(args)
+
+		switch {
+		case option == "COUNT" && hasValue:
+			count, err := strconv.Atoi(args[i+1].bulk)
+			if err != nil {
+				return opts, errNotInteger, false
+			}
+			if count < 1 {
+				return opts, errSyntax, false
+			}
+			opts.count = count
+			i++
+		case option == "MATCH" && hasValue:
+			opts.pattern = args[i+1].bulk
+			i++
+		case option == "TYPE" && hasValue && command == "SCAN":
+			opts.typ = strings.ToLower(args[i+1].bulk)
+			i++
+		case option == "NOVALUES" && command == "HSCAN":
+			opts.noValues = true
+		default:
+			return opts, errSyntax, false
+		}
+	}
+
+	return opts, token{}, true
+}
+
+func (opts scanOptions) matches(name string) bool {
+	return opts.pattern == "" || opts.pattern == "*" || globMatch(opts.pattern, name)
+}
+
+func scanReply(cursor uint64, elements []string) token {
+	return token{
+		typ: string(ARRAY),
+		array: []token{
+			{typ: string(BULK), bulk: strconv.FormatUint(cursor, 10)},
+			bulkArray(elements),
+		},
+	}
+}
+
+// SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]
+func scan(args []token) token {
+	if len(args) < 1 {
+		return wrongArgs("SCAN")
+	}
+
+	opts, errTok, ok := parseScanOptions("SCAN", args)
+	if !ok {
+		return errTok
+	}
+
+	batch, next := keyIndex.batch(opts.cursor, opts.count)
+
+	// Like in Redis COUNT bounds the keys looked at, filtering comes after
+	matched := []string{}
+	for _, k := range batch {
+		obj, exists := lookupKey(k)
+		if !exists || !opts.matches(k) {
+			continue
+		}
+		if opts.typ != "" && obj.typ != opts.typ {
+			continue
+		}
+		matched = append(matched, k)
+	}
+
+	return scanReply(next, matched)
+}
+
+// HSCAN key cursor [MATCH pattern] [COUNT count] [NOVALUES]
+func hscan(args []token) token {
+	if len(args) < 2 {
+		return wrongArgs("HSCAN")
+	}
+
+	opts, errTok, ok := parseScanOptions("HSCAN", args[1:])
+	if !ok {
+		return errTok
+	}
+
+	hash, ok := lookupHash(args[0].bulk)
+	if !ok {
+		return errWrongType
+	}
+	if hash == nil {
+		return scanReply(0, nil)
+	}
+
+	batch, next := scanIndexOf(args[0].bulk).batch(opts.cursor, opts.count)
+
+	matched := []string{}
+	for _, field := range batch {
+		if !opts.matches(field) {
+			continue
+		}
+		matched = append(matched, field)
+		if !opts.noValues {
+			matched = append(matched, hash[field])
+		}
+	}
+
+	return scanReply(next, matched)
+}
+
+// SSCAN key cursor [MATCH pattern] [COUNT count]
+func sscan(args []token) token {
+	if len(args) < 2 {
+		return wrongArgs("SSCAN")
+	}
+
+	opts, errTok, ok := parseScanOptions("SSCAN", args[1:])
+	if !ok {
+		return errTok
+	}
+
+	members, ok := lookupSet(args[0].bulk)
+	if !ok {
+		return errWrongType
+	}
+	if members == nil {
+		return scanReply(0, nil)
+	}
+
+	batch, next := scanIndexOf(args[0].bulk).batch(opts.cursor, opts.count)
+
+	matched := []string{}
+	for _, m := range batch {
+		if opts.matches(m) {
+			matched = append(matched, m)
+		}
+	}
+
+	return scanReply(next, matched)
+}
+
+// ZSCAN key cursor [MATCH pattern] [COUNT count]
+func zscan(args []token) token {
+	if len(args) < 2 {
+		return wrongArgs("ZSCAN")
+	}
+
+	opts, errTok, ok := parseScanOptions("ZSCAN", args[1:])
+	if !ok {
+		return errTok
+	}
+
+	zs, ok := lookupZset(args[0].bulk)
+	if !ok {
+		return errWrongType
+	}
+	if zs == nil {
+		return scanReply(0, nil)
+	}
+
+	batch, next := zs.names.batch(opts.cursor, opts.count)
+
+	matched := []string{}
+	for _, m := range batch {
+		if opts.matches(m) {
+			matched = append(matched, m, formatScore(zs.dict[m]))
+		}
+	}
+
+	return scanReply(next, matched)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		str     string
+		want    bool
+	}{
+		{"*", "", true},
+		{"*", "anything", true},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h*llo", "heeeello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h[b-a]llo", "hallo", true},
+		{"h[a-b]llo", "hcllo", false},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{`[\]]`, "]", true},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxbyy", false},
+		{"*a*a*a*a*a*a*a*a*b", "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.str, func(t *testing.T) {
+			if got := globMatch(tt.pattern, tt.str); got != tt.want {
+				t.Errorf("Failed globMatch. wanted %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+// scanAll iterates with the given command until the cursor comes back to 0,
+// adding more keys in between calls when grow is set.
+func scanAll(t *testing.T, grow func(round int), args ...string) []string {
+	t.Helper()
+
+	seen := []string{}
+	cursor := "0"
+	for round := 0; ; round++ {
+		// The cursor follows the key, SCAN itself has none
+		at := 2
+		if args[0] == "SCAN" {
+			at = 1
+		}
+		call := append(append(append([]string{}, args[:at]...), cursor), args[at:]...)
+
+		reply := run(t, call...)
+		if reply.typ != string(ARRAY) || len(reply.array) != 2 {
+			t.Fatalf("Failed scan. got %v", reply)
+		}
+
+		for _, el := range reply.array[1].array {
+			seen = append(seen, el.bulk)
+		}
+
+		cursor = reply.array[0].bulk
+		if cursor == "0" {
+			return seen
+		}
+
+		if grow != nil {
+			grow(round)
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		run(t, "SET", fmt.Sprintf("scan:str:%d", i), "v")
+	}
+	run(t, "RPUSH", "scan:list", "a")
+
+	t.Run("keys with a pattern", func(t *testing.T) {
+		got := sortedBulks(run(t, "KEYS", "scan:str:[1-2]"))
+		want := []string{"scan:str:1", "scan:str:2"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed keys. wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("every key is returned once while the keyspace grows", func(t *testing.T) {
+		seen := scanAll(t, func(round int) {
+			for i := 0; i < 20; i++ {
+				run(t, "SET", fmt.Sprintf("scan:grow:%d:%d", round, i), "v")
+			}
+		}, "SCAN", "MATCH", "scan:str:*", "COUNT", "5")
+
+		sort.Strings(seen)
+		want := []string{}
+		for i := 0; i < 50; i++ {
+			want = append(want, "scan:str:"+strconv.Itoa(i))
+		}
+		sort.Strings(want)
+
+		if !reflect.DeepEqual(seen, want) {
+			t.Errorf("Failed scan. wanted %v, got %v", want, seen)
+		}
+	})
+
+	t.Run("type filter", func(t *testing.T) {
+		got := scanAll(t, nil, "SCAN", "MATCH", "scan:*", "TYPE", "list", "COUNT", "1000")
+		want := []string{"scan:list"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed scan. wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("invalid cursor", func(t *testing.T) {
+		want := token{typ: string(ERROR), val: "ERR invalid cursor"}
+		if got := run(t, "SCAN", "abc"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed scan. wanted %v, got %v", want, got)
+		}
+	})
+}
+
+func TestScanCollections(t *testing.T) {
+	run(t, "HSET", "scan:hash", "f1", "v1", "f2", "v2", "g1", "v3")
+	run(t, "SADD", "scan:set", "a", "b", "c")
+	run(t, "ZADD", "scan:zset", "1", "a", "2.5", "b")
+
+	t.Run("hscan", func(t *testing.T) {
+		got := scanAll(t, nil, "HSCAN", "scan:hash", "MATCH", "f*", "COUNT", "1")
+		pairs := []string{}
+		for i := 0; i < len(got); i += 2 {
+			pairs = append(pairs, got[i]+"="+got[i+1])
+		}
+		sort.Strings(pairs)
+
+		want := []string{"f1=v1", "f2=v2"}
+		if !reflect.DeepEqual(pairs, want) {
+			t.Errorf("Failed hscan. wanted %v, got %v", want, pairs)
+		}
+
+		got = scanAll(t, nil, "HSCAN", "scan:hash", "MATCH", "g*", "NOVALUES")
+		if !reflect.DeepEqual(got, []string{"g1"}) {
+			t.Errorf("Failed hscan novalues. got %v", got)
+		}
+	})
+
+	t.Run("sscan", func(t *testing.T) {
+		got := scanAll(t, nil, "SSCAN", "scan:set", "COUNT", "2")
+		sort.Strings(got)
+		want := []string{"a", "b", "c"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed sscan. wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("zscan", func(t *testing.T) {
+		got := scanAll(t, nil, "ZSCAN", "scan:zset", "MATCH", "b")
+		want := []string{"b", "2.5"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed zscan. wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("removed elements leave the index", func(t *testing.T) {
+		run(t, "SADD", "scan:shrink", "a", "b", "c", "d")
+		run(t, "SREM", "scan:shrink", "a")
+		run(t, "SMOVE", "scan:shrink", "scan:moved", "b")
+
+		got := scanAll(t, nil, "SSCAN", "scan:shrink", "COUNT", "1")
+		sort.Strings(got)
+		want := []string{"c", "d"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed sscan. wanted %v, got %v", want, got)
+		}
+
+		run(t, "HDEL", "scan:hash", "g1")
+		got = scanAll(t, nil, "HSCAN", "scan:hash", "MATCH", "g*")
+		if len(got) != 0 {
+			t.Errorf("Failed hscan. wanted nothing, got %v", got)
+		}
+	})
+
+	t.Run("batches stay around count", func(t *testing.T) {
+		for i := 0; i < 100; i++ {
+			run(t, "SADD", "scan:big", strconv.Itoa(i))
+		}
+
+		reply := run(t, "SSCAN", "scan:big", "0", "COUNT", "10")
+		if got := len(reply.array[1].array); got != 10 {
+			t.Errorf("Failed sscan. wanted 10 members, got %d", got)
+		}
+	})
+
+	t.Run("wrong type", func(t *testing.T) {
+		if got := run(t, "SSCAN", "scan:hash", "0"); !reflect.DeepEqual(got, errWrongType) {
+			t.Errorf("Failed sscan. wanted %v, got %v", errWrongType, got)
+		}
+	})
+}
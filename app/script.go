@@ -0,0 +1,534 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// Scripts run while the dispatcher holds mux, so like transactions nothing
+// else runs until they return. Each run gets an interpreter of its own, in
+// which redis.call and redis.pcall go straight to Handlers. Replicas don't
+// run scripts, they get the commands the script wrote with instead.
+
+// scripts holds the compiled scripts by the SHA1 of their body.
+// Guarded by mux.
+var scripts = map[string]*lua.FunctionProto{}
+
+// scriptEffects holds what replicas need to apply to end up like the last
+// script left the keyspace. Guarded by mux.
+var scriptEffects []token
+
+// scriptCommands run scripts, they reach replicas as their effects
+var scriptCommands = map[string]bool{
+	"EVAL":     true,
+	"EVALSHA":  true,
+	"FCALL":    true,
+	"FCALL_RO": true,
+}
+
+// deniedInScripts can't be called from scripts, on top of the commands
+// that need a client of their own
+var deniedInScripts = map[string]bool{
+	"EVAL":     true,
+	"EVALSHA":  true,
+	"SCRIPT":   true,
+	"FUNCTION": true,
+	"FCALL":    true,
+	"FCALL_RO": true,
+	"WAIT":     true,
+	"PSYNC":    true,
+	"REPLCONF": true,
+}
+
+// The scripting commands call Handlers themselves, so they can't be part
+// of its definition
+func init() {
+	Handlers["EVAL"] = commandSpec{eval, -3}
+	Handlers["EVALSHA"] = commandSpec{evalsha, -3}
+	Handlers["SCRIPT"] = commandSpec{script, -2}
+}
+
+func sha1hex(body string) string {
+	sum := sha1.Sum([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+// loadScript compiles body and adds it to the script cache.
+// Callers must hold mux.
+func loadScript(body string) (string, *lua.FunctionProto, *token) {
+	sha := sha1hex(body)
+	if proto, ok := scripts[sha]; ok {
+		return sha, proto, nil
+	}
+
+	chunk, err := parse.Parse(strings.NewReader(body), "@user_script")
+	if err != nil {
+		return "", nil, &token{typ: string(ERROR), val: fmt.Sprintf("ERR Error compiling script (new function): %v", err)}
+	}
+
+	proto, err := lua.Compile(chunk, "@user_script")
+	if err != nil {
+		return "", nil, &token{typ: string(ERROR), val: fmt.Sprintf("ERR Error compiling script (new function): %v", err)}
+	}
+
+	scripts[sha] = proto
+
+	return sha, proto, nil
+}
+
+// parseScriptArgs splits the arguments following the script of EVAL and
+// EVALSHA into its keys and the other arguments
+func parseScriptArgs(args []token) ([]string, []string, *token) {
+	numkeys, err := strconv.Atoi(args[0].bulk)
+	if err != nil {
+		return nil, nil, &errNotInteger
+	}
+
+	if numkeys < 0 {
+		return nil, nil, &token{typ: string(ERROR), val: "ERR Number of keys can't be negative"}
+	}
+
+	if numkeys > len(args)-1 {
+		return nil, nil, &token{typ: string(ERROR), val: "ERR Number of keys can't be greater than number of args"}
+	}
+
+	keys := make([]string, 0, numkeys)
+	for _, arg := range args[1 : numkeys+1] {
+		keys = append(keys, arg.bulk)
+	}
+
+	argv := make([]string, 0, len(args)-numkeys-1)
+	for _, arg := range args[numkeys+1:] {
+		argv = append(argv, arg.bulk)
+	}
+
+	return keys, argv, nil
+}
+
+// scriptRun is what the redis table of an interpreter acts on
+type scriptRun struct {
+	// effects collects what the commands called wrote, for replicas
+	effects []token
+	// readOnly refuses commands that write
+	readOnly bool
+	// loading is set while a library registers its functions, which
+	// can't call commands yet
+	loading bool
+	// function is set for the functions of libraries
+	function bool
+}
+
+// runScript runs proto with the KEYS and ARGV globals set and returns its
+// reply. Callers must hold mux.
+func runScript(proto *lua.FunctionProto, keys, argv []string) token {
+	run := &scriptRun{}
+	L := newScriptState(run)
+	defer L.Close()
+
+	L.SetGlobal("KEYS", stringsTable(L, keys))
+	L.SetGlobal("ARGV", stringsTable(L, argv))
+
+	return runFunction(L, run, L.NewFunctionFromProto(proto))
+}
+
+// runFunction calls fn with args in L, whose redis table acts on run, and
+// returns its reply. Callers must hold mux.
+func runFunction(L *lua.LState, run *scriptRun, fn *lua.LFunction, args ...lua.LValue) token {
+	// Scripts can't wait for other clients, blocking commands time out
+	// right away
+	defer func(blocking bool) { denyBlocking = blocking }(denyBlocking)
+	denyBlocking = true
+
+	run.effects = []token{}
+	defer func() { scriptEffects = run.effects }()
+
+	// Killing the script cancels its context, which stops the interpreter
+	ctx, kill := context.WithCancel(context.Background())
+	defer kill()
+	L.SetContext(ctx)
+	defer L.RemoveContext()
+
+	script := startScript(run.function, kill)
+	defer endScript()
+
+	L.Push(fn)
+	for _, arg := range args {
+		L.Push(arg)
+	}
+
+	if err := L.PCall(len(args), 1, nil); err != nil {
+		if script.wasKilled() {
+			command := "SCRIPT KILL"
+			if run.function {
+				command = "FUNCTION KILL"
+			}
+			return token{typ: string(ERROR), val: fmt.Sprintf("ERR Script killed by user with %s...", command)}
+		}
+
+		return scriptErrorReply(err)
+	}
+
+	reply := luaToToken(L.Get(-1))
+	L.Pop(1)
+
+	return reply
+}
+
+// newScriptState returns an interpreter with the libraries scripts may use
+// and the redis table, which acts on run
+func newScriptState(run *scriptRun) *lua.LState {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+
+	// Nothing may reach the filesystem
+	L.SetGlobal("dofile", lua.LNil)
+	L.SetGlobal("loadfile", lua.LNil)
+
+	redis := L.NewTable()
+	L.SetFuncs(redis, map[string]lua.LGFunction{
+		"call":  func(L *lua.LState) int { return redisCall(L, run, true) },
+		"pcall": func(L *lua.LState) int { return redisCall(L, run, false) },
+		"error_reply": func(L *lua.LState) int {
+			L.Push(replyTable(L, "err", L.CheckString(1)))
+			return 1
+		},
+		"status_reply": func(L *lua.LState) int {
+			L.Push(replyTable(L, "ok", L.CheckString(1)))
+			return 1
+		},
+		"sha1hex": func(L *lua.LState) int {
+			L.Push(lua.LString(sha1hex(L.CheckString(1))))
+			return 1
+		},
+		"log": func(L *lua.LState) int {
+			fmt.Printf("Script log (%d): %s\n", L.CheckInt(1), L.CheckString(2))
+			return 0
+		},
+	})
+	for level, name := range []string{"LOG_DEBUG", "LOG_VERBOSE", "LOG_NOTICE", "LOG_WARNING"} {
+		L.SetField(redis, name, lua.LNumber(level))
+	}
+	L.SetGlobal("redis", redis)
+
+	return L
+}
+
+// redisCall runs the command given as arguments on the Lua stack and
+// pushes its reply. Errors are raised when raise is set, like redis.call
+// does, otherwise they are returned like redis.pcall does.
+func redisCall(L *lua.LState, run *scriptRun, raise bool) int {
+	fail := func(message string) int {
+		if raise {
+			L.Error(replyTable(L, "err", message), 1)
+			return 0
+		}
+
+		L.Push(replyTable(L, "err", message))
+		return 1
+	}
+
+	if run.loading {
+		return fail("ERR redis.call can only be called inside a script invocation")
+	}
+
+	n := L.GetTop()
+	if n == 0 {
+		return fail("ERR Please specify at least one argument for this redis lib call")
+	}
+
+	values := make([]token, 0, n)
+	for i := 1; i <= n; i++ {
+		switch v := L.Get(i).(type) {
+		case lua.LString, lua.LNumber:
+			values = append(values, token{typ: string(BULK), bulk: v.String()})
+		default:
+			return fail("ERR Lua redis lib command arguments must be strings or integers")
+		}
+	}
+
+	t := token{typ: string(ARRAY), array: values}
+	command := strings.ToUpper(values[0].bulk)
+	args := values[1:]
+
+	if deniedInScripts[command] || clientHandlers[command] != nil {
+		return fail("ERR This Redis command is not allowed from script")
+	}
+
+	spec, ok := Handlers[command]
+	if !ok {
+		return fail("ERR Unknown Redis command called from script")
+	}
+
+	if !checkArity(command, args) {
+		return fail("ERR Wrong number of args calling Redis command from script")
+	}
+
+	if run.readOnly && writesData(command) {
+		return fail("ERR Write commands are not allowed from read-only scripts.")
+	}
+
+	result := spec.handler(args)
+	run.effects = append(run.effects, propagatedCommands(t, command, args, result)...)
+	if len(run.effects) > 0 {
+		scriptWrote()
+	}
+
+	if result.typ == string(ERROR) {
+		return fail(result.val)
+	}
+
+	L.Push(tokenToLua(L, result, !simpleStringIsData(command, args)))
+	return 1
+}
+
+// writesData reports whether command may change the keyspace, which
+// read-only scripts can't do
+func writesData(command string) bool {
+	switch command {
+	case "PUBLISH", "SPUBLISH":
+		return false
+	case "BLPOP", "BRPOP", "BLMOVE", "GETEX":
+		return true
+	default:
+		return writeCommands[command]
+	}
+}
+
+// simpleStringIsData reports whether the simple string a command replies
+// with holds data, which other servers send as a bulk string, rather than
+// a status
+func simpleStringIsData(command string, args []token) bool {
+	switch command {
+	case "GET", "ECHO", "INFO":
+		return true
+	case "PING":
+		return len(args) > 0
+	default:
+		return false
+	}
+}
+
+func replyTable(L *lua.LState, field, message string) *lua.LTable {
+	tbl := L.NewTable()
+	tbl.RawSetString(field, lua.LString(message))
+	return tbl
+}
+
+func stringsTable(L *lua.LState, values []string) *lua.LTable {
+	tbl := L.CreateTable(len(values), 0)
+	for _, v := range values {
+		tbl.Append(lua.LString(v))
+	}
+	return tbl
+}
+
+// tokenToLua converts a reply to what scripts get for it. Simple strings
+// become status tables when status is set.
+func tokenToLua(L *lua.LState, t token, status bool) lua.LValue {
+	switch t.typ {
+	case string(INTEGER):
+		n, _ := strconv.ParseInt(t.val, 10, 64)
+		return lua.LNumber(n)
+	case string(STRING):
+		if status {
+			return replyTable(L, "ok", t.val)
+		}
+		return lua.LString(t.val)
+	case string(ERROR):
+		return replyTable(L, "err", t.val)
+	case string(ARRAY), string(SET):
+		tbl := L.CreateTable(len(t.array), 0)
+		for _, element := range t.array {
+			tbl.Append(tokenToLua(L, element, false))
+		}
+		return tbl
+	case string(NULL), string(NULLARRAY):
+		return lua.LFalse
+	default:
+		// Array elements without a type are bulk strings
+		return lua.LString(t.bulk)
+	}
+}
+
+// luaToToken converts what a script returned to its reply
+func luaToToken(lv lua.LValue) token {
+	switch v := lv.(type) {
+	case lua.LString:
+		return token{typ: string(BULK), bulk: string(v)}
+	case lua.LNumber:
+		// Numbers are truncated to integers, scripts return floats as strings
+		return token{typ: string(INTEGER), val: strconv.FormatInt(int64(v), 10)}
+	case lua.LBool:
+		if v {
+			return intToken(1)
+		}
+		return token{typ: string(NULL)}
+	case *lua.LTable:
+		if message, ok := v.RawGetString("err").(lua.LString); ok {
+			return token{typ: string(ERROR), val: string(message)}
+		}
+
+		if status, ok := v.RawGetString("ok").(lua.LString); ok {
+			return token{typ: string(STRING), val: string(status)}
+		}
+
+		// Arrays end at the first nil
+		array := []token{}
+		for i := 1; ; i++ {
+			element := v.RawGetInt(i)
+			if element == lua.LNil {
+				break
+			}
+			array = append(array, luaToToken(element))
+		}
+		return token{typ: string(ARRAY), array: array}
+	default:
+		return token{typ: string(NULL)}
+	}
+}
+
+// scriptErrorReply converts an error raised by a script to its reply
+func scriptErrorReply(err error) token {
+	return raisedError(err, "ERR Error running script")
+}
+
+// raisedError converts an error raised by Lua to an error reply, which
+// prefix introduces unless the error is a reply already
+func raisedError(err error, prefix string) token {
+	apiErr, ok := err.(*lua.ApiError)
+	if !ok {
+		return token{typ: string(ERROR), val: fmt.Sprintf("%s: %v", prefix, err)}
+	}
+
+	// Errors raised by redis.call and redis.error_reply keep their code
+	if tbl, ok := apiErr.Object.(*lua.LTable); ok {
+		if message, ok := tbl.RawGetString("err").(lua.LString); ok {
+			return token{typ: string(ERROR), val: string(message)}
+		}
+	}
+
+	return token{typ: string(ERROR), val: fmt.Sprintf("%s: %s", prefix, apiErr.Object.String())}
+}
+
+// EVAL script numkeys [key [key ...]] [arg [arg ...]]
+func eval(args []token) token {
+	if len(args) < 2 {
+		return wrongArgs("EVAL")
+	}
+
+	// Nothing to replicate unless the script runs
+	scriptEffects = nil
+
+	keys, argv, errTok := parseScriptArgs(args[1:])
+	if errTok != nil {
+		return *errTok
+	}
+
+	_, proto, errTok := loadScript(args[0].bulk)
+	if errTok != nil {
+		return *errTok
+	}
+
+	return runScript(proto, keys, argv)
+}
+
+// EVALSHA sha1 numkeys [key [key ...]] [arg [arg ...]]
+func evalsha(args []token) token {
+	if len(args) < 2 {
+		return wrongArgs("EVALSHA")
+	}
+
+	// Nothing to replicate unless the script runs
+	scriptEffects = nil
+
+	keys, argv, errTok := parseScriptArgs(args[1:])
+	if errTok != nil {
+		return *errTok
+	}
+
+	proto, ok := scripts[strings.ToLower(args[0].bulk)]
+	if !ok {
+		return token{typ: string(ERROR), val: "NOSCRIPT No matching script. Please use EVAL."}
+	}
+
+	return runScript(proto, keys, argv)
+}
+
+// SCRIPT LOAD script | EXISTS sha1 [sha1 ...] | FLUSH [ASYNC|SYNC] | KILL
+func script(args []token) token {
+	if len(args) == 0 {
+		return wrongArgs("SCRIPT")
+	}
+
+	switch strings.ToUpper(args[0].bulk) {
+	case "LOAD":
+		if len(args) != 2 {
+			return wrongArgs("SCRIPT|LOAD")
+		}
+
+		sha, _, errTok := loadScript(args[1].bulk)
+		if errTok != nil {
+			return *errTok
+		}
+
+		return token{typ: string(BULK), bulk: sha}
+	case "EXISTS":
+		if len(args) < 2 {
+			return wrongArgs("SCRIPT|EXISTS")
+		}
+
+		exists := make([]token, 0, len(args)-1)
+		for _, arg := range args[1:] {
+			if _, ok := scripts[strings.ToLower(arg.bulk)]; ok {
+				exists = append(exists, intToken(1))
+			} else {
+				exists = append(exists, intToken(0))
+			}
+		}
+
+		return token{typ: string(ARRAY), array: exists}
+	case "KILL":
+		// SCRIPT KILL itself doesn't wait for mux, see scriptControl
+		return wrongArgs("SCRIPT|KILL")
+	case "FLUSH":
+		if len(args) > 2 {
+			return wrongArgs("SCRIPT|FLUSH")
+		}
+
+		if len(args) == 2 {
+			mode := strings.ToUpper(args[1].bulk)
+			if mode != "ASYNC" && mode != "SYNC" {
+				return token{typ: string(ERROR), val: "ERR SCRIPT FLUSH only support SYNC|ASYNC option"}
+			}
+		}
+
+		clear(scripts)
+
+		return token{typ: string(STRING), val: "OK"}
+	default:
+		return token{
+			typ: string(ERROR),
+			val: fmt.Sprintf("ERR unknown subcommand '%s'. Try SCRIPT HELP.", args[0].bulk),
+		}
+	}
+}
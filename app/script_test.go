@@ -0,0 +1,176 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEval(t *testing.T) {
+	run(t, "SET", "sc:str", "hello")
+	run(t, "RPUSH", "sc:list", "a", "b")
+
+	cases := []struct {
+		name string
+		args []string
+		want token
+	}{
+		{
+			name: "keys and argv",
+			args: []string{"EVAL", "return {KEYS[1], ARGV[1], #KEYS, #ARGV}", "1", "k", "a"},
+			want: token{typ: string(ARRAY), array: []token{
+				{typ: string(BULK), bulk: "k"},
+				{typ: string(BULK), bulk: "a"},
+				intToken(1),
+				intToken(1),
+			}},
+		},
+		{
+			name: "numbers are truncated",
+			args: []string{"EVAL", "return 3.99", "0"},
+			want: intToken(3),
+		},
+		{
+			name: "booleans",
+			args: []string{"EVAL", "return {true, false, 1}", "0"},
+			// false becomes a null reply, not the end of the array
+			want: token{typ: string(ARRAY), array: []token{intToken(1), {typ: string(NULL)}, intToken(1)}},
+		},
+		{
+			name: "array ends at nil",
+			args: []string{"EVAL", "return {1, nil, 3}", "0"},
+			want: token{typ: string(ARRAY), array: []token{intToken(1)}},
+		},
+		{
+			name: "status reply",
+			args: []string{"EVAL", "return redis.call('SET', KEYS[1], 'v')", "1", "sc:set"},
+			want: token{typ: string(STRING), val: "OK"},
+		},
+		{
+			name: "status is a table",
+			args: []string{"EVAL", "return redis.call('PING')['ok']", "0"},
+			want: token{typ: string(BULK), bulk: "PONG"},
+		},
+		{
+			name: "get returns a string",
+			args: []string{"EVAL", "return type(redis.call('GET', 'sc:str'))", "0"},
+			want: token{typ: string(BULK), bulk: "string"},
+		},
+		{
+			name: "missing key is false",
+			args: []string{"EVAL", "return redis.call('GET', 'sc:missing') == false", "0"},
+			want: intToken(1),
+		},
+		{
+			name: "arrays and integers",
+			args: []string{"EVAL", "local l = redis.call('LRANGE', 'sc:list', 0, -1); return {l[2], redis.call('LLEN', 'sc:list') + 1}", "0"},
+			want: token{typ: string(ARRAY), array: []token{{typ: string(BULK), bulk: "b"}, intToken(3)}},
+		},
+		{
+			name: "call raises errors",
+			args: []string{"EVAL", "redis.call('INCR', 'sc:str'); return 'unreachable'", "0"},
+			want: errNotInteger,
+		},
+		{
+			name: "pcall returns errors",
+			args: []string{"EVAL", "return redis.pcall('LPUSH', 'sc:str', 'x')['err']", "0"},
+			want: token{typ: string(BULK), bulk: errWrongType.val},
+		},
+		{
+			name: "error reply",
+			args: []string{"EVAL", "return redis.error_reply('MY failure')", "0"},
+			want: token{typ: string(ERROR), val: "MY failure"},
+		},
+		{
+			name: "unknown command",
+			args: []string{"EVAL", "return redis.call('NOSUCH')", "0"},
+			want: token{typ: string(ERROR), val: "ERR Unknown Redis command called from script"},
+		},
+		{
+			name: "command not allowed",
+			args: []string{"EVAL", "return redis.call('EVAL', 'return 1', '0')", "0"},
+			want: token{typ: string(ERROR), val: "ERR This Redis command is not allowed from script"},
+		},
+		{
+			name: "blocking commands don't block",
+			args: []string{"EVAL", "return redis.call('BLPOP', 'sc:empty', 0)", "0"},
+			want: token{typ: string(NULL)},
+		},
+		{
+			name: "sha1hex",
+			args: []string{"EVAL", "return redis.sha1hex('')", "0"},
+			want: token{typ: string(BULK), bulk: "da39a3ee5e6b4b0d3255bfef95601890afd80709"},
+		},
+		{
+			name: "negative numkeys",
+			args: []string{"EVAL", "return 1", "-1"},
+			want: token{typ: string(ERROR), val: "ERR Number of keys can't be negative"},
+		},
+		{
+			name: "too many keys",
+			args: []string{"EVAL", "return 1", "2", "k"},
+			want: token{typ: string(ERROR), val: "ERR Number of keys can't be greater than number of args"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := run(t, c.args...); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("Failed %s. wanted %v, got %v", c.name, c.want, got)
+			}
+		})
+	}
+
+	t.Run("compile error", func(t *testing.T) {
+		if got := run(t, "EVAL", "return (", "0"); got.typ != string(ERROR) {
+			t.Errorf("Failed compile error. wanted an error, got %v", got)
+		}
+	})
+}
+
+func TestScriptCache(t *testing.T) {
+	body := "return ARGV[1] .. ARGV[2]"
+	sha := "702b19e4aa19aaa9858b9343630276d13af5822e"
+
+	steps := []struct {
+		args []string
+		want token
+	}{
+		{[]string{"SCRIPT", "FLUSH"}, token{typ: string(STRING), val: "OK"}},
+		{[]string{"EVALSHA", sha, "0", "a", "b"}, token{typ: string(ERROR), val: "NOSCRIPT No matching script. Please use EVAL."}},
+		{[]string{"SCRIPT", "LOAD", body}, token{typ: string(BULK), bulk: sha}},
+		{[]string{"SCRIPT", "EXISTS", sha, "ffff"}, token{typ: string(ARRAY), array: []token{intToken(1), intToken(0)}}},
+		{[]string{"EVALSHA", sha, "0", "a", "b"}, token{typ: string(BULK), bulk: "ab"}},
+		{[]string{"SCRIPT", "FLUSH", "ASYNC"}, token{typ: string(STRING), val: "OK"}},
+		{[]string{"SCRIPT", "EXISTS", sha}, token{typ: string(ARRAY), array: []token{intToken(0)}}},
+		// EVAL caches what it runs
+		{[]string{"EVAL", body, "0", "c", "d"}, token{typ: string(BULK), bulk: "cd"}},
+		{[]string{"SCRIPT", "EXISTS", sha}, token{typ: string(ARRAY), array: []token{intToken(1)}}},
+	}
+
+	for _, step := range steps {
+		if got := run(t, step.args...); !reflect.DeepEqual(got, step.want) {
+			t.Errorf("Failed %v. wanted %v, got %v", step.args, step.want, got)
+		}
+	}
+}
+
+func TestScriptEffects(t *testing.T) {
+	run(t, "SADD", "sc:members", "m")
+
+	got := run(t, "EVAL", "redis.call('SET', 'sc:fx', '1'); redis.call('GET', 'sc:fx'); return redis.call('SPOP', 'sc:members')", "0")
+	if want := (token{typ: string(BULK), bulk: "m"}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Failed eval. wanted %v, got %v", want, got)
+	}
+
+	mux.Lock()
+	effects := propagatedCommands(token{}, "EVAL", nil, got)
+	mux.Unlock()
+
+	want := []token{
+		bulkArray([]string{"SET", "sc:fx", "1"}),
+		bulkArray([]string{"SREM", "sc:members", "m"}),
+	}
+	if !reflect.DeepEqual(effects, want) {
+		t.Errorf("Failed effects. wanted %v, got %v", want, effects)
+	}
+}
@@ -19,7 +19,83 @@ var (
 	waitACKCh chan struct{}
 )
 
-var replicas []net.Conn
+// replicas are the connections the replication stream is sent to.
+// Guarded by mux.
+var replicas []*client
+
+// writeCommands are the commands that modify the datastore
+// and therefore need to be propagated to replicas
+var writeCommands = map[string]bool{
+	"SET":            true,
+	"DEL":            true,
+	"LPUSH":          true,
+	"RPUSH":          true,
+	"LPUSHX":         true,
+	"RPUSHX":         true,
+	"LPOP":           true,
+	"RPOP":           true,
+	"LSET":           true,
+	"LTRIM":          true,
+	"LINSERT":        true,
+	"LREM":           true,
+	"LMOVE":          true,
+	"HSET":           true,
+	"HMSET":          true,
+	"HSETNX":         true,
+	"HDEL":           true,
+	"HINCRBY":        true,
+	"HINCRBYFLOAT":   true,
+	"SADD":           true,
+	"SREM":           true,
+	"SMOVE":          true,
+	"SPOP":           true,
+	"SINTERSTORE":    true,
+	"SUNIONSTORE":    true,
+	"SDIFFSTORE":     true,
+	"ZADD":           true,
+	"ZINCRBY":        true,
+	"ZREM":           true,
+	"ZPOPMIN":        true,
+	"ZPOPMAX":        true,
+	"EXPIRE":         true,
+	"PEXPIRE":        true,
+	"EXPIREAT":       true,
+	"PEXPIREAT":      true,
+	"PERSIST":        true,
+	"UNLINK":         true,
+	"RENAME":         true,
+	"RENAMENX":       true,
+	"COPY":           true,
+	"XADD":           true,
+	"XDEL":           true,
+	"XTRIM":          true,
+	"XGROUP":         true,
+	"XREADGROUP":     true,
+	"XACK":           true,
+	"XCLAIM":         true,
+	"XAUTOCLAIM":     true,
+	"INCR":           true,
+	"DECR":           true,
+	"INCRBY":         true,
+	"DECRBY":         true,
+	"INCRBYFLOAT":    true,
+	"APPEND":         true,
+	"SETRANGE":       true,
+	"GETSET":         true,
+	"GETDEL":         true,
+	"MSET":           true,
+	"MSETNX":         true,
+	"PUBLISH":        true,
+	"SPUBLISH":       true,
+	"SETBIT":         true,
+	"BITOP":          true,
+	"BITFIELD":       true,
+	"PFADD":          true,
+	"PFMERGE":        true,
+	"GEOADD":         true,
+	"GEOSEARCHSTORE": true,
+	"FLUSHALL":       true,
+}
 
 type Replicas struct {
 	conn         net.Conn
@@ -65,6 +141,11 @@ func main() {
 		defer r.file.Close()
 	}
 
+	// Replicas leave expiring keys to the master
+	if Role == "master" {
+		StartActiveExpire()
+	}
+
 	// time.Sleep(1 * time.Second)
 	// Send Handshake to master if asked for
 	if Role == "slave" {
@@ -93,13 +174,18 @@ func main() {
 }
 
 func process(conn net.Conn) {
-	defer conn.Close()
+	// The client's writer goroutine closes conn once its output is sent
+	c := newClient(conn)
+	defer c.close()
+
+	// One reader for the whole connection, so pipelined commands
+	// buffered along with the current one aren't lost
+	resp := NewResp(conn)
 
 	for {
-		resp := NewResp(conn)
 		t, err := resp.Read()
 		if err != nil {
-			fmt.Errorf("Failed to read from conn: %v", err)
+			fmt.Printf("Failed to read from conn: %v\n", err)
 			return
 		}
 
@@ -117,36 +203,83 @@ func process(conn net.Conn) {
 		fmt.Println("MAIN COMMAND: ", command)
 		args := t.array[1:]
 
-		if command == "PSYNC" {
-			replicas = append(replicas, conn)
+		// Subscribed clients only get to manage their subscriptions
+		if c.subscribed() {
+			switch {
+			case !subscribedModeCommands[command]:
+				c.write(subscribedModeError(command))
+				continue
+			case command == "PING":
+				c.write(subscribedPing(args))
+				continue
+			}
+		}
+
+		// A running script holds mux, what can't wait for it is handled here
+		if reply, handled := scriptControl(command, args); handled {
+			c.write(reply)
+			continue
 		}
 
-		encoder := NewEncoder(conn, conn)
-		handler, ok := Handlers[command]
+		// Inside MULTI everything but the transaction commands is queued
+		if c.multi && !transactionCommands[command] {
+			c.queue(t, command, args)
+			continue
+		}
+
+		if clientHandler, ok := clientHandlers[command]; ok {
+			clientHandler(c, args)
+			continue
+		}
+
+		spec, ok := Handlers[command]
 
 		if !ok {
 			fmt.Println("Invalid command: ", string(command), ok)
-			encoder.Encode(
+			c.write(
 				token{typ: string(STRING), val: ""},
 			)
 			continue
 		}
 
-		result := handler(args)
-		encoder.Encode(result)
+		// Commands run one at a time, and reach the replicas in that order
+		if reply, locked := lockUnlessBusy(command, args); !locked {
+			c.write(reply)
+			continue
+		}
+
+		if command == "PSYNC" {
+			replicas = append(replicas, c)
+			c.limitOutput(replicaOutputLimit)
+		}
+
+		// Blocked clients stop waiting once their connection drops
+		wait := func() {}
+		if blockingCommands[command] {
+			connectionGone, wait = resp.watchClosed()
+		}
+		result := spec.handler(args)
+		connectionGone = nil
+		if Role == "master" {
+			commands := propagatedCommands(t, command, args, result)
+			// What a script wrote reaches replicas as a whole too
+			if scriptCommands[command] && len(commands) > 1 {
+				commands = multiExec(commands)
+			}
+			replicate(commands...)
+		}
+		mux.Unlock()
+
+		c.write(result)
+		wait()
 
-		// Add to replication buffer
 		if Role == "master" {
 			switch command {
-			case "SET":
-				// Keep track of bytes written for master
-				bytesWritten += TokenLength(t)
-				propagate(t)
-			case "DEL":
-				propagate(t)
 			case "REPLCONF":
 				if t.array[1].bulk == "GETACK" {
+					mux.Lock()
 					propagate(t)
+					mux.Unlock()
 				}
 				if t.array[1].bulk == "ACK" {
 					if waitACKCh != nil {
@@ -179,7 +312,7 @@ func process(conn net.Conn) {
 		case string(STRING):
 			if strings.Contains(result.val, "FULLRESYNC") {
 				token := psyncWithRDB()
-				encoder.Encode(token)
+				c.write(token)
 				fmt.Println("FULLRESYNC: ", conn.LocalAddr().String())
 			}
 		}
@@ -187,8 +320,134 @@ func process(conn net.Conn) {
 	}
 }
 
+// propagatedCommands returns the commands replicas have to apply to end up
+// with the same data as the master after running t, if any, followed by
+// the ones of the blocked clients it served. Callers must hold mux.
+func propagatedCommands(t token, command string, args []token, result token) []token {
+	commands := commandEffects(t, command, args, result)
+	if len(servedCommands) == 0 {
+		return commands
+	}
+
+	commands = append(append([]token(nil), commands...), servedCommands...)
+	servedCommands = nil
+
+	return commands
+}
+
+// commandEffects returns what replicas have to apply to mirror t itself
+func commandEffects(t token, command string, args []token, result token) []token {
+	// Replicas apply what a script wrote rather than run it again, which
+	// counts even when the script failed afterwards
+	if scriptCommands[command] {
+		return scriptEffects
+	}
+
+	if result.typ == string(ERROR) {
+		return nil
+	}
+
+	switch command {
+	case "SPOP":
+		// Replicas would pick different members, so tell them which ones went
+		popped := []string{}
+		switch result.typ {
+		case string(BULK):
+			popped = append(popped, result.bulk)
+		case string(ARRAY):
+			for _, member := range result.array {
+				popped = append(popped, member.bulk)
+			}
+		}
+		if len(popped) == 0 {
+			return nil
+		}
+
+		return []token{bulkArray(append([]string{"SREM", args[0].bulk}, popped...))}
+	case "XADD":
+		// Generated IDs depend on the master's clock, send the one it picked
+		if result.typ == string(BULK) {
+			return []token{xaddWithID(args, result.bulk)}
+		}
+	case "FUNCTION":
+		// Only the subcommands changing the libraries matter to replicas
+		switch strings.ToUpper(args[0].bulk) {
+		case "LOAD", "DELETE", "FLUSH", "RESTORE":
+			return []token{t}
+		}
+		return nil
+	case "GETEX":
+		// Only the TTL change matters to replicas
+		if changed, ok := getexCommand(args, result); ok {
+			return []token{changed}
+		}
+		return nil
+	}
+
+	if absolute, ok := absoluteExpiryCommand(command, args, result); ok {
+		return []token{absolute}
+	}
+
+	if commands, ok := groupCommands(command, args, result); ok {
+		return commands
+	}
+
+	if writeCommands[command] {
+		return []token{t}
+	}
+
+	return nil
+}
+
+// replicate adds commands to the replication stream, keeping track of the
+// bytes written for WAIT
+func replicate(commands ...token) {
+	for _, command := range commands {
+		bytesWritten += TokenLength(command)
+		propagate(command)
+	}
+}
+
 func propagate(tok token) {
-	for _, conn := range replicas {
-		PropagateToReplica(conn, tok)
+	for _, replica := range replicas {
+		replica.write(tok)
 	}
 }
+
+// exitProcess ends the server, tests replace it
+var exitProcess = os.Exit
+
+// SHUTDOWN [NOSAVE|SAVE] [NOW] [FORCE]
+func shutdown(c *client, args []token) {
+	save, nosave := false, false
+	for _, arg := range args {
+		switch strings.ToUpper(arg.bulk) {
+		case "SAVE":
+			save = true
+		case "NOSAVE":
+			nosave = true
+		case "NOW", "FORCE":
+		case "ABORT":
+			c.write(token{typ: string(ERROR), val: "ERR No shutdown in progress."})
+			return
+		default:
+			c.write(errSyntax)
+			return
+		}
+	}
+
+	if save && nosave {
+		c.write(errSyntax)
+		return
+	}
+
+	// Nothing writes RDB files yet, so there is no saving on the way out
+	if save {
+		fmt.Println("Could not save the RDB file before shutting down")
+		c.write(token{typ: string(ERROR), val: "ERR Errors trying to SHUTDOWN. Check logs."})
+		return
+	}
+
+	fmt.Println("Shutting down")
+	exitProcess(0)
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lookupSet returns the set stored at key. A missing key yields a nil
+// map, ok is false when the key holds another type.
+// Callers must hold mux.
+func lookupSet(key string) (members map[string]struct{}, ok bool) {
+	obj, exists := lookupKey(key)
+	if !exists {
+		return nil, true
+	}
+
+	if obj.typ != "set" {
+		return nil, false
+	}
+
+	return obj.setData, true
+}
+
+// setForWrite returns the set at key, creating an empty one if the key
+// does not exist yet. Callers must hold mux.
+func setForWrite(key string) (map[string]struct{}, bool) {
+	members, ok := lookupSet(key)
+	if !ok {
+		return nil, false
+	}
+
+	if members == nil {
+		members = make(map[string]struct{})
+		putKey(key, object{
+			typ:       "set",
+			createdAt: time.Now().UTC(),
+			setData:   members,
+			index:     newScanIndex(),
+		})
+	}
+
+	return members, true
+}
+
+// storeSet replaces whatever is stored at key with members,
+// deleting the key when the set is empty. Callers must hold mux.
+func storeSet(key string, members map[string]struct{}) {
+	if len(members) == 0 {
+		removeKey(key)
+		return
+	}
+
+	index := newScanIndex()
+	for m := range members {
+		index.add(m)
+	}
+
+	putKey(key, object{
+		typ:       "set",
+		createdAt: time.Now().UTC(),
+		setData:   members,
+		index:     index,
+	})
+}
+
+func setMembers(members map[string]struct{}) token {
+	values := make([]string, 0, len(members))
+	for m := range members {
+		values = append(values, m)
+	}
+
+	return bulkArray(values)
+}
+
+// SADD key member [member ...]
+func sadd(args []token) token {
+	if len(args) < 2 {
+		return wrongArgs("SADD")
+	}
+
+	members, ok := setForWrite(args[0].bulk)
+	if !ok {
+		return errWrongType
+	}
+
+	index := scanIndexOf(args[0].bulk)
+	added := 0
+	for _, m := range args[1:] {
+		if _, exists := members[m.bulk]; !exists {
+			members[m.bulk] = struct{}{}
+			index.add(m.bulk)
+			added++
+		}
+	}
+
+	if added > 0 {
+		notifyKeyspaceEvent(notifySet, "sadd", args[0].bulk)
+	}
+
+	return intToken(added)
+}
+
+// SREM key member [member ...]
+func srem(args []token) token {
+	if len(args) < 2 {
+		return wrongArgs("SREM")
+	}
+
+	key := args[0].bulk
+	members, ok := lookupSet(key)
+	if !ok {
+		return errWrongType
+	}
+
+	removed := 0
+	for _, m := range args[1:] {
+		if _, exists := members[m.bulk]; exists {
+			delete(members, m.bulk)
+			scanIndexOf(key).remove(m.bulk)
+			removed++
+		}
+	}
+
+	if removed > 0 {
+		notifyKeyspaceEvent(notifySet, "srem", key)
+	}
+
+	if members != nil && len(members) == 0 {
+		removeKey(key)
+		notifyKeyspaceEvent(notifyGeneric, "del", key)
+	}
+
+	return intToken(removed)
+}
+
+// SMEMBERS key
+func smembers(args []token) token {
+	if len(args) != 1 {
+		return wrongArgs("SMEMBERS")
+	}
+
+	members, ok := lookupSet(args[0].bulk)
+	if !ok {
+		return errWrongType
+	}
+
+	return setMembers(members)
+}
+
+// SISMEMBER key member
+func sismember(args []token) token {
+	if len(args) != 2 {
+		return wrongArgs("SISMEMBER")
+	}
+
+	members, ok := lookupSet(args[0].bulk)
+	if !ok {
+		return errWrongType
+	}
+
+	if _, exists := members[args[1].bulk]; exists {
+		return intToken(1)
+	}
+
+	return intToken(0)
+}
+
+// SMISMEMBER key member [member ...]
+func smismember(args []token) token {
+	if len(args) < 2 {
+		return wrongArgs("SMISMEMBER")
+	}
+
+	members, ok := lookupSet(args[0].bulk)
+	if !ok {
+		return errWrongType
+	}
+
+	result := make([]token, 0, len(args)-1)
+	for _, m := range args[1:] {
+		if _, exists := members[m.bulk]; exists {
+			result = append(result, intToken(1))
+		} else {
+			result = append(result, intToken(0))
+		}
+	}
+
+	return token{typ: string(ARRAY), array: result}
+}
+
+// SCARD key
+func scard(args []token) token {
+	if len(args) != 1 {
+		return wrongArgs("SCARD")
+	}
+
+	members, ok := lookupSet(args[0].bulk)
+	if !ok {
+		return errWrongType
+	}
+
+	return intToken(len(members))
+}
+
+// SMOVE source destination member
+func smove(args []token) token {
+	if len(args) != 3 {
+		return wrongArgs("SMOVE")
+	}
+
+	src, dst, member := args[0].bulk, args[1].bulk, args[2].bulk
+
+	srcMembers, ok := lookupSet(src)
+	if !ok {
+		return errWrongType
+	}
+	if _, ok := lookupSet(dst); !ok {
+		return errWrongType
+	}
+
+	if _, exists := srcMembers[member]; !exists {
+		return intToken(0)
+	}
+
+	// Moving a member onto its own set changes nothing
+	if src == dst {
+		return intToken(1)
+	}
+
+	delete(srcMembers, member)
+	scanIndexOf(src).remove(member)
+	notifyKeyspaceEvent(notifySet, "srem", src)
+	if len(srcMembers) == 0 {
+		removeKey(src)
+		notifyKeyspaceEvent(notifyGeneric, "del", src)
+	}
+
+	dstMembers, _ := setForWrite(dst)
+	if _, exists := dstMembers[member]; !exists {
+		dstMembers[member] = struct{}{}
+		scanIndexOf(dst).add(member)
+		notifyKeyspaceEvent(notifySet, "sadd", dst)
+	}
+
+	return intToken(1)
+}
+
+// SPOP key [count]
+func spop(args []token) token {
+	if len(args) < 1 || len(args) > 2 {
+		return wrongArgs("SPOP")
+	}
+
+	count := 1
+	if len(args) == 2 {
+		n, err := strconv.Atoi(args[1].bulk)
+		if err != nil || n < 0 {
+			return token{typ: string(ERROR), val: "ERR value is out of range, must be positive"}
+		}
+		count = n
+	}
+
+	key := args[0].bulk
+	members, ok := lookupSet(key)
+	if !ok {
+		return errWrongType
+	}
+
+	popped := []string{}
+	// Map iteration order is unspecified, which is random enough here
+	for m := range members {
+		if len(popped) == count {
+			break
+		}
+		popped = append(popped, m)
+		delete(members, m)
+		scanIndexOf(key).remove(m)
+	}
+
+	if len(popped) > 0 {
+		notifyKeyspaceEvent(notifySet, "spop", key)
+	}
+
+	if members != nil && len(members) == 0 {
+		removeKey(key)
+		notifyKeyspaceEvent(notifyGeneric, "del", key)
+	}
+
+	if len(args) == 2 {
+		return bulkArray(popped)
+	}
+
+	if len(popped) == 0 {
+		return token{typ: string(NULL)}
+	}
+
+	return token{typ: string(BULK), bulk: popped[0]}
+}
+
+// SRANDMEMBER key [count]
+func srandmember(args []token) token {
+	if len(args) < 1 || len(args) > 2 {
+		return wrongArgs("SRANDMEMBER")
+	}
+
+	count := 1
+	if len(args) == 2 {
+		n, err := strconv.Atoi(args[1].bulk)
+		if err != nil {
+			return errNotInteger
+		}
+		count = n
+	}
+
+	members, ok := lookupSet(args[0].bulk)
+	if !ok {
+		return errWrongType
+	}
+
+	// A negative count allows the same member to be returned more than once
+	repeat := count < 0
+	if repeat {
+		count = -count
+	}
+
+	picked := []string{}
+	for len(picked) < count && len(members) > 0 {
+		for m := range members {
+			if len(picked) == count {
+				break
+			}
+			picked = append(picked, m)
+			if repeat {
+				break
+			}
+		}
+
+		if !repeat {
+			break
+		}
+	}
+
+	if len(args) == 2 {
+		return bulkArray(picked)
+	}
+
+	if len(picked) == 0 {
+		return token{typ: string(NULL)}
+	}
+
+	return token{typ: string(BULK), bulk: picked[0]}
+}
+
+// setAlgebra computes the intersection, union or difference of the sets
+// stored at keys. ok is false when one of the keys is not a set.
+// Callers must hold mux.
+func setAlgebra(op string, keys []token) (map[string]struct{}, bool) {
+	sets := make([]map[string]struct{}, 0, len(keys))
+	for _, k := range keys {
+		members, ok := lookupSet(k.bulk)
+		if !ok {
+			return nil, false
+		}
+		sets = append(sets, members)
+	}
+
+	result := make(map[string]struct{})
+
+	switch op {
+	case "SINTER":
+		for m := range sets[0] {
+			inAll := true
+			for _, other := range sets[1:] {
+				if _, exists := other[m]; !exists {
+					inAll = false
+					break
+				}
+			}
+
+			if inAll {
+				result[m] = struct{}{}
+			}
+		}
+	case "SUNION":
+		for _, members := range sets {
+			for m := range members {
+				result[m] = struct{}{}
+			}
+		}
+	case "SDIFF":
+		for m := range sets[0] {
+			result[m] = struct{}{}
+		}
+		for _, other := range sets[1:] {
+			for m := range other {
+				delete(result, m)
+			}
+		}
+	}
+
+	return result, true
+}
+
+func setOperation(op string, args []token) token {
+	if len(args) < 1 {
+		return wrongArgs(op)
+	}
+
+	result, ok := setAlgebra(op, args)
+	if !ok {
+		return errWrongType
+	}
+
+	return setMembers(result)
+}
+
+func setOperationStore(op string, args []token) token {
+	if len(args) < 2 {
+		return wrongArgs(op + "STORE")
+	}
+
+	result, ok := setAlgebra(op, args[1:])
+	if !ok {
+		return errWrongType
+	}
+
+	dst := args[0].bulk
+	_, existed := lookupKey(dst)
+	storeSet(dst, result)
+
+	switch {
+	case len(result) > 0:
+		notifyKeyspaceEvent(notifySet, strings.ToLower(op)+"store", dst)
+	case existed:
+		notifyKeyspaceEvent(notifyGeneric, "del", dst)
+	}
+
+	return intToken(len(result))
+}
+
+// SINTER key [key ...]
+func sinter(args []token) token {
+	return setOperation("SINTER", args)
+}
+
+// SUNION key [key ...]
+func sunion(args []token) token {
+	return setOperation("SUNION", args)
+}
+
+// SDIFF key [key ...]
+func sdiff(args []token) token {
+	return setOperation("SDIFF", args)
+}
+
+// SINTERSTORE destination key [key ...]
+func sinterstore(args []token) token {
+	return setOperationStore("SINTER", args)
+}
+
+// SUNIONSTORE destination key [key ...]
+func sunionstore(args []token) token {
+	return setOperationStore("SUNION", args)
+}
+
+// SDIFFSTORE destination key [key ...]
+func sdiffstore(args []token) token {
+	return setOperationStore("SDIFF", args)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// sortedBulks returns the bulk strings of an array reply in sorted order
+func sortedBulks(tok token) []string {
+	values := []string{}
+	for _, v := range tok.array {
+		values = append(values, v.bulk)
+	}
+	sort.Strings(values)
+
+	return values
+}
+
+func TestSet(t *testing.T) {
+	t.Run("sadd and members", func(t *testing.T) {
+		if got := run(t, "SADD", "set:a", "x", "y", "x"); !reflect.DeepEqual(got, intToken(2)) {
+			t.Errorf("Failed sadd. wanted %v, got %v", intToken(2), got)
+		}
+
+		if got := sortedBulks(run(t, "SMEMBERS", "set:a")); !reflect.DeepEqual(got, []string{"x", "y"}) {
+			t.Errorf("Failed smembers. got %v", got)
+		}
+
+		if got := run(t, "SISMEMBER", "set:a", "y"); !reflect.DeepEqual(got, intToken(1)) {
+			t.Errorf("Failed sismember. wanted %v, got %v", intToken(1), got)
+		}
+
+		if got := run(t, "SCARD", "set:a"); !reflect.DeepEqual(got, intToken(2)) {
+			t.Errorf("Failed scard. wanted %v, got %v", intToken(2), got)
+		}
+	})
+
+	t.Run("srem removes empty sets", func(t *testing.T) {
+		run(t, "SADD", "set:rem", "x")
+
+		if got := run(t, "SREM", "set:rem", "x", "z"); !reflect.DeepEqual(got, intToken(1)) {
+			t.Errorf("Failed srem. wanted %v, got %v", intToken(1), got)
+		}
+
+		want := token{typ: string(STRING), val: "none"}
+		if got := run(t, "TYPE", "set:rem"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed type. wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("algebra", func(t *testing.T) {
+		run(t, "SADD", "set:one", "a", "b", "c")
+		run(t, "SADD", "set:two", "b", "c", "d")
+
+		if got := sortedBulks(run(t, "SINTER", "set:one", "set:two")); !reflect.DeepEqual(got, []string{"b", "c"}) {
+			t.Errorf("Failed sinter. got %v", got)
+		}
+		if got := sortedBulks(run(t, "SUNION", "set:one", "set:two")); !reflect.DeepEqual(got, []string{"a", "b", "c", "d"}) {
+			t.Errorf("Failed sunion. got %v", got)
+		}
+		if got := sortedBulks(run(t, "SDIFF", "set:one", "set:two")); !reflect.DeepEqual(got, []string{"a"}) {
+			t.Errorf("Failed sdiff. got %v", got)
+		}
+		if got := sortedBulks(run(t, "SINTER", "set:one", "set:missing")); len(got) != 0 {
+			t.Errorf("Failed sinter. got %v", got)
+		}
+	})
+
+	t.Run("store variants", func(t *testing.T) {
+		run(t, "SADD", "set:s1", "a", "b")
+		run(t, "SADD", "set:s2", "b")
+		run(t, "SET", "set:dest", "string")
+
+		if got := run(t, "SDIFFSTORE", "set:dest", "set:s1", "set:s2"); !reflect.DeepEqual(got, intToken(1)) {
+			t.Errorf("Failed sdiffstore. wanted %v, got %v", intToken(1), got)
+		}
+		if got := sortedBulks(run(t, "SMEMBERS", "set:dest")); !reflect.DeepEqual(got, []string{"a"}) {
+			t.Errorf("Failed sdiffstore. got %v", got)
+		}
+
+		// An empty result removes the destination
+		run(t, "SINTERSTORE", "set:dest", "set:s1", "set:missing")
+		want := token{typ: string(STRING), val: "none"}
+		if got := run(t, "TYPE", "set:dest"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed type. wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("wrong type", func(t *testing.T) {
+		run(t, "SET", "set:str", "value")
+		run(t, "SADD", "set:ok", "a")
+
+		if got := run(t, "SADD", "set:str", "a"); !reflect.DeepEqual(got, errWrongType) {
+			t.Errorf("Failed wrongtype. wanted %v, got %v", errWrongType, got)
+		}
+		if got := run(t, "SUNION", "set:ok", "set:str"); !reflect.DeepEqual(got, errWrongType) {
+			t.Errorf("Failed wrongtype. wanted %v, got %v", errWrongType, got)
+		}
+	})
+}
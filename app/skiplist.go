@@ -0,0 +1,359 @@
+package main
+
+import (
+	"math/rand"
+	"strings"
+)
+
+// The sorted set index is a skiplist ordered by (score, member), following
+// the layout Redis uses in t_zset.c. Every level keeps the span (number of
+// nodes skipped) of its forward pointer so ranks can be computed while
+// descending, and a backward pointer on level 0 allows reverse traversal.
+const (
+	skiplistMaxLevel = 32
+	skiplistP        = 0.25
+)
+
+type skiplistLevel struct {
+	forward *skiplistNode
+	span    int
+}
+
+type skiplistNode struct {
+	member   string
+	score    float64
+	backward *skiplistNode
+	level    []skiplistLevel
+}
+
+type skiplist struct {
+	header *skiplistNode
+	tail   *skiplistNode
+	length int
+	level  int
+}
+
+func newSkiplist() *skiplist {
+	return &skiplist{
+		header: &skiplistNode{level: make([]skiplistLevel, skiplistMaxLevel)},
+		level:  1,
+	}
+}
+
+// randomLevel returns a level between 1 and skiplistMaxLevel where
+// higher levels are exponentially less likely
+func randomLevel() int {
+	level := 1
+	for level < skiplistMaxLevel && rand.Float64() < skiplistP {
+		level++
+	}
+
+	return level
+}
+
+// before reports whether node sorts strictly before (score, member)
+func (n *skiplistNode) before(score float64, member string) bool {
+	return n.score < score || (n.score == score && n.member < member)
+}
+
+// insert adds a new node. The caller makes sure member is not present yet.
+func (sl *skiplist) insert(score float64, member string) *skiplistNode {
+	var update [skiplistMaxLevel]*skiplistNode
+	var rank [skiplistMaxLevel]int
+
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		if i < sl.level-1 {
+			rank[i] = rank[i+1]
+		}
+
+		for x.level[i].forward != nil && x.level[i].forward.before(score, member) {
+			rank[i] += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	level := randomLevel()
+	if level > sl.level {
+		for i := sl.level; i < level; i++ {
+			rank[i] = 0
+			update[i] = sl.header
+			update[i].level[i].span = sl.length
+		}
+		sl.level = level
+	}
+
+	x = &skiplistNode{
+		member: member,
+		score:  score,
+		level:  make([]skiplistLevel, level),
+	}
+
+	for i := 0; i < level; i++ {
+		x.level[i].forward = update[i].level[i].forward
+		update[i].level[i].forward = x
+
+		x.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
+		update[i].level[i].span = (rank[0] - rank[i]) + 1
+	}
+
+	// Levels above the new node now skip one more node
+	for i := level; i < sl.level; i++ {
+		update[i].level[i].span++
+	}
+
+	if update[0] != sl.header {
+		x.backward = update[0]
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x
+	} else {
+		sl.tail = x
+	}
+	sl.length++
+
+	return x
+}
+
+func (sl *skiplist) deleteNode(x *skiplistNode, update []*skiplistNode) {
+	for i := 0; i < sl.level; i++ {
+		if update[i].level[i].forward == x {
+			update[i].level[i].span += x.level[i].span - 1
+			update[i].level[i].forward = x.level[i].forward
+		} else {
+			update[i].level[i].span--
+		}
+	}
+
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x.backward
+	} else {
+		sl.tail = x.backward
+	}
+
+	for sl.level > 1 && sl.header.level[sl.level-1].forward == nil {
+		sl.level--
+	}
+	sl.length--
+}
+
+// delete removes the node matching score and member, reporting whether it was found
+func (sl *skiplist) delete(score float64, member string) bool {
+	update := make([]*skiplistNode, skiplistMaxLevel)
+
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && x.level[i].forward.before(score, member) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	x = x.level[0].forward
+	if x != nil && x.score == score && x.member == member {
+		sl.deleteNode(x, update)
+		return true
+	}
+
+	return false
+}
+
+// rank returns the 1-based position of the node, or 0 when it is missing
+func (sl *skiplist) rank(score float64, member string) int {
+	rank := 0
+
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil &&
+			(x.level[i].forward.before(score, member) ||
+				(x.level[i].forward.score == score && x.level[i].forward.member == member)) {
+			rank += x.level[i].span
+			x = x.level[i].forward
+		}
+
+		if x != sl.header && x.member == member {
+			return rank
+		}
+	}
+
+	return 0
+}
+
+// byRank returns the node at the 1-based rank, or nil when out of range
+func (sl *skiplist) byRank(rank int) *skiplistNode {
+	traversed := 0
+
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span <= rank {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+
+		if traversed == rank && x != sl.header {
+			return x
+		}
+	}
+
+	return nil
+}
+
+// scoreRange is a score interval, with each end optionally exclusive
+type scoreRange struct {
+	min, max     float64
+	minex, maxex bool
+}
+
+func (r scoreRange) gteMin(score float64) bool {
+	if r.minex {
+		return score > r.min
+	}
+	return score >= r.min
+}
+
+func (r scoreRange) lteMax(score float64) bool {
+	if r.maxex {
+		return score < r.max
+	}
+	return score <= r.max
+}
+
+func (r scoreRange) empty() bool {
+	return r.min > r.max || (r.min == r.max && (r.minex || r.maxex))
+}
+
+// firstInRange returns the first node with a score inside r
+func (sl *skiplist) firstInRange(r scoreRange) *skiplistNode {
+	if r.empty() {
+		return nil
+	}
+
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !r.gteMin(x.level[i].forward.score) {
+			x = x.level[i].forward
+		}
+	}
+
+	x = x.level[0].forward
+	if x == nil || !r.lteMax(x.score) {
+		return nil
+	}
+
+	return x
+}
+
+// lastInRange returns the last node with a score inside r
+func (sl *skiplist) lastInRange(r scoreRange) *skiplistNode {
+	if r.empty() {
+		return nil
+	}
+
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && r.lteMax(x.level[i].forward.score) {
+			x = x.level[i].forward
+		}
+	}
+
+	if x == sl.header || !r.gteMin(x.score) {
+		return nil
+	}
+
+	return x
+}
+
+// lexBound is one end of a lexicographical range. inf is -1 for "-",
+// 1 for "+" and 0 for a regular inclusive or exclusive value.
+type lexBound struct {
+	value     string
+	exclusive bool
+	inf       int
+}
+
+type lexRange struct {
+	min, max lexBound
+}
+
+func (r lexRange) gteMin(member string) bool {
+	switch r.min.inf {
+	case -1:
+		return true
+	case 1:
+		return false
+	}
+
+	if r.min.exclusive {
+		return member > r.min.value
+	}
+	return member >= r.min.value
+}
+
+func (r lexRange) lteMax(member string) bool {
+	switch r.max.inf {
+	case 1:
+		return true
+	case -1:
+		return false
+	}
+
+	if r.max.exclusive {
+		return member < r.max.value
+	}
+	return member <= r.max.value
+}
+
+func (r lexRange) empty() bool {
+	if r.min.inf == 1 || r.max.inf == -1 {
+		return true
+	}
+	if r.min.inf == -1 || r.max.inf == 1 {
+		return false
+	}
+
+	cmp := strings.Compare(r.min.value, r.max.value)
+	return cmp > 0 || (cmp == 0 && (r.min.exclusive || r.max.exclusive))
+}
+
+// firstInLexRange returns the first node whose member is inside r.
+// Lex ranges are only meaningful when all members share the same score.
+func (sl *skiplist) firstInLexRange(r lexRange) *skiplistNode {
+	if r.empty() {
+		return nil
+	}
+
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !r.gteMin(x.level[i].forward.member) {
+			x = x.level[i].forward
+		}
+	}
+
+	x = x.level[0].forward
+	if x == nil || !r.lteMax(x.member) {
+		return nil
+	}
+
+	return x
+}
+
+// lastInLexRange returns the last node whose member is inside r
+func (sl *skiplist) lastInLexRange(r lexRange) *skiplistNode {
+	if r.empty() {
+		return nil
+	}
+
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && r.lteMax(x.level[i].forward.member) {
+			x = x.level[i].forward
+		}
+	}
+
+	if x == sl.header || !r.gteMin(x.member) {
+		return nil
+	}
+
+	return x
+}
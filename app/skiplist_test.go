@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestSkiplist(t *testing.T) {
+	t.Run("ranks stay consistent through inserts and deletes", func(t *testing.T) {
+		sl := newSkiplist()
+		scores := map[string]float64{}
+
+		for i := 0; i < 500; i++ {
+			member := fmt.Sprintf("m%d", i)
+			scores[member] = float64(rand.Intn(50))
+			sl.insert(scores[member], member)
+		}
+
+		for i := 0; i < 500; i += 3 {
+			member := fmt.Sprintf("m%d", i)
+			if !sl.delete(scores[member], member) {
+				t.Fatalf("Failed delete of %s", member)
+			}
+			delete(scores, member)
+		}
+
+		entries := []zsetEntry{}
+		for m, s := range scores {
+			entries = append(entries, zsetEntry{member: m, score: s})
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			if entries[i].score != entries[j].score {
+				return entries[i].score < entries[j].score
+			}
+			return entries[i].member < entries[j].member
+		})
+
+		if sl.length != len(entries) {
+			t.Fatalf("Failed length. wanted %d, got %d", len(entries), sl.length)
+		}
+
+		for i, e := range entries {
+			if got := sl.rank(e.score, e.member); got != i+1 {
+				t.Fatalf("Failed rank of %s. wanted %d, got %d", e.member, i+1, got)
+			}
+
+			node := sl.byRank(i + 1)
+			if node == nil || node.member != e.member {
+				t.Fatalf("Failed byRank %d. wanted %s, got %v", i+1, e.member, node)
+			}
+		}
+
+		// Walking backwards from the tail visits everything in reverse
+		i := len(entries) - 1
+		for node := sl.tail; node != nil; node = node.backward {
+			if node.member != entries[i].member {
+				t.Fatalf("Failed backward walk. wanted %s, got %s", entries[i].member, node.member)
+			}
+			i--
+		}
+	})
+
+	t.Run("score ranges", func(t *testing.T) {
+		sl := newSkiplist()
+		for i := 1; i <= 5; i++ {
+			sl.insert(float64(i), fmt.Sprintf("m%d", i))
+		}
+
+		r := scoreRange{min: 2, max: 4, minex: true}
+		if first := sl.firstInRange(r); first == nil || first.member != "m3" {
+			t.Errorf("Failed firstInRange. got %v", first)
+		}
+		if last := sl.lastInRange(r); last == nil || last.member != "m4" {
+			t.Errorf("Failed lastInRange. got %v", last)
+		}
+		if node := sl.firstInRange(scoreRange{min: 6, max: 10}); node != nil {
+			t.Errorf("Failed firstInRange. wanted nil, got %v", node)
+		}
+	})
+}
@@ -0,0 +1,860 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// streamID identifies a stream entry: the milliseconds part followed by a
+// sequence number for entries added within the same millisecond.
+type streamID struct {
+	ms  uint64
+	seq uint64
+}
+
+var maxStreamID = streamID{ms: math.MaxUint64, seq: math.MaxUint64}
+
+func (id streamID) String() string {
+	return fmt.Sprintf("%d-%d", id.ms, id.seq)
+}
+
+func (id streamID) less(other streamID) bool {
+	return id.ms < other.ms || (id.ms == other.ms && id.seq < other.seq)
+}
+
+// next returns the smallest ID greater than id, ok is false when id is
+// already the largest one.
+func (id streamID) next() (streamID, bool) {
+	switch {
+	case id.seq < math.MaxUint64:
+		return streamID{ms: id.ms, seq: id.seq + 1}, true
+	case id.ms < math.MaxUint64:
+		return streamID{ms: id.ms + 1}, true
+	default:
+		return id, false
+	}
+}
+
+// prev returns the largest ID smaller than id, ok is false when id is 0-0.
+func (id streamID) prev() (streamID, bool) {
+	switch {
+	case id.seq > 0:
+		return streamID{ms: id.ms, seq: id.seq - 1}, true
+	case id.ms > 0:
+		return streamID{ms: id.ms - 1, seq: math.MaxUint64}, true
+	default:
+		return id, false
+	}
+}
+
+// parseStreamID reads "<ms>-<seq>" or just "<ms>", in which case the
+// sequence number is missingSeq.
+func parseStreamID(s string, missingSeq uint64) (streamID, bool) {
+	msPart, seqPart, hasSeq := strings.Cut(s, "-")
+
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return streamID{}, false
+	}
+
+	if !hasSeq {
+		return streamID{ms: ms, seq: missingSeq}, true
+	}
+
+	seq, err := strconv.ParseUint(seqPart, 10, 64)
+	if err != nil {
+		return streamID{}, false
+	}
+
+	return streamID{ms: ms, seq: seq}, true
+}
+
+var errInvalidStreamID = token{
+	typ: string(ERROR),
+	val: "ERR Invalid stream ID specified as stream command argument",
+}
+
+type streamEntry struct {
+	id streamID
+	// Field names and values, alternating, in the order they were given
+	fields []string
+}
+
+// stream keeps its entries sorted by ID. lastID is the ID of the newest
+// entry ever added, which may have been deleted since, new entries must
+// always be greater than it. Trimming reslices entries from the front,
+// evicted counts the slots left behind until they get compacted away.
+type stream struct {
+	entries      []streamEntry
+	evicted      int
+	lastID       streamID
+	maxDeletedID streamID
+	entriesAdded uint64
+	groups       map[string]*consumerGroup
+}
+
+// clone returns a deep copy of s
+func (s *stream) clone() *stream {
+	c := *s
+	c.entries = append([]streamEntry(nil), s.entries...)
+	c.evicted = 0
+
+	if s.groups != nil {
+		c.groups = make(map[string]*consumerGroup, len(s.groups))
+		for name, g := range s.groups {
+			c.groups[name] = g.clone()
+		}
+	}
+
+	return &c
+}
+
+// search returns the index of the first entry whose ID is at least id
+func (s *stream) search(id streamID) int {
+	return sort.Search(len(s.entries), func(i int) bool {
+		return !s.entries[i].id.less(id)
+	})
+}
+
+// rangeEntries returns the entries with an ID within [start, end]
+func (s *stream) rangeEntries(start, end streamID) []streamEntry {
+	if end.less(start) {
+		return nil
+	}
+
+	from, to := s.search(start), len(s.entries)
+	if next, ok := end.next(); ok {
+		to = s.search(next)
+	}
+
+	return s.entries[from:to]
+}
+
+// streamNodeMaxEntries is how many entries Redis packs in a stream node,
+// approximate trims only evict whole nodes of that size
+const streamNodeMaxEntries = 100
+
+// trim evicts the oldest entries until at most spec.maxLen are left or,
+// when spec.byID is set, until none is smaller than spec.minID. A positive
+// limit caps the number of entries evicted. Returns how many were evicted.
+func (s *stream) trim(spec trimSpec) int {
+	evict := 0
+	if spec.byID {
+		evict = s.search(spec.minID)
+	} else if len(s.entries) > spec.maxLen {
+		evict = len(s.entries) - spec.maxLen
+	}
+
+	if spec.limit > 0 && evict > spec.limit {
+		evict = spec.limit
+	}
+
+	if spec.approx {
+		evict -= evict % streamNodeMaxEntries
+	}
+
+	if evict == 0 {
+		return 0
+	}
+
+	s.maxDeletedID = maxID(s.maxDeletedID, s.entries[evict-1].id)
+
+	// Evicted slots are cleared so their fields can be collected, and only
+	// copied away once they outnumber the entries left
+	clear(s.entries[:evict])
+	s.entries = s.entries[evict:]
+	s.evicted += evict
+	if s.evicted > len(s.entries) {
+		s.entries = append(make([]streamEntry, 0, len(s.entries)), s.entries...)
+		s.evicted = 0
+	}
+
+	return evict
+}
+
+func maxID(a, b streamID) streamID {
+	if a.less(b) {
+		return b
+	}
+
+	return a
+}
+
+// lookupStream returns the stream stored at key. A missing key yields a
+// nil stream, ok is false when the key holds another type.
+// Callers must hold mux.
+func lookupStream(key string) (s *stream, ok bool) {
+	obj, exists := lookupKey(key)
+	if !exists {
+		return nil, true
+	}
+
+	if obj.typ != "stream" {
+		return nil, false
+	}
+
+	return obj.streamData, true
+}
+
+func entryToken(e streamEntry) token {
+	return token{
+		typ: string(ARRAY),
+		array: []token{
+			{typ: string(BULK), bulk: e.id.String()},
+			bulkArray(e.fields),
+		},
+	}
+}
+
+func entriesToken(entries []streamEntry) token {
+	arr := make([]token, 0, len(entries))
+	for _, e := range entries {
+		arr = append(arr, entryToken(e))
+	}
+
+	return token{typ: string(ARRAY), array: arr}
+}
+
+// trimSpec holds the MAXLEN/MINID arguments shared by XADD and XTRIM
+type trimSpec struct {
+	set    bool
+	byID   bool
+	maxLen int
+	minID  streamID
+	approx bool
+	limit  int
+}
+
+// parseTrimSpec reads MAXLEN|MINID [=|~] threshold [LIMIT count] starting
+// at args[i], returning the index of the first argument after it.
+func parseTrimSpec(args []token, i int) (trimSpec, int, *token) {
+	spec := trimSpec{set: true, byID: strings.ToUpper(args[i].bulk) == "MINID"}
+	i++
+
+	if i < len(args) && (args[i].bulk == "=" || args[i].bulk == "~") {
+		spec.approx = args[i].bulk == "~"
+		i++
+	}
+
+	if i >= len(args) {
+		return spec, i, &errSyntax
+	}
+
+	if spec.byID {
+		id, ok := parseStreamID(args[i].bulk, 0)
+		if !ok {
+			return spec, i, &errInvalidStreamID
+		}
+		spec.minID = id
+	} else {
+		n, err := strconv.Atoi(args[i].bulk)
+		if err != nil {
+			return spec, i, &errNotInteger
+		}
+		if n < 0 {
+			return spec, i, &token{typ: string(ERROR), val: "ERR The MAXLEN argument must be >= 0."}
+		}
+		spec.maxLen = n
+	}
+	i++
+
+	if i+1 < len(args) && strings.ToUpper(args[i].bulk) == "LIMIT" {
+		n, err := strconv.Atoi(args[i+1].bulk)
+		if err != nil || n < 0 {
+			return spec, i, &token{typ: string(ERROR), val: "ERR The LIMIT argument must be >= 0."}
+		}
+		if !spec.approx {
+			return spec, i, &token{
+				typ: string(ERROR),
+				val: "ERR syntax error, LIMIT cannot be used without the special ~ option",
+			}
+		}
+		spec.limit = n
+		i += 2
+	} else if spec.approx {
+		// Like Redis, an approximate trim evicts at most 100 nodes at once
+		spec.limit = 100 * streamNodeMaxEntries
+	}
+
+	return spec, i, nil
+}
+
+// xaddOptions reads the options of XADD that precede the entry ID and
+// returns the index of the ID argument.
+func xaddOptions(args []token) (noMkStream bool, trim trimSpec, idIndex int, errTok *token) {
+	i := 1
+	for i < len(args) {
+		switch strings.ToUpper(args[i].bulk) {
+		case "NOMKSTREAM":
+			noMkStream = true
+			i++
+		case "MAXLEN", "MINID":
+			spec, next, errTok := parseTrimSpec(args, i)
+			if errTok != nil {
+				return false, trim, i, errTok
+			}
+			trim = spec
+			i = next
+		default:
+			return noMkStream, trim, i, nil
+		}
+	}
+
+	return noMkStream, trim, i, nil
+}
+
+// xaddWithID returns XADD args with the ID argument replaced by id
+func xaddWithID(args []token, id string) token {
+	_, _, idIndex, _ := xaddOptions(args)
+
+	values := []string{"XADD"}
+	for i, arg := range args {
+		if i == idIndex {
+			values = append(values, id)
+		} else {
+			values = append(values, arg.bulk)
+		}
+	}
+
+	return bulkArray(values)
+}
+
+// xaddIDSpec is the ID argument of XADD: either fully explicit, "<ms>-*"
+// leaving the sequence number to the server or "*" for a generated one.
+type xaddIDSpec struct {
+	id      streamID
+	autoSeq bool
+	autoAll bool
+}
+
+func parseXAddID(arg string) (xaddIDSpec, bool) {
+	if arg == "*" {
+		return xaddIDSpec{autoAll: true}, true
+	}
+
+	if ms, found := strings.CutSuffix(arg, "-*"); found {
+		n, err := strconv.ParseUint(ms, 10, 64)
+		if err != nil {
+			return xaddIDSpec{}, false
+		}
+		return xaddIDSpec{id: streamID{ms: n}, autoSeq: true}, true
+	}
+
+	id, ok := parseStreamID(arg, 0)
+	if !ok {
+		return xaddIDSpec{}, false
+	}
+
+	return xaddIDSpec{id: id}, true
+}
+
+var errXAddIDTooSmall = token{
+	typ: string(ERROR),
+	val: "ERR The ID specified in XADD is equal or smaller than the target stream top item",
+}
+
+// resolve returns the ID the new entry gets in a stream whose newest ID
+// so far is last.
+func (spec xaddIDSpec) resolve(last streamID) (streamID, *token) {
+	switch {
+	case spec.autoAll:
+		// Never go backwards, even if the clock does
+		ms := uint64(time.Now().UnixMilli())
+		if ms > last.ms {
+			return streamID{ms: ms}, nil
+		}
+
+		id, ok := last.next()
+		if !ok {
+			return id, &token{
+				typ: string(ERROR),
+				val: "ERR The stream has exhausted the last possible ID, unable to add more items",
+			}
+		}
+		return id, nil
+	case spec.autoSeq:
+		if spec.id.ms > last.ms {
+			return spec.id, nil
+		}
+		if spec.id.ms < last.ms || last.seq == math.MaxUint64 {
+			return spec.id, &errXAddIDTooSmall
+		}
+		// Also turns 0-* into 0-1 on a new stream
+		return streamID{ms: last.ms, seq: last.seq + 1}, nil
+	default:
+		if !last.less(spec.id) {
+			return spec.id, &errXAddIDTooSmall
+		}
+		return spec.id, nil
+	}
+}
+
+// XADD key [NOMKSTREAM] [MAXLEN|MINID [=|~] threshold [LIMIT count]] *|id field value [field value ...]
+func xadd(args []token) token {
+	if len(args) < 4 {
+		return wrongArgs("XADD")
+	}
+
+	noMkStream, trim, i, errTok := xaddOptions(args)
+	if errTok != nil {
+		return *errTok
+	}
+
+	fields := args[i:]
+	if len(fields) < 3 || len(fields[1:])%2 != 0 {
+		return wrongArgs("XADD")
+	}
+
+	spec, ok := parseXAddID(fields[0].bulk)
+	if !ok {
+		return errInvalidStreamID
+	}
+	if !spec.autoAll && !spec.autoSeq && spec.id == (streamID{}) {
+		return token{typ: string(ERROR), val: "ERR The ID specified in XADD must be greater than 0-0"}
+	}
+
+	key := args[0].bulk
+	s, ok := lookupStream(key)
+	if !ok {
+		return errWrongType
+	}
+
+	if s == nil && noMkStream {
+		return token{typ: string(NULL)}
+	}
+
+	var last streamID
+	if s != nil {
+		last = s.lastID
+	}
+
+	id, errTok := spec.resolve(last)
+	if errTok != nil {
+		return *errTok
+	}
+
+	if s == nil {
+		s = &stream{}
+		putKey(key, object{
+			typ:        "stream",
+			createdAt:  time.Now().UTC(),
+			streamData: s,
+		})
+	}
+
+	entry := streamEntry{id: id, fields: make([]string, 0, len(fields)-1)}
+	for _, f := range fields[1:] {
+		entry.fields = append(entry.fields, f.bulk)
+	}
+
+	s.entries = append(s.entries, entry)
+	s.lastID = id
+	s.entriesAdded++
+
+	notifyKeyspaceEvent(notifyStream, "xadd", key)
+
+	if trim.set && s.trim(trim) > 0 {
+		notifyKeyspaceEvent(notifyStream, "xtrim", key)
+	}
+
+	serveBlockedClients(key)
+
+	return token{typ: string(BULK), bulk: id.String()}
+}
+
+// XLEN key
+func xlen(args []token) token {
+	if len(args) != 1 {
+		return wrongArgs("XLEN")
+	}
+
+	s, ok := lookupStream(args[0].bulk)
+	if !ok {
+		return errWrongType
+	}
+	if s == nil {
+		return intToken(0)
+	}
+
+	return intToken(len(s.entries))
+}
+
+// parseRangeID reads a range boundary: - and + stand for the smallest and
+// largest IDs, a leading ( makes the boundary exclusive and a missing
+// sequence number covers the whole millisecond.
+func parseRangeID(arg string, isStart bool) (streamID, *token) {
+	switch arg {
+	case "-":
+		return streamID{}, nil
+	case "+":
+		return maxStreamID, nil
+	}
+
+	exclusive := strings.HasPrefix(arg, "(")
+	if exclusive {
+		arg = arg[1:]
+	}
+
+	var missingSeq uint64
+	if !isStart {
+		missingSeq = math.MaxUint64
+	}
+
+	id, ok := parseStreamID(arg, missingSeq)
+	if !ok {
+		return id, &errInvalidStreamID
+	}
+
+	if exclusive {
+		if isStart {
+			id, ok = id.next()
+		} else {
+			id, ok = id.prev()
+		}
+		if !ok {
+			which := "end"
+			if isStart {
+				which = "start"
+			}
+			return id, &token{typ: string(ERROR), val: fmt.Sprintf("ERR invalid %s ID for the interval", which)}
+		}
+	}
+
+	return id, nil
+}
+
+func xrangeGeneric(command string, args []token, rev bool) token {
+	if len(args) != 3 && len(args) != 5 {
+		return wrongArgs(command)
+	}
+
+	startArg, endArg := args[1].bulk, args[2].bulk
+	if rev {
+		startArg, endArg = endArg, startArg
+	}
+
+	start, errTok := parseRangeID(startArg, true)
+	if errTok != nil {
+		return *errTok
+	}
+	end, errTok := parseRangeID(endArg, false)
+	if errTok != nil {
+		return *errTok
+	}
+
+	count := -1
+	if len(args) == 5 {
+		if strings.ToUpper(args[3].bulk) != "COUNT" {
+			return errSyntax
+		}
+		n, err := strconv.Atoi(args[4].bulk)
+		if err != nil {
+			return errNotInteger
+		}
+		if n < 0 {
+			n = 0
+		}
+		count = n
+	}
+
+	if count == 0 {
+		return token{typ: string(NULLARRAY)}
+	}
+
+	s, ok := lookupStream(args[0].bulk)
+	if !ok {
+		return errWrongType
+	}
+	if s == nil {
+		return entriesToken(nil)
+	}
+
+	entries := s.rangeEntries(start, end)
+	if rev {
+		reversed := make([]streamEntry, len(entries))
+		for i, e := range entries {
+			reversed[len(entries)-1-i] = e
+		}
+		entries = reversed
+	}
+
+	if count > 0 && len(entries) > count {
+		entries = entries[:count]
+	}
+
+	return entriesToken(entries)
+}
+
+// XRANGE key start end [COUNT count]
+func xrange(args []token) token {
+	return xrangeGeneric("XRANGE", args, false)
+}
+
+// XREVRANGE key end start [COUNT count]
+func xrevrange(args []token) token {
+	return xrangeGeneric("XREVRANGE", args, true)
+}
+
+// entriesAfter returns up to count entries of s newer than id,
+// count <= 0 meaning all of them.
+func entriesAfter(s *stream, id streamID, count int) []streamEntry {
+	if s == nil {
+		return nil
+	}
+
+	next, ok := id.next()
+	if !ok {
+		return nil
+	}
+
+	entries := s.entries[s.search(next):]
+	if count > 0 && len(entries) > count {
+		entries = entries[:count]
+	}
+
+	return entries
+}
+
+// xreadArgs holds the arguments shared by XREAD and XREADGROUP
+type xreadArgs struct {
+	count    int
+	blocking bool
+	timeout  time.Duration
+	// Only used by XREADGROUP
+	group    string
+	consumer string
+	noAck    bool
+	// The IDs are left unparsed as $ and > depend on the command
+	keys []string
+	ids  []string
+}
+
+func parseXReadArgs(command string, args []token) (xreadArgs, *token) {
+	parsed := xreadArgs{}
+	isGroup := command == "XREADGROUP"
+
+	i := 0
+	for ; i < len(args); i++ {
+		option := strings.ToUpper(args[i].bulk)
+		if option == "STREAMS" {
+			break
+		}
+
+		switch {
+		case option == "NOACK" && isGroup:
+			parsed.noAck = true
+			continue
+		case option == "GROUP" && isGroup && i+2 < len(args):
+			parsed.group, parsed.consumer = args[i+1].bulk, args[i+2].bulk
+			i += 2
+			continue
+		case (option == "GROUP" || option == "NOACK") && !isGroup:
+			return parsed, &token{
+				typ: string(ERROR),
+				val: fmt.Sprintf("ERR The %s option is only supported by XREADGROUP. You called XREAD instead.", option),
+			}
+		}
+
+		if i+1 >= len(args) {
+			return parsed, &errSyntax
+		}
+
+		switch option {
+		case "COUNT":
+			n, err := strconv.Atoi(args[i+1].bulk)
+			if err != nil {
+				return parsed, &errNotInteger
+			}
+			parsed.count = n
+		case "BLOCK":
+			ms, err := strconv.ParseInt(args[i+1].bulk, 10, 64)
+			if err != nil {
+				return parsed, &token{typ: string(ERROR), val: "ERR timeout is not an integer or out of range"}
+			}
+			if ms < 0 {
+				return parsed, &token{typ: string(ERROR), val: "ERR timeout is negative"}
+			}
+			parsed.blocking = true
+			parsed.timeout = time.Duration(ms) * time.Millisecond
+		default:
+			return parsed, &errSyntax
+		}
+		i++
+	}
+
+	if i >= len(args) {
+		return parsed, &errSyntax
+	}
+
+	if isGroup && parsed.group == "" {
+		return parsed, &token{typ: string(ERROR), val: "ERR Missing GROUP option for XREADGROUP"}
+	}
+
+	streams := args[i+1:]
+	if len(streams) == 0 || len(streams)%2 != 0 {
+		return parsed, &token{
+			typ: string(ERROR),
+			val: fmt.Sprintf(
+				"ERR Unbalanced '%s' list of streams: for each stream key an ID or '$' must be specified.",
+				strings.ToLower(command),
+			),
+		}
+	}
+
+	n := len(streams) / 2
+	for j := 0; j < n; j++ {
+		parsed.keys = append(parsed.keys, streams[j].bulk)
+		parsed.ids = append(parsed.ids, streams[n+j].bulk)
+	}
+
+	return parsed, nil
+}
+
+// streamReadReply builds the reply of XREAD and XREADGROUP for one stream
+func streamReadReply(key string, entries token) token {
+	return token{
+		typ:   string(ARRAY),
+		array: []token{{typ: string(BULK), bulk: key}, entries},
+	}
+}
+
+// XREAD [COUNT count] [BLOCK milliseconds] STREAMS key [key ...] id [id ...]
+func xread(args []token) token {
+	parsed, errTok := parseXReadArgs("XREAD", args)
+	if errTok != nil {
+		return *errTok
+	}
+
+	ids := make(map[string]streamID, len(parsed.keys))
+	result := []token{}
+	for j, key := range parsed.keys {
+		s, ok := lookupStream(key)
+		if !ok {
+			return errWrongType
+		}
+
+		var id streamID
+		switch parsed.ids[j] {
+		case "$":
+			if s != nil {
+				id = s.lastID
+			}
+		case ">":
+			return token{
+				typ: string(ERROR),
+				val: "ERR The > ID can be specified only when calling XREADGROUP using the GROUP <group> <consumer> option.",
+			}
+		default:
+			parsedID, ok := parseStreamID(parsed.ids[j], 0)
+			if !ok {
+				return errInvalidStreamID
+			}
+			id = parsedID
+		}
+		ids[key] = id
+
+		if entries := entriesAfter(s, id, parsed.count); len(entries) > 0 {
+			result = append(result, streamReadReply(key, entriesToken(entries)))
+		}
+	}
+
+	if len(result) > 0 || !parsed.blocking {
+		if len(result) == 0 {
+			return token{typ: string(NULLARRAY)}
+		}
+		return token{typ: string(ARRAY), array: result}
+	}
+
+	client := &blockedClient{
+		keys:      parsed.keys,
+		stream:    true,
+		streamIDs: ids,
+		count:     parsed.count,
+		reply:     make(chan token, 1),
+	}
+	block(client)
+
+	return waitUntilServed(client, parsed.timeout, token{typ: string(NULLARRAY)})
+}
+
+// XDEL key id [id ...]
+func xdel(args []token) token {
+	if len(args) < 2 {
+		return wrongArgs("XDEL")
+	}
+
+	// Validate every ID before deleting anything
+	ids := make([]streamID, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		id, ok := parseStreamID(arg.bulk, 0)
+		if !ok {
+			return errInvalidStreamID
+		}
+		ids = append(ids, id)
+	}
+
+	s, ok := lookupStream(args[0].bulk)
+	if !ok {
+		return errWrongType
+	}
+	if s == nil {
+		return intToken(0)
+	}
+
+	deleted := 0
+	for _, id := range ids {
+		i := s.search(id)
+		if i == len(s.entries) || s.entries[i].id != id {
+			continue
+		}
+
+		s.entries = append(s.entries[:i], s.entries[i+1:]...)
+		s.maxDeletedID = maxID(s.maxDeletedID, id)
+		deleted++
+	}
+
+	if deleted > 0 {
+		notifyKeyspaceEvent(notifyStream, "xdel", args[0].bulk)
+	}
+
+	return intToken(deleted)
+}
+
+// XTRIM key MAXLEN|MINID [=|~] threshold [LIMIT count]
+func xtrim(args []token) token {
+	if len(args) < 3 {
+		return wrongArgs("XTRIM")
+	}
+
+	option := strings.ToUpper(args[1].bulk)
+	if option != "MAXLEN" && option != "MINID" {
+		return errSyntax
+	}
+
+	spec, next, errTok := parseTrimSpec(args, 1)
+	if errTok != nil {
+		return *errTok
+	}
+	if next != len(args) {
+		return errSyntax
+	}
+
+	s, ok := lookupStream(args[0].bulk)
+	if !ok {
+		return errWrongType
+	}
+	if s == nil {
+		return intToken(0)
+	}
+
+	trimmed := s.trim(spec)
+	if trimmed > 0 {
+		notifyKeyspaceEvent(notifyStream, "xtrim", args[0].bulk)
+	}
+
+	return intToken(trimmed)
+}
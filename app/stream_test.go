@@ -0,0 +1,251 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// entryIDs returns the IDs of the entries in an XRANGE style reply
+func entryIDs(tok token) []string {
+	ids := []string{}
+	for _, entry := range tok.array {
+		ids = append(ids, entry.array[0].bulk)
+	}
+
+	return ids
+}
+
+func TestStreamRange(t *testing.T) {
+	run(t, "XADD", "stream:range", "1-1", "a", "1", "b", "2")
+	run(t, "XADD", "stream:range", "1-2", "c", "3")
+	run(t, "XADD", "stream:range", "2-0", "d", "4")
+	run(t, "XADD", "stream:range", "10-0", "e", "5")
+
+	t.Run("entries keep every field", func(t *testing.T) {
+		want := token{typ: string(ARRAY), array: []token{
+			{typ: string(ARRAY), array: []token{
+				{typ: string(BULK), bulk: "1-1"},
+				bulkArray([]string{"a", "1", "b", "2"}),
+			}},
+		}}
+		if got := run(t, "XRANGE", "stream:range", "-", "+", "COUNT", "1"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed xrange. wanted %v, got %v", want, got)
+		}
+	})
+
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{"numeric order", []string{"XRANGE", "stream:range", "-", "+"}, []string{"1-1", "1-2", "2-0", "10-0"}},
+		{"whole millisecond", []string{"XRANGE", "stream:range", "1", "1"}, []string{"1-1", "1-2"}},
+		{"exclusive", []string{"XRANGE", "stream:range", "(1-1", "(10-0"}, []string{"1-2", "2-0"}},
+		{"reverse", []string{"XREVRANGE", "stream:range", "+", "-", "COUNT", "2"}, []string{"10-0", "2-0"}},
+		{"missing key", []string{"XRANGE", "stream:none", "-", "+"}, []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := entryIDs(run(t, tt.args...)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Failed %s. wanted %v, got %v", tt.args[0], tt.want, got)
+			}
+		})
+	}
+
+	t.Run("xlen", func(t *testing.T) {
+		if got := run(t, "XLEN", "stream:range"); !reflect.DeepEqual(got, intToken(4)) {
+			t.Errorf("Failed xlen. wanted %v, got %v", intToken(4), got)
+		}
+	})
+}
+
+func TestStreamWrite(t *testing.T) {
+	t.Run("ids must increase", func(t *testing.T) {
+		run(t, "XADD", "stream:ids", "5-0", "f", "v")
+
+		want := token{
+			typ: string(ERROR),
+			val: "ERR The ID specified in XADD is equal or smaller than the target stream top item",
+		}
+		if got := run(t, "XADD", "stream:ids", "4-9", "f", "v"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed xadd. wanted %v, got %v", want, got)
+		}
+
+		want = token{typ: string(ERROR), val: "ERR The ID specified in XADD must be greater than 0-0"}
+		if got := run(t, "XADD", "stream:zero", "0-0", "f", "v"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed xadd. wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("xdel keeps the last id", func(t *testing.T) {
+		run(t, "XADD", "stream:del", "1-0", "f", "v")
+		run(t, "XADD", "stream:del", "2-0", "f", "v")
+
+		if got := run(t, "XDEL", "stream:del", "2-0", "3-0"); !reflect.DeepEqual(got, intToken(1)) {
+			t.Errorf("Failed xdel. wanted %v, got %v", intToken(1), got)
+		}
+
+		if got := run(t, "XADD", "stream:del", "2-0", "f", "v"); got.typ != string(ERROR) {
+			t.Errorf("Failed xadd after xdel. got %v", got)
+		}
+	})
+
+	t.Run("xtrim", func(t *testing.T) {
+		for _, id := range []string{"1-0", "2-0", "3-0", "4-0"} {
+			run(t, "XADD", "stream:trim", id, "f", "v")
+		}
+
+		if got := run(t, "XTRIM", "stream:trim", "MAXLEN", "3"); !reflect.DeepEqual(got, intToken(1)) {
+			t.Errorf("Failed xtrim maxlen. wanted %v, got %v", intToken(1), got)
+		}
+		if got := run(t, "XTRIM", "stream:trim", "MINID", "=", "4"); !reflect.DeepEqual(got, intToken(2)) {
+			t.Errorf("Failed xtrim minid. wanted %v, got %v", intToken(2), got)
+		}
+
+		run(t, "XADD", "stream:trim", "MAXLEN", "1", "5-0", "f", "v")
+		want := []string{"5-0"}
+		if got := entryIDs(run(t, "XRANGE", "stream:trim", "-", "+")); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed xadd maxlen. wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("approximate xtrim evicts whole nodes", func(t *testing.T) {
+		for i := 1; i <= 250; i++ {
+			run(t, "XADD", "stream:approx", strconv.Itoa(i)+"-0", "f", "v")
+		}
+
+		if got := run(t, "XTRIM", "stream:approx", "MAXLEN", "~", "120"); !reflect.DeepEqual(got, intToken(100)) {
+			t.Errorf("Failed xtrim ~. wanted %v, got %v", intToken(100), got)
+		}
+		if got := run(t, "XTRIM", "stream:approx", "MAXLEN", "~", "120"); !reflect.DeepEqual(got, intToken(0)) {
+			t.Errorf("Failed xtrim ~. wanted %v, got %v", intToken(0), got)
+		}
+		if got := run(t, "XTRIM", "stream:approx", "MAXLEN", "=", "120"); !reflect.DeepEqual(got, intToken(30)) {
+			t.Errorf("Failed xtrim =. wanted %v, got %v", intToken(30), got)
+		}
+
+		want := []string{"131-0"}
+		if got := entryIDs(run(t, "XRANGE", "stream:approx", "-", "+", "COUNT", "1")); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed xrange. wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("nomkstream", func(t *testing.T) {
+		want := token{typ: string(NULL)}
+		if got := run(t, "XADD", "stream:nomk", "NOMKSTREAM", "1-0", "f", "v"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed xadd. wanted %v, got %v", want, got)
+		}
+	})
+}
+
+func TestXRead(t *testing.T) {
+	run(t, "XADD", "stream:read:a", "1-0", "f", "v")
+	run(t, "XADD", "stream:read:a", "2-0", "f", "v")
+
+	t.Run("reads entries after the id", func(t *testing.T) {
+		got := run(t, "XREAD", "COUNT", "1", "STREAMS", "stream:read:a", "stream:read:b", "1-0", "0")
+		if len(got.array) != 1 || got.array[0].array[0].bulk != "stream:read:a" {
+			t.Fatalf("Failed xread. got %v", got)
+		}
+		if ids := entryIDs(got.array[0].array[1]); !reflect.DeepEqual(ids, []string{"2-0"}) {
+			t.Errorf("Failed xread. got %v", ids)
+		}
+	})
+
+	t.Run("unbalanced streams", func(t *testing.T) {
+		if got := run(t, "XREAD", "STREAMS", "stream:read:a"); got.typ != string(ERROR) {
+			t.Errorf("Failed xread. got %v", got)
+		}
+	})
+
+	t.Run("block times out", func(t *testing.T) {
+		want := token{typ: string(NULLARRAY)}
+		if got := run(t, "XREAD", "BLOCK", "50", "STREAMS", "stream:read:a", "$"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed xread. wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("block is served by xadd on any stream", func(t *testing.T) {
+		result := make(chan token)
+		go func() {
+			result <- run(t, "XREAD", "BLOCK", "0", "STREAMS", "stream:read:a", "stream:read:c", "$", "$")
+		}()
+		waitForBlocked(t, "stream:read:c", 1)
+
+		run(t, "XADD", "stream:read:c", "7-0", "f", "v")
+
+		got := <-result
+		if len(got.array) != 1 || got.array[0].array[0].bulk != "stream:read:c" {
+			t.Fatalf("Failed xread. got %v", got)
+		}
+		if ids := entryIDs(got.array[0].array[1]); !reflect.DeepEqual(ids, []string{"7-0"}) {
+			t.Errorf("Failed xread. got %v", ids)
+		}
+
+		waitForBlocked(t, "stream:read:a", 0)
+	})
+}
+
+func TestStreamIDGeneration(t *testing.T) {
+	tests := []struct {
+		name string
+		id   string
+		want token
+	}{
+		{"sequence on a new stream", "0-*", token{typ: string(BULK), bulk: "0-1"}},
+		{"sequence within the millisecond", "0-*", token{typ: string(BULK), bulk: "0-2"}},
+		{"sequence on a new millisecond", "5-*", token{typ: string(BULK), bulk: "5-0"}},
+		{"older millisecond", "4-*", errXAddIDTooSmall},
+		{"compared numerically", "11-0", token{typ: string(BULK), bulk: "11-0"}},
+		{"not smaller than 11-0", "1-10", errXAddIDTooSmall},
+		{"malformed", "1-x", errInvalidStreamID},
+		{"negative", "-1", errInvalidStreamID},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := run(t, "XADD", "stream:gen", tt.id, "f", "v"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Failed xadd. wanted %v, got %v", tt.want, got)
+			}
+		})
+	}
+
+	t.Run("generated ids increase", func(t *testing.T) {
+		first := run(t, "XADD", "stream:auto", "*", "f", "v")
+		second := run(t, "XADD", "stream:auto", "*", "f", "v")
+
+		a, okA := parseStreamID(first.bulk, 0)
+		b, okB := parseStreamID(second.bulk, 0)
+		if !okA || !okB || !a.less(b) {
+			t.Errorf("Failed xadd. got %v then %v", first, second)
+		}
+	})
+
+	t.Run("exhausted stream", func(t *testing.T) {
+		run(t, "XADD", "stream:max", "18446744073709551615-18446744073709551615", "f", "v")
+
+		if got := run(t, "XADD", "stream:max", "*", "f", "v"); got.typ != string(ERROR) {
+			t.Errorf("Failed xadd. got %v", got)
+		}
+	})
+
+	t.Run("replicas get the generated id", func(t *testing.T) {
+		args := []token{
+			{typ: string(BULK), bulk: "stream:repl"},
+			{typ: string(BULK), bulk: "MAXLEN"},
+			{typ: string(BULK), bulk: "10"},
+			{typ: string(BULK), bulk: "*"},
+			{typ: string(BULK), bulk: "f"},
+			{typ: string(BULK), bulk: "v"},
+		}
+		result := token{typ: string(BULK), bulk: "42-0"}
+
+		want := bulkArray([]string{"XADD", "stream:repl", "MAXLEN", "10", "42-0", "f", "v"})
+		got := propagatedCommands(token{}, "XADD", args, result)
+		if len(got) != 1 || !reflect.DeepEqual(got[0], want) {
+			t.Errorf("Failed propagation. wanted %v, got %v", want, got)
+		}
+	})
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxStringLength is the largest string SETRANGE and APPEND may build,
+// the default proto-max-bulk-len of Redis
+const maxStringLength = 512 * 1024 * 1024
+
+var errStringTooLong = token{
+	typ: string(ERROR),
+	val: "ERR string exceeds maximum allowed size (proto-max-bulk-len)",
+}
+
+// lookupString returns the string stored at key, exists is false when
+// there is none and ok is false when the key holds another type.
+// Callers must hold mux.
+func lookupString(key string) (value string, exists bool, ok bool) {
+	obj, exists := lookupKey(key)
+	if !exists {
+		return "", false, true
+	}
+
+	if obj.typ != "string" {
+		return "", true, false
+	}
+
+	return obj.str(), true, true
+}
+
+// storeString writes value to key. Modifying commands keep the TTL the
+// key already has, commands that replace the value drop it.
+// Callers must hold mux.
+func storeString(key, value string, keepTTL bool) {
+	obj := object{
+		value:     value,
+		createdAt: time.Now().UTC(),
+		typ:       "string",
+	}
+
+	if old, exists := datastore[key]; exists && keepTTL {
+		obj.expiry = old.expiry
+	}
+
+	putKey(key, obj)
+}
+
+func incrGeneric(key string, delta int64) token {
+	value, exists, ok := lookupString(key)
+	if !ok {
+		return errWrongType
+	}
+
+	var current int64
+	if exists {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return errNotInteger
+		}
+		current = n
+	}
+
+	if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+		return token{typ: string(ERROR), val: "ERR increment or decrement would overflow"}
+	}
+
+	current += delta
+	storeString(key, strconv.FormatInt(current, 10), true)
+	notifyKeyspaceEvent(notifyString, "incrby", key)
+
+	return intToken(int(current))
+}
+
+// INCR key
+func incr(args []token) token {
+	if len(args) != 1 {
+		return wrongArgs("INCR")
+	}
+
+	return incrGeneric(args[0].bulk, 1)
+}
+
+// DECR key
+func decr(args []token) token {
+	if len(args) != 1 {
+		return wrongArgs("DECR")
+	}
+
+	return incrGeneric(args[0].bulk, -1)
+}
+
+// INCRBY key increment
+func incrby(args []token) token {
+	if len(args) != 2 {
+		return wrongArgs("INCRBY")
+	}
+
+	delta, err := strconv.ParseInt(args[1].bulk, 10, 64)
+	if err != nil {
+		return errNotInteger
+	}
+
+	return incrGeneric(args[0].bulk, delta)
+}
+
+// DECRBY key decrement
+func decrby(args []token) token {
+	if len(args) != 2 {
+		return wrongArgs("DECRBY")
+	}
+
+	delta, err := strconv.ParseInt(args[1].bulk, 10, 64)
+	if err != nil {
+		return errNotInteger
+	}
+	if delta == math.MinInt64 {
+		return token{typ: string(ERROR), val: "ERR decrement would overflow"}
+	}
+
+	return incrGeneric(args[0].bulk, -delta)
+}
+
+// INCRBYFLOAT key increment
+func incrbyfloat(args []token) token {
+	if len(args) != 2 {
+		return wrongArgs("INCRBYFLOAT")
+	}
+
+	incr, err := strconv.ParseFloat(args[1].bulk, 64)
+	if err != nil || math.IsNaN(incr) || math.IsInf(incr, 0) {
+		return errNotFloat
+	}
+
+	key := args[0].bulk
+	value, exists, ok := lookupString(key)
+	if !ok {
+		return errWrongType
+	}
+
+	var current float64
+	if exists {
+		current, err = strconv.ParseFloat(value, 64)
+		if err != nil || math.IsNaN(current) || math.IsInf(current, 0) {
+			return errNotFloat
+		}
+	}
+
+	current += incr
+	if math.IsNaN(current) || math.IsInf(current, 0) {
+		return token{typ: string(ERROR), val: "ERR increment would produce NaN or Infinity"}
+	}
+
+	formatted := strconv.FormatFloat(current, 'f', -1, 64)
+	storeString(key, formatted, true)
+	notifyKeyspaceEvent(notifyString, "incrbyfloat", key)
+
+	return token{typ: string(BULK), bulk: formatted}
+}
+
+// APPEND key value
+func appendString(args []token) token {
+	if len(args) != 2 {
+		return wrongArgs("APPEND")
+	}
+
+	key := args[0].bulk
+	value, _, ok := lookupString(key)
+	if !ok {
+		return errWrongType
+	}
+
+	if len(value)+len(args[1].bulk) > maxStringLength {
+		return errStringTooLong
+	}
+
+	value += args[1].bulk
+	storeString(key, value, true)
+	notifyKeyspaceEvent(notifyString, "append", key)
+
+	return intToken(len(value))
+}
+
+// STRLEN key
+func strlen(args []token) token {
+	if len(args) != 1 {
+		return wrongArgs("STRLEN")
+	}
+
+	value, _, ok := lookupString(args[0].bulk)
+	if !ok {
+		return errWrongType
+	}
+
+	return intToken(len(value))
+}
+
+// GETRANGE key start end
+func getrange(args []token) token {
+	if len(args) != 3 {
+		return wrongArgs("GETRANGE")
+	}
+
+	start, err := strconv.Atoi(args[1].bulk)
+	if err != nil {
+		return errNotInteger
+	}
+	end, err := strconv.Atoi(args[2].bulk)
+	if err != nil {
+		return errNotInteger
+	}
+
+	value, _, ok := lookupString(args[0].bulk)
+	if !ok {
+		return errWrongType
+	}
+
+	// Both ends are inclusive, negative ones count from the end
+	n := len(value)
+	if start < 0 && end < 0 && start > end {
+		return token{typ: string(BULK), bulk: ""}
+	}
+	if start < 0 {
+		start = max(n+start, 0)
+	}
+	if end < 0 {
+		end = max(n+end, 0)
+	}
+	if end >= n {
+		end = n - 1
+	}
+
+	if n == 0 || start > end {
+		return token{typ: string(BULK), bulk: ""}
+	}
+
+	return token{typ: string(BULK), bulk: value[start : end+1]}
+}
+
+// SETRANGE key offset value
+func setrange(args []token) token {
+	if len(args) != 3 {
+		return wrongArgs("SETRANGE")
+	}
+
+	offset, err := strconv.Atoi(args[1].bulk)
+	if err != nil {
+		return errNotInteger
+	}
+	if offset < 0 {
+		return token{typ: string(ERROR), val: "ERR offset is out of range"}
+	}
+
+	patch := args[2].bulk
+	if offset+len(patch) > maxStringLength {
+		return errStringTooLong
+	}
+
+	key := args[0].bulk
+	value, exists, ok := lookupString(key)
+	if !ok {
+		return errWrongType
+	}
+
+	// An empty patch changes nothing and doesn't create the key
+	if len(patch) == 0 {
+		return intToken(len(value))
+	}
+
+	buf := []byte(value)
+	if end := offset + len(patch); end > len(buf) {
+		// The gap is padded with zero bytes
+		buf = append(buf, make([]byte, end-len(buf))...)
+	}
+	copy(buf[offset:], patch)
+
+	storeString(key, string(buf), exists)
+	notifyKeyspaceEvent(notifyString, "setrange", key)
+
+	return intToken(len(buf))
+}
+
+// GETSET key value
+func getset(args []token) token {
+	if len(args) != 2 {
+		return wrongArgs("GETSET")
+	}
+
+	key := args[0].bulk
+	value, exists, ok := lookupString(key)
+	if !ok {
+		return errWrongType
+	}
+
+	storeString(key, args[1].bulk, false)
+	notifyKeyspaceEvent(notifyString, "set", key)
+
+	if !exists {
+		return token{typ: string(NULL)}
+	}
+
+	return token{typ: string(BULK), bulk: value}
+}
+
+// GETDEL key
+func getdel(args []token) token {
+	if len(args) != 1 {
+		return wrongArgs("GETDEL")
+	}
+
+	key := args[0].bulk
+	value, exists, ok := lookupString(key)
+	if !ok {
+		return errWrongType
+	}
+	if !exists {
+		return token{typ: string(NULL)}
+	}
+
+	removeKey(key)
+	delete(expires, key)
+	notifyKeyspaceEvent(notifyGeneric, "del", key)
+
+	return token{typ: string(BULK), bulk: value}
+}
+
+// GETEX key [EX seconds|PX milliseconds|EXAT unix-time-seconds|PXAT unix-time-milliseconds|PERSIST]
+func getex(args []token) token {
+	if len(args) < 1 {
+		return wrongArgs("GETEX")
+	}
+
+	persist := false
+	var expiryTime time.Time
+
+	for i := 1; i < len(args); i++ {
+		opt := strings.ToUpper(args[i].bulk)
+
+		switch opt {
+		case "PERSIST":
+			if !expiryTime.IsZero() {
+				return errSyntax
+			}
+			persist = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if persist || !expiryTime.IsZero() || i+1 >= len(args) {
+				return errSyntax
+			}
+
+			when, errTok := parseExpiryOption("getex", opt, args[i+1].bulk)
+			if errTok != nil {
+				return *errTok
+			}
+			expiryTime = when
+			i++
+		default:
+			return errSyntax
+		}
+	}
+
+	key := args[0].bulk
+	value, exists, ok := lookupString(key)
+	if !ok {
+		return errWrongType
+	}
+	if !exists {
+		return token{typ: string(NULL)}
+	}
+
+	reply := token{typ: string(BULK), bulk: value}
+
+	switch {
+	case persist:
+		obj := datastore[key]
+		obj.expiry = 0
+		putKey(key, obj)
+		delete(expires, key)
+		notifyKeyspaceEvent(notifyGeneric, "persist", key)
+	case !expiryTime.IsZero():
+		if time.Until(expiryTime) <= 0 {
+			removeKey(key)
+			delete(expires, key)
+			notifyKeyspaceEvent(notifyGeneric, "del", key)
+			return reply
+		}
+
+		obj := datastore[key]
+		obj.expiry = int(expiryTime.UnixMilli())
+		putKey(key, obj)
+		trackExpiry(key)
+		notifyKeyspaceEvent(notifyGeneric, "expire", key)
+	}
+
+	return reply
+}
+
+// MGET key [key ...]
+func mget(args []token) token {
+	if len(args) < 1 {
+		return wrongArgs("MGET")
+	}
+
+	// Missing keys and keys of other types both come back as nil
+	values := make([]token, 0, len(args))
+	for _, arg := range args {
+		value, exists, ok := lookupString(arg.bulk)
+		if !exists || !ok {
+			values = append(values, token{typ: string(NULL)})
+			continue
+		}
+		values = append(values, token{typ: string(BULK), bulk: value})
+	}
+
+	return token{typ: string(ARRAY), array: values}
+}
+
+// MSET key value [key value ...]
+func mset(args []token) token {
+	if len(args) < 2 || len(args)%2 != 0 {
+		return wrongArgs("MSET")
+	}
+
+	for i := 0; i < len(args); i += 2 {
+		storeString(args[i].bulk, args[i+1].bulk, false)
+		notifyKeyspaceEvent(notifyString, "set", args[i].bulk)
+	}
+
+	return token{typ: string(STRING), val: "OK"}
+}
+
+// MSETNX key value [key value ...]
+func msetnx(args []token) token {
+	if len(args) < 2 || len(args)%2 != 0 {
+		return wrongArgs("MSETNX")
+	}
+
+	// Nothing is set if any of the keys exists
+	for i := 0; i < len(args); i += 2 {
+		if _, exists := lookupKey(args[i].bulk); exists {
+			return intToken(0)
+		}
+	}
+
+	for i := 0; i < len(args); i += 2 {
+		storeString(args[i].bulk, args[i+1].bulk, false)
+		notifyKeyspaceEvent(notifyString, "set", args[i].bulk)
+	}
+
+	return intToken(1)
+}
+
+// getexCommand returns what replicas need to apply after GETEX changed
+// the TTL of a key: the absolute expiry, PERSIST or DEL if it expired
+// right away. Callers must hold mux.
+func getexCommand(args []token, result token) (token, bool) {
+	if result.typ != string(BULK) || len(args) < 2 {
+		return token{}, false
+	}
+
+	key := args[0].bulk
+
+	obj, exists := lookupKey(key)
+	switch {
+	case !exists:
+		return bulkArray([]string{"DEL", key}), true
+	case obj.expiry == 0:
+		return bulkArray([]string{"PERSIST", key}), true
+	default:
+		return bulkArray([]string{"PEXPIREAT", key, strconv.Itoa(obj.expiry)}), true
+	}
+}
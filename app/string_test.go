@@ -0,0 +1,200 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestCounters(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want token
+	}{
+		{"incr creates the key", []string{"INCR", "str:counter"}, intToken(1)},
+		{"incrby", []string{"INCRBY", "str:counter", "41"}, intToken(42)},
+		{"decr", []string{"DECR", "str:counter"}, intToken(41)},
+		{"decrby", []string{"DECRBY", "str:counter", "50"}, intToken(-9)},
+		{"incrbyfloat", []string{"INCRBYFLOAT", "str:counter", "1.5"}, token{typ: string(BULK), bulk: "-7.5"}},
+		{"not an integer anymore", []string{"INCR", "str:counter"}, errNotInteger},
+		{"bad increment", []string{"INCRBY", "str:other", "x"}, errNotInteger},
+		{"bad float", []string{"INCRBYFLOAT", "str:other", "x"}, errNotFloat},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := run(t, tt.args...); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Failed %s. wanted %v, got %v", tt.args[0], tt.want, got)
+			}
+		})
+	}
+
+	t.Run("overflow", func(t *testing.T) {
+		run(t, "SET", "str:max", "9223372036854775807")
+
+		want := token{typ: string(ERROR), val: "ERR increment or decrement would overflow"}
+		if got := run(t, "INCR", "str:max"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed incr. wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("wrong type", func(t *testing.T) {
+		run(t, "RPUSH", "str:list", "a")
+
+		if got := run(t, "INCR", "str:list"); !reflect.DeepEqual(got, errWrongType) {
+			t.Errorf("Failed incr. wanted %v, got %v", errWrongType, got)
+		}
+	})
+
+	t.Run("incr keeps the ttl", func(t *testing.T) {
+		run(t, "SET", "str:ttl", "1", "EX", "100")
+		run(t, "INCR", "str:ttl")
+
+		if got := run(t, "TTL", "str:ttl"); !reflect.DeepEqual(got, intToken(100)) {
+			t.Errorf("Failed incr ttl. wanted %v, got %v", intToken(100), got)
+		}
+	})
+
+	t.Run("concurrent increments are atomic", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				run(t, "INCR", "str:atomic")
+			}()
+		}
+		wg.Wait()
+
+		want := token{typ: string(STRING), val: "50"}
+		if got := run(t, "GET", "str:atomic"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed concurrent incr. wanted %v, got %v", want, got)
+		}
+	})
+}
+
+func TestStringRanges(t *testing.T) {
+	bulk := func(s string) token { return token{typ: string(BULK), bulk: s} }
+
+	tests := []struct {
+		name string
+		args []string
+		want token
+	}{
+		{"append creates the key", []string{"APPEND", "str:range", "Hello"}, intToken(5)},
+		{"append", []string{"APPEND", "str:range", " World"}, intToken(11)},
+		{"strlen", []string{"STRLEN", "str:range"}, intToken(11)},
+		{"strlen of a missing key", []string{"STRLEN", "str:none"}, intToken(0)},
+		{"getrange", []string{"GETRANGE", "str:range", "0", "4"}, bulk("Hello")},
+		{"getrange negative", []string{"GETRANGE", "str:range", "-5", "-1"}, bulk("World")},
+		{"getrange past the end", []string{"GETRANGE", "str:range", "6", "100"}, bulk("World")},
+		{"getrange reversed", []string{"GETRANGE", "str:range", "5", "1"}, bulk("")},
+		{"setrange", []string{"SETRANGE", "str:range", "6", "Redis"}, intToken(11)},
+		{"setrange pads with zero bytes", []string{"SETRANGE", "str:pad", "3", "x"}, intToken(4)},
+		{"padded value", []string{"GETRANGE", "str:pad", "0", "-1"}, bulk("\x00\x00\x00x")},
+		{"setrange with nothing to write", []string{"SETRANGE", "str:empty", "5", ""}, intToken(0)},
+		{"setrange negative", []string{"SETRANGE", "str:range", "-1", "x"}, token{typ: string(ERROR), val: "ERR offset is out of range"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := run(t, tt.args...); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Failed %s. wanted %v, got %v", tt.args[0], tt.want, got)
+			}
+		})
+	}
+
+	want := token{typ: string(STRING), val: "Hello Redis"}
+	if got := run(t, "GET", "str:range"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Failed setrange. wanted %v, got %v", want, got)
+	}
+
+	if got := run(t, "EXISTS", "str:empty"); !reflect.DeepEqual(got, intToken(0)) {
+		t.Errorf("Empty setrange created the key")
+	}
+}
+
+func TestStringGetters(t *testing.T) {
+	null := token{typ: string(NULL)}
+
+	t.Run("getset drops the ttl", func(t *testing.T) {
+		run(t, "SET", "str:getset", "old", "EX", "100")
+
+		want := token{typ: string(BULK), bulk: "old"}
+		if got := run(t, "GETSET", "str:getset", "new"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed getset. wanted %v, got %v", want, got)
+		}
+		if got := run(t, "TTL", "str:getset"); !reflect.DeepEqual(got, intToken(-1)) {
+			t.Errorf("Failed getset ttl. wanted %v, got %v", intToken(-1), got)
+		}
+	})
+
+	t.Run("getdel", func(t *testing.T) {
+		run(t, "SET", "str:getdel", "v")
+
+		want := token{typ: string(BULK), bulk: "v"}
+		if got := run(t, "GETDEL", "str:getdel"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed getdel. wanted %v, got %v", want, got)
+		}
+		if got := run(t, "GETDEL", "str:getdel"); !reflect.DeepEqual(got, null) {
+			t.Errorf("Failed getdel. wanted %v, got %v", null, got)
+		}
+	})
+
+	t.Run("getex", func(t *testing.T) {
+		run(t, "SET", "str:getex", "v")
+
+		run(t, "GETEX", "str:getex", "EX", "100")
+		if got := run(t, "TTL", "str:getex"); !reflect.DeepEqual(got, intToken(100)) {
+			t.Errorf("Failed getex ex. wanted %v, got %v", intToken(100), got)
+		}
+
+		run(t, "GETEX", "str:getex", "PERSIST")
+		if got := run(t, "TTL", "str:getex"); !reflect.DeepEqual(got, intToken(-1)) {
+			t.Errorf("Failed getex persist. wanted %v, got %v", intToken(-1), got)
+		}
+
+		if got := run(t, "GETEX", "str:getex", "EX", "1", "PERSIST"); !reflect.DeepEqual(got, errSyntax) {
+			t.Errorf("Failed getex. wanted %v, got %v", errSyntax, got)
+		}
+	})
+
+	t.Run("mset and mget", func(t *testing.T) {
+		run(t, "MSET", "str:m1", "a", "str:m2", "b")
+		run(t, "RPUSH", "str:mlist", "x")
+
+		want := token{typ: string(ARRAY), array: []token{
+			{typ: string(BULK), bulk: "a"},
+			{typ: string(BULK), bulk: "b"},
+			null,
+			null,
+		}}
+		if got := run(t, "MGET", "str:m1", "str:m2", "str:mnone", "str:mlist"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed mget. wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("msetnx is all or nothing", func(t *testing.T) {
+		if got := run(t, "MSETNX", "str:nx1", "a", "str:m1", "b"); !reflect.DeepEqual(got, intToken(0)) {
+			t.Errorf("Failed msetnx. wanted %v, got %v", intToken(0), got)
+		}
+		if got := run(t, "EXISTS", "str:nx1"); !reflect.DeepEqual(got, intToken(0)) {
+			t.Errorf("Failed msetnx set some of the keys")
+		}
+		if got := run(t, "MSETNX", "str:nx1", "a", "str:nx2", "b"); !reflect.DeepEqual(got, intToken(1)) {
+			t.Errorf("Failed msetnx. wanted %v, got %v", intToken(1), got)
+		}
+	})
+
+	t.Run("getex propagates the absolute expiry", func(t *testing.T) {
+		run(t, "SET", "str:getexrepl", "v")
+		args := bulkArray([]string{"str:getexrepl", "PX", "100000"}).array
+		result := run(t, "GETEX", "str:getexrepl", "PX", "100000")
+
+		got := propagatedCommands(token{}, "GETEX", args, result)
+		if len(got) != 1 || got[0].array[0].bulk != "PEXPIREAT" {
+			t.Errorf("Failed getex propagation. got %v", got)
+		}
+	})
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A transaction queues the commands sent after MULTI and runs them all on
+// EXEC while holding mux, so no other client sees it half done. Commands
+// that can't be queued, because they don't exist or have the wrong number
+// of arguments, make EXEC discard the whole transaction. Errors a command
+// returns when it runs don't stop the others.
+
+// transactionCommands are run right away by clients inside MULTI
+var transactionCommands = map[string]bool{
+	"MULTI":   true,
+	"EXEC":    true,
+	"DISCARD": true,
+	"WATCH":   true,
+}
+
+// checkArity reports whether a command given args, not counting its name,
+// has an acceptable number of them. Commands are checked when they are
+// queued, to refuse them before EXEC like Redis does.
+func checkArity(command string, args []token) bool {
+	arity := Handlers[command].arity
+
+	n := len(args) + 1
+	if arity < 0 {
+		return n >= -arity
+	}
+
+	return n == arity
+}
+
+func unknownCommand(command string, args []token) token {
+	var quoted strings.Builder
+	for _, arg := range args {
+		fmt.Fprintf(&quoted, "'%s' ", arg.bulk)
+	}
+
+	return token{
+		typ: string(ERROR),
+		val: fmt.Sprintf("ERR unknown command '%s', with args beginning with: %s", command, quoted.String()),
+	}
+}
+
+// queue adds t to the transaction of c, or refuses it and marks the
+// transaction as failed
+func (c *client) queue(t token, command string, args []token) {
+	var refused token
+	switch {
+	case command == "UNWATCH":
+		// EXEC forgets the watched keys anyway, so this only takes a reply
+		c.queued = append(c.queued, t)
+		c.write(token{typ: string(STRING), val: "QUEUED"})
+		return
+	case clientHandlers[command] != nil:
+		refused = token{typ: string(ERROR), val: "ERR Command not allowed inside a transaction"}
+	case Handlers[command].handler == nil:
+		refused = unknownCommand(t.array[0].bulk, args)
+	case !checkArity(command, args):
+		refused = wrongArgs(command)
+	default:
+		c.queued = append(c.queued, t)
+		c.write(token{typ: string(STRING), val: "QUEUED"})
+		return
+	}
+
+	c.dirty = true
+	c.write(refused)
+}
+
+// endTransaction leaves MULTI, forgetting whatever was queued
+func (c *client) endTransaction() {
+	c.multi = false
+	c.queued = nil
+	c.dirty = false
+}
+
+// MULTI
+func multi(c *client, args []token) {
+	if len(args) != 0 {
+		c.write(wrongArgs("MULTI"))
+		return
+	}
+
+	if c.multi {
+		c.write(token{typ: string(ERROR), val: "ERR MULTI calls can not be nested"})
+		return
+	}
+
+	c.multi = true
+	c.write(token{typ: string(STRING), val: "OK"})
+}
+
+// DISCARD
+func discard(c *client, args []token) {
+	if len(args) != 0 {
+		c.write(wrongArgs("DISCARD"))
+		return
+	}
+
+	if !c.multi {
+		c.write(token{typ: string(ERROR), val: "ERR DISCARD without MULTI"})
+		return
+	}
+
+	// Like EXEC, a BUSY error leaves the transaction open
+	if reply, locked := lockUnlessBusy("DISCARD", args); !locked {
+		c.write(reply)
+		return
+	}
+	c.endTransaction()
+	c.unwatchAll()
+	mux.Unlock()
+
+	c.write(token{typ: string(STRING), val: "OK"})
+}
+
+// EXEC
+func exec(c *client, args []token) {
+	if len(args) != 0 {
+		c.write(wrongArgs("EXEC"))
+		return
+	}
+
+	if !c.multi {
+		c.write(token{typ: string(ERROR), val: "ERR EXEC without MULTI"})
+		return
+	}
+
+	// Like on arrival, a BUSY error leaves the transaction open
+	if reply, locked := lockUnlessBusy("EXEC", args); !locked {
+		c.write(reply)
+		return
+	}
+
+	queued, dirty := c.queued, c.dirty
+	c.endTransaction()
+
+	reply := c.execQueued(queued, dirty)
+	mux.Unlock()
+
+	c.write(reply)
+}
+
+// execQueued runs the commands queued by c unless the transaction failed
+// or one of the keys c watches changed, and returns the reply to EXEC.
+// Callers must hold mux.
+func (c *client) execQueued(queued []token, dirty bool) token {
+	// Whatever happens, the keys are no longer watched afterwards
+	touched := c.watchedKeysTouched()
+	c.unwatchAll()
+
+	if dirty {
+		return token{typ: string(ERROR), val: "EXECABORT Transaction discarded because of previous errors."}
+	}
+
+	if touched {
+		return token{typ: string(NULLARRAY)}
+	}
+
+	replies, replicated := runTransaction(queued)
+	// Replicas apply the transaction as a whole too
+	if Role == "master" && len(replicated) > 0 {
+		replicate(multiExec(replicated)...)
+	}
+
+	return token{typ: string(ARRAY), array: replies}
+}
+
+// multiExec wraps commands in MULTI and EXEC, for replicas to apply them
+// as a whole
+func multiExec(commands []token) []token {
+	wrapped := make([]token, 0, len(commands)+2)
+	wrapped = append(wrapped, bulkArray([]string{"MULTI"}))
+	wrapped = append(wrapped, commands...)
+	return append(wrapped, bulkArray([]string{"EXEC"}))
+}
+
+// runTransaction runs commands one after the other and returns their
+// replies along with what replicas need to apply to get the same result.
+// None of the commands may block. Callers must hold mux.
+func runTransaction(commands []token) (replies []token, replicated []token) {
+	denyBlocking = true
+	defer func() { denyBlocking = false }()
+
+	replies = make([]token, 0, len(commands))
+	for _, t := range commands {
+		command := strings.ToUpper(t.array[0].bulk)
+		args := t.array[1:]
+
+		if command == "UNWATCH" {
+			replies = append(replies, token{typ: string(STRING), val: "OK"})
+			continue
+		}
+
+		result := Handlers[command].handler(args)
+		replies = append(replies, result)
+		replicated = append(replicated, propagatedCommands(t, command, args, result)...)
+	}
+
+	return replies, replicated
+}
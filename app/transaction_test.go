@@ -0,0 +1,122 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTransaction(t *testing.T) {
+	ok := token{typ: string(STRING), val: "OK"}
+	queued := token{typ: string(STRING), val: "QUEUED"}
+
+	t.Run("exec runs the queued commands", func(t *testing.T) {
+		c := newTestConn(t)
+
+		steps := []struct {
+			args []string
+			want token
+		}{
+			{[]string{"MULTI"}, ok},
+			{[]string{"SET", "tx:a", "1"}, queued},
+			{[]string{"INCR", "tx:a"}, queued},
+			{[]string{"INCR", "tx:str"}, queued},
+			{[]string{"GET", "tx:a"}, queued},
+			{[]string{"BLPOP", "tx:empty", "0"}, queued},
+		}
+		run(t, "SET", "tx:str", "abc")
+
+		for _, step := range steps {
+			if got := c.do(t, step.args...); !reflect.DeepEqual(got, step.want) {
+				t.Errorf("Failed %v. wanted %v, got %v", step.args, step.want, got)
+			}
+		}
+
+		// Errors don't stop the other commands and nothing blocks
+		want := token{typ: string(ARRAY), array: []token{
+			ok,
+			intToken(2),
+			errNotInteger,
+			{typ: string(STRING), val: "2"},
+			{typ: string(NULLARRAY)},
+		}}
+		if got := c.do(t, "EXEC"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed exec. wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("queueing errors abort exec", func(t *testing.T) {
+		c := newTestConn(t)
+
+		steps := []struct {
+			args []string
+			want token
+		}{
+			{[]string{"MULTI"}, ok},
+			{[]string{"SET", "tx:b", "1"}, queued},
+			{[]string{"SET", "tx:b"}, wrongArgs("SET")},
+			{[]string{"NOSUCH", "x"}, token{typ: string(ERROR), val: "ERR unknown command 'NOSUCH', with args beginning with: 'x' "}},
+			{[]string{"SUBSCRIBE", "tx:channel"}, token{typ: string(ERROR), val: "ERR Command not allowed inside a transaction"}},
+			{[]string{"EXEC"}, token{typ: string(ERROR), val: "EXECABORT Transaction discarded because of previous errors."}},
+			{[]string{"EXISTS", "tx:b"}, intToken(0)},
+		}
+
+		for _, step := range steps {
+			if got := c.do(t, step.args...); !reflect.DeepEqual(got, step.want) {
+				t.Errorf("Failed %v. wanted %v, got %v", step.args, step.want, got)
+			}
+		}
+	})
+
+	t.Run("every command has an arity", func(t *testing.T) {
+		for command, spec := range Handlers {
+			if spec.arity == 0 {
+				t.Errorf("Failed %s. wanted an arity, got 0", command)
+			}
+		}
+	})
+
+	t.Run("discard", func(t *testing.T) {
+		c := newTestConn(t)
+
+		steps := []struct {
+			args []string
+			want token
+		}{
+			{[]string{"EXEC"}, token{typ: string(ERROR), val: "ERR EXEC without MULTI"}},
+			{[]string{"DISCARD"}, token{typ: string(ERROR), val: "ERR DISCARD without MULTI"}},
+			{[]string{"MULTI"}, ok},
+			{[]string{"MULTI"}, token{typ: string(ERROR), val: "ERR MULTI calls can not be nested"}},
+			{[]string{"SET", "tx:c", "1"}, queued},
+			{[]string{"DISCARD"}, ok},
+			{[]string{"EXISTS", "tx:c"}, intToken(0)},
+		}
+
+		for _, step := range steps {
+			if got := c.do(t, step.args...); !reflect.DeepEqual(got, step.want) {
+				t.Errorf("Failed %v. wanted %v, got %v", step.args, step.want, got)
+			}
+		}
+	})
+
+	t.Run("replicated commands", func(t *testing.T) {
+		commands := []token{
+			bulkArray([]string{"SET", "tx:d", "1"}),
+			bulkArray([]string{"GET", "tx:d"}),
+			bulkArray([]string{"SADD", "tx:set", "m"}),
+			bulkArray([]string{"SPOP", "tx:set"}),
+		}
+
+		mux.Lock()
+		_, got := runTransaction(commands)
+		mux.Unlock()
+
+		want := []token{
+			commands[0],
+			commands[2],
+			bulkArray([]string{"SREM", "tx:set", "m"}),
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed replicated. wanted %v, got %v", want, got)
+		}
+	})
+}
@@ -0,0 +1,113 @@
+package main
+
+// WATCH makes the next EXEC of a client fail if one of the keys it watches
+// changed in the meantime. Every change to a key bumps its version, which
+// is only kept while some client watches the key, and EXEC compares the
+// versions with the ones seen by WATCH.
+
+// keyVersion is the version of a watched key and how many clients
+// watch it
+type keyVersion struct {
+	version  uint64
+	watchers int
+}
+
+// keyVersions holds the watched keys. Guarded by mux.
+var keyVersions = map[string]*keyVersion{}
+
+// touchWatchedKey bumps the version of key if anyone watches it.
+// Callers must hold mux.
+func touchWatchedKey(key string) {
+	if v, ok := keyVersions[key]; ok {
+		v.version++
+	}
+}
+
+// watch makes c watch key. Callers must hold mux.
+func (c *client) watch(key string) {
+	if _, watching := c.watched[key]; watching {
+		return
+	}
+
+	// A key that is already expired changes now rather than under EXEC
+	lookupKey(key)
+
+	v, ok := keyVersions[key]
+	if !ok {
+		v = &keyVersion{}
+		keyVersions[key] = v
+	}
+	v.watchers++
+
+	c.watched[key] = v.version
+}
+
+// unwatchAll forgets every key c watches. Callers must hold mux.
+func (c *client) unwatchAll() {
+	for key := range c.watched {
+		v := keyVersions[key]
+		v.watchers--
+		if v.watchers == 0 {
+			delete(keyVersions, key)
+		}
+	}
+
+	clear(c.watched)
+}
+
+// watchedKeysTouched reports whether a key c watches changed since
+// WATCH. Callers must hold mux.
+func (c *client) watchedKeysTouched() bool {
+	for key, version := range c.watched {
+		// Keys that expired since count as changed, even if nobody
+		// noticed yet
+		lookupKey(key)
+
+		if keyVersions[key].version != version {
+			return true
+		}
+	}
+
+	return false
+}
+
+// WATCH key [key ...]
+func watch(c *client, args []token) {
+	if len(args) < 1 {
+		c.write(wrongArgs("WATCH"))
+		return
+	}
+
+	if c.multi {
+		c.write(token{typ: string(ERROR), val: "ERR WATCH inside MULTI is not allowed"})
+		return
+	}
+
+	if reply, locked := lockUnlessBusy("WATCH", args); !locked {
+		c.write(reply)
+		return
+	}
+	for _, arg := range args {
+		c.watch(arg.bulk)
+	}
+	mux.Unlock()
+
+	c.write(token{typ: string(STRING), val: "OK"})
+}
+
+// UNWATCH
+func unwatch(c *client, args []token) {
+	if len(args) != 0 {
+		c.write(wrongArgs("UNWATCH"))
+		return
+	}
+
+	if reply, locked := lockUnlessBusy("UNWATCH", args); !locked {
+		c.write(reply)
+		return
+	}
+	c.unwatchAll()
+	mux.Unlock()
+
+	c.write(token{typ: string(STRING), val: "OK"})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	ok := token{typ: string(STRING), val: "OK"}
+	aborted := token{typ: string(NULLARRAY)}
+
+	cases := []struct {
+		name string
+		key  string
+		// setup runs before WATCH, touch between WATCH and MULTI
+		setup []string
+		touch func(t *testing.T)
+		want  token
+	}{
+		{
+			name:  "untouched",
+			key:   "wt:same",
+			setup: []string{"SET", "wt:same", "1"},
+			touch: func(t *testing.T) { run(t, "GET", "wt:same") },
+			want:  token{typ: string(ARRAY), array: []token{ok}},
+		},
+		{
+			name:  "written by another client",
+			key:   "wt:written",
+			setup: []string{"SET", "wt:written", "1"},
+			touch: func(t *testing.T) { run(t, "APPEND", "wt:written", "2") },
+			want:  aborted,
+		},
+		{
+			name:  "created by another client",
+			key:   "wt:created",
+			touch: func(t *testing.T) { run(t, "LPUSH", "wt:created", "a") },
+			want:  aborted,
+		},
+		{
+			name:  "expired",
+			key:   "wt:expired",
+			setup: []string{"SET", "wt:expired", "1", "PX", "20"},
+			touch: func(t *testing.T) { time.Sleep(30 * time.Millisecond) },
+			want:  aborted,
+		},
+		{
+			name:  "flushed",
+			key:   "wt:flushed",
+			setup: []string{"SET", "wt:flushed", "1"},
+			touch: func(t *testing.T) { run(t, "FLUSHALL") },
+			want:  aborted,
+		},
+		{
+			name:  "write that changes nothing",
+			key:   "wt:noop",
+			setup: []string{"SADD", "wt:noop", "m"},
+			touch: func(t *testing.T) { run(t, "SADD", "wt:noop", "m") },
+			want:  token{typ: string(ARRAY), array: []token{ok}},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conn := newTestConn(t)
+			if c.setup != nil {
+				run(t, c.setup...)
+			}
+
+			if got := conn.do(t, "WATCH", c.key, "wt:other"); !reflect.DeepEqual(got, ok) {
+				t.Fatalf("Failed watch. wanted %v, got %v", ok, got)
+			}
+			c.touch(t)
+
+			conn.do(t, "MULTI")
+			conn.do(t, "SET", "wt:result", c.name)
+			if got := conn.do(t, "EXEC"); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("Failed %s. wanted %v, got %v", c.name, c.want, got)
+			}
+
+			// The keys are no longer watched after EXEC
+			run(t, "SET", c.key, "again")
+			conn.do(t, "MULTI")
+			conn.do(t, "PING")
+			if got, want := conn.do(t, "EXEC"), (token{typ: string(ARRAY), array: []token{{typ: string(STRING), val: "PONG"}}}); !reflect.DeepEqual(got, want) {
+				t.Errorf("Failed exec. wanted %v, got %v", want, got)
+			}
+		})
+	}
+
+	t.Run("unwatch", func(t *testing.T) {
+		conn := newTestConn(t)
+
+		steps := []struct {
+			args []string
+			want token
+		}{
+			{[]string{"WATCH", "wt:unwatched"}, ok},
+			{[]string{"UNWATCH"}, ok},
+			{[]string{"SET", "wt:unwatched", "1"}, ok},
+			{[]string{"MULTI"}, ok},
+			{[]string{"WATCH", "wt:unwatched"}, token{typ: string(ERROR), val: "ERR WATCH inside MULTI is not allowed"}},
+			{[]string{"UNWATCH"}, token{typ: string(STRING), val: "QUEUED"}},
+			{[]string{"EXEC"}, token{typ: string(ARRAY), array: []token{ok}}},
+		}
+
+		for _, step := range steps {
+			if got := conn.do(t, step.args...); !reflect.DeepEqual(got, step.want) {
+				t.Errorf("Failed %v. wanted %v, got %v", step.args, step.want, got)
+			}
+		}
+
+		mux.Lock()
+		defer mux.Unlock()
+		if _, watched := keyVersions["wt:unwatched"]; watched {
+			t.Errorf("Failed unwatch. the key still has a version")
+		}
+	})
+}
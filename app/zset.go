@@ -0,0 +1,844 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// zset pairs a member to score dictionary with a skiplist ordered by
+// score, giving O(1) score lookups and O(log n) rank and range queries.
+type zset struct {
+	dict  map[string]float64
+	zsl   *skiplist
+	names *scanIndex
+}
+
+func newZset() *zset {
+	return &zset{
+		dict:  make(map[string]float64),
+		zsl:   newSkiplist(),
+		names: newScanIndex(),
+	}
+}
+
+func (z *zset) len() int {
+	return len(z.dict)
+}
+
+// add inserts member or moves it to its new score
+func (z *zset) add(member string, score float64) {
+	if current, exists := z.dict[member]; exists {
+		if current == score {
+			return
+		}
+		z.zsl.delete(current, member)
+	} else {
+		z.names.add(member)
+	}
+
+	z.dict[member] = score
+	z.zsl.insert(score, member)
+}
+
+func (z *zset) remove(member string) bool {
+	score, exists := z.dict[member]
+	if !exists {
+		return false
+	}
+
+	delete(z.dict, member)
+	z.zsl.delete(score, member)
+	z.names.remove(member)
+
+	return true
+}
+
+// zsetEntry is a member and its score as returned by range queries
+type zsetEntry struct {
+	member string
+	score  float64
+}
+
+// lookupZset returns the sorted set stored at key. A missing key yields
+// nil, ok is false when the key holds another type.
+// Callers must hold mux.
+func lookupZset(key string) (zs *zset, ok bool) {
+	obj, exists := lookupKey(key)
+	if !exists {
+		return nil, true
+	}
+
+	if obj.typ != "zset" {
+		return nil, false
+	}
+
+	return obj.zsetData, true
+}
+
+// storeZset replaces whatever is stored at key with zs,
+// deleting the key when the set is empty. Callers must hold mux.
+func storeZset(key string, zs *zset) {
+	if zs == nil || zs.len() == 0 {
+		removeKey(key)
+		return
+	}
+
+	putKey(key, object{
+		typ:       "zset",
+		createdAt: time.Now().UTC(),
+		zsetData:  zs,
+	})
+}
+
+// formatScore renders a score the way Redis replies with doubles: whole
+// numbers every double in their range represents exactly are printed as
+// integers, anything else in the shortest form that reads back the same.
+func formatScore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	case score > -(1<<52) && score < 1<<52 && score == math.Trunc(score):
+		return strconv.FormatInt(int64(score), 10)
+	}
+
+	return strconv.FormatFloat(score, 'g', -1, 64)
+}
+
+// parseScore parses a score argument, accepting +inf and -inf but not NaN
+func parseScore(arg string) (float64, bool) {
+	score, err := strconv.ParseFloat(arg, 64)
+	if err != nil || math.IsNaN(score) {
+		return 0, false
+	}
+
+	return score, true
+}
+
+// parseScoreRange parses min and max as accepted by ZRANGEBYSCORE,
+// where a leading '(' makes the bound exclusive
+func parseScoreRange(min, max string) (scoreRange, bool) {
+	var r scoreRange
+	var ok bool
+
+	if strings.HasPrefix(min, "(") {
+		r.minex = true
+		min = min[1:]
+	}
+	if strings.HasPrefix(max, "(") {
+		r.maxex = true
+		max = max[1:]
+	}
+
+	if r.min, ok = parseScore(min); !ok {
+		return r, false
+	}
+	if r.max, ok = parseScore(max); !ok {
+		return r, false
+	}
+
+	return r, true
+}
+
+func parseLexBound(arg string) (lexBound, bool) {
+	switch {
+	case arg == "-":
+		return lexBound{inf: -1}, true
+	case arg == "+":
+		return lexBound{inf: 1}, true
+	case strings.HasPrefix(arg, "("):
+		return lexBound{value: arg[1:], exclusive: true}, true
+	case strings.HasPrefix(arg, "["):
+		return lexBound{value: arg[1:]}, true
+	default:
+		return lexBound{}, false
+	}
+}
+
+// parseLexRange parses min and max as accepted by ZRANGEBYLEX
+func parseLexRange(min, max string) (lexRange, bool) {
+	var r lexRange
+	var ok bool
+
+	if r.min, ok = parseLexBound(min); !ok {
+		return r, false
+	}
+	if r.max, ok = parseLexBound(max); !ok {
+		return r, false
+	}
+
+	return r, true
+}
+
+var (
+	errNotFloat       = token{typ: string(ERROR), val: "ERR value is not a valid float"}
+	errMinMaxNotFloat = token{typ: string(ERROR), val: "ERR min or max is not a float"}
+	errMinMaxNotLex   = token{typ: string(ERROR), val: "ERR min or max not valid string range item"}
+)
+
+// ZADD key [NX|XX] [GT|LT] [CH] [INCR] score member [score member ...]
+func zadd(args []token) token {
+	if len(args) < 3 {
+		return wrongArgs("ZADD")
+	}
+
+	var nx, xx, gt, lt, ch, incr bool
+
+	i := 1
+flags:
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(args[i].bulk) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GT":
+			gt = true
+		case "LT":
+			lt = true
+		case "CH":
+			ch = true
+		case "INCR":
+			incr = true
+		default:
+			break flags
+		}
+	}
+
+	pairs := args[i:]
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		return errSyntax
+	}
+
+	if nx && xx {
+		return token{typ: string(ERROR), val: "ERR XX and NX options at the same time are not compatible"}
+	}
+	if (gt && lt) || (nx && (gt || lt)) {
+		return token{typ: string(ERROR), val: "ERR GT, LT, and/or NX options at the same time are not compatible"}
+	}
+	if incr && len(pairs) != 2 {
+		return token{typ: string(ERROR), val: "ERR INCR option supports a single increment-element pair"}
+	}
+
+	scores := make([]float64, 0, len(pairs)/2)
+	for j := 0; j < len(pairs); j += 2 {
+		score, ok := parseScore(pairs[j].bulk)
+		if !ok {
+			return errNotFloat
+		}
+		scores = append(scores, score)
+	}
+
+	key := args[0].bulk
+	zs, ok := lookupZset(key)
+	if !ok {
+		return errWrongType
+	}
+
+	created := zs == nil
+	if created {
+		zs = newZset()
+	}
+
+	added, updated := 0, 0
+	applied := false
+	var result float64
+
+	for j := 0; j < len(pairs); j += 2 {
+		member := pairs[j+1].bulk
+		score := scores[j/2]
+
+		current, exists := zs.dict[member]
+		if exists {
+			if nx {
+				continue
+			}
+
+			if incr {
+				score += current
+				if math.IsNaN(score) {
+					return token{typ: string(ERROR), val: "ERR resulting score is not a number (NaN)"}
+				}
+			}
+
+			if (gt && score <= current) || (lt && score >= current) {
+				continue
+			}
+
+			if score != current {
+				zs.add(member, score)
+				updated++
+			}
+		} else {
+			if xx {
+				continue
+			}
+
+			zs.add(member, score)
+			added++
+		}
+
+		applied = true
+		result = score
+	}
+
+	if created && zs.len() > 0 {
+		storeZset(key, zs)
+	}
+
+	if added > 0 || updated > 0 {
+		event := "zadd"
+		if incr {
+			event = "zincr"
+		}
+		notifyKeyspaceEvent(notifyZset, event, key)
+	}
+
+	if incr {
+		if !applied {
+			return token{typ: string(NULL)}
+		}
+		return token{typ: string(BULK), bulk: formatScore(result)}
+	}
+
+	if ch {
+		return intToken(added + updated)
+	}
+
+	return intToken(added)
+}
+
+// ZINCRBY key increment member
+func zincrby(args []token) token {
+	if len(args) != 3 {
+		return wrongArgs("ZINCRBY")
+	}
+
+	return zadd([]token{args[0], {typ: string(BULK), bulk: "INCR"}, args[1], args[2]})
+}
+
+// ZREM key member [member ...]
+func zrem(args []token) token {
+	if len(args) < 2 {
+		return wrongArgs("ZREM")
+	}
+
+	key := args[0].bulk
+	zs, ok := lookupZset(key)
+	if !ok {
+		return errWrongType
+	}
+
+	if zs == nil {
+		return intToken(0)
+	}
+
+	removed := 0
+	for _, m := range args[1:] {
+		if zs.remove(m.bulk) {
+			removed++
+		}
+	}
+
+	if removed > 0 {
+		notifyKeyspaceEvent(notifyZset, "zrem", key)
+	}
+
+	if zs.len() == 0 {
+		removeKey(key)
+		notifyKeyspaceEvent(notifyGeneric, "del", key)
+	}
+
+	return intToken(removed)
+}
+
+// ZCARD key
+func zcard(args []token) token {
+	if len(args) != 1 {
+		return wrongArgs("ZCARD")
+	}
+
+	zs, ok := lookupZset(args[0].bulk)
+	if !ok {
+		return errWrongType
+	}
+
+	if zs == nil {
+		return intToken(0)
+	}
+
+	return intToken(zs.len())
+}
+
+// ZSCORE key member
+func zscore(args []token) token {
+	if len(args) != 2 {
+		return wrongArgs("ZSCORE")
+	}
+
+	zs, ok := lookupZset(args[0].bulk)
+	if !ok {
+		return errWrongType
+	}
+
+	if zs == nil {
+		return token{typ: string(NULL)}
+	}
+
+	score, exists := zs.dict[args[1].bulk]
+	if !exists {
+		return token{typ: string(NULL)}
+	}
+
+	return token{typ: string(BULK), bulk: formatScore(score)}
+}
+
+// ZMSCORE key member [member ...]
+func zmscore(args []token) token {
+	if len(args) < 2 {
+		return wrongArgs("ZMSCORE")
+	}
+
+	zs, ok := lookupZset(args[0].bulk)
+	if !ok {
+		return errWrongType
+	}
+
+	scores := make([]token, 0, len(args)-1)
+	for _, m := range args[1:] {
+		if zs == nil {
+			scores = append(scores, token{typ: string(NULL)})
+			continue
+		}
+
+		score, exists := zs.dict[m.bulk]
+		if !exists {
+			scores = append(scores, token{typ: string(NULL)})
+			continue
+		}
+		scores = append(scores, token{typ: string(BULK), bulk: formatScore(score)})
+	}
+
+	return token{typ: string(ARRAY), array: scores}
+}
+
+func zrankGeneric(command string, args []token, rev bool) token {
+	if len(args) < 2 || len(args) > 3 {
+		return wrongArgs(command)
+	}
+
+	withScore := len(args) == 3
+	if withScore && strings.ToUpper(args[2].bulk) != "WITHSCORE" {
+		return errSyntax
+	}
+
+	zs, ok := lookupZset(args[0].bulk)
+	if !ok {
+		return errWrongType
+	}
+
+	nullReply := token{typ: string(NULL)}
+	if withScore {
+		nullReply = token{typ: string(NULLARRAY)}
+	}
+
+	if zs == nil {
+		return nullReply
+	}
+
+	member := args[1].bulk
+	score, exists := zs.dict[member]
+	if !exists {
+		return nullReply
+	}
+
+	rank := zs.zsl.rank(score, member) - 1
+	if rev {
+		rank = zs.len() - 1 - rank
+	}
+
+	if withScore {
+		return token{
+			typ: string(ARRAY),
+			array: []token{
+				intToken(rank),
+				{typ: string(BULK), bulk: formatScore(score)},
+			},
+		}
+	}
+
+	return intToken(rank)
+}
+
+// ZRANK key member [WITHSCORE]
+func zrank(args []token) token {
+	return zrankGeneric("ZRANK", args, false)
+}
+
+// ZREVRANK key member [WITHSCORE]
+func zrevrank(args []token) token {
+	return zrankGeneric("ZREVRANK", args, true)
+}
+
+// ZCOUNT key min max
+func zcount(args []token) token {
+	if len(args) != 3 {
+		return wrongArgs("ZCOUNT")
+	}
+
+	r, ok := parseScoreRange(args[1].bulk, args[2].bulk)
+	if !ok {
+		return errMinMaxNotFloat
+	}
+
+	zs, ok := lookupZset(args[0].bulk)
+	if !ok {
+		return errWrongType
+	}
+
+	if zs == nil {
+		return intToken(0)
+	}
+
+	first := zs.zsl.firstInRange(r)
+	if first == nil {
+		return intToken(0)
+	}
+	last := zs.zsl.lastInRange(r)
+
+	return intToken(zs.zsl.rank(last.score, last.member) - zs.zsl.rank(first.score, first.member) + 1)
+}
+
+// ZLEXCOUNT key min max
+func zlexcount(args []token) token {
+	if len(args) != 3 {
+		return wrongArgs("ZLEXCOUNT")
+	}
+
+	r, ok := parseLexRange(args[1].bulk, args[2].bulk)
+	if !ok {
+		return errMinMaxNotLex
+	}
+
+	zs, ok := lookupZset(args[0].bulk)
+	if !ok {
+		return errWrongType
+	}
+
+	if zs == nil {
+		return intToken(0)
+	}
+
+	first := zs.zsl.firstInLexRange(r)
+	if first == nil {
+		return intToken(0)
+	}
+	last := zs.zsl.lastInLexRange(r)
+
+	return intToken(zs.zsl.rank(last.score, last.member) - zs.zsl.rank(first.score, first.member) + 1)
+}
+
+const (
+	zrangeByRank = iota
+	zrangeByScore
+	zrangeByLex
+)
+
+// zrangeSpec describes a range query over a sorted set
+type zrangeSpec struct {
+	by          int
+	rev         bool
+	start, stop int
+	score       scoreRange
+	lex         lexRange
+	offset      int
+	limit       int // Negative means no limit
+}
+
+// rangeEntries returns the entries selected by spec, in reply order
+func (z *zset) rangeEntries(spec zrangeSpec) []zsetEntry {
+	entries := []zsetEntry{}
+
+	if spec.by == zrangeByRank {
+		from, to := listRange(spec.start, spec.stop, z.len())
+
+		var node *skiplistNode
+		if spec.rev {
+			node = z.zsl.byRank(z.len() - from)
+		} else {
+			node = z.zsl.byRank(from + 1)
+		}
+
+		for i := from; i < to && node != nil; i++ {
+			entries = append(entries, zsetEntry{member: node.member, score: node.score})
+			if spec.rev {
+				node = node.backward
+			} else {
+				node = node.level[0].forward
+			}
+		}
+
+		return entries
+	}
+
+	var node *skiplistNode
+	inRange := func(n *skiplistNode) bool {
+		if spec.by == zrangeByScore {
+			if spec.rev {
+				return spec.score.gteMin(n.score)
+			}
+			return spec.score.lteMax(n.score)
+		}
+
+		if spec.rev {
+			return spec.lex.gteMin(n.member)
+		}
+		return spec.lex.lteMax(n.member)
+	}
+
+	switch {
+	case spec.by == zrangeByScore && spec.rev:
+		node = z.zsl.lastInRange(spec.score)
+	case spec.by == zrangeByScore:
+		node = z.zsl.firstInRange(spec.score)
+	case spec.rev:
+		node = z.zsl.lastInLexRange(spec.lex)
+	default:
+		node = z.zsl.firstInLexRange(spec.lex)
+	}
+
+	skip := spec.offset
+	for node != nil && inRange(node) {
+		if spec.limit >= 0 && len(entries) == spec.limit {
+			break
+		}
+
+		if skip > 0 {
+			skip--
+		} else {
+			entries = append(entries, zsetEntry{member: node.member, score: node.score})
+		}
+
+		if spec.rev {
+			node = node.backward
+		} else {
+			node = node.level[0].forward
+		}
+	}
+
+	return entries
+}
+
+// zsetEntriesToken builds the flat member [score] reply used by range commands
+func zsetEntriesToken(entries []zsetEntry, withScores bool) token {
+	values := make([]string, 0, len(entries)*2)
+	for _, e := range entries {
+		values = append(values, e.member)
+		if withScores {
+			values = append(values, formatScore(e.score))
+		}
+	}
+
+	return bulkArray(values)
+}
+
+// zrangeGeneric implements the ZRANGE family. extended enables the
+// BYSCORE, BYLEX and REV options only accepted by ZRANGE itself.
+func zrangeGeneric(command string, args []token, by int, rev, extended bool) token {
+	if len(args) < 3 {
+		return wrongArgs(command)
+	}
+
+	spec := zrangeSpec{by: by, rev: rev, limit: -1}
+	withScores, hasLimit := false, false
+
+	for i := 3; i < len(args); i++ {
+		switch strings.ToUpper(args[i].bulk) {
+		case "WITHSCORES":
+			withScores = true
+		case "LIMIT":
+			if i+2 >= len(args) {
+				return errSyntax
+			}
+
+			offset, err := strconv.Atoi(args[i+1].bulk)
+			if err != nil {
+				return errNotInteger
+			}
+			limit, err := strconv.Atoi(args[i+2].bulk)
+			if err != nil {
+				return errNotInteger
+			}
+
+			spec.offset, spec.limit = offset, limit
+			hasLimit = true
+			i += 2
+		case "BYSCORE":
+			if !extended {
+				return errSyntax
+			}
+			spec.by = zrangeByScore
+		case "BYLEX":
+			if !extended {
+				return errSyntax
+			}
+			spec.by = zrangeByLex
+		case "REV":
+			if !extended {
+				return errSyntax
+			}
+			spec.rev = true
+		default:
+			return errSyntax
+		}
+	}
+
+	if hasLimit && spec.by == zrangeByRank {
+		return token{
+			typ: string(ERROR),
+			val: "ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX",
+		}
+	}
+	if withScores && spec.by == zrangeByLex {
+		return token{
+			typ: string(ERROR),
+			val: "ERR syntax error, WITHSCORES not supported in combination with BYLEX",
+		}
+	}
+
+	// Reversed score and lex ranges take the maximum first
+	min, max := args[1].bulk, args[2].bulk
+	if spec.rev && spec.by != zrangeByRank {
+		min, max = max, min
+	}
+
+	switch spec.by {
+	case zrangeByRank:
+		start, err := strconv.Atoi(min)
+		if err != nil {
+			return errNotInteger
+		}
+		stop, err := strconv.Atoi(max)
+		if err != nil {
+			return errNotInteger
+		}
+		spec.start, spec.stop = start, stop
+	case zrangeByScore:
+		r, ok := parseScoreRange(min, max)
+		if !ok {
+			return errMinMaxNotFloat
+		}
+		spec.score = r
+	case zrangeByLex:
+		r, ok := parseLexRange(min, max)
+		if !ok {
+			return errMinMaxNotLex
+		}
+		spec.lex = r
+	}
+
+	if spec.offset < 0 {
+		return bulkArray(nil)
+	}
+
+	zs, ok := lookupZset(args[0].bulk)
+	if !ok {
+		return errWrongType
+	}
+
+	if zs == nil {
+		return bulkArray(nil)
+	}
+
+	return zsetEntriesToken(zs.rangeEntries(spec), withScores)
+}
+
+// ZRANGE key start stop [BYSCORE|BYLEX] [REV] [LIMIT offset count] [WITHSCORES]
+func zrange(args []token) token {
+	return zrangeGeneric("ZRANGE", args, zrangeByRank, false, true)
+}
+
+// ZREVRANGE key start stop [WITHSCORES]
+func zrevrange(args []token) token {
+	return zrangeGeneric("ZREVRANGE", args, zrangeByRank, true, false)
+}
+
+// ZRANGEBYSCORE key min max [WITHSCORES] [LIMIT offset count]
+func zrangebyscore(args []token) token {
+	return zrangeGeneric("ZRANGEBYSCORE", args, zrangeByScore, false, false)
+}
+
+// ZREVRANGEBYSCORE key max min [WITHSCORES] [LIMIT offset count]
+func zrevrangebyscore(args []token) token {
+	return zrangeGeneric("ZREVRANGEBYSCORE", args, zrangeByScore, true, false)
+}
+
+// ZRANGEBYLEX key min max [LIMIT offset count]
+func zrangebylex(args []token) token {
+	return zrangeGeneric("ZRANGEBYLEX", args, zrangeByLex, false, false)
+}
+
+// ZREVRANGEBYLEX key max min [LIMIT offset count]
+func zrevrangebylex(args []token) token {
+	return zrangeGeneric("ZREVRANGEBYLEX", args, zrangeByLex, true, false)
+}
+
+func zpop(command string, args []token, max bool) token {
+	if len(args) < 1 || len(args) > 2 {
+		return wrongArgs(command)
+	}
+
+	count := 1
+	if len(args) == 2 {
+		n, err := strconv.Atoi(args[1].bulk)
+		if err != nil || n < 0 {
+			return token{typ: string(ERROR), val: "ERR value is out of range, must be positive"}
+		}
+		count = n
+	}
+
+	key := args[0].bulk
+	zs, ok := lookupZset(key)
+	if !ok {
+		return errWrongType
+	}
+
+	if zs == nil {
+		return bulkArray(nil)
+	}
+
+	entries := []zsetEntry{}
+	for len(entries) < count && zs.len() > 0 {
+		node := zs.zsl.header.level[0].forward
+		if max {
+			node = zs.zsl.tail
+		}
+
+		entries = append(entries, zsetEntry{member: node.member, score: node.score})
+		zs.remove(node.member)
+	}
+
+	if len(entries) > 0 {
+		notifyKeyspaceEvent(notifyZset, strings.ToLower(command), key)
+	}
+
+	if zs.len() == 0 {
+		removeKey(key)
+		notifyKeyspaceEvent(notifyGeneric, "del", key)
+	}
+
+	return zsetEntriesToken(entries, true)
+}
+
+// ZPOPMIN key [count]
+func zpopmin(args []token) token {
+	return zpop("ZPOPMIN", args, false)
+}
+
+// ZPOPMAX key [count]
+func zpopmax(args []token) token {
+	return zpop("ZPOPMAX", args, true)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestZset(t *testing.T) {
+	run(t, "ZADD", "zset:board", "10", "alice", "20", "bob", "15", "carol")
+
+	t.Run("zadd flags", func(t *testing.T) {
+		if got := run(t, "ZADD", "zset:flags", "1", "a", "2", "b"); !reflect.DeepEqual(got, intToken(2)) {
+			t.Errorf("Failed zadd. wanted %v, got %v", intToken(2), got)
+		}
+		if got := run(t, "ZADD", "zset:flags", "NX", "5", "a", "3", "c"); !reflect.DeepEqual(got, intToken(1)) {
+			t.Errorf("Failed zadd nx. wanted %v, got %v", intToken(1), got)
+		}
+		if got := run(t, "ZADD", "zset:flags", "XX", "CH", "5", "a", "9", "d"); !reflect.DeepEqual(got, intToken(1)) {
+			t.Errorf("Failed zadd xx ch. wanted %v, got %v", intToken(1), got)
+		}
+		if got := run(t, "ZADD", "zset:flags", "GT", "CH", "1", "a", "4", "b"); !reflect.DeepEqual(got, intToken(1)) {
+			t.Errorf("Failed zadd gt. wanted %v, got %v", intToken(1), got)
+		}
+
+		want := token{typ: string(BULK), bulk: "7.5"}
+		if got := run(t, "ZADD", "zset:flags", "INCR", "2.5", "a"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed zadd incr. wanted %v, got %v", want, got)
+		}
+
+		want = token{typ: string(NULL)}
+		if got := run(t, "ZADD", "zset:flags", "LT", "INCR", "1", "a"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed zadd lt incr. wanted %v, got %v", want, got)
+		}
+
+		want = token{typ: string(ERROR), val: "ERR XX and NX options at the same time are not compatible"}
+		if got := run(t, "ZADD", "zset:flags", "NX", "XX", "1", "a"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed zadd. wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("zrange", func(t *testing.T) {
+		want := bulkArray([]string{"alice", "carol", "bob"})
+		if got := run(t, "ZRANGE", "zset:board", "0", "-1"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed zrange. wanted %v, got %v", want, got)
+		}
+
+		want = bulkArray([]string{"bob", "20", "carol", "15"})
+		if got := run(t, "ZRANGE", "zset:board", "0", "1", "REV", "WITHSCORES"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed zrange rev. wanted %v, got %v", want, got)
+		}
+
+		want = bulkArray([]string{"carol", "bob"})
+		if got := run(t, "ZRANGEBYSCORE", "zset:board", "(10", "+inf"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed zrangebyscore. wanted %v, got %v", want, got)
+		}
+
+		want = bulkArray([]string{"carol"})
+		if got := run(t, "ZRANGE", "zset:board", "+inf", "-inf", "BYSCORE", "REV", "LIMIT", "1", "1"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed zrange byscore rev limit. wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("zrangebylex", func(t *testing.T) {
+		run(t, "ZADD", "zset:lex", "0", "a", "0", "b", "0", "c", "0", "d")
+
+		want := bulkArray([]string{"b", "c"})
+		if got := run(t, "ZRANGEBYLEX", "zset:lex", "(a", "[c"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed zrangebylex. wanted %v, got %v", want, got)
+		}
+
+		want = bulkArray([]string{"d", "c", "b", "a"})
+		if got := run(t, "ZREVRANGEBYLEX", "zset:lex", "+", "-"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed zrevrangebylex. wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("rank and score", func(t *testing.T) {
+		if got := run(t, "ZRANK", "zset:board", "bob"); !reflect.DeepEqual(got, intToken(2)) {
+			t.Errorf("Failed zrank. wanted %v, got %v", intToken(2), got)
+		}
+		if got := run(t, "ZREVRANK", "zset:board", "bob"); !reflect.DeepEqual(got, intToken(0)) {
+			t.Errorf("Failed zrevrank. wanted %v, got %v", intToken(0), got)
+		}
+
+		want := token{typ: string(BULK), bulk: "15"}
+		if got := run(t, "ZSCORE", "zset:board", "carol"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed zscore. wanted %v, got %v", want, got)
+		}
+
+		if got := run(t, "ZCOUNT", "zset:board", "10", "(20"); !reflect.DeepEqual(got, intToken(2)) {
+			t.Errorf("Failed zcount. wanted %v, got %v", intToken(2), got)
+		}
+	})
+
+	t.Run("zincrby, zrem and zpopmin", func(t *testing.T) {
+		run(t, "ZADD", "zset:pop", "1", "a", "2", "b", "3", "c")
+
+		want := token{typ: string(BULK), bulk: "5"}
+		if got := run(t, "ZINCRBY", "zset:pop", "4", "a"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed zincrby. wanted %v, got %v", want, got)
+		}
+
+		want = bulkArray([]string{"b", "2", "c", "3"})
+		if got := run(t, "ZPOPMIN", "zset:pop", "2"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed zpopmin. wanted %v, got %v", want, got)
+		}
+
+		if got := run(t, "ZREM", "zset:pop", "a", "x"); !reflect.DeepEqual(got, intToken(1)) {
+			t.Errorf("Failed zrem. wanted %v, got %v", intToken(1), got)
+		}
+
+		if got := run(t, "ZCARD", "zset:pop"); !reflect.DeepEqual(got, intToken(0)) {
+			t.Errorf("Failed zcard. wanted %v, got %v", intToken(0), got)
+		}
+	})
+
+	t.Run("wrong type", func(t *testing.T) {
+		run(t, "SET", "zset:str", "value")
+
+		if got := run(t, "ZADD", "zset:str", "1", "a"); !reflect.DeepEqual(got, errWrongType) {
+			t.Errorf("Failed wrongtype. wanted %v, got %v", errWrongType, got)
+		}
+
+		want := token{typ: string(STRING), val: "zset"}
+		if got := run(t, "TYPE", "zset:board"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed type. wanted %v, got %v", want, got)
+		}
+	})
+}
+
+func TestFormatScore(t *testing.T) {
+	cases := []struct {
+		name  string
+		score float64
+		want  string
+	}{
+		{"integer", 1e6, "1000000"},
+		{"geohash", 3471579339700058, "3471579339700058"},
+		{"negative", -42, "-42"},
+		{"fraction", 2.5, "2.5"},
+		{"shortest round trip", 0.1, "0.1"},
+		{"past exact integers", 1 << 53, "9.007199254740992e+15"},
+		{"inf", math.Inf(1), "inf"},
+		{"-inf", math.Inf(-1), "-inf"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := formatScore(c.score); got != c.want {
+				t.Errorf("Failed %s. wanted %v, got %v", c.name, c.want, got)
+			}
+		})
+	}
+
+	t.Run("zscore", func(t *testing.T) {
+		run(t, "ZADD", "zset:format", "1e6", "m")
+
+		want := token{typ: string(BULK), bulk: "1000000"}
+		if got := run(t, "ZSCORE", "zset:format", "m"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Failed zscore. wanted %v, got %v", want, got)
+		}
+	})
+}
@@ -10,6 +10,8 @@ module github.com/codecrafters-io/redis-starter-go
 
 go 1.22
 
+require github.com/yuin/gopher-lua v1.1.1
+
 require (
 	github.com/fatih/color v1.17.0 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect